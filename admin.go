@@ -0,0 +1,279 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// instances are the provisioned storage modules, for the admin API.
+var instances struct {
+	mu      sync.Mutex
+	storage []*RestStorage
+}
+
+func registerInstance(r *RestStorage) {
+	instances.mu.Lock()
+	defer instances.mu.Unlock()
+	instances.storage = append(instances.storage, r)
+}
+
+func unregisterInstance(r *RestStorage) {
+	instances.mu.Lock()
+	defer instances.mu.Unlock()
+	for i, s := range instances.storage {
+		if s == r {
+			instances.storage = append(instances.storage[:i], instances.storage[i+1:]...)
+			return
+		}
+	}
+}
+
+// AdminAPI is a module that serves the /rest_storage/ endpoints of the
+// admin API, to inspect the storage modules without querying the backend
+// directly.
+type AdminAPI struct{}
+
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.rest_storage",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+func (a AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/rest_storage/",
+			Handler: caddy.AdminHandlerFunc(a.handle),
+		},
+	}
+}
+
+// instanceStatus describes a storage module at /rest_storage/.
+type instanceStatus struct {
+	Endpoint   string         `json:"endpoint"`
+	Namespace  string         `json:"namespace,omitempty"`
+	InstanceID string         `json:"instance_id"`
+	Health     string         `json:"health"`
+	Locks      []string       `json:"locks"`
+	Caches     map[string]int `json:"caches,omitempty"`
+}
+
+func (a AdminAPI) handle(w http.ResponseWriter, req *http.Request) error {
+	action := strings.Trim(strings.TrimPrefix(req.URL.Path, "/rest_storage"), "/")
+	if action == "" {
+		if req.Method != http.MethodGet {
+			return methodNotAllowed(req)
+		}
+		return writeJSON(w, statuses())
+	}
+
+	r, err := findInstance(req.URL.Query().Get("endpoint"))
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "keys":
+		return r.adminKeys(w, req)
+	case "stat":
+		return r.adminStat(w, req)
+	case "delete":
+		return r.adminDelete(w, req)
+	case "unlock":
+		return r.adminUnlock(w, req)
+	}
+
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("unknown action %q", action),
+	}
+}
+
+func statuses() []instanceStatus {
+	instances.mu.Lock()
+	defer instances.mu.Unlock()
+
+	statuses := []instanceStatus{}
+	for _, r := range instances.storage {
+		status := instanceStatus{
+			Endpoint:   r.Endpoint,
+			Namespace:  r.Namespace,
+			InstanceID: r.InstanceID,
+			Health:     r.Health(),
+			Locks:      r.storageKeys(r.locks.keys()),
+		}
+		if r.Cache != nil {
+			status.Caches = map[string]int{
+				"values":    r.values.len(),
+				"not_found": r.missingKeys.len(),
+				"stat":      r.keyInfos.len(),
+				"exists":    r.existence.len(),
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// findInstance returns the storage module with endpoint; an empty endpoint
+// selects the only one there is.
+func findInstance(endpoint string) (*RestStorage, error) {
+	instances.mu.Lock()
+	defer instances.mu.Unlock()
+
+	if endpoint == "" {
+		if len(instances.storage) == 1 {
+			return instances.storage[0], nil
+		}
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("%d storage modules are provisioned; select one with the endpoint parameter", len(instances.storage)),
+		}
+	}
+
+	endpoint = normalizeEndpoint(endpoint)
+	for _, r := range instances.storage {
+		if r.Endpoint == endpoint {
+			return r, nil
+		}
+	}
+	return nil, caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("no storage module with endpoint %s", endpoint),
+	}
+}
+
+func (r *RestStorage) adminKeys(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return methodNotAllowed(req)
+	}
+
+	query := req.URL.Query()
+	recursive, _ := strconv.ParseBool(query.Get("recursive"))
+
+	keys, err := r.List(req.Context(), query.Get("prefix"), recursive)
+	if errors.Is(err, fs.ErrNotExist) {
+		keys = []string{}
+	} else if err != nil {
+		return backendError(err)
+	}
+
+	return writeJSON(w, keys)
+}
+
+func (r *RestStorage) adminStat(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return methodNotAllowed(req)
+	}
+
+	key, err := keyParam(req)
+	if err != nil {
+		return err
+	}
+
+	info, err := r.Stat(req.Context(), key)
+	if err != nil {
+		return backendError(err)
+	}
+
+	return writeJSON(w, info)
+}
+
+func (r *RestStorage) adminDelete(w http.ResponseWriter, req *http.Request) error {
+	key, err := r.adminActionKey(req)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Warn("Deleting key through the admin API", zap.String("key", key), zap.String("remote_addr", req.RemoteAddr))
+
+	if err := r.Delete(req.Context(), key); err != nil {
+		return backendError(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *RestStorage) adminUnlock(w http.ResponseWriter, req *http.Request) error {
+	key, err := r.adminActionKey(req)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Warn("Force-unlocking key through the admin API", zap.String("key", key), zap.String("remote_addr", req.RemoteAddr))
+
+	if err := r.forceUnlock(req.Context(), r.backendKey(key)); err != nil {
+		return backendError(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// adminActionKey returns the key of a POST request changing the storage,
+// if admin_actions allows them.
+func (r *RestStorage) adminActionKey(req *http.Request) (string, error) {
+	if req.Method != http.MethodPost {
+		return "", methodNotAllowed(req)
+	}
+	if !r.AdminActions {
+		return "", caddy.APIError{
+			HTTPStatus: http.StatusForbidden,
+			Err:        errors.New("admin_actions is not enabled for this storage module"),
+		}
+	}
+	return keyParam(req)
+}
+
+func keyParam(req *http.Request) (string, error) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		return "", caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New("missing key parameter"),
+		}
+	}
+	return key, nil
+}
+
+func methodNotAllowed(req *http.Request) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method %s not allowed", req.Method),
+	}
+}
+
+func backendError(err error) error {
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		status = http.StatusForbidden
+	}
+	return caddy.APIError{HTTPStatus: status, Err: err}
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
@@ -0,0 +1,228 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AuditConfig records every change made through the module as JSON lines,
+// to a file or another HTTP endpoint. Each record carries the SHA-256 hash
+// of the record before it, so records removed or altered afterwards break
+// the chain.
+type AuditConfig struct {
+	// The file records are appended to.
+	File string `json:"file,omitempty"`
+	// The URL each record is POSTed to, as application/x-ndjson.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers sent to the endpoint, e.g. for authorization.
+	Header http.Header `json:"header,omitempty"`
+}
+
+func (c *AuditConfig) provision() (*auditLog, error) {
+	log := &auditLog{
+		endpoint: c.Endpoint,
+		header:   c.Header,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if c.File != "" {
+		// Continue the chain of the records already in the file.
+		last, err := lastLine(c.File)
+		if err != nil {
+			return nil, fmt.Errorf("audit: %v", err)
+		}
+		if last != nil {
+			log.prev = recordHash(last)
+		}
+
+		file, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("audit: %v", err)
+		}
+		log.file = file
+	}
+
+	return log, nil
+}
+
+func (c *AuditConfig) validate() error {
+	if c.File == "" && c.Endpoint == "" {
+		return errors.New("audit: file or endpoint must be specified")
+	}
+	return nil
+}
+
+// AuditRecord is a line of the audit log.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// The key as passed to the module; the key as stored in the backend
+	// if it can't be decoded.
+	Key        string `json:"key"`
+	InstanceID string `json:"instance_id"`
+	// "ok" or "error"
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// The hex-encoded SHA-256 hash of the previous line, without its
+	// newline; empty for the first record.
+	Prev string `json:"prev"`
+}
+
+// auditLog writes audit records to the sinks of an AuditConfig. A nil
+// *auditLog records nothing.
+type auditLog struct {
+	endpoint string
+	header   http.Header
+	client   *http.Client
+
+	mu   sync.Mutex
+	file *os.File
+	prev string
+}
+
+// audit records op on the backend key with its outcome. Failures to record
+// are logged, but don't fail the operation.
+func (r *RestStorage) audit(op, backendKey string, err error) {
+	// Nothing changes in dry runs.
+	if r.auditLog == nil || r.DryRun {
+		return
+	}
+
+	key, ok := r.storageKey(backendKey)
+	if !ok {
+		key = backendKey
+	}
+
+	record := AuditRecord{
+		Time:       time.Now().UTC(),
+		Operation:  op,
+		Key:        key,
+		InstanceID: r.InstanceID,
+		Outcome:    "ok",
+	}
+	if err != nil {
+		record.Outcome = "error"
+		record.Error = err.Error()
+	}
+
+	if err := r.auditLog.write(record); err != nil {
+		r.logger.Error("Unable to write audit record",
+			zap.String("operation", op),
+			zap.String("key", key),
+			zap.Error(err))
+	}
+}
+
+// auditKeys records op on each of the backend keys with the same outcome.
+func (r *RestStorage) auditKeys(op string, backendKeys []string, err error) {
+	for _, key := range backendKeys {
+		r.audit(op, key, err)
+	}
+}
+
+// write chains record to the previous one and writes it to the sinks.
+func (l *auditLog) write(record AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record.Prev = l.prev
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.prev = recordHash(line)
+	line = append(line, '\n')
+
+	var errs []error
+	if l.file != nil {
+		if _, err := l.file.Write(line); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if l.endpoint != "" {
+		errs = append(errs, l.post(line))
+	}
+	return errors.Join(errs...)
+}
+
+func (l *auditLog) post(line []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", l.endpoint, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	for name, values := range l.header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	req.Header.Set("Content-Type", ndjsonContentType)
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (l *auditLog) close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+func recordHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// lastLine returns the last line of the file at path, or nil if it doesn't
+// exist or is empty.
+func lastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+
+	return last, scanner.Err()
+}
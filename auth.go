@@ -0,0 +1,85 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// hasAuth reports whether at least one way of authenticating requests
+// is configured.
+func (r *RestStorage) hasAuth() bool {
+	return r.apiKeySources() > 0 || r.HMAC != nil || r.AWSSigV4 != nil || r.bearerMethods() > 0
+}
+
+// apiKeySources counts the configured sources of the api key.
+func (r *RestStorage) apiKeySources() int {
+	count := 0
+	for _, configured := range []bool{r.ApiKey != "", r.ApiKeyFile != "", r.Vault != nil} {
+		if configured {
+			count++
+		}
+	}
+	return count
+}
+
+// bearerMethods counts the configured methods that produce a bearer token.
+func (r *RestStorage) bearerMethods() int {
+	count := 0
+	for _, configured := range []bool{r.OAuth2 != nil, r.GCPIDToken != nil, r.AzureAD != nil, r.JWT != nil} {
+		if configured {
+			count++
+		}
+	}
+	return count
+}
+
+// apiKey returns the key to send with each request, preferring the
+// current contents of the api key file or vault secret when configured.
+func (r *RestStorage) apiKey(secondary bool) string {
+	if secondary {
+		return r.ApiKeySecondary
+	}
+	if r.keyFile != nil {
+		return r.keyFile.get()
+	}
+	if r.vaultSecret != nil {
+		return r.vaultSecret.get()
+	}
+	return r.ApiKey
+}
+
+// usingSecondaryKey reports whether the secondary api key is in use
+// because the backend rejected the primary one.
+func (r *RestStorage) usingSecondaryKey() bool {
+	return r.ApiKeySecondary != "" && r.useSecondaryKey.Load()
+}
+
+// authorize adds apiKey and the other configured credentials to req. body is
+// the exact request body, used by the signing methods.
+func (r *RestStorage) authorize(req *http.Request, body []byte, apiKey string) error {
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+
+	if r.tokenSource != nil {
+		token, err := r.tokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("obtaining access token: %v", err)
+		}
+		token.SetAuthHeader(req)
+	}
+
+	if r.HMAC != nil {
+		r.HMAC.sign(req, body, time.Now())
+	}
+
+	// SigV4 must run last since it signs the final set of headers.
+	if r.AWSSigV4 != nil {
+		if err := r.AWSSigV4.sign(req, body, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
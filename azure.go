@@ -0,0 +1,127 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// AzureADConfig authenticates with Microsoft Entra ID (Azure AD) access
+// tokens. When ClientSecret is set, tokens are obtained with the client
+// credentials flow for TenantID; otherwise the managed identity of the
+// host is used, with ClientID selecting a user-assigned identity.
+type AzureADConfig struct {
+	TenantID     string `json:"tenant_id,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// e.g. api://storage-api/.default
+	Scope string `json:"scope"`
+}
+
+func (a *AzureADConfig) validate() error {
+	if a.Scope == "" {
+		return errors.New("azure_ad: scope must be specified")
+	}
+
+	if a.ClientSecret != "" && (a.TenantID == "" || a.ClientID == "") {
+		return errors.New("azure_ad: tenant_id and client_id are required with client_secret")
+	}
+
+	return nil
+}
+
+func (a *AzureADConfig) tokenSource(ctx context.Context) oauth2.TokenSource {
+	if a.ClientSecret != "" {
+		cfg := clientcredentials.Config{
+			TokenURL:     "https://login.microsoftonline.com/" + url.PathEscape(a.TenantID) + "/oauth2/v2.0/token",
+			ClientID:     a.ClientID,
+			ClientSecret: a.ClientSecret,
+			Scopes:       []string{a.Scope},
+		}
+		return cfg.TokenSource(ctx)
+	}
+
+	return oauth2.ReuseTokenSource(nil, &azureManagedIdentitySource{
+		ctx:        ctx,
+		clientID:   a.ClientID,
+		resource:   strings.TrimSuffix(a.Scope, "/.default"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	})
+}
+
+type azureManagedIdentitySource struct {
+	ctx        context.Context
+	clientID   string
+	resource   string
+	httpClient *http.Client
+}
+
+// Token requests a token from App Service's identity endpoint when
+// available, and from the VM instance metadata service otherwise.
+func (s *azureManagedIdentitySource) Token() (*oauth2.Token, error) {
+	query := url.Values{"resource": {s.resource}}
+	if s.clientID != "" {
+		query.Set("client_id", s.clientID)
+	}
+
+	var req *http.Request
+	var err error
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		query.Set("api-version", "2019-08-01")
+		req, err = http.NewRequestWithContext(s.ctx, "GET", endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		query.Set("api-version", "2018-02-01")
+		req, err = http.NewRequestWithContext(s.ctx, "GET", azureIMDSTokenURL+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("azure_ad: fetching managed identity token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("azure_ad: unknown status code received: %v: %s", resp.StatusCode, body)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, err
+	}
+
+	expiresOn, err := strconv.ParseInt(tokenResp.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("azure_ad: parsing expires_on: %v", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tokenResp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Unix(expiresOn, 0),
+	}, nil
+}
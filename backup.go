@@ -0,0 +1,320 @@
+package rest
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+// Archives written by export start with the manifest, followed by a file
+// below keysDir for each key.
+const (
+	manifestName = "manifest.json"
+	keysDir      = "keys/"
+)
+
+// archiveManifest describes an archive written by export.
+type archiveManifest struct {
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Endpoint string    `json:"endpoint"`
+	Prefixes []string  `json:"prefixes,omitempty"`
+	Keys     int       `json:"keys"`
+	// Whether the values are encrypted with --key-file, like values
+	// encrypted by the encryption option with a static key.
+	Encrypted bool `json:"encrypted"`
+}
+
+func exportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [--config <path>] [--adapter <name>] [--output <file>] [--prefix <prefix>...] [--key-file <file>]",
+		Short: "Writes all keys in the rest backend to a tar.gz archive",
+		Long: `
+Writes all keys in the rest backend, or those below the --prefix options, to
+a tar.gz archive that import can restore, as a backup independent of the
+backend. Each key is a file below keys/ with the modification time reported
+by the backend; manifest.json describes the archive.
+
+With --key-file, a file containing a base64-encoded 32-byte key, the values
+are encrypted with AES-256-GCM. The key names aren't encrypted.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdExport),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().StringP("output", "o", "rest-storage-export.tar.gz", "The archive to write, or - for stdout")
+	cmd.Flags().StringSlice("prefix", nil, "Only export the keys below this prefix; may be repeated")
+	cmd.Flags().String("key-file", "", "File with the base64-encoded key to encrypt values with")
+	return cmd
+}
+
+func importCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import [--config <path>] [--adapter <name>] [--input <file>] [--prefix <prefix>...] [--key-file <file>] [--skip-existing]",
+		Short: "Stores the keys of an archive written by export in the rest backend",
+		Long: `
+Stores the keys of an archive written by export, or those below the --prefix
+options, in the rest backend. Existing keys are overwritten, unless
+--skip-existing is given. Archives of encrypted values need the --key-file
+they were exported with.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdImport),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().StringP("input", "i", "rest-storage-export.tar.gz", "The archive to read, or - for stdin")
+	cmd.Flags().StringSlice("prefix", nil, "Only import the keys below this prefix; may be repeated")
+	cmd.Flags().String("key-file", "", "File with the base64-encoded key the values are encrypted with")
+	cmd.Flags().Bool("skip-existing", false, "Don't overwrite keys that exist in the backend")
+	return cmd
+}
+
+func cmdExport(fl caddycmd.Flags) (int, error) {
+	encryption, err := archiveEncryption(fl.String("key-file"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	r, cancel, err := storageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	ctx := context.Background()
+
+	prefixes, _ := fl.GetStringSlice("prefix")
+	var keys []string
+	seen := make(map[string]bool)
+	for _, prefix := range prefixesOrRoot(prefixes) {
+		found, err := storedKeys(ctx, r, prefix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("listing keys below %q: %v", prefix, err)
+		}
+		for _, key := range found {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if output := fl.String("output"); output != "-" {
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	gz := gzip.NewWriter(out)
+	archive := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(archiveManifest{
+		Version:   1,
+		Created:   time.Now().UTC(),
+		Endpoint:  r.Endpoint,
+		Prefixes:  prefixes,
+		Keys:      len(keys),
+		Encrypted: encryption != nil,
+	}, "", "\t")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := writeArchiveFile(archive, manifestName, time.Now(), manifest); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	for i, key := range keys {
+		value, err := r.Load(ctx, key)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("loading %s: %v", key, err)
+		}
+		info, err := r.Stat(ctx, key)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("stat %s: %v", key, err)
+		}
+
+		if encryption != nil {
+			value, err = encryption.encrypt(key, value)
+			if err != nil {
+				return caddy.ExitCodeFailedStartup, fmt.Errorf("encrypting %s: %v", key, err)
+			}
+		}
+
+		if err := writeArchiveFile(archive, keysDir+key, info.Modified, value); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+
+		if n := i + 1; n%100 == 0 || n == len(keys) {
+			fmt.Fprintf(os.Stderr, "Exported %d of %d keys\n", n, len(keys))
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := gz.Close(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdImport(fl caddycmd.Flags) (int, error) {
+	encryption, err := archiveEncryption(fl.String("key-file"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var in io.Reader = os.Stdin
+	if input := fl.String("input"); input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("reading archive: %v", err)
+	}
+	archive := tar.NewReader(gz)
+
+	header, err := archive.Next()
+	if err != nil || header.Name != manifestName {
+		return caddy.ExitCodeFailedStartup, errors.New("not an archive written by export: missing manifest")
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding manifest: %v", err)
+	}
+	if manifest.Version != 1 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if manifest.Encrypted && encryption == nil {
+		return caddy.ExitCodeFailedStartup, errors.New("the archive is encrypted; --key-file is required")
+	}
+	if !manifest.Encrypted {
+		encryption = nil
+	}
+
+	r, cancel, err := storageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	ctx := context.Background()
+	prefixes, _ := fl.GetStringSlice("prefix")
+	skipExisting := fl.Bool("skip-existing")
+
+	var imported, skipped int
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("reading archive: %v", err)
+		}
+
+		key, ok := strings.CutPrefix(header.Name, keysDir)
+		if !ok || header.Typeflag != tar.TypeReg || !hasAnyPrefix(key, prefixes) {
+			continue
+		}
+		if skipExisting && r.Exists(ctx, key) {
+			skipped++
+			continue
+		}
+
+		value, err := io.ReadAll(archive)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("reading %s: %v", key, err)
+		}
+		if encryption != nil {
+			value, _, err = encryption.decrypt(ctx, key, value)
+			if err != nil {
+				return caddy.ExitCodeFailedStartup, fmt.Errorf("decrypting %s: %v", key, err)
+			}
+		}
+
+		if err := r.Store(ctx, key, value); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("storing %s: %v", key, err)
+		}
+
+		imported++
+		if imported%100 == 0 {
+			fmt.Printf("Imported %d keys\n", imported)
+		}
+	}
+
+	fmt.Printf("Imported %d keys, skipped %d existing keys\n", imported, skipped)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// archiveEncryption returns the encryption of archive values with the key
+// in keyFile, or nil without a key file.
+func archiveEncryption(keyFile string) (*EncryptionConfig, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	aead, err := loadEncryptionKey("", keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("--key-file: %v", err)
+	}
+	return &EncryptionConfig{aead: aead}, nil
+}
+
+func writeArchiveFile(archive *tar.Writer, name string, modified time.Time, data []byte) error {
+	err := archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o600,
+		Size:     int64(len(data)),
+		ModTime:  modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
+
+func prefixesOrRoot(prefixes []string) []string {
+	if len(prefixes) == 0 {
+		return []string{""}
+	}
+	return prefixes
+}
+
+// hasAnyPrefix reports whether key is one of prefixes or below one of them;
+// any key matches no prefixes.
+func hasAnyPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(prefix, "/")
+		if prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,573 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// The maximum number of items sent in one batch request.
+const maxBatchSize = 100
+
+type StoreBatchRequest struct {
+	// Fencing tokens are sent once for the whole batch, not per item.
+	Items         []StoreRequest    `json:"items" protobuf:"1"`
+	FencingTokens map[string]uint64 `json:"fencing_tokens,omitempty" protobuf:"2"`
+}
+
+type DeleteBatchRequest struct {
+	Keys          []string          `json:"keys" protobuf:"1"`
+	FencingTokens map[string]uint64 `json:"fencing_tokens,omitempty" protobuf:"2"`
+}
+
+type BatchResponse struct {
+	// Items without a result are treated as successful.
+	Results []BatchResult `json:"results,omitempty" protobuf:"1"`
+}
+
+// BatchResult is the outcome of one item of a batch request.
+type BatchResult struct {
+	Key string `json:"key" protobuf:"1"`
+	// The status code the backend would have responded to the item with
+	// on its own, e.g. 201, 404, 409 or 412.
+	Status int64 `json:"status" protobuf:"2"`
+	// An error message, if the item failed.
+	Error string `json:"error,omitempty" protobuf:"3"`
+	// The version of a stored or loaded value, used as its ETag.
+	Version string `json:"version,omitempty" protobuf:"4"`
+	// The value of a loaded key, and its hex-encoded SHA-256 hash.
+	Value    []byte `json:"value,omitempty" protobuf:"5"`
+	Checksum string `json:"checksum,omitempty" protobuf:"6"`
+}
+
+func (b BatchResult) failed() bool {
+	return b.Status >= 300
+}
+
+// StoreBatch stores several values, keyed by key. If the backend reports
+// the batch capability, they are sent in batches of up to 100 values;
+// otherwise, they are stored one by one. The errors of all values that
+// couldn't be stored are joined.
+func (r *RestStorage) StoreBatch(ctx context.Context, values map[string][]byte) error {
+	if r.ReadOnly {
+		return &ReadOnlyError{Operation: opStoreBatch, Key: fmt.Sprintf("%d keys", len(values))}
+	}
+	if r.DryRun {
+		for key, value := range values {
+			r.logDryRun(opStore, r.backendKey(key), zap.Int("size", len(value)))
+		}
+		return nil
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Which of the values the backend accepted isn't known here, so the
+	// mirror copies them from the backend.
+	defer r.mirrorLater(keys...)
+
+	var errs []error
+	var items []StoreRequest
+	for _, key := range keys {
+		opts := storeOptions{
+			createOnly: r.createOnly(key),
+			ttl:        r.keyTTL(key),
+		}
+
+		if !r.capabilities[CapabilityBatch] {
+			if err := r.store(ctx, r.backendKey(key), values[key], opts); err != nil {
+				errs = append(errs, fmt.Errorf("storing %v: %w", key, err))
+			}
+			continue
+		}
+
+		_, item, err := r.storeRequest(r.backendKey(key), values[key], opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		// Too large for a single request body.
+		if r.ChunkedUpload != nil && len(item.Value) > r.ChunkedUpload.Threshold {
+			if err := r.store(ctx, item.Key, values[key], opts); err != nil {
+				errs = append(errs, fmt.Errorf("storing %v: %w", key, err))
+			}
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	for start := 0; start < len(items); start += maxBatchSize {
+		if err := r.storeBatch(ctx, items[start:min(start+maxBatchSize, len(items))]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *RestStorage) storeBatch(ctx context.Context, items []StoreRequest) (err error) {
+	// Like store, before the request: the batch may be applied in part
+	// even if it fails.
+	for _, item := range items {
+		r.invalidate(item.Key)
+	}
+
+	// Once the response is decoded, the items are audited one by one.
+	var results map[string]BatchResult
+	defer func() {
+		if results == nil {
+			keys := make([]string, len(items))
+			for i, item := range items {
+				keys[i] = item.Key
+			}
+			r.auditKeys(opStore, keys, err)
+		}
+	}()
+
+	resp, err := r.call(ctx, opStoreBatch, "", nil, StoreBatchRequest{
+		Items:         items,
+		FencingTokens: r.locks.fencingTokens(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opStoreBatch, resp, 200) {
+		return r.statusError(resp)
+	}
+
+	var batchResp BatchResponse
+
+	err = decode(resp, &batchResp)
+
+	if err != nil {
+		return err
+	}
+
+	results = batchResults(batchResp)
+
+	var errs []error
+	for _, item := range items {
+		result := results[item.Key]
+		if !result.failed() {
+			r.setETag(item.Key, versionETag(result.Version), item.Value)
+			r.diskCache.put(item.Key, item.Value, r.logger)
+			r.audit(opStore, item.Key, nil)
+			r.emitKey(EventStored, item.Key)
+			continue
+		}
+
+		var itemErr error
+		switch {
+		case item.CreateOnly && result.Status == 409:
+			itemErr = &AlreadyExistsError{Key: item.Key}
+		case item.IfMatch != "" && result.Status == 412:
+			itemErr = &ConflictError{Key: item.Key, Version: item.IfMatch}
+		default:
+			itemErr = fmt.Errorf("storing %v: %w", item.Key, result.statusError())
+		}
+		r.audit(opStore, item.Key, itemErr)
+		errs = append(errs, itemErr)
+	}
+
+	return errors.Join(errs...)
+}
+
+// DeleteBatch deletes several keys, like StoreBatch stores several values.
+// Keys that don't exist are skipped.
+func (r *RestStorage) DeleteBatch(ctx context.Context, keys []string) error {
+	if r.ReadOnly {
+		return &ReadOnlyError{Operation: opDeleteBatch, Key: fmt.Sprintf("%d keys", len(keys))}
+	}
+	if r.DryRun {
+		for _, key := range keys {
+			r.logDryRun(opDelete, r.backendKey(key))
+		}
+		return nil
+	}
+
+	var errs []error
+	var backendKeys []string
+	storageKeys := make(map[string]string)
+	for _, key := range keys {
+		if !r.capabilities[CapabilityBatch] {
+			if err := r.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("deleting %v: %w", key, err))
+			}
+			continue
+		}
+
+		backendKey := r.backendKey(key)
+		r.forgetETag(backendKey)
+		r.invalidate(backendKey)
+		r.diskCache.removePrefix(backendKey)
+		backendKeys = append(backendKeys, backendKey)
+		storageKeys[backendKey] = key
+	}
+
+	for start := 0; start < len(backendKeys); start += maxBatchSize {
+		batch := backendKeys[start:min(start+maxBatchSize, len(backendKeys))]
+		failed, err := r.deleteBatch(ctx, batch)
+
+		// The keys are deleted from the fallback storage like with
+		// Delete, and during an outage only from there.
+		batchFailed := false
+		for _, backendKey := range batch {
+			key := storageKeys[backendKey]
+			keyErr := err
+			if keyErr == nil {
+				keyErr = failed[backendKey]
+			}
+			if keyErr = r.fallbackDelete(ctx, key, keyErr); keyErr == nil {
+				continue
+			}
+			if err != nil {
+				batchFailed = true
+			} else {
+				errs = append(errs, fmt.Errorf("deleting %v: %w", key, keyErr))
+			}
+		}
+		if batchFailed {
+			errs = append(errs, err)
+		}
+	}
+	if len(backendKeys) > 0 {
+		r.mirrorLater(keys...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// deleteBatch deletes keys, as named in the backend, in one request, and
+// returns the errors of the keys that couldn't be deleted, other than those
+// that don't exist.
+func (r *RestStorage) deleteBatch(ctx context.Context, keys []string) (failed map[string]error, err error) {
+	// Once the response is decoded, the keys are audited one by one.
+	var decoded bool
+	defer func() {
+		if !decoded {
+			r.auditKeys(opDelete, keys, err)
+		}
+	}()
+
+	resp, err := r.call(ctx, opDeleteBatch, "", nil, DeleteBatchRequest{
+		Keys:          keys,
+		FencingTokens: r.locks.fencingTokens(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opDeleteBatch, resp, 200) {
+		return nil, r.statusError(resp)
+	}
+
+	var batchResp BatchResponse
+
+	err = decode(resp, &batchResp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decoded = true
+
+	failed = make(map[string]error)
+	for _, result := range batchResp.Results {
+		if !result.failed() {
+			r.audit(opDelete, result.Key, nil)
+			r.emitKey(EventDeleted, result.Key)
+			continue
+		}
+
+		r.audit(opDelete, result.Key, result.statusError())
+		if result.Status != 404 {
+			failed[result.Key] = result.statusError()
+		}
+	}
+
+	return failed, nil
+}
+
+func batchResults(batchResp BatchResponse) map[string]BatchResult {
+	results := make(map[string]BatchResult, len(batchResp.Results))
+	for _, result := range batchResp.Results {
+		results[result.Key] = result
+	}
+	return results
+}
+
+func (b BatchResult) statusError() error {
+	return &StatusError{StatusCode: int(b.Status), Message: b.Error}
+}
+
+type LoadBatchRequest struct {
+	Keys []string `json:"keys" protobuf:"1"`
+}
+
+// How long values loaded along with another key are kept for their own
+// Load.
+const batchLoadTTL = 10 * time.Second
+
+// loadBatch loads several keys, as named in the backend, in one request and
+// returns the values as stored. Keys that don't exist are missing from the
+// result.
+func (r *RestStorage) loadBatch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	resp, err := r.call(ctx, opLoadBatch, "", nil, LoadBatchRequest{
+		Keys: keys,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opLoadBatch, resp, 200) {
+		return nil, r.statusError(resp)
+	}
+
+	var batchResp BatchResponse
+
+	err = decode(resp, &batchResp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte)
+	for _, result := range batchResp.Results {
+		if result.Status == 404 {
+			continue
+		}
+		if result.failed() {
+			return nil, fmt.Errorf("loading %v: %w", result.Key, result.statusError())
+		}
+
+		if r.Checksums {
+			if err := compareChecksum(result.Key, result.Checksum, result.Value); err != nil {
+				return nil, err
+			}
+		}
+
+		r.setETag(result.Key, versionETag(result.Version), result.Value)
+		values[result.Key] = result.Value
+	}
+
+	return values, nil
+}
+
+// relatedKeys returns the backend keys that certmagic usually loads right
+// after key: the other files of the same certificate resource, e.g. the
+// .key and .json files of certificates/<issuer>/<name>/<name>.crt. They
+// are only returned if the backend supports batches.
+func (r *RestStorage) relatedKeys(key string) []string {
+	if !r.capabilities[CapabilityBatch] || !strings.HasPrefix(key, "certificates/") {
+		return nil
+	}
+
+	dir, file := path.Split(key)
+	ext := path.Ext(file)
+	name := strings.TrimSuffix(file, ext)
+	if name != path.Base(dir) {
+		return nil
+	}
+
+	var related []string
+	for _, relatedExt := range []string{".crt", ".key", ".json"} {
+		if relatedExt != ext {
+			related = append(related, r.backendKey(dir+name+relatedExt))
+		}
+	}
+	if len(related) == 3 {
+		// Not a certificate resource file.
+		return nil
+	}
+	return related
+}
+
+// batchLoads holds the values loaded along with other keys until they are
+// loaded themselves.
+type batchLoads struct {
+	mu     sync.Mutex
+	values map[string]batchLoad
+}
+
+type batchLoad struct {
+	value   []byte
+	expires time.Time
+}
+
+func newBatchLoads() *batchLoads {
+	return &batchLoads{values: make(map[string]batchLoad)}
+}
+
+func (b *batchLoads) add(values map[string][]byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for key, loaded := range b.values {
+		if now.After(loaded.expires) {
+			delete(b.values, key)
+		}
+	}
+
+	for key, value := range values {
+		b.values[key] = batchLoad{value: value, expires: now.Add(batchLoadTTL)}
+	}
+}
+
+// take returns and forgets the value of key, if it was loaded recently.
+func (b *batchLoads) take(key string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loaded, ok := b.values[key]
+	delete(b.values, key)
+	if !ok || time.Now().After(loaded.expires) {
+		return nil, false
+	}
+	return loaded.value, true
+}
+
+func (b *batchLoads) forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.values, key)
+}
+
+type StatBatchRequest struct {
+	Keys []string `json:"keys" protobuf:"1"`
+}
+
+type StatBatchResponse struct {
+	// Keys that don't exist are left out.
+	Results []StatResponse `json:"results" protobuf:"1"`
+}
+
+// StatBatch returns the KeyInfo of several keys, keyed by key. Keys that
+// don't exist are missing from the result. If the backend reports the
+// batch capability, up to 100 keys are sent per request; otherwise, they
+// are stat'ed one by one.
+func (r *RestStorage) StatBatch(ctx context.Context, keys []string) (map[string]certmagic.KeyInfo, error) {
+	infos := make(map[string]certmagic.KeyInfo, len(keys))
+
+	if !r.capabilities[CapabilityBatch] {
+		for _, key := range keys {
+			info, err := r.Stat(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("stat %v: %w", key, err)
+			}
+			infos[key] = info
+		}
+		return infos, nil
+	}
+
+	// Hashed keys can't be decoded, so results are matched by backend key.
+	byBackendKey := make(map[string]string, len(keys))
+	backendKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		backendKey := r.backendKey(key)
+		byBackendKey[backendKey] = key
+		backendKeys = append(backendKeys, backendKey)
+	}
+
+	for start := 0; start < len(backendKeys); start += maxBatchSize {
+		results, err := r.statBatch(ctx, backendKeys[start:min(start+maxBatchSize, len(backendKeys))])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range results {
+			key, ok := byBackendKey[info.Key]
+			if !ok {
+				continue
+			}
+			info.Key = key
+			infos[key] = info
+		}
+	}
+
+	return infos, nil
+}
+
+func (r *RestStorage) statBatch(ctx context.Context, keys []string) ([]certmagic.KeyInfo, error) {
+	resp, err := r.call(ctx, opStatBatch, "", nil, StatBatchRequest{
+		Keys: keys,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opStatBatch, resp, 200) {
+		return nil, r.statusError(resp)
+	}
+
+	var batchResp StatBatchResponse
+
+	err = decode(resp, &batchResp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]certmagic.KeyInfo, 0, len(batchResp.Results))
+	for _, statResp := range batchResp.Results {
+		modified, err := r.parseTimestamp(string(statResp.Modified))
+		if err != nil {
+			return nil, fmt.Errorf("stat %v: %v", statResp.Key, err)
+		}
+
+		infos = append(infos, certmagic.KeyInfo{
+			Key:        statResp.Key,
+			Modified:   modified,
+			Size:       statResp.Size,
+			IsTerminal: statResp.IsTerminal,
+		})
+	}
+
+	return infos, nil
+}
+
+func (b *batchLoads) clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.values)
+}
+
+func (b *batchLoads) forgetPrefix(prefix string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key := range b.values {
+		if underPrefix(key, prefix) {
+			delete(b.values, key)
+		}
+	}
+}
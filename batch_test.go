@@ -0,0 +1,104 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestDeleteBatchOutage checks that keys deleted with DeleteBatch aren't
+// served from the disk cache or the fallback storage once the backend is
+// down, and that deletes during an outage are synced later.
+func TestDeleteBatchOutage(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, &RestStorage{
+		DetectCapabilities: true,
+		DiskCache:          &DiskCacheConfig{Path: t.TempDir()},
+		Fallback:           testFallback(t),
+	})
+	if !r.capabilities[CapabilityBatch] {
+		t.Fatal("the server doesn't report the batch capability")
+	}
+	ctx := context.Background()
+
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		if err := r.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if _, err := r.Load(ctx, key); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+	}
+
+	if err := r.DeleteBatch(ctx, []string{"a", "b", "missing"}); err != nil {
+		t.Fatalf("DeleteBatch: %v", err)
+	}
+	server.Close()
+
+	if err := r.DeleteBatch(ctx, []string{"c"}); err != nil {
+		t.Fatalf("DeleteBatch during the outage: %v", err)
+	}
+	if op := r.fallback.pendingWrites()["c"]; op != opDelete {
+		t.Errorf("DeleteBatch during the outage is pending as %q", op)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if value, err := r.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Load of %s after DeleteBatch returned %q, %v", key, value, err)
+		}
+	}
+	if value, err := r.Load(ctx, "d"); err != nil || string(value) != "d" {
+		t.Errorf("Load of d during the outage returned %q, %v", value, err)
+	}
+}
+
+// TestStoreBatchFailure checks that a batch the backend applied but failed
+// to answer doesn't leave the old values cached.
+func TestStoreBatchFailure(t *testing.T) {
+	server := newTestServer(t)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if strings.HasSuffix(resp.Request.URL.Path, "/store_batch") {
+			resp.StatusCode = http.StatusBadGateway
+		}
+		return nil
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	r := server.storage(t, &RestStorage{
+		Endpoint:           front.URL + "/",
+		DetectCapabilities: true,
+		Cache:              &CacheConfig{},
+	})
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b"} {
+		if err := r.Store(ctx, key, []byte("old")); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if _, err := r.Load(ctx, key); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+	}
+
+	if err := r.StoreBatch(ctx, map[string][]byte{"a": []byte("new"), "b": []byte("new")}); err == nil {
+		t.Fatal("StoreBatch succeeded")
+	}
+	for _, key := range []string{"a", "b"} {
+		if value, err := r.Load(ctx, key); err != nil || string(value) != "new" {
+			t.Errorf("Load of %s after the failed StoreBatch returned %q, %v", key, value, err)
+		}
+	}
+}
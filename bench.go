@@ -0,0 +1,331 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func benchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bench [--config <path>] [--adapter <name>] [--duration <duration>] [--concurrency <n>] [--mix <op=weight,...>] [--keys <n>] [--value-size <bytes>]",
+		Short: "Measures the latency and throughput of the rest backend",
+		Long: `
+Sends a mix of operations to the rest backend from --concurrency workers
+for --duration, and prints the throughput and latency percentiles of each
+operation, e.g. to plan the capacity of the backend before moving a fleet
+to it.
+
+--mix is the relative weight of each operation, e.g. load=60,store=20 for
+three loads per store. The operations are store, load, list (the keys
+directly below a directory), and lock, which acquires and releases a lock
+of the worker; unlock latency is reported separately.
+
+--keys keys of --value-size random bytes are stored below --prefix before
+the run, and loads and stores pick one of them at random. Caches and the
+fallback storage are bypassed. The keys are deleted afterwards.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdBench),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().DurationP("duration", "d", 30*time.Second, "How long to send requests")
+	cmd.Flags().Int("concurrency", 16, "Number of operations in flight at a time")
+	cmd.Flags().String("mix", "load=60,store=20,list=10,lock=10", "Relative weights of the operations")
+	cmd.Flags().Int("keys", 1000, "Number of keys to store before the run")
+	cmd.Flags().Int("value-size", 4096, "Size of the values in bytes")
+	cmd.Flags().String("prefix", "", "The directory of the keys (default: rest_storage_bench/<random>)")
+	return cmd
+}
+
+// benchOps are the operations bench can send, in the order they are
+// reported.
+var benchOps = []string{opStore, opLoad, opList, opLock, opUnlock}
+
+// benchWeight is the weight of an operation in the mix.
+type benchWeight struct {
+	op     string
+	weight int
+}
+
+// parseBenchMix parses a mix like "load=60,store=20".
+func parseBenchMix(mix string) ([]benchWeight, error) {
+	var weights []benchWeight
+	total := 0
+	for _, item := range strings.Split(mix, ",") {
+		op, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("--mix: %q is not <operation>=<weight>", item)
+		}
+		if op == opUnlock || !slices.Contains(benchOps, op) {
+			return nil, fmt.Errorf("--mix: unknown operation %q; expected one of store, load, list, lock", op)
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("--mix: weight of %s must be a non-negative integer", op)
+		}
+		weights = append(weights, benchWeight{op: op, weight: weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.New("--mix: the weights must not all be zero")
+	}
+	return weights, nil
+}
+
+func cmdBench(fl caddycmd.Flags) (int, error) {
+	duration, _ := fl.GetDuration("duration")
+	concurrency := fl.Int("concurrency")
+	numKeys := fl.Int("keys")
+	valueSize := fl.Int("value-size")
+	if duration <= 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--duration must be positive")
+	}
+	if concurrency < 1 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--concurrency must be at least 1")
+	}
+	if numKeys < 1 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--keys must be at least 1")
+	}
+	if valueSize < 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--value-size must not be negative")
+	}
+	mix, err := parseBenchMix(fl.String("mix"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	r, cancel, err := storageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	if r.ReadOnly || r.DryRun {
+		return caddy.ExitCodeFailedStartup, errors.New("the configured storage is read-only or in dry run mode")
+	}
+
+	prefix := fl.String("prefix")
+	if prefix == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		prefix = path.Join("rest_storage_bench", hex.EncodeToString(id))
+	}
+
+	value := make([]byte, valueSize)
+	if _, err := rand.Read(value); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	b := &bench{
+		r:      r,
+		ctx:    withoutFallback(context.Background()),
+		prefix: prefix,
+		mix:    mix,
+		value:  value,
+		keys:   make([]string, numKeys),
+	}
+	for i := range b.keys {
+		b.keys[i] = path.Join(prefix, "keys", strconv.Itoa(i))
+	}
+	for _, w := range mix {
+		b.totalWeight += w.weight
+	}
+
+	fmt.Printf("Storing %d keys below %s\n", numKeys, prefix)
+	failed := forEachKey(b.keys, concurrency, "Stored", func(key string) error {
+		return r.Store(b.ctx, key, value)
+	})
+	if failed > 0 {
+		b.cleanup(concurrency)
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d keys could not be stored", failed)
+	}
+
+	fmt.Printf("Running %s with concurrency %d\n", duration, concurrency)
+	results := b.run(duration, concurrency)
+	b.cleanup(concurrency)
+
+	b.report(results, duration)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// bench runs the bench command.
+type bench struct {
+	r      *RestStorage
+	ctx    context.Context
+	prefix string
+
+	mix         []benchWeight
+	totalWeight int
+
+	value []byte
+	keys  []string
+}
+
+// benchResults are the latencies and errors of each operation.
+type benchResults struct {
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newBenchResults() *benchResults {
+	return &benchResults{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+}
+
+// run sends operations from concurrency workers until duration elapsed.
+func (b *bench) run(duration time.Duration, concurrency int) *benchResults {
+	deadline := time.Now().Add(duration)
+
+	results := newBenchResults()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Each worker has its own results and lock, so workers wait
+			// for the backend, not for each other.
+			own := newBenchResults()
+			lockKey := path.Join(b.prefix, "locks", strconv.Itoa(i))
+			rnd := mathrand.New(mathrand.NewSource(time.Now().UnixNano() + int64(i)))
+			for time.Now().Before(deadline) {
+				b.do(b.pick(rnd), rnd, lockKey, own)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for op, latencies := range own.latencies {
+				results.latencies[op] = append(results.latencies[op], latencies...)
+			}
+			for op, n := range own.errors {
+				results.errors[op] += n
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// pick returns an operation of the mix at random, by weight.
+func (b *bench) pick(rnd *mathrand.Rand) string {
+	n := rnd.Intn(b.totalWeight)
+	for _, w := range b.mix {
+		if n < w.weight {
+			return w.op
+		}
+		n -= w.weight
+	}
+	return b.mix[len(b.mix)-1].op
+}
+
+// do sends op and records its latency, or its error.
+func (b *bench) do(op string, rnd *mathrand.Rand, lockKey string, results *benchResults) {
+	key := b.keys[rnd.Intn(len(b.keys))]
+
+	measure := func(op string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		if err != nil {
+			results.errors[op]++
+			return err
+		}
+		results.latencies[op] = append(results.latencies[op], time.Since(start))
+		return nil
+	}
+
+	switch op {
+	case opStore:
+		measure(opStore, func() error {
+			return b.r.Store(b.ctx, key, b.value)
+		})
+	case opLoad:
+		b.r.invalidate(b.r.backendKey(key))
+		measure(opLoad, func() error {
+			_, err := b.r.Load(b.ctx, key)
+			return err
+		})
+	case opList:
+		dir := path.Join(b.prefix, "keys")
+		b.r.invalidatePrefix(b.r.backendKey(dir))
+		measure(opList, func() error {
+			_, err := b.r.List(b.ctx, dir, false)
+			return err
+		})
+	case opLock:
+		if measure(opLock, func() error { return b.r.Lock(b.ctx, lockKey) }) != nil {
+			return
+		}
+		measure(opUnlock, func() error { return b.r.Unlock(b.ctx, lockKey) })
+	}
+}
+
+// cleanup deletes the keys below the prefix.
+func (b *bench) cleanup(concurrency int) {
+	keys, err := b.r.List(b.ctx, b.prefix, true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Unable to list the keys below %s: %v\n", b.prefix, err)
+		return
+	}
+	forEachKey(keys, concurrency, "Deleted", func(key string) error {
+		if err := b.r.Delete(b.ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+// report prints the throughput and latency percentiles of each operation.
+func (b *bench) report(results *benchResults, duration time.Duration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Operation\tCount\tErrors\tOps/s\tp50\tp90\tp99\tMax\t")
+
+	var total, totalErrors int
+	for _, op := range benchOps {
+		latencies := results.latencies[op]
+		errs := results.errors[op]
+		if len(latencies) == 0 && errs == 0 {
+			continue
+		}
+		total += len(latencies)
+		totalErrors += errs
+
+		slices.Sort(latencies)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			op, len(latencies), errs, float64(len(latencies))/duration.Seconds(),
+			latencyPercentile(latencies, 0.5), latencyPercentile(latencies, 0.9), latencyPercentile(latencies, 0.99), latencyPercentile(latencies, 1))
+	}
+	fmt.Fprintf(w, "total\t%d\t%d\t%.1f\t\t\t\t\t\n", total, totalErrors, float64(total)/duration.Seconds())
+	w.Flush()
+}
+
+// latencyPercentile returns the q-th quantile of the sorted latencies, by
+// nearest rank, rounded for display.
+func latencyPercentile(latencies []time.Duration, q float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(latencies)))) - 1
+	return latencies[max(i, 0)].Round(time.Microsecond)
+}
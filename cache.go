@@ -0,0 +1,306 @@
+package rest
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// CacheConfig caches loaded values in memory, so that certificates and OCSP
+// staples loaded over and over don't cost a round trip each time. Values
+// stored or deleted through this instance are evicted; changes made by
+// other instances are seen once the cached value expires, or with Watch, as
+// soon as the backend reports them.
+type CacheConfig struct {
+	// The maximum number of values cached. The least recently used value is
+	// evicted first. Defaults to 1000. It also bounds the ETags remembered
+	// with conditional_load and optimistic_concurrency.
+	MaxEntries int `json:"max_entries,omitempty"`
+	// How long values are cached. Defaults to 5m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// How long to remember that a key doesn't exist, so that repeated
+	// Loads of missing keys (e.g. certificates of bogus hostnames probed
+	// with on-demand TLS) don't reach the backend. Zero (the default)
+	// disables this.
+	NotFoundTTL caddy.Duration `json:"not_found_ttl,omitempty"`
+	// How long the results of Stat and Exists are cached, for
+	// maintenance routines that call them in tight loops. Zero (the
+	// default) disables this.
+	StatTTL caddy.Duration `json:"stat_ttl,omitempty"`
+}
+
+const defaultCacheMaxEntries = 1000
+
+func (c *CacheConfig) provision() {
+	if c.MaxEntries == 0 {
+		c.MaxEntries = defaultCacheMaxEntries
+	}
+	if c.TTL == 0 {
+		c.TTL = caddy.Duration(5 * time.Minute)
+	}
+}
+
+func (c *CacheConfig) validate() error {
+	if c.MaxEntries < 0 {
+		return errors.New("cache: max_entries must not be negative")
+	}
+	if c.TTL < 0 || c.NotFoundTTL < 0 || c.StatTTL < 0 {
+		return errors.New("cache: ttls must not be negative")
+	}
+	return nil
+}
+
+// lruCache is a size-bounded cache whose entries expire after a TTL, unless
+// it's zero. A nil *lruCache caches nothing.
+type lruCache[V any] struct {
+	// the cache label of lookups in metrics
+	name string
+
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	// The front is the most recently used entry.
+	entries *list.List
+	byKey   map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](name string, maxEntries int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		name:       name,
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    list.New(),
+		byKey:      make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+
+	value, ok := c.lookup(key)
+	observeCacheLookup(c.name, ok)
+	if !ok {
+		return zero, false
+	}
+	return value, true
+}
+
+func (c *lruCache[V]) lookup(key string) (V, bool) {
+	var zero V
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.byKey[key]
+	if !ok {
+		return zero, false
+	}
+
+	entry := elem.Value.(*lruEntry[V])
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.entries.Remove(elem)
+		delete(c.byKey, key)
+		return zero, false
+	}
+
+	c.entries.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) add(key string, value V) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lruEntry[V]{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if elem, ok := c.byKey[key]; ok {
+		elem.Value = entry
+		c.entries.MoveToFront(elem)
+		return
+	}
+
+	c.byKey[key] = c.entries.PushFront(entry)
+	for c.entries.Len() > c.maxEntries {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.byKey, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+func (c *lruCache[V]) remove(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.byKey[key]; ok {
+		c.entries.Remove(elem)
+		delete(c.byKey, key)
+	}
+}
+
+// removePrefix removes prefix and the keys below it.
+func (c *lruCache[V]) removePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.byKey {
+		if underPrefix(key, prefix) {
+			c.entries.Remove(elem)
+			delete(c.byKey, key)
+		}
+	}
+}
+
+// len returns the number of entries, including expired ones not evicted
+// yet.
+func (c *lruCache[V]) len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.entries.Len()
+}
+
+func (c *lruCache[V]) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries.Init()
+	clear(c.byKey)
+}
+
+// loadGenerations counts the invalidations of keys while they are loaded,
+// so that a Load that raced a Store or Delete doesn't cache the value they
+// replaced after they invalidated it.
+type loadGenerations struct {
+	mu sync.Mutex
+	// Counts the invalidations of prefixes and of all keys.
+	all uint64
+	// The keys being loaded.
+	keys map[string]*loadGeneration
+}
+
+type loadGeneration struct {
+	invalidations uint64
+	loads         int
+}
+
+func newLoadGenerations() *loadGenerations {
+	return &loadGenerations{keys: make(map[string]*loadGeneration)}
+}
+
+// start records a load of key, which must be ended with end, and returns
+// the generation to pass to fill.
+func (g *loadGenerations) start(key string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	gen, ok := g.keys[key]
+	if !ok {
+		gen = new(loadGeneration)
+		g.keys[key] = gen
+	}
+	gen.loads++
+	return g.all + gen.invalidations
+}
+
+func (g *loadGenerations) end(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if gen := g.keys[key]; gen != nil {
+		if gen.loads--; gen.loads == 0 {
+			delete(g.keys, key)
+		}
+	}
+}
+
+// fill calls add to cache what was loaded of key, unless key was
+// invalidated since the load started.
+func (g *loadGenerations) fill(key string, start uint64, add func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if gen := g.keys[key]; gen != nil && g.all+gen.invalidations == start {
+		add()
+	}
+}
+
+func (g *loadGenerations) invalidate(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if gen := g.keys[key]; gen != nil {
+		gen.invalidations++
+	}
+}
+
+func (g *loadGenerations) invalidateAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.all++
+}
+
+// invalidate drops the copies of the value of key kept by this instance,
+// after it was changed.
+func (r *RestStorage) invalidate(key string) {
+	r.loadGenerations.invalidate(key)
+	r.batchLoads.forget(key)
+	r.values.remove(key)
+	r.missingKeys.remove(key)
+	r.keyInfos.remove(key)
+	r.existence.remove(key)
+}
+
+// invalidatePrefix drops the copies of the values of prefix and the keys
+// below it.
+func (r *RestStorage) invalidatePrefix(prefix string) {
+	r.loadGenerations.invalidateAll()
+	r.batchLoads.forgetPrefix(prefix)
+	r.values.removePrefix(prefix)
+	r.missingKeys.removePrefix(prefix)
+	r.keyInfos.removePrefix(prefix)
+	r.existence.removePrefix(prefix)
+}
+
+// invalidateAll drops the copies of all values, e.g. when changes made by
+// other instances may have been missed. Conditional loads revalidate their
+// values anyway.
+func (r *RestStorage) invalidateAll() {
+	r.loadGenerations.invalidateAll()
+	r.batchLoads.clear()
+	r.values.clear()
+	r.missingKeys.clear()
+	r.keyInfos.clear()
+	r.existence.clear()
+}
@@ -0,0 +1,117 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// TestLoadRacingStore checks that a Load that started before a Store, and
+// got the old value, doesn't cache it after the Store invalidated it.
+func TestLoadRacingStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string // the value before the Store, or "" if the key is missing
+	}{
+		{"replaced value", "old"},
+		{"missing key", ""},
+	}
+
+	for _, test := range tests {
+		server := newTestServer(t)
+		target, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The proxy holds back the response of the first load until the
+		// Store is done.
+		loaded, release := make(chan struct{}), make(chan struct{})
+		var once sync.Once
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if strings.HasSuffix(resp.Request.URL.Path, "/load") {
+				once.Do(func() {
+					close(loaded)
+					<-release
+				})
+			}
+			return nil
+		}
+		front := httptest.NewServer(proxy)
+		defer front.Close()
+
+		r := server.storage(t, &RestStorage{
+			Endpoint: front.URL + "/",
+			Cache:    &CacheConfig{NotFoundTTL: caddy.Duration(time.Minute)},
+		})
+		ctx := context.Background()
+
+		if test.value != "" {
+			direct := server.storage(t, nil)
+			if err := direct.Store(ctx, "key", []byte(test.value)); err != nil {
+				t.Fatalf("%s: Store: %v", test.name, err)
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Load(ctx, "key")
+		}()
+
+		<-loaded
+		if err := r.Store(ctx, "key", []byte("new")); err != nil {
+			t.Fatalf("%s: Store: %v", test.name, err)
+		}
+		close(release)
+		<-done
+
+		value, err := r.Load(ctx, "key")
+		if err != nil {
+			t.Errorf("%s: Load after the Store: %v", test.name, err)
+		} else if string(value) != "new" {
+			t.Errorf("%s: Load after the Store returned %q from the cache", test.name, value)
+		}
+	}
+}
+
+func TestLoadGenerations(t *testing.T) {
+	g := newLoadGenerations()
+	filled := func(key string, gen uint64) bool {
+		var ok bool
+		g.fill(key, gen, func() { ok = true })
+		return ok
+	}
+
+	a := g.start("a")
+	b := g.start("b")
+	g.invalidate("a")
+	if filled("a", a) {
+		t.Error("a load of an invalidated key was cached")
+	}
+	if !filled("b", b) {
+		t.Error("a load of another key wasn't cached")
+	}
+	g.end("a")
+	g.end("b")
+
+	a = g.start("a")
+	g.invalidateAll()
+	if filled("a", a) {
+		t.Error("a load was cached after all keys were invalidated")
+	}
+	g.end("a")
+
+	if len(g.keys) != 0 {
+		t.Errorf("%d keys are still tracked after their loads ended", len(g.keys))
+	}
+}
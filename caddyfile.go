@@ -0,0 +1,349 @@
+package rest
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UnmarshalCaddyfile sets up the storage module from Caddyfile tokens:
+//
+//	storage rest [<endpoint>] {
+//		endpoint <url>
+//		api_key <key>
+//		cache {
+//			ttl 5m
+//		}
+//		routes {
+//			load {
+//				method GET
+//				path keys/{key}
+//			}
+//		}
+//		...
+//	}
+//
+// Every option of the JSON config is a subdirective of the same name, and
+// nested objects are nested blocks. Booleans may be given without a value
+// to set them, lists take their items as arguments, and maps take one entry
+// per line. A nested block without subdirectives, or with the argument
+// true, enables the feature with its defaults. Other modules, such as the
+// fallback storage, take the module name followed by its own Caddyfile
+// syntax.
+func (r *RestStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the module name
+
+	if d.NextArg() {
+		r.Endpoint = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		name := d.Val()
+
+		switch name {
+		case "apikey", "apiKey", "ApiKey":
+			// Spellings accepted by earlier versions.
+			name = "api_key"
+		case "ttl":
+			// ttl <prefix> <duration>, as accepted by earlier versions.
+			name = "ttls"
+		case "log_requests":
+			// log_requests bodies
+			if d.CountRemainingArgs() == 1 {
+				d.NextArg()
+				if d.Val() == "bodies" {
+					r.LogRequests = &LogRequestsConfig{Bodies: true}
+					continue
+				}
+				d.Prev()
+			}
+		}
+
+		if err := unmarshalField(d, reflect.ValueOf(r).Elem(), name, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalField sets the field of the struct v whose JSON name is name
+// from the arguments and block of the current token. path is the name of
+// the field including the names of the blocks it is nested in, for errors.
+func unmarshalField(d *caddyfile.Dispenser, v reflect.Value, name, path string) error {
+	fields := jsonFields(v)
+
+	field, ok := fields[name]
+	if !ok {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return d.Errf("unrecognized option '%s'; expected one of: %s", path, strings.Join(names, ", "))
+	}
+
+	if namespace := moduleNamespace(field.tag); namespace != "" {
+		return unmarshalModule(d, field.value, namespace)
+	}
+
+	return unmarshalValue(d, field.value, path)
+}
+
+// jsonField is a field of a struct and its tag.
+type jsonField struct {
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+// jsonFields returns the exported fields of the struct v, including those of
+// embedded structs, by JSON name.
+func jsonFields(v reflect.Value) map[string]jsonField {
+	fields := make(map[string]jsonField)
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for name, value := range jsonFields(v.Field(i)) {
+				fields[name] = value
+			}
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = jsonField{value: v.Field(i), tag: field.Tag}
+	}
+
+	return fields
+}
+
+// moduleNamespace returns the namespace of the guest modules of a field
+// tagged with e.g. `caddy:"namespace=caddy.storage inline_key=module"`.
+func moduleNamespace(tag reflect.StructTag) string {
+	for _, option := range strings.Fields(tag.Get("caddy")) {
+		if namespace, ok := strings.CutPrefix(option, "namespace="); ok {
+			return namespace
+		}
+	}
+	return ""
+}
+
+// unmarshalModule sets the raw JSON v of a guest module from its name and
+// Caddyfile tokens, e.g. "storage file_system { root /var/lib/caddy }".
+func unmarshalModule(d *caddyfile.Dispenser, v reflect.Value, namespace string) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	name := d.Val()
+
+	unm, err := caddyfile.UnmarshalModule(d, namespace+"."+name)
+	if err != nil {
+		return err
+	}
+
+	v.SetBytes(caddyconfig.JSONModuleObject(unm, "module", name, nil))
+	return nil
+}
+
+var durationType = reflect.TypeOf(caddy.Duration(0))
+
+// unmarshalValue sets v from the remaining arguments of the current line
+// and the block following them, if any.
+func unmarshalValue(d *caddyfile.Dispenser, v reflect.Value, path string) error {
+	if v.Type() == durationType {
+		value, err := singleArg(d)
+		if err != nil {
+			return err
+		}
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing %s: %v", path, err)
+		}
+		v.SetInt(int64(dur))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		value, err := singleArg(d)
+		if err != nil {
+			return err
+		}
+		v.SetString(value)
+
+	case reflect.Bool:
+		if !d.NextArg() {
+			v.SetBool(true)
+			return nil
+		}
+		value, err := strconv.ParseBool(d.Val())
+		if err != nil {
+			return d.Errf("parsing %s: %v", path, err)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		v.SetBool(value)
+
+	case reflect.Int, reflect.Int64:
+		value, err := singleArg(d)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return d.Errf("parsing %s: %v", path, err)
+		}
+		v.SetInt(n)
+
+	case reflect.Float64:
+		value, err := singleArg(d)
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return d.Errf("parsing %s: %v", path, err)
+		}
+		v.SetFloat(f)
+
+	case reflect.Pointer:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return d.Errf("%s can't be configured in the Caddyfile; use JSON", path)
+		}
+		// <name> true|false enables the feature with its defaults or
+		// disables it.
+		if d.CountRemainingArgs() == 1 {
+			d.NextArg()
+			enabled, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s: %v", path, err)
+			}
+			if enabled {
+				v.Set(reflect.New(v.Type().Elem()))
+			} else {
+				v.Set(reflect.Zero(v.Type()))
+			}
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalValue(d, v.Elem(), path)
+
+	case reflect.Struct:
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			name := d.Val()
+			if err := unmarshalField(d, v, name, path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		if elem.Kind() == reflect.Struct {
+			// Each occurrence of the directive adds an item.
+			item := reflect.New(elem).Elem()
+			if err := unmarshalValue(d, item, path); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, item))
+			return nil
+		}
+
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		for _, arg := range args {
+			item := reflect.New(elem).Elem()
+			switch elem.Kind() {
+			case reflect.String:
+				item.SetString(arg)
+			case reflect.Int:
+				n, err := strconv.Atoi(arg)
+				if err != nil {
+					return d.Errf("parsing %s: %v", path, err)
+				}
+				item.SetInt(int64(n))
+			default:
+				return d.Errf("%s can't be configured in the Caddyfile; use JSON", path)
+			}
+			v.Set(reflect.Append(v, item))
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		// <name> <key> <value...> sets a single entry.
+		if d.NextArg() {
+			return unmarshalMapEntry(d, v, path)
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if err := unmarshalMapEntry(d, v, path); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return d.Errf("%s can't be configured in the Caddyfile; use JSON", path)
+	}
+
+	return nil
+}
+
+// unmarshalMapEntry sets the entry of the map v keyed by the current token
+// from the arguments and block following it.
+func unmarshalMapEntry(d *caddyfile.Dispenser, v reflect.Value, path string) error {
+	key := d.Val()
+	entryPath := path + "." + key
+
+	value := reflect.New(v.Type().Elem()).Elem()
+	if existing := v.MapIndex(reflect.ValueOf(key)); existing.IsValid() {
+		value.Set(existing)
+	}
+
+	if err := unmarshalValue(d, value, entryPath); err != nil {
+		return err
+	}
+
+	v.SetMapIndex(reflect.ValueOf(key), value)
+	return nil
+}
+
+// singleArg returns the only remaining argument of the current line.
+func singleArg(d *caddyfile.Dispenser) (string, error) {
+	if !d.NextArg() {
+		return "", d.ArgErr()
+	}
+	value := d.Val()
+	if d.NextArg() {
+		return "", d.ArgErr()
+	}
+	return value, nil
+}
@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// the config as JSON
+		want string
+	}{
+		{
+			name:  "endpoint argument",
+			input: `rest https://storage.example.com/`,
+			want:  `{"endpoint": "https://storage.example.com/"}`,
+		},
+		{
+			name: "scalars",
+			input: `rest {
+				endpoint https://storage.example.com/
+				api_key secret
+				conditional_load
+				checksums false
+				list_page_size 500
+				lock_timeout 1m30s
+			}`,
+			want: `{
+				"endpoint": "https://storage.example.com/",
+				"api_key": "secret",
+				"conditional_load": true,
+				"list_page_size": 500,
+				"lock_timeout": 90000000000
+			}`,
+		},
+		{
+			name: "nested blocks",
+			input: `rest {
+				cache {
+					max_entries 100
+					ttl 10m
+				}
+				fault_injection {
+					error_rate 0.25
+					operations load store
+				}
+			}`,
+			want: `{
+				"cache": {"max_entries": 100, "ttl": 600000000000},
+				"fault_injection": {"error_rate": 0.25, "operations": ["load", "store"]}
+			}`,
+		},
+		{
+			name: "feature toggles",
+			input: `rest {
+				cache
+				disk_cache true
+				compression false
+			}`,
+			want: `{"cache": {}, "disk_cache": {}}`,
+		},
+		{
+			name: "embedded struct",
+			input: `rest {
+				encryption {
+					kms {
+						vault {
+							address https://vault.example.com
+							key_name caddy
+						}
+					}
+				}
+			}`,
+			want: `{"encryption": {"kms": {"vault": {"address": "https://vault.example.com", "key_name": "caddy"}}}}`,
+		},
+		{
+			name: "list of structs",
+			input: `rest {
+				encryption {
+					keys {
+						id new
+						key_file /etc/caddy/new.key
+					}
+					keys {
+						id old
+						key_file /etc/caddy/old.key
+					}
+				}
+			}`,
+			want: `{"encryption": {"keys": [
+				{"id": "new", "key_file": "/etc/caddy/new.key"},
+				{"id": "old", "key_file": "/etc/caddy/old.key"}
+			]}}`,
+		},
+		{
+			name: "maps",
+			input: `rest {
+				routes {
+					load {
+						method GET
+						path keys/{key}
+					}
+				}
+				status_codes load {
+					not_found 404 410
+				}
+				ttls ocsp 24h
+				ttls {
+					acme 1h
+				}
+			}`,
+			want: `{
+				"routes": {"load": {"method": "GET", "path": "keys/{key}"}},
+				"status_codes": {"load": {"not_found": [404, 410]}},
+				"ttls": {"ocsp": 86400000000000, "acme": 3600000000000}
+			}`,
+		},
+		{
+			name: "legacy spellings",
+			input: `rest {
+				apiKey secret
+				ttl ocsp 24h
+				log_requests bodies
+			}`,
+			want: `{"api_key": "secret", "ttls": {"ocsp": 86400000000000}, "log_requests": {"bodies": true}}`,
+		},
+		{
+			name: "guest module",
+			input: `rest {
+				fallback {
+					storage file_system {
+						root /var/lib/caddy
+					}
+				}
+			}`,
+			want: `{"fallback": {"storage": {"module": "file_system", "root": "/var/lib/caddy"}}}`,
+		},
+	}
+
+	for _, test := range tests {
+		var r RestStorage
+		if err := r.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input)); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var want RestStorage
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got, err := json.Marshal(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantJSON, err := json.Marshal(&want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, wantJSON) {
+			t.Errorf("%s: got %s, want %s", test.name, got, wantJSON)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`rest a b`, "wrong argument count"},
+		{"rest {\nbogus 1\n}", "unrecognized option 'bogus'"},
+		{"rest {\ncache {\nbogus 1\n}\n}", "unrecognized option 'cache.bogus'"},
+		{"rest {\napi_key\n}", "wrong argument count"},
+		{"rest {\napi_key a b\n}", "wrong argument count"},
+		{"rest {\nchecksums maybe\n}", "parsing checksums"},
+		{"rest {\nlist_page_size many\n}", "parsing list_page_size"},
+		{"rest {\nlock_timeout soon\n}", "parsing lock_timeout"},
+		{"rest {\nfault_injection {\nerror_rate often\n}\n}", "parsing fault_injection.error_rate"},
+		{"rest {\ncache maybe\n}", "parsing cache"},
+		{"rest {\nstatus_codes load {\nnot_found gone\n}\n}", "parsing status_codes.load.not_found"},
+		{"rest {\ncreate_only\n}", "wrong argument count"},
+	}
+
+	for _, test := range tests {
+		var r RestStorage
+		err := r.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.input, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	checksumHeader = "x-checksum-sha256"
+	// S3 expects and returns base64-encoded checksums.
+	s3ChecksumHeader     = "x-amz-checksum-sha256"
+	s3ChecksumModeHeader = "x-amz-checksum-mode"
+)
+
+// CorruptionError is returned by Load when the value received doesn't
+// match the checksum reported by the backend.
+type CorruptionError struct {
+	Key string
+	// Hex-encoded SHA-256 hashes.
+	Expected string
+	Actual   string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("value of %v is corrupted: expected SHA-256 %v, got %v", e.Key, e.Expected, e.Actual)
+}
+
+// setChecksum adds the checksum of value to the headers of a Store and
+// returns it hex-encoded.
+func (r *RestStorage) setChecksum(header http.Header, value []byte) string {
+	sum := sha256.Sum256(value)
+	if r.Dialect == DialectS3 {
+		header.Set(s3ChecksumHeader, base64.StdEncoding.EncodeToString(sum[:]))
+	} else {
+		header.Set(checksumHeader, hex.EncodeToString(sum[:]))
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyChecksum compares value, loaded from key, with the checksum in the
+// response body (if any) or headers of resp. Values without a checksum
+// can't be verified and are accepted.
+func (r *RestStorage) verifyChecksum(key string, resp *http.Response, checksum string, value []byte) error {
+	if !r.Checksums {
+		return nil
+	}
+
+	if checksum == "" {
+		checksum = resp.Header.Get(checksumHeader)
+	}
+	if checksum == "" {
+		// Checksums of multipart uploads end in -<parts> and can't be
+		// compared with the checksum of the value.
+		if s3Checksum := resp.Header.Get(s3ChecksumHeader); s3Checksum != "" && !strings.Contains(s3Checksum, "-") {
+			decoded, err := base64.StdEncoding.DecodeString(s3Checksum)
+			if err != nil {
+				return fmt.Errorf("decoding %s: %v", s3ChecksumHeader, err)
+			}
+			checksum = hex.EncodeToString(decoded)
+		}
+	}
+
+	return compareChecksum(key, checksum, value)
+}
+
+// compareChecksum compares value with a hex-encoded SHA-256 checksum, if
+// there is one.
+func compareChecksum(key, checksum string, value []byte) error {
+	if checksum == "" {
+		return nil
+	}
+
+	actual := sha256Hex(value)
+	if !strings.EqualFold(checksum, actual) {
+		return &CorruptionError{Key: key, Expected: strings.ToLower(checksum), Actual: actual}
+	}
+	return nil
+}
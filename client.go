@@ -0,0 +1,150 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+)
+
+// clients are the connections, caches and held locks of the storage
+// modules. Modules with the same endpoint and config, including the
+// credentials, share them, so a config reload that leaves the storage
+// config as it is doesn't cold-start the caches and connections, and
+// doesn't release and acquire the locks again.
+var clients = caddy.NewUsagePool()
+
+// client is the state of a storage module that survives config reloads.
+type client struct {
+	httpClient *http.Client
+	grpcConn   *grpc.ClientConn
+
+	useSecondaryKey *atomic.Bool
+	locks           *heldLocks
+	localLocks      *localLocks
+	uploads         *uploads
+	etags           *lruCache[etagEntry]
+	batchLoads      *batchLoads
+	values          *lruCache[[]byte]
+	missingKeys     *lruCache[struct{}]
+	keyInfos        *lruCache[certmagic.KeyInfo]
+	existence       *lruCache[bool]
+	loads           *singleflight.Group
+	loadGenerations *loadGenerations
+
+	// The context of lease renewals, which outlive the module that
+	// acquired the lock until the last module sharing the client is
+	// cleaned up.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// clientKey identifies the client of r by its endpoint and config.
+func (r *RestStorage) clientKey() (string, error) {
+	config, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return r.Endpoint + " " + sha256Hex(config), nil
+}
+
+// newClient creates the client of r, for the first module with its key.
+func (r *RestStorage) newClient() (*client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if socket, ok := unixSocket(r.Endpoint); ok {
+		transport.DialContext = dialUnix(socket)
+	}
+
+	c := &client{
+		httpClient:      &http.Client{Transport: transport},
+		useSecondaryKey: new(atomic.Bool),
+		locks:           newHeldLocks(),
+		localLocks:      newLocalLocks(),
+		uploads:         newUploads(),
+		batchLoads:      newBatchLoads(),
+		loads:           new(singleflight.Group),
+		loadGenerations: newLoadGenerations(),
+	}
+
+	if isGRPCEndpoint(r.Endpoint) {
+		conn, err := dialGRPC(r.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		c.grpcConn = conn
+	}
+
+	if r.ConditionalLoad || r.OptimisticConcurrency {
+		maxEntries := defaultCacheMaxEntries
+		if r.Cache != nil {
+			maxEntries = r.Cache.MaxEntries
+		}
+		c.etags = newETagCache(maxEntries)
+	}
+
+	if r.Cache != nil {
+		c.values = newLRUCache[[]byte]("values", r.Cache.MaxEntries, time.Duration(r.Cache.TTL))
+		if r.Cache.NotFoundTTL > 0 {
+			c.missingKeys = newLRUCache[struct{}]("not_found", r.Cache.MaxEntries, time.Duration(r.Cache.NotFoundTTL))
+		}
+		if r.Cache.StatTTL > 0 {
+			c.keyInfos = newLRUCache[certmagic.KeyInfo]("stat", r.Cache.MaxEntries, time.Duration(r.Cache.StatTTL))
+			c.existence = newLRUCache[bool]("exists", r.Cache.MaxEntries, time.Duration(r.Cache.StatTTL))
+		}
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	return c, nil
+}
+
+// Destruct stops the lease renewals. The locks themselves are released by
+// the Cleanup of the last module sharing the client.
+func (c *client) Destruct() error {
+	c.cancel()
+	return nil
+}
+
+// useClient loads or creates the client of r and sets up r to use it.
+func (r *RestStorage) useClient() error {
+	key, err := r.clientKey()
+	if err != nil {
+		return err
+	}
+
+	value, loaded, err := clients.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return r.newClient()
+	})
+	if err != nil {
+		return err
+	}
+	r.poolKey = key
+
+	c := value.(*client)
+	r.httpClient = c.httpClient
+	r.grpcConn = c.grpcConn
+	r.useSecondaryKey = c.useSecondaryKey
+	r.locks = c.locks
+	r.localLocks = c.localLocks
+	r.uploads = c.uploads
+	r.etags = c.etags
+	r.batchLoads = c.batchLoads
+	r.values = c.values
+	r.missingKeys = c.missingKeys
+	r.keyInfos = c.keyInfos
+	r.existence = c.existence
+	r.loads = c.loads
+	r.loadGenerations = c.loadGenerations
+	r.leaseCtx = c.ctx
+
+	if loaded {
+		r.logger.Debug("Reusing connections, caches and locks of the previous config")
+	}
+	return nil
+}
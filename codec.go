@@ -0,0 +1,117 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// EncodingJSON encodes request and response bodies as JSON. This is
+	// the default.
+	EncodingJSON = "json"
+	// EncodingMsgpack encodes request and response bodies as MessagePack.
+	EncodingMsgpack = "msgpack"
+	// EncodingProtobuf encodes request and response bodies as the Protocol
+	// Buffers messages defined in proto/storage.proto.
+	EncodingProtobuf = "protobuf"
+	// EncodingCBOR encodes request and response bodies as CBOR.
+	EncodingCBOR = "cbor"
+)
+
+// codec encodes request bodies and decodes response bodies.
+type codec interface {
+	contentType() string
+	marshal(v any) ([]byte, error)
+	decode(r io.Reader, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) contentType() string { return "application/json" }
+
+func (jsonCodec) marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) decode(r io.Reader, v any) error { return json.NewDecoder(r).Decode(v) }
+
+// msgpackCodec uses the json struct tags, so the field names are the same
+// as in JSON. Values are sent as binary rather than base64 strings.
+type msgpackCodec struct{}
+
+func (msgpackCodec) contentType() string { return "application/msgpack" }
+
+func (msgpackCodec) marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) decode(r io.Reader, v any) error {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// cborCodec falls back to the json struct tags, so the field names are the
+// same as in JSON. Values are sent as byte strings.
+type cborCodec struct{}
+
+func (cborCodec) contentType() string { return "application/cbor" }
+
+func (cborCodec) marshal(v any) ([]byte, error) { return cbor.Marshal(v) }
+
+func (cborCodec) decode(r io.Reader, v any) error { return cbor.NewDecoder(r).Decode(v) }
+
+var codecs = map[string]codec{
+	EncodingJSON:     jsonCodec{},
+	EncodingMsgpack:  msgpackCodec{},
+	EncodingProtobuf: protobufCodec{},
+	EncodingCBOR:     cborCodec{},
+}
+
+// codec returns the codec for request bodies.
+func (r *RestStorage) codec() codec {
+	if c, ok := codecs[r.Encoding]; ok {
+		return c
+	}
+	return jsonCodec{}
+}
+
+// decode decodes the body of resp according to its Content-Type, so
+// backends may answer in a different encoding than requested.
+func decode(resp *http.Response, v any) error {
+	return responseCodec(resp).decode(resp.Body, v)
+}
+
+// responseCodec returns the codec of the Content-Type of resp. Anything
+// unknown is decoded as JSON.
+func responseCodec(resp *http.Response) codec {
+	return contentTypeCodec(resp.Header.Get("Content-Type"))
+}
+
+// contentTypeCodec returns the codec of contentType, or the JSON codec if
+// it is unknown.
+func contentTypeCodec(contentType string) codec {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+		return msgpackCodec{}
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		return protobufCodec{}
+	case "application/cbor":
+		return cborCodec{}
+	default:
+		return jsonCodec{}
+	}
+}
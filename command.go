@@ -0,0 +1,76 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "rest-storage",
+		Usage: "<command> [flags]",
+		Short: "Manages the keys in the rest storage backend",
+		Long: `
+Commands to manage the keys in the backend of the rest storage module, as
+configured in the storage of a Caddy config (--config, the Caddyfile in the
+current directory by default), and to run and check a backend.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.AddCommand(migrateCommand())
+			cmd.AddCommand(exportCommand())
+			cmd.AddCommand(importCommand())
+			cmd.AddCommand(gcCommand())
+			cmd.AddCommand(doctorCommand())
+			cmd.AddCommand(serveCommand())
+			cmd.AddCommand(conformanceCommand())
+			cmd.AddCommand(openAPICommand())
+			cmd.AddCommand(kvCommand())
+			cmd.AddCommand(benchCommand())
+		},
+	})
+}
+
+// addConfigFlags adds the flags selecting the config with the rest storage
+// module to cmd.
+func addConfigFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("config", "c", "", "Configuration file with the rest storage module")
+	cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+}
+
+// storageFromConfig provisions the rest storage module configured in the
+// config selected by the flags. Canceling the returned context cleans it up.
+func storageFromConfig(fl caddycmd.Flags) (*RestStorage, context.CancelFunc, error) {
+	config, configFile, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cfg struct {
+		StorageRaw json.RawMessage `json:"storage"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("decoding config: %v", err)
+	}
+	if len(cfg.StorageRaw) == 0 {
+		return nil, nil, fmt.Errorf("no storage configured in %s", configFile)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+
+	storage, err := loadStorageModule(ctx, cfg.StorageRaw)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	r, ok := storage.(*RestStorage)
+	if !ok {
+		cancel()
+		return nil, nil, fmt.Errorf("the storage configured in %s is not the rest module", configFile)
+	}
+
+	return r, cancel, nil
+}
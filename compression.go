@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// CompressionConfig compresses values before they are stored (and
+// encrypted) and decompresses them after they are loaded. Compressed values
+// start with "CRZ" and a byte identifying the algorithm: 'z' for zstd or
+// 'g' for gzip. Values without this header are returned as they are, so
+// existing data stays readable.
+type CompressionConfig struct {
+	// "zstd" (the default) or "gzip".
+	Algorithm string `json:"algorithm,omitempty"`
+	// Values smaller than this many bytes are stored uncompressed.
+	// Defaults to 512.
+	MinSize int `json:"min_size,omitempty"`
+
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+}
+
+var compressionMagic = []byte("CRZ")
+
+const (
+	compressionIDZstd = 'z'
+	compressionIDGzip = 'g'
+)
+
+func (c *CompressionConfig) provision() error {
+	if c.Algorithm == "" {
+		c.Algorithm = CompressionZstd
+	}
+	if c.MinSize == 0 {
+		c.MinSize = 512
+	}
+
+	var err error
+	c.zstdEncoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	c.zstdDecoder, err = zstd.NewReader(nil)
+	return err
+}
+
+func (c *CompressionConfig) validate() error {
+	switch c.Algorithm {
+	case "", CompressionZstd, CompressionGzip:
+	default:
+		return fmt.Errorf("compression: unknown algorithm %q", c.Algorithm)
+	}
+	if c.MinSize < 0 {
+		return errors.New("compression: min_size must not be negative")
+	}
+	return nil
+}
+
+func (c *CompressionConfig) cleanup() {
+	if c.zstdEncoder != nil {
+		c.zstdEncoder.Close()
+	}
+	if c.zstdDecoder != nil {
+		c.zstdDecoder.Close()
+	}
+}
+
+// compress returns the compressed value, or value itself if it is too
+// small or doesn't get smaller.
+func (c *CompressionConfig) compress(value []byte) ([]byte, error) {
+	if len(value) < c.MinSize {
+		return value, nil
+	}
+
+	var out []byte
+	switch c.Algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		buf.Write(compressionMagic)
+		buf.WriteByte(compressionIDGzip)
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	default:
+		out = append(append([]byte{}, compressionMagic...), compressionIDZstd)
+		out = c.zstdEncoder.EncodeAll(value, out)
+	}
+
+	if len(out) >= len(value) {
+		return value, nil
+	}
+	return out, nil
+}
+
+func (c *CompressionConfig) decompress(value []byte) ([]byte, error) {
+	if len(value) <= len(compressionMagic) || !bytes.HasPrefix(value, compressionMagic) {
+		return value, nil
+	}
+
+	compressed := value[len(compressionMagic)+1:]
+	switch value[len(compressionMagic)] {
+	case compressionIDZstd:
+		return c.zstdDecoder.DecodeAll(compressed, nil)
+	case compressionIDGzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return value, nil
+	}
+}
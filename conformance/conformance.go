@@ -0,0 +1,867 @@
+// Package conformance checks that a storage backend implements the API the
+// rest storage module speaks, in its default RPC dialect with JSON bodies.
+// The checks are black-box: they only send HTTP requests to the backend, so
+// implementers can run them against their server in any language, from a
+// Go test with Test or from the command line with
+// caddy rest-storage conformance.
+//
+// All keys are created below a temporary prefix and deleted afterwards.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Backend is the backend to check.
+type Backend struct {
+	// The endpoint of the backend, as configured in the rest storage
+	// module, e.g. https://storage.example.com/storage/.
+	Endpoint string
+	// Sent in the x-api-key header, if set. The checks then also verify
+	// that requests with another API key are rejected.
+	APIKey string
+	// The client to send requests with. Defaults to http.DefaultClient.
+	Client *http.Client
+	// The temporary keys are created below this prefix. Defaults to a
+	// random prefix below conformance/.
+	Prefix string
+	// Whether to check lock leases, i.e. /renew.
+	Leases bool
+	// How many holders race for a lock in the mutual exclusion check.
+	// Defaults to 8.
+	Contenders int
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Check string
+	// Nil if the check passed.
+	Err error
+}
+
+// Run runs all checks against the backend and returns their results. It
+// only returns an error if the checks couldn't be run at all.
+func Run(ctx context.Context, backend Backend) ([]Result, error) {
+	c, err := newChecker(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, check := range c.checks() {
+		results = append(results, Result{Check: check.name, Err: check.fn()})
+	}
+	c.cleanup()
+
+	return results, nil
+}
+
+// Test runs each check as a subtest of t.
+func Test(t *testing.T, backend Backend) {
+	t.Helper()
+
+	c, err := newChecker(context.Background(), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.cleanup)
+
+	for _, check := range c.checks() {
+		t.Run(check.name, func(t *testing.T) {
+			if err := check.fn(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+type checker struct {
+	backend Backend
+	ctx     context.Context
+	prefix  string
+}
+
+func newChecker(ctx context.Context, backend Backend) (*checker, error) {
+	if backend.Endpoint == "" {
+		return nil, errors.New("no endpoint given")
+	}
+	if !strings.HasSuffix(backend.Endpoint, "/") {
+		backend.Endpoint += "/"
+	}
+	if backend.Client == nil {
+		backend.Client = http.DefaultClient
+	}
+	if backend.Contenders == 0 {
+		backend.Contenders = 8
+	}
+
+	prefix := backend.Prefix
+	if prefix == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		prefix = path.Join("conformance", hex.EncodeToString(id))
+	}
+
+	return &checker{backend: backend, ctx: ctx, prefix: prefix}, nil
+}
+
+func (c *checker) key(name string) string {
+	return path.Join(c.prefix, name)
+}
+
+func (c *checker) checks() []check {
+	checks := []check{
+		{"store", c.checkStore},
+		{"load", c.checkLoad},
+		{"base64 values", c.checkBase64},
+		{"load missing key", c.checkLoadMissing},
+		{"overwrite", c.checkOverwrite},
+		{"exists", c.checkExists},
+		{"stat", c.checkStat},
+		{"stat directory", c.checkStatDirectory},
+		{"stat missing key", c.checkStatMissing},
+		{"list", c.checkList},
+		{"recursive list", c.checkRecursiveList},
+		{"list missing prefix", c.checkListMissing},
+		{"delete", c.checkDelete},
+		{"delete missing key", c.checkDeleteMissing},
+		{"delete directory", c.checkDeleteDirectory},
+		{"lock", c.checkLock},
+		{"lock conflict", c.checkLockConflict},
+		{"unlock", c.checkUnlock},
+		{"unlock by another holder", c.checkUnlockOther},
+		{"force unlock", c.checkForceUnlock},
+		{"lock mutual exclusion", c.checkMutualExclusion},
+		{"fencing tokens", c.checkFencingTokens},
+	}
+	if c.backend.Leases {
+		checks = append(checks, check{"renew", c.checkRenew})
+	}
+	if c.backend.APIKey != "" {
+		checks = append(checks, check{"authentication", c.checkAuthentication})
+	}
+	return checks
+}
+
+// response is a response with its body read.
+type response struct {
+	status int
+	body   []byte
+}
+
+// call sends body as JSON to the operation op and returns the response.
+func (c *checker) call(method, op string, body any) (*response, error) {
+	return c.callWithKey(method, op, body, c.backend.APIKey)
+}
+
+func (c *checker) callWithKey(method, op string, body any, apiKey string) (*response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.backend.Endpoint+op, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+
+	resp, err := c.backend.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &response{status: resp.StatusCode, body: respBody}, nil
+}
+
+// expect returns an error unless resp has one of the status codes.
+func expect(op string, resp *response, codes ...int) error {
+	if slices.Contains(codes, resp.status) {
+		return nil
+	}
+	body := strings.TrimSpace(string(resp.body))
+	if len(body) > 200 {
+		body = body[:200] + "..."
+	}
+	return fmt.Errorf("%s responded with %d, expected %v: %s", op, resp.status, codes, body)
+}
+
+func decodeBody(op string, resp *response, v any) error {
+	if err := json.Unmarshal(resp.body, v); err != nil {
+		return fmt.Errorf("decoding %s response %q: %v", op, resp.body, err)
+	}
+	return nil
+}
+
+func (c *checker) store(key string, value []byte) error {
+	resp, err := c.call(http.MethodPost, "store", map[string]any{"key": key, "value": value})
+	if err != nil {
+		return err
+	}
+	return expect("store", resp, http.StatusCreated)
+}
+
+// load returns the value of key, or nil if the backend responds with 404.
+func (c *checker) load(key string) ([]byte, error) {
+	resp, err := c.call(http.MethodPost, "load", map[string]any{"key": key})
+	if err != nil {
+		return nil, err
+	}
+	if resp.status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := expect("load", resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var loadResp struct {
+		Value *string `json:"value"`
+	}
+	if err := decodeBody("load", resp, &loadResp); err != nil {
+		return nil, err
+	}
+	if loadResp.Value == nil {
+		return nil, fmt.Errorf("load response %q has no value", resp.body)
+	}
+	value, err := base64.StdEncoding.DecodeString(*loadResp.Value)
+	if err != nil {
+		return nil, fmt.Errorf("value of load response is not standard base64: %v", err)
+	}
+	return value, nil
+}
+
+func (c *checker) expectValue(key string, want []byte) error {
+	value, err := c.load(key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return fmt.Errorf("load of %s responded with 404 after it was stored", key)
+	}
+	if !bytes.Equal(value, want) {
+		return fmt.Errorf("load of %s returned %q, stored %q", key, value, want)
+	}
+	return nil
+}
+
+func (c *checker) expectMissing(key string) error {
+	value, err := c.load(key)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		return fmt.Errorf("%s can still be loaded", key)
+	}
+	return nil
+}
+
+func (c *checker) list(prefix string, recursive bool) (*response, []string, error) {
+	resp, err := c.call(http.MethodPost, "list", map[string]any{"prefix": prefix, "recursive": recursive})
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.status != http.StatusOK {
+		return resp, nil, nil
+	}
+
+	var listResp struct {
+		Keys       []string `json:"keys"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	if err := decodeBody("list", resp, &listResp); err != nil {
+		return nil, nil, err
+	}
+	if listResp.NextCursor != "" {
+		return nil, nil, fmt.Errorf("list paginated %d keys without a limit", len(listResp.Keys))
+	}
+	return resp, listResp.Keys, nil
+}
+
+func (c *checker) checkStore() error {
+	return c.store(c.key("value"), []byte("first"))
+}
+
+func (c *checker) checkLoad() error {
+	return c.expectValue(c.key("value"), []byte("first"))
+}
+
+// checkBase64 stores every byte value, including bytes that aren't valid
+// UTF-8, and values whose base64 encoding has padding.
+func (c *checker) checkBase64() error {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	values := map[string][]byte{
+		"base64/all":   all,
+		"base64/pad1":  []byte("ab"),
+		"base64/pad2":  []byte("a"),
+		"base64/empty": {},
+	}
+	for name, value := range values {
+		key := c.key(name)
+		if err := c.store(key, value); err != nil {
+			return err
+		}
+		if err := c.expectValue(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkLoadMissing() error {
+	resp, err := c.call(http.MethodPost, "load", map[string]any{"key": c.key("missing")})
+	if err != nil {
+		return err
+	}
+	return expect("load of a missing key", resp, http.StatusNotFound)
+}
+
+func (c *checker) checkOverwrite() error {
+	key := c.key("value")
+	if err := c.store(key, []byte("second")); err != nil {
+		return err
+	}
+	return c.expectValue(key, []byte("second"))
+}
+
+func (c *checker) checkExists() error {
+	for key, want := range map[string]bool{c.key("value"): true, c.key("missing"): false} {
+		resp, err := c.call(http.MethodPost, "exists", map[string]any{"key": key})
+		if err != nil {
+			return err
+		}
+		// 404 is accepted for missing keys.
+		if !want && resp.status == http.StatusNotFound {
+			continue
+		}
+		if err := expect("exists", resp, http.StatusOK); err != nil {
+			return err
+		}
+
+		var existsResp struct {
+			Exists *bool `json:"exists"`
+		}
+		if err := decodeBody("exists", resp, &existsResp); err != nil {
+			return err
+		}
+		if existsResp.Exists == nil {
+			return fmt.Errorf("exists response %q has no exists field", resp.body)
+		}
+		if *existsResp.Exists != want {
+			return fmt.Errorf("exists reported %v for %s, expected %v", *existsResp.Exists, key, want)
+		}
+	}
+	return nil
+}
+
+// statResponse is a /stat response, with the fields whose format is
+// checked left raw.
+type statResponse struct {
+	Key        string          `json:"key"`
+	Modified   json.RawMessage `json:"modified"`
+	Size       *int64          `json:"size"`
+	IsTerminal *bool           `json:"isTerminal"`
+}
+
+func (c *checker) stat(key string) (*response, *statResponse, error) {
+	resp, err := c.call(http.MethodPost, "stat", map[string]any{"key": key})
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.status != http.StatusOK {
+		return resp, nil, nil
+	}
+
+	var statResp statResponse
+	if err := decodeBody("stat", resp, &statResp); err != nil {
+		return nil, nil, err
+	}
+	return resp, &statResp, nil
+}
+
+func (c *checker) checkStat() error {
+	key := c.key("value")
+	before := time.Now()
+
+	resp, statResp, err := c.stat(key)
+	if err != nil {
+		return err
+	}
+	if err := expect("stat", resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	if statResp.Key != key {
+		return fmt.Errorf("stat reported the key %q, expected %q", statResp.Key, key)
+	}
+	if statResp.Size == nil || *statResp.Size != int64(len("second")) {
+		return fmt.Errorf("stat response %q doesn't report the size %d", resp.body, len("second"))
+	}
+	if statResp.IsTerminal == nil || !*statResp.IsTerminal {
+		return fmt.Errorf("stat response %q doesn't report the value as terminal", resp.body)
+	}
+
+	modified, err := parseTimestamp(statResp.Modified)
+	if err != nil {
+		return err
+	}
+	// Allow for clocks that are off by a while.
+	if modified.Before(before.Add(-24*time.Hour)) || modified.After(before.Add(24*time.Hour)) {
+		return fmt.Errorf("stat reported the modification time %v for a value stored just now", modified)
+	}
+	return nil
+}
+
+func (c *checker) checkStatDirectory() error {
+	if err := c.store(c.key("dir/nested"), []byte("nested")); err != nil {
+		return err
+	}
+
+	// Backends may not know directories, but must not report them as values.
+	resp, statResp, err := c.stat(c.key("dir"))
+	if err != nil {
+		return err
+	}
+	if resp.status == http.StatusNotFound {
+		return nil
+	}
+	if err := expect("stat of a directory", resp, http.StatusOK, http.StatusNotFound); err != nil {
+		return err
+	}
+	if statResp.IsTerminal != nil && *statResp.IsTerminal {
+		return fmt.Errorf("stat reported the directory %s as terminal", c.key("dir"))
+	}
+	return nil
+}
+
+func (c *checker) checkStatMissing() error {
+	resp, _, err := c.stat(c.key("missing"))
+	if err != nil {
+		return err
+	}
+	return expect("stat of a missing key", resp, http.StatusNotFound)
+}
+
+// parseTimestamp parses a timestamp in one of the formats the rest storage
+// module accepts: RFC 3339, an HTTP date, or Unix epoch seconds or
+// milliseconds as a number or string.
+func parseTimestamp(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, errors.New("no modification time is reported")
+	}
+
+	value := string(raw)
+	if s, err := strconv.Unquote(value); err == nil {
+		value = s
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, http.TimeFormat, time.RFC1123, time.RFC1123Z, time.RFC850, time.ANSIC} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	if epoch, err := strconv.ParseFloat(value, 64); err == nil {
+		// Numbers this large are milliseconds.
+		if epoch > 1e11 {
+			return time.UnixMilli(int64(epoch)), nil
+		}
+		return time.Unix(int64(epoch), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("modification time %s is in none of the supported formats", raw)
+}
+
+func (c *checker) checkList() error {
+	resp, keys, err := c.list(c.prefix, false)
+	if err != nil {
+		return err
+	}
+	if err := expect("list", resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	for _, key := range []string{c.key("value"), c.key("dir")} {
+		if !slices.Contains(keys, key) {
+			return fmt.Errorf("list of %s is missing %s: %v", c.prefix, key, keys)
+		}
+	}
+	if slices.Contains(keys, c.key("dir/nested")) {
+		return fmt.Errorf("non-recursive list of %s includes %s", c.prefix, c.key("dir/nested"))
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, c.prefix+"/") {
+			return fmt.Errorf("list returned %q, which is not a full key below %s", key, c.prefix)
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkRecursiveList() error {
+	resp, keys, err := c.list(c.prefix, true)
+	if err != nil {
+		return err
+	}
+	if err := expect("recursive list", resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	for _, key := range []string{c.key("value"), c.key("dir/nested")} {
+		if !slices.Contains(keys, key) {
+			return fmt.Errorf("recursive list of %s is missing %s: %v", c.prefix, key, keys)
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkListMissing() error {
+	resp, keys, err := c.list(c.key("missing"), false)
+	if err != nil {
+		return err
+	}
+	if err := expect("list of a missing prefix", resp, http.StatusNotFound, http.StatusOK); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("list of a missing prefix returned %v", keys)
+	}
+	return nil
+}
+
+func (c *checker) checkDelete() error {
+	key := c.key("value")
+	resp, err := c.call(http.MethodDelete, "delete", map[string]any{"key": key})
+	if err != nil {
+		return err
+	}
+	if err := expect("delete", resp, http.StatusNoContent); err != nil {
+		return err
+	}
+	return c.expectMissing(key)
+}
+
+func (c *checker) checkDeleteMissing() error {
+	resp, err := c.call(http.MethodDelete, "delete", map[string]any{"key": c.key("missing")})
+	if err != nil {
+		return err
+	}
+	return expect("delete of a missing key", resp, http.StatusNotFound)
+}
+
+func (c *checker) checkDeleteDirectory() error {
+	resp, err := c.call(http.MethodDelete, "delete", map[string]any{"key": c.key("dir")})
+	if err != nil {
+		return err
+	}
+	if err := expect("delete of a directory", resp, http.StatusNoContent); err != nil {
+		return err
+	}
+	return c.expectMissing(c.key("dir/nested"))
+}
+
+// lock requests the lock on key for holder and returns the response.
+func (c *checker) lock(key, holder string, ttl int64) (*response, error) {
+	lockReq := map[string]any{
+		"key":       key,
+		"holder":    holder,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	if ttl > 0 {
+		lockReq["ttl"] = ttl
+	}
+	return c.call(http.MethodPost, "lock", lockReq)
+}
+
+func (c *checker) unlock(key, holder string, force bool) (*response, error) {
+	unlockReq := map[string]any{
+		"key":       key,
+		"holder":    holder,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	if force {
+		unlockReq["force"] = true
+	}
+	return c.call(http.MethodPost, "unlock", unlockReq)
+}
+
+// mustLock acquires the lock on key for holder.
+func (c *checker) mustLock(key, holder string) error {
+	resp, err := c.lock(key, holder, 0)
+	if err != nil {
+		return err
+	}
+	return expect("lock", resp, http.StatusCreated)
+}
+
+func (c *checker) mustUnlock(key, holder string) error {
+	resp, err := c.unlock(key, holder, false)
+	if err != nil {
+		return err
+	}
+	return expect("unlock", resp, http.StatusNoContent)
+}
+
+func (c *checker) checkLock() error {
+	return c.mustLock(c.key("lock"), "conformance-a")
+}
+
+func (c *checker) checkLockConflict() error {
+	resp, err := c.lock(c.key("lock"), "conformance-b", 0)
+	if err != nil {
+		return err
+	}
+	if err := expect("lock of a held lock", resp, http.StatusLocked); err != nil {
+		return err
+	}
+
+	// The body may describe the holder.
+	var lockedResp struct {
+		Holder     string          `json:"holder"`
+		AcquiredAt json.RawMessage `json:"acquired_at"`
+	}
+	if len(bytes.TrimSpace(resp.body)) == 0 || json.Unmarshal(resp.body, &lockedResp) != nil {
+		return nil
+	}
+	if lockedResp.Holder != "" && lockedResp.Holder != "conformance-a" {
+		return fmt.Errorf("423 response names %q as the holder, not conformance-a", lockedResp.Holder)
+	}
+	if len(lockedResp.AcquiredAt) > 0 && string(lockedResp.AcquiredAt) != "null" {
+		if _, err := parseTimestamp(lockedResp.AcquiredAt); err != nil {
+			return fmt.Errorf("acquired_at of 423 response: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkUnlock() error {
+	key := c.key("lock")
+	if err := c.mustUnlock(key, "conformance-a"); err != nil {
+		return err
+	}
+	// The lock must be free for others now.
+	if err := c.mustLock(key, "conformance-b"); err != nil {
+		return fmt.Errorf("after unlocking: %v", err)
+	}
+	return c.mustUnlock(key, "conformance-b")
+}
+
+func (c *checker) checkUnlockOther() error {
+	key := c.key("lock-other")
+	if err := c.mustLock(key, "conformance-a"); err != nil {
+		return err
+	}
+	defer c.unlock(key, "conformance-a", true)
+
+	// Backends may refuse the unlock, or ignore it, but must not release
+	// the lock of another holder.
+	if _, err := c.unlock(key, "conformance-b", false); err != nil {
+		return err
+	}
+	resp, err := c.lock(key, "conformance-c", 0)
+	if err != nil {
+		return err
+	}
+	if resp.status == http.StatusCreated {
+		c.unlock(key, "conformance-c", true)
+		return errors.New("an unlock by another holder released the lock")
+	}
+	return expect("lock of a held lock", resp, http.StatusLocked)
+}
+
+func (c *checker) checkForceUnlock() error {
+	key := c.key("lock-force")
+	if err := c.mustLock(key, "conformance-a"); err != nil {
+		return err
+	}
+
+	resp, err := c.unlock(key, "conformance-b", true)
+	if err != nil {
+		return err
+	}
+	if err := expect("forced unlock", resp, http.StatusNoContent); err != nil {
+		return err
+	}
+	if err := c.mustLock(key, "conformance-b"); err != nil {
+		return fmt.Errorf("after a forced unlock: %v", err)
+	}
+	return c.mustUnlock(key, "conformance-b")
+}
+
+// checkMutualExclusion lets holders race for a lock, several times, and
+// checks that exactly one of them gets it each time.
+func (c *checker) checkMutualExclusion() error {
+	key := c.key("lock-race")
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		statuses := make([]int, c.backend.Contenders)
+		errs := make([]error, c.backend.Contenders)
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := c.lock(key, fmt.Sprintf("conformance-%d", i), 0)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				statuses[i] = resp.status
+			}(i)
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+
+		winner := -1
+		for i, status := range statuses {
+			switch status {
+			case http.StatusCreated:
+				if winner >= 0 {
+					return fmt.Errorf("round %d: conformance-%d and conformance-%d both acquired the lock", round, winner, i)
+				}
+				winner = i
+			case http.StatusLocked:
+			default:
+				return fmt.Errorf("round %d: lock responded with %d, expected 201 or 423", round, status)
+			}
+		}
+		if winner < 0 {
+			return fmt.Errorf("round %d: none of %d holders acquired the free lock", round, len(statuses))
+		}
+
+		if err := c.mustUnlock(key, fmt.Sprintf("conformance-%d", winner)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFencingTokens checks that the fencing tokens in /lock responses, if
+// any, increase every time a lock is granted.
+func (c *checker) checkFencingTokens() error {
+	key := c.key("lock-fencing")
+
+	var last uint64
+	for i := 0; i < 3; i++ {
+		resp, err := c.lock(key, "conformance-a", 0)
+		if err != nil {
+			return err
+		}
+		if err := expect("lock", resp, http.StatusCreated); err != nil {
+			return err
+		}
+
+		var lockResp struct {
+			FencingToken *uint64 `json:"fencing_token"`
+		}
+		if len(bytes.TrimSpace(resp.body)) > 0 {
+			if err := decodeBody("lock", resp, &lockResp); err != nil {
+				return err
+			}
+		}
+		if err := c.mustUnlock(key, "conformance-a"); err != nil {
+			return err
+		}
+
+		// Fencing tokens are optional.
+		if lockResp.FencingToken == nil {
+			return nil
+		}
+		if *lockResp.FencingToken <= last {
+			return fmt.Errorf("fencing token %d doesn't increase over %d", *lockResp.FencingToken, last)
+		}
+		last = *lockResp.FencingToken
+	}
+	return nil
+}
+
+func (c *checker) checkRenew() error {
+	key := c.key("lease")
+	renew := func(holder string) (*response, error) {
+		return c.call(http.MethodPost, "renew", map[string]any{"key": key, "holder": holder, "ttl": 30})
+	}
+
+	resp, err := c.lock(key, "conformance-a", 30)
+	if err != nil {
+		return err
+	}
+	if err := expect("lock with a ttl", resp, http.StatusCreated); err != nil {
+		return err
+	}
+
+	resp, err = renew("conformance-a")
+	if err != nil {
+		return err
+	}
+	if err := expect("renew", resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return err
+	}
+
+	resp, err = renew("conformance-b")
+	if err != nil {
+		return err
+	}
+	if err := expect("renew by another holder", resp, http.StatusNotFound, http.StatusConflict, http.StatusGone); err != nil {
+		return err
+	}
+
+	if err := c.mustUnlock(key, "conformance-a"); err != nil {
+		return err
+	}
+	resp, err = renew("conformance-a")
+	if err != nil {
+		return err
+	}
+	return expect("renew of a released lock", resp, http.StatusNotFound, http.StatusConflict, http.StatusGone)
+}
+
+func (c *checker) checkAuthentication() error {
+	resp, err := c.callWithKey(http.MethodPost, "load", map[string]any{"key": c.key("missing")}, c.backend.APIKey+"-wrong")
+	if err != nil {
+		return err
+	}
+	return expect("load with a wrong API key", resp, http.StatusUnauthorized, http.StatusForbidden)
+}
+
+// cleanup deletes the temporary keys and releases the locks.
+func (c *checker) cleanup() {
+	c.call(http.MethodDelete, "delete", map[string]any{"key": c.prefix})
+	for _, name := range []string{"lock", "lock-other", "lock-force", "lock-race", "lock-fencing", "lease"} {
+		c.unlock(c.key(name), "", true)
+	}
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/appmasker/caddy_rest_storage/conformance"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func conformanceCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "conformance --endpoint <url> [--api-key <key>] [--leases]",
+		Short: "Checks that a backend implements the API of the rest storage module",
+		Long: `
+Sends black-box requests to the backend at --endpoint and prints whether it
+responds as the API specifies: status codes, base64 values, stat fields,
+recursive and non-recursive listing, and locks, including several holders
+racing for a lock. With --leases, renewing locks is checked as well.
+
+Unlike doctor, the command doesn't need a Caddy config, so backend
+implementers can run it against their server directly. The temporary keys
+are created below conformance/ and deleted afterwards. The command exits
+with status 1 if any check failed.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdConformance),
+	}
+	cmd.Flags().StringP("endpoint", "e", "", "The endpoint of the backend")
+	cmd.Flags().String("api-key", "", "The API key to send in the x-api-key header")
+	cmd.Flags().Bool("leases", false, "Also check renewing lock leases")
+	cmd.Flags().String("prefix", "", "The prefix to create the temporary keys below")
+	return cmd
+}
+
+func cmdConformance(fl caddycmd.Flags) (int, error) {
+	endpoint := fl.String("endpoint")
+	if endpoint == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--endpoint is required")
+	}
+
+	fmt.Printf("Checking %s\n", endpoint)
+	results, err := conformance.Run(context.Background(), conformance.Backend{
+		Endpoint: endpoint,
+		APIKey:   fl.String("api-key"),
+		Prefix:   fl.String("prefix"),
+		Leases:   fl.Bool("leases"),
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var failed int
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", result.Check, result.Err)
+			continue
+		}
+		fmt.Printf("PASS  %s\n", result.Check)
+	}
+
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	fmt.Printf("All %d checks passed\n", len(results))
+	return caddy.ExitCodeSuccess, nil
+}
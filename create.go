@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AlreadyExistsError is returned by create-only Stores when the key already
+// exists. It matches fs.ErrExist.
+type AlreadyExistsError struct {
+	Key string
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("key %v already exists", e.Key)
+}
+
+func (e *AlreadyExistsError) Is(target error) bool {
+	return target == fs.ErrExist
+}
+
+// Create stores value at key only if key doesn't exist yet, so that the
+// first writer wins. Otherwise, it returns an *AlreadyExistsError.
+func (r *RestStorage) Create(ctx context.Context, key string, value []byte) (err error) {
+	if err := r.checkWritable(opStore, key); err != nil {
+		return err
+	}
+	if r.DryRun {
+		r.logDryRun(opStore, r.backendKey(key), zap.Int("size", len(value)), zap.Bool("create_only", true))
+		return nil
+	}
+
+	defer func(start time.Time) { r.logFailure(opStore, key, start, err) }(time.Now())
+	defer func() { err = r.fallbackCreate(ctx, key, value, err) }()
+	defer func() {
+		if err == nil {
+			r.mirrorStore(ctx, key, value)
+		}
+	}()
+
+	return r.store(ctx, r.backendKey(key), value, storeOptions{
+		createOnly: true,
+		ttl:        r.keyTTL(key),
+	})
+}
+
+// createOnly reports whether key matches one of the CreateOnly patterns.
+func (r *RestStorage) createOnly(key string) bool {
+	for _, pattern := range r.CreateOnly {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func validateCreateOnly(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("create_only: invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// storeError returns the error for an unsuccessful response to a Store of
+// key with the given headers. With If-Match, a 412 means that the value
+// changed since it was loaded. With If-None-Match: *, a 409 (or, as WebDAV
+// servers and S3 respond, a 412) means that the key already exists.
+func (r *RestStorage) storeError(key string, header http.Header, resp *http.Response) error {
+	if header.Get("If-None-Match") == "*" {
+		if resp.StatusCode == http.StatusConflict ||
+			(resp.StatusCode == http.StatusPreconditionFailed && (r.Dialect == DialectWebDAV || r.Dialect == DialectS3)) {
+			return &AlreadyExistsError{Key: key}
+		}
+	}
+
+	if ifMatch := header.Get("If-Match"); ifMatch != "" && resp.StatusCode == http.StatusPreconditionFailed {
+		return &ConflictError{Key: key, Version: ifMatch}
+	}
+
+	return r.statusError(resp)
+}
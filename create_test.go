@@ -0,0 +1,68 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestCreate(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, nil)
+	ctx := context.Background()
+
+	if err := r.Create(ctx, "key", []byte("first")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	var exists *AlreadyExistsError
+	err := r.Create(ctx, "key", []byte("second"))
+	if !errors.As(err, &exists) || !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Create of an existing key returned %v, not an AlreadyExistsError", err)
+	}
+
+	value, err := r.Load(ctx, "key")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if string(value) != "first" {
+		t.Errorf("Load returned %q after a failed Create, want the first value", value)
+	}
+}
+
+func TestCreateFallback(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, &RestStorage{
+		Fallback: testFallback(t),
+	})
+	ctx := context.Background()
+
+	// Successful creates are written through.
+	if err := r.Create(ctx, "created", []byte("value")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if value, err := r.fallback.storage.Load(ctx, "created"); err != nil || string(value) != "value" {
+		t.Errorf("the fallback storage has %q, %v after Create", value, err)
+	}
+
+	// Creates during an outage fail, and aren't synced later.
+	server.Close()
+	if err := r.Create(ctx, "outage", []byte("value")); err == nil {
+		t.Error("Create succeeded while the backend was unavailable")
+	}
+	if r.fallback.storage.Exists(ctx, "outage") {
+		t.Error("Create wrote to the fallback storage while the backend was unavailable")
+	}
+	if op, ok := r.fallback.pendingWrites()["outage"]; ok {
+		t.Errorf("Create during an outage is pending as %q", op)
+	}
+
+	// Stores still fall back.
+	if err := r.Store(ctx, "stored", []byte("value")); err != nil {
+		t.Errorf("Store during an outage: %v", err)
+	}
+	if op := r.fallback.pendingWrites()["stored"]; op != opStore {
+		t.Errorf("Store during an outage is pending as %q", op)
+	}
+}
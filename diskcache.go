@@ -0,0 +1,204 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DiskCacheConfig mirrors loaded and stored values into a local directory,
+// so that Load can still serve them while the backend is unreachable.
+// Values are written as they are stored in the backend, i.e. encrypted if
+// encryption is enabled.
+type DiskCacheConfig struct {
+	// The directory to cache values in. Defaults to rest_storage_cache in
+	// Caddy's data directory.
+	Path string `json:"path,omitempty"`
+	// Values last confirmed by the backend longer ago than this aren't
+	// served anymore. Defaults to 168h (one week).
+	MaxStaleness caddy.Duration `json:"max_staleness,omitempty"`
+}
+
+func (c *DiskCacheConfig) provision() (*diskCache, error) {
+	if c.Path == "" {
+		c.Path = filepath.Join(caddy.AppDataDir(), "rest_storage_cache")
+	}
+	if c.MaxStaleness == 0 {
+		c.MaxStaleness = caddy.Duration(7 * 24 * time.Hour)
+	}
+
+	if err := os.MkdirAll(c.Path, 0o700); err != nil {
+		return nil, fmt.Errorf("disk_cache: %v", err)
+	}
+
+	return &diskCache{
+		dir:          c.Path,
+		maxStaleness: time.Duration(c.MaxStaleness),
+		written:      make(map[string][sha256.Size]byte),
+	}, nil
+}
+
+func (c *DiskCacheConfig) validate() error {
+	if c.MaxStaleness < 0 {
+		return errors.New("disk_cache: max_staleness must not be negative")
+	}
+	return nil
+}
+
+// diskCache stores each value in a file named after the SHA-256 hash of its
+// key. The modification time of the file is when the backend last
+// confirmed the value. A nil *diskCache caches nothing.
+type diskCache struct {
+	dir          string
+	maxStaleness time.Duration
+
+	mu sync.Mutex
+	// the hashes of the values written by this instance, by key
+	written map[string][sha256.Size]byte
+	// whether values were served from the cache since the backend last
+	// answered
+	serving bool
+}
+
+func (d *diskCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+// put records value as confirmed by the backend.
+func (d *diskCache) put(key string, value []byte, logger *zap.Logger) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.serving {
+		d.serving = false
+		logger.Info("Storage backend is reachable again; no longer serving from the disk cache")
+	}
+
+	file := d.file(key)
+	sum := sha256.Sum256(value)
+	if written, ok := d.written[key]; ok && written == sum {
+		now := time.Now()
+		if err := os.Chtimes(file, now, now); err == nil {
+			return
+		}
+	}
+
+	if err := writeFileAtomic(file, value); err != nil {
+		logger.Warn("Unable to write to the disk cache", zap.String("key", key), zap.Error(err))
+		delete(d.written, key)
+		return
+	}
+	d.written[key] = sum
+}
+
+// get returns the value of key if it isn't too stale.
+func (d *diskCache) get(key string, logger *zap.Logger) (value []byte, ok bool) {
+	if d == nil {
+		return nil, false
+	}
+	defer func() { observeCacheLookup("disk", ok) }()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	file := d.file(key)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, false
+	}
+
+	age := time.Since(info.ModTime())
+	if age > d.maxStaleness {
+		logger.Warn("Value in the disk cache is too stale to serve", zap.String("key", key), zap.Duration("age", age))
+		return nil, false
+	}
+
+	value, err = os.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+
+	d.serving = true
+	logger.Warn("Storage backend is unreachable; serving value from the disk cache",
+		zap.String("key", key), zap.Duration("age", age))
+
+	return value, true
+}
+
+// removePrefix removes prefix and the keys below it that this instance
+// wrote.
+func (d *diskCache) removePrefix(prefix string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	os.Remove(d.file(prefix))
+	for key := range d.written {
+		if underPrefix(key, prefix) {
+			delete(d.written, key)
+			os.Remove(d.file(key))
+		}
+	}
+}
+
+// writeFileAtomic writes value to a temporary file first, so that readers
+// never see a partially written file.
+func writeFileAtomic(file string, value []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// unavailable reports whether err means that the backend couldn't be
+// reached or failed, as opposed to e.g. the key not existing or the request
+// being canceled. Callers whose context is done must not take a deadline
+// it exceeded for an outage either.
+func unavailable(err error) bool {
+	if errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled {
+		return false
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+
+	if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+		return true
+	}
+
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && (statusErr.StatusCode >= 500 || statusErr.StatusCode == 429)
+}
@@ -0,0 +1,60 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&url.Error{Op: "Get", URL: "http://backend", Err: errors.New("connection refused")}, true},
+		{&url.Error{Op: "Get", URL: "http://backend", Err: context.DeadlineExceeded}, true},
+		{&url.Error{Op: "Get", URL: "http://backend", Err: context.Canceled}, false},
+		{fmt.Errorf("storing: %w", &url.Error{Op: "Put", URL: "http://backend", Err: context.Canceled}), false},
+		{status.Error(codes.Unavailable, "unavailable"), true},
+		{status.Error(codes.DeadlineExceeded, "deadline exceeded"), true},
+		{status.Error(codes.Canceled, "canceled"), false},
+		{status.Error(codes.NotFound, "not found"), false},
+		{&StatusError{StatusCode: 503}, true},
+		{&StatusError{StatusCode: 429}, true},
+		{&StatusError{StatusCode: 409}, false},
+		{errors.New("decoding response"), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := unavailable(test.err); got != test.want {
+			t.Errorf("unavailable(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+// TestFallbackCanceled checks that writes canceled by the caller aren't
+// taken for an outage and synced later.
+func TestFallbackCanceled(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, &RestStorage{
+		Fallback: testFallback(t),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := r.Store(ctx, "key", []byte("value")); err == nil {
+		t.Error("Store with a canceled context succeeded")
+	}
+	if err := r.Delete(ctx, "key"); err == nil {
+		t.Error("Delete with a canceled context succeeded")
+	}
+	if pending := r.fallback.pendingWrites(); len(pending) != 0 {
+		t.Errorf("canceled writes are pending: %v", pending)
+	}
+}
@@ -0,0 +1,301 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func doctorCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor [--config <path>] [--adapter <name>]",
+		Short: "Checks that the rest backend implements every operation correctly",
+		Long: `
+Exercises the rest backend end-to-end with temporary keys below
+rest_storage_doctor/ and prints whether each capability works as Caddy
+expects: storing, loading, stat, exists, listing, deleting, create-only
+stores, and locking, including a second instance contending for a lock.
+
+Caches and the fallback storage are bypassed, so the results reflect the
+backend itself. The temporary keys are deleted afterwards. The command
+exits with status 1 if any check failed.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdDoctor),
+	}
+	addConfigFlags(cmd)
+	return cmd
+}
+
+func cmdDoctor(fl caddycmd.Flags) (int, error) {
+	r, cancel, err := storageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	if r.ReadOnly || r.DryRun {
+		return caddy.ExitCodeFailedStartup, errors.New("the configured storage is read-only or in dry run mode")
+	}
+
+	// A second instance holding a lock of its own, to contend with r.
+	other, cancelOther, err := storageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancelOther()
+	other.InstanceID = r.InstanceID + "-doctor"
+	other.LockMode = LockModeFailFast
+	other.LockAttempts = 1
+	// Identical configs share their client state, including the held locks.
+	other.locks = newHeldLocks()
+	other.localLocks = newLocalLocks()
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	d := &doctor{
+		r:      r,
+		other:  other,
+		ctx:    withoutFallback(context.Background()),
+		prefix: path.Join("rest_storage_doctor", hex.EncodeToString(id)),
+	}
+
+	fmt.Printf("Checking %s with keys below %s\n", r.Endpoint, d.prefix)
+	d.run()
+	d.cleanup()
+
+	if d.failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d of %d checks failed", d.failed, d.checks)
+	}
+	fmt.Printf("All %d checks passed\n", d.checks)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// doctor runs the checks of the doctor command.
+type doctor struct {
+	r, other *RestStorage
+	ctx      context.Context
+	// All temporary keys are below prefix.
+	prefix string
+
+	checks, failed int
+}
+
+func (d *doctor) key(name string) string {
+	return path.Join(d.prefix, name)
+}
+
+// check runs fn and prints whether the capability passed.
+func (d *doctor) check(capability string, fn func() error) {
+	d.checks++
+	if err := fn(); err != nil {
+		d.failed++
+		fmt.Printf("FAIL  %s: %v\n", capability, err)
+		return
+	}
+	fmt.Printf("PASS  %s\n", capability)
+}
+
+// load loads key from the backend, not from a cache.
+func (d *doctor) load(key string) ([]byte, error) {
+	d.r.invalidate(d.r.backendKey(key))
+	return d.r.Load(d.ctx, key)
+}
+
+func (d *doctor) exists(key string) (bool, error) {
+	d.r.invalidate(d.r.backendKey(key))
+	return d.r.exists(d.ctx, d.r.backendKey(key))
+}
+
+// expectValue loads key and compares it with want.
+func (d *doctor) expectValue(key string, want []byte) error {
+	value, err := d.load(key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(value, want) {
+		return fmt.Errorf("loaded %q, stored %q", value, want)
+	}
+	return nil
+}
+
+// expectMissing checks that key doesn't exist according to Load, Exists
+// and Stat.
+func (d *doctor) expectMissing(key string) error {
+	if _, err := d.load(key); !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Load of %s returned %v, not fs.ErrNotExist", key, err)
+	}
+	exists, err := d.exists(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Exists reports %s as existing", key)
+	}
+	if _, err := d.r.Stat(d.ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Stat of %s returned %v, not fs.ErrNotExist", key, err)
+	}
+	return nil
+}
+
+func (d *doctor) run() {
+	value := d.key("value")
+	nested := d.key("dir/nested")
+	missing := d.key("missing")
+	created := d.key("created")
+	lock := d.key("lock")
+
+	d.check("store", func() error {
+		if err := d.r.Store(d.ctx, value, []byte("first")); err != nil {
+			return err
+		}
+		return d.r.Store(d.ctx, nested, []byte("nested"))
+	})
+
+	d.check("load", func() error {
+		return d.expectValue(value, []byte("first"))
+	})
+
+	d.check("overwrite", func() error {
+		if err := d.r.Store(d.ctx, value, []byte("second")); err != nil {
+			return err
+		}
+		return d.expectValue(value, []byte("second"))
+	})
+
+	d.check("stat", func() error {
+		d.r.invalidate(d.r.backendKey(value))
+		info, err := d.r.Stat(d.ctx, value)
+		if err != nil {
+			return err
+		}
+		if !info.IsTerminal {
+			return errors.New("value is not reported as terminal")
+		}
+		if info.Modified.IsZero() {
+			return errors.New("no modification time is reported")
+		}
+		return nil
+	})
+
+	d.check("exists", func() error {
+		exists, err := d.exists(value)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s is reported as missing", value)
+		}
+		return nil
+	})
+
+	d.check("missing keys", func() error {
+		return d.expectMissing(missing)
+	})
+
+	d.check("list", func() error {
+		keys, err := d.r.List(d.ctx, d.prefix, false)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(keys, value) {
+			return fmt.Errorf("%s is missing from %v", value, keys)
+		}
+		if slices.Contains(keys, nested) {
+			return fmt.Errorf("non-recursive listing includes %s", nested)
+		}
+		return nil
+	})
+
+	d.check("recursive list", func() error {
+		keys, err := d.r.List(d.ctx, d.prefix, true)
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{value, nested} {
+			if !slices.Contains(keys, key) {
+				return fmt.Errorf("%s is missing from %v", key, keys)
+			}
+		}
+		return nil
+	})
+
+	d.check("create", func() error {
+		return d.r.Create(d.ctx, created, []byte("created"))
+	})
+
+	d.check("create conflict", func() error {
+		err := d.r.Create(d.ctx, created, []byte("again"))
+		if !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("create-only store of an existing key returned %v, not fs.ErrExist", err)
+		}
+		return d.expectValue(created, []byte("created"))
+	})
+
+	d.check("delete", func() error {
+		if err := d.r.Delete(d.ctx, value); err != nil {
+			return err
+		}
+		return d.expectMissing(value)
+	})
+
+	d.check("delete directory", func() error {
+		err := d.r.Delete(d.ctx, path.Dir(nested))
+		if err != nil {
+			return err
+		}
+		return d.expectMissing(nested)
+	})
+
+	d.check("lock", func() error {
+		return d.r.Lock(d.ctx, lock)
+	})
+
+	d.check("lock conflict", func() error {
+		err := d.other.Lock(d.ctx, lock)
+		if err == nil {
+			d.other.Unlock(d.ctx, lock)
+			return errors.New("a second instance acquired the held lock")
+		}
+		var lockedErr *LockedError
+		if !errors.As(err, &lockedErr) {
+			return fmt.Errorf("a second instance got %v, not a locked response", err)
+		}
+		return nil
+	})
+
+	d.check("unlock", func() error {
+		if err := d.r.Unlock(d.ctx, lock); err != nil {
+			return err
+		}
+		// The lock must be free for others now.
+		if err := d.other.Lock(d.ctx, lock); err != nil {
+			return fmt.Errorf("a second instance couldn't lock after unlocking: %v", err)
+		}
+		return d.other.Unlock(d.ctx, lock)
+	})
+}
+
+// cleanup deletes the temporary keys that are left.
+func (d *doctor) cleanup() {
+	keys, err := d.r.List(d.ctx, d.prefix, true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Unable to list temporary keys below %s: %v\n", d.prefix, err)
+		return
+	}
+	for _, key := range keys {
+		if err := d.r.Delete(d.ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Unable to delete temporary key %s: %v\n", key, err)
+		}
+	}
+}
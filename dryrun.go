@@ -0,0 +1,15 @@
+package rest
+
+import "go.uber.org/zap"
+
+// logDryRun logs the request for op on the backend key that dry_run keeps
+// from being sent.
+func (r *RestStorage) logDryRun(op, backendKey string, fields ...zap.Field) {
+	key, ok := r.storageKey(backendKey)
+	if !ok {
+		key = backendKey
+	}
+
+	r.logger.Info("Dry run; not sending request",
+		append([]zap.Field{zap.String("operation", op), zap.String("key", key)}, fields...)...)
+}
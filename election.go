@@ -0,0 +1,287 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// LeaderElection elects a single leader among the Caddy instances sharing a
+// REST storage backend, using the lock and renew endpoints. The leader holds
+// a lock lease on Key and renews it every third of the TTL; the others try to
+// acquire the lock every RetryInterval. Leadership is lost if the lease can't
+// be renewed before it expires.
+//
+// It is available as the rest_storage_leader app, which requires the rest
+// storage module to be configured as Caddy's storage. Other plugins can get
+// it with ctx.App("rest_storage_leader") and call IsLeader or Subscribe to
+// run fleet-wide singleton tasks. It can also be used directly by creating
+// one with NewLeaderElection.
+type LeaderElection struct {
+	// The lock key to elect a leader with. Defaults to "leader".
+	Key string `json:"key,omitempty"`
+	// The lease TTL. Defaults to 30s.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// How often followers try to become the leader. Defaults to 10s.
+	RetryInterval caddy.Duration `json:"retry_interval,omitempty"`
+
+	storage *RestStorage
+	logger  *zap.Logger
+
+	mu          sync.Mutex
+	leader      bool
+	subscribers []chan bool
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+// NewLeaderElection returns an election among the users of storage. Call
+// Start to begin participating.
+func NewLeaderElection(storage *RestStorage, key string, ttl time.Duration) *LeaderElection {
+	e := &LeaderElection{
+		Key:     key,
+		TTL:     caddy.Duration(ttl),
+		storage: storage,
+		logger:  storage.logger.Named("leader"),
+	}
+	e.setDefaults()
+	return e
+}
+
+func (*LeaderElection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "rest_storage_leader",
+		New: func() caddy.Module { return new(LeaderElection) },
+	}
+}
+
+func (e *LeaderElection) Provision(ctx caddy.Context) error {
+	storage, ok := ctx.Storage().(*RestStorage)
+	if !ok {
+		return fmt.Errorf("rest_storage_leader requires the rest storage module, but storage is %T", ctx.Storage())
+	}
+
+	e.storage = storage
+	e.logger = ctx.Logger()
+	e.setDefaults()
+
+	return nil
+}
+
+func (e *LeaderElection) setDefaults() {
+	if e.Key == "" {
+		e.Key = "leader"
+	}
+	if e.TTL == 0 {
+		e.TTL = caddy.Duration(30 * time.Second)
+	}
+	if e.RetryInterval == 0 {
+		e.RetryInterval = caddy.Duration(10 * time.Second)
+	}
+}
+
+func (e *LeaderElection) Validate() error {
+	if time.Duration(e.TTL) < 3*time.Second {
+		return errors.New("ttl must be at least 3s")
+	}
+	if e.RetryInterval < 0 {
+		return errors.New("retry_interval must not be negative")
+	}
+	return nil
+}
+
+// Start begins participating in the election in the background.
+func (e *LeaderElection) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.done = make(chan struct{})
+
+	go e.run(ctx)
+
+	return nil
+}
+
+// Stop leaves the election, giving up leadership if held.
+func (e *LeaderElection) Stop() error {
+	if e.cancel == nil {
+		return nil
+	}
+
+	e.cancel()
+	<-e.done
+
+	return nil
+}
+
+// IsLeader reports whether this instance is currently the leader.
+func (e *LeaderElection) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Subscribe returns a channel that receives true when this instance becomes
+// the leader and false when it loses leadership. Slow receivers only see the
+// latest state.
+func (e *LeaderElection) Subscribe() <-chan bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ch := make(chan bool, 1)
+	e.subscribers = append(e.subscribers, ch)
+	return ch
+}
+
+func (e *LeaderElection) setLeader(leader bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leader == leader {
+		return
+	}
+	e.leader = leader
+
+	if leader {
+		e.logger.Info("Became the leader", zap.String("key", e.Key), zap.String("instance_id", e.storage.InstanceID))
+	} else {
+		e.logger.Warn("Lost leadership", zap.String("key", e.Key), zap.String("instance_id", e.storage.InstanceID))
+	}
+
+	for _, ch := range e.subscribers {
+		// Replace any state the subscriber hasn't received yet.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- leader
+	}
+}
+
+func (e *LeaderElection) run(ctx context.Context) {
+	defer close(e.done)
+
+	ttl := time.Duration(e.TTL)
+	var lastRenewal time.Time
+
+	for {
+		wait := time.Duration(e.RetryInterval)
+
+		if e.IsLeader() {
+			wait = ttl / 3
+			renewed, err := e.renew(ctx)
+			switch {
+			case err != nil:
+				if ctx.Err() == nil {
+					e.logger.Error("Error renewing leader lease", zap.Error(err))
+				}
+				if time.Since(lastRenewal) >= ttl {
+					e.setLeader(false)
+				}
+			case !renewed:
+				e.setLeader(false)
+			default:
+				lastRenewal = time.Now()
+			}
+		} else {
+			acquired, err := e.acquire(ctx)
+			if err != nil && ctx.Err() == nil {
+				e.logger.Error("Error acquiring leader lock", zap.Error(err))
+			} else if acquired {
+				lastRenewal = time.Now()
+				e.setLeader(true)
+				wait = ttl / 3
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				e.resign()
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (e *LeaderElection) acquire(ctx context.Context) (bool, error) {
+	key := e.storage.backendKey(e.Key)
+	resp, err := e.storage.call(ctx, opLock, key, nil, LockRequest{
+		Key:       key,
+		TTL:       int64(time.Duration(e.TTL) / time.Second),
+		Holder:    e.storage.InstanceID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case e.storage.succeeded(opLock, resp, 201):
+		return true, nil
+	case e.storage.locked(resp):
+		return false, nil
+	default:
+		return false, e.storage.statusError(resp)
+	}
+}
+
+func (e *LeaderElection) renew(ctx context.Context) (bool, error) {
+	key := e.storage.backendKey(e.Key)
+	resp, err := e.storage.call(ctx, opRenew, key, nil, RenewRequest{
+		Key:    key,
+		TTL:    int64(time.Duration(e.TTL) / time.Second),
+		Holder: e.storage.InstanceID,
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case e.storage.succeeded(opRenew, resp, 200, 204):
+		return true, nil
+	case e.storage.notFound(opRenew, resp), resp.StatusCode == 409, resp.StatusCode == 410:
+		return false, nil
+	default:
+		return false, e.storage.statusError(resp)
+	}
+}
+
+func (e *LeaderElection) resign() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key := e.storage.backendKey(e.Key)
+	resp, err := e.storage.call(ctx, opUnlock, key, nil, UnlockRequest{
+		Key:       key,
+		Holder:    e.storage.InstanceID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+
+	e.setLeader(false)
+
+	if err != nil {
+		e.logger.Error("Error giving up leadership", zap.Error(err))
+		return
+	}
+
+	resp.Body.Close()
+}
+
+// Interface guards
+var (
+	_ caddy.App         = (*LeaderElection)(nil)
+	_ caddy.Provisioner = (*LeaderElection)(nil)
+	_ caddy.Validator   = (*LeaderElection)(nil)
+)
@@ -0,0 +1,327 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// EncryptionConfig encrypts values with AES-256-GCM before they are stored
+// and decrypts them after they are loaded, so the backend operator can't
+// read private keys. Values encrypted with a static key are
+//
+//	"CRS1" || 12-byte nonce || ciphertext and tag
+//
+// values encrypted with a data key wrapped by a KMS are
+//
+//	"CRS2" || uint16 length of the wrapped key || wrapped key || 12-byte nonce || ciphertext and tag
+//
+// and values encrypted with a key of a key ring are
+//
+//	"CRS3" || uint8 length of the key ID || key ID || 12-byte nonce || ciphertext and tag
+//
+// The storage key is the additional data, so a value can't be moved to
+// another key.
+type EncryptionConfig struct {
+	// The base64-encoded 32-byte key.
+	Key string `json:"key,omitempty"`
+	// A file containing the base64-encoded key.
+	KeyFile string `json:"key_file,omitempty"`
+	// KMS generates a data key at startup and wraps it with a master key
+	// of a key management service instead.
+	KMS *KMSConfig `json:"kms,omitempty"`
+	// Keys is a key ring for key rotation: values are encrypted with the
+	// first key, and decrypted with the key whose ID they carry.
+	Keys []EncryptionKey `json:"keys,omitempty"`
+
+	// ReencryptOnRead stores values again that Load decrypted with
+	// another than the current key (or that weren't encrypted), so data
+	// migrates to the current key as it is used.
+	ReencryptOnRead bool `json:"reencrypt_on_read,omitempty"`
+
+	// AllowUnencrypted returns values without the encryption header as they
+	// are, so existing data can still be read after enabling encryption.
+	// It is re-encrypted the next time it is stored.
+	AllowUnencrypted bool `json:"allow_unencrypted,omitempty"`
+
+	aead cipher.AEAD
+	// With a key ring: the ID of aead and the ciphers of all keys, by ID.
+	currentID string
+	ring      map[string]cipher.AEAD
+	// With a KMS: the wrapped data key of aead, and the data keys of
+	// values written with other data keys, by wrapped key.
+	wrapper    keyWrapper
+	wrappedKey []byte
+	dataKeysMu sync.Mutex
+	dataKeys   map[string]cipher.AEAD
+}
+
+// EncryptionKey is a key of a key ring.
+type EncryptionKey struct {
+	// Identifies the key in encrypted values. At most 255 bytes.
+	ID string `json:"id"`
+	// The base64-encoded 32-byte key.
+	Key string `json:"key,omitempty"`
+	// A file containing the base64-encoded key.
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// The headers of encrypted values.
+var (
+	encryptionMagic         = []byte("CRS1")
+	envelopeEncryptionMagic = []byte("CRS2")
+	keyRingEncryptionMagic  = []byte("CRS3")
+)
+
+func (e *EncryptionConfig) provision(ctx context.Context) error {
+	if e.KMS != nil {
+		return e.provisionKMS(ctx)
+	}
+
+	if len(e.Keys) > 0 {
+		e.ring = make(map[string]cipher.AEAD)
+		for _, key := range e.Keys {
+			aead, err := loadEncryptionKey(key.Key, key.KeyFile)
+			if err != nil {
+				return fmt.Errorf("encryption: key %s: %v", key.ID, err)
+			}
+			e.ring[key.ID] = aead
+		}
+		e.currentID = e.Keys[0].ID
+		e.aead = e.ring[e.currentID]
+		return nil
+	}
+
+	aead, err := loadEncryptionKey(e.Key, e.KeyFile)
+	if err != nil {
+		return fmt.Errorf("encryption: %v", err)
+	}
+	e.aead = aead
+	return nil
+}
+
+// loadEncryptionKey returns the cipher of the base64-encoded key, or of the
+// key in keyFile.
+func loadEncryptionKey(encoded, keyFile string) (cipher.AEAD, error) {
+	if keyFile != "" {
+		contents, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file: %v", err)
+		}
+		encoded = string(contents)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+
+	return newGCM(key)
+}
+
+// provisionKMS generates the data key of this instance and wraps it.
+func (e *EncryptionConfig) provisionKMS(ctx context.Context) error {
+	wrapper, err := e.KMS.wrapper(ctx)
+	if err != nil {
+		return err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+
+	wrappedKey, err := wrapper.wrap(ctx, dataKey)
+	if err != nil {
+		return fmt.Errorf("encryption: wrapping data key: %v", err)
+	}
+	if len(wrappedKey) > 0xffff {
+		return errors.New("encryption: wrapped data key is too long")
+	}
+
+	e.aead, err = newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	e.wrapper = wrapper
+	e.wrappedKey = wrappedKey
+	e.dataKeys = map[string]cipher.AEAD{string(wrappedKey): e.aead}
+
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *EncryptionConfig) validate() error {
+	sources := 0
+	for _, configured := range []bool{e.Key != "", e.KeyFile != "", e.KMS != nil, len(e.Keys) > 0} {
+		if configured {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("encryption: exactly one of key, key_file, kms and keys must be specified")
+	}
+
+	ids := make(map[string]bool)
+	for _, key := range e.Keys {
+		if key.ID == "" || len(key.ID) > 255 {
+			return errors.New("encryption: key IDs must be 1 to 255 bytes long")
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("encryption: duplicate key ID %q", key.ID)
+		}
+		ids[key.ID] = true
+		if (key.Key == "") == (key.KeyFile == "") {
+			return fmt.Errorf("encryption: exactly one of key and key_file must be specified for key %s", key.ID)
+		}
+	}
+
+	if e.KMS != nil {
+		return e.KMS.validate()
+	}
+	return nil
+}
+
+func (e *EncryptionConfig) encrypt(key string, value []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 6+len(e.wrappedKey)+len(e.currentID)+len(nonce)+len(value)+e.aead.Overhead())
+	switch {
+	case e.wrappedKey != nil:
+		out = append(out, envelopeEncryptionMagic...)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(e.wrappedKey)))
+		out = append(out, e.wrappedKey...)
+	case e.currentID != "":
+		out = append(out, keyRingEncryptionMagic...)
+		out = append(out, byte(len(e.currentID)))
+		out = append(out, e.currentID...)
+	default:
+		out = append(out, encryptionMagic...)
+	}
+	out = append(out, nonce...)
+
+	return e.aead.Seal(out, nonce, value, []byte(key)), nil
+}
+
+// decrypt returns the plaintext of value, and whether it was encrypted with
+// the current key.
+func (e *EncryptionConfig) decrypt(ctx context.Context, key string, value []byte) ([]byte, bool, error) {
+	var candidates []cipher.AEAD
+	var sealed []byte
+	current := false
+	switch {
+	case bytes.HasPrefix(value, encryptionMagic):
+		if e.wrapper != nil {
+			return nil, false, fmt.Errorf("value of %v is encrypted with a static key, not a KMS data key", key)
+		}
+		sealed = value[len(encryptionMagic):]
+		if e.ring == nil {
+			candidates, current = []cipher.AEAD{e.aead}, true
+		} else {
+			// Values encrypted before the key ring carry no key ID.
+			for _, aead := range e.ring {
+				candidates = append(candidates, aead)
+			}
+		}
+
+	case bytes.HasPrefix(value, envelopeEncryptionMagic):
+		if e.wrapper == nil {
+			return nil, false, fmt.Errorf("value of %v is encrypted with a KMS data key, but no kms is configured", key)
+		}
+		rest := value[len(envelopeEncryptionMagic):]
+		if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+			return nil, false, fmt.Errorf("encrypted value of %v is truncated", key)
+		}
+		wrappedKey := rest[2 : 2+binary.BigEndian.Uint16(rest)]
+
+		aead, err := e.dataKey(ctx, wrappedKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("unwrapping data key of %v: %v", key, err)
+		}
+		// Every instance has its own data key, all wrapped by the same
+		// master key.
+		candidates, current = []cipher.AEAD{aead}, true
+		sealed = rest[2+len(wrappedKey):]
+
+	case bytes.HasPrefix(value, keyRingEncryptionMagic):
+		rest := value[len(keyRingEncryptionMagic):]
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, false, fmt.Errorf("encrypted value of %v is truncated", key)
+		}
+		keyID := string(rest[1 : 1+rest[0]])
+
+		aead, ok := e.ring[keyID]
+		if !ok {
+			return nil, false, fmt.Errorf("value of %v is encrypted with unknown key %q", key, keyID)
+		}
+		candidates, current = []cipher.AEAD{aead}, keyID == e.currentID
+		sealed = rest[1+len(keyID):]
+
+	default:
+		if e.AllowUnencrypted {
+			return value, false, nil
+		}
+		return nil, false, fmt.Errorf("value of %v is not encrypted", key)
+	}
+
+	var err error
+	for _, aead := range candidates {
+		if len(sealed) < aead.NonceSize() {
+			return nil, false, fmt.Errorf("encrypted value of %v is truncated", key)
+		}
+
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		var plaintext []byte
+		plaintext, err = aead.Open(nil, nonce, ciphertext, []byte(key))
+		if err == nil {
+			return plaintext, current, nil
+		}
+	}
+	return nil, false, fmt.Errorf("decrypting value of %v: %v", key, err)
+}
+
+// dataKey returns the cipher of a wrapped data key, unwrapping it with the
+// KMS the first time it is seen.
+func (e *EncryptionConfig) dataKey(ctx context.Context, wrappedKey []byte) (cipher.AEAD, error) {
+	e.dataKeysMu.Lock()
+	defer e.dataKeysMu.Unlock()
+
+	if aead, ok := e.dataKeys[string(wrappedKey)]; ok {
+		return aead, nil
+	}
+
+	dataKey, err := e.wrapper.unwrap(ctx, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	e.dataKeys[string(wrappedKey)] = aead
+	return aead, nil
+}
@@ -0,0 +1,283 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testEncryptionKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func provisionEncryption(t *testing.T, e *EncryptionConfig) *EncryptionConfig {
+	t.Helper()
+
+	if err := e.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if err := e.provision(context.Background()); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	return e
+}
+
+func TestEncryptionStaticKey(t *testing.T) {
+	e := provisionEncryption(t, &EncryptionConfig{Key: testEncryptionKey(t)})
+	ctx := context.Background()
+
+	sealed, err := e.encrypt("certs/a.key", []byte("private key"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !bytes.HasPrefix(sealed, []byte("CRS1")) || len(sealed) != 4+12+len("private key")+16 {
+		t.Errorf("encrypted value %x isn't CRS1 || nonce || ciphertext and tag", sealed)
+	}
+	if bytes.Contains(sealed, []byte("private key")) {
+		t.Error("the encrypted value contains the plaintext")
+	}
+
+	plaintext, current, err := e.decrypt(ctx, "certs/a.key", sealed)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if string(plaintext) != "private key" || !current {
+		t.Errorf("decrypt returned %q, current %t", plaintext, current)
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+	}{
+		// The storage key is the additional data.
+		{"another key", "certs/b.key", sealed},
+		{"tampered", "certs/a.key", tampered},
+		{"truncated", "certs/a.key", sealed[:10]},
+		{"not encrypted", "certs/a.key", []byte("private key")},
+		{"KMS header", "certs/a.key", append([]byte("CRS2"), sealed[4:]...)},
+		{"other key", "certs/a.key", mustEncrypt(t, provisionEncryption(t, &EncryptionConfig{Key: testEncryptionKey(t)}), "certs/a.key")},
+	}
+	for _, test := range tests {
+		if _, _, err := e.decrypt(ctx, test.key, test.value); err == nil {
+			t.Errorf("%s: decrypt succeeded", test.name)
+		}
+	}
+}
+
+func mustEncrypt(t *testing.T, e *EncryptionConfig, key string) []byte {
+	t.Helper()
+
+	sealed, err := e.encrypt(key, []byte("value of "+key))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	return sealed
+}
+
+func TestEncryptionAllowUnencrypted(t *testing.T) {
+	e := provisionEncryption(t, &EncryptionConfig{Key: testEncryptionKey(t), AllowUnencrypted: true})
+
+	plaintext, current, err := e.decrypt(context.Background(), "key", []byte("plain"))
+	if err != nil || string(plaintext) != "plain" || current {
+		t.Errorf("decrypt of an unencrypted value returned %q, %t, %v", plaintext, current, err)
+	}
+}
+
+func TestEncryptionKeyRing(t *testing.T) {
+	oldKey, newKey := testEncryptionKey(t), testEncryptionKey(t)
+	ctx := context.Background()
+
+	static := provisionEncryption(t, &EncryptionConfig{Key: oldKey})
+	before := provisionEncryption(t, &EncryptionConfig{Keys: []EncryptionKey{{ID: "old", Key: oldKey}}})
+	ring := provisionEncryption(t, &EncryptionConfig{Keys: []EncryptionKey{{ID: "new", Key: newKey}, {ID: "old", Key: oldKey}}})
+
+	sealed := mustEncrypt(t, ring, "key")
+	if want := append([]byte("CRS3"), append([]byte{3}, "new"...)...); !bytes.HasPrefix(sealed, want) {
+		t.Errorf("encrypted value %x doesn't start with CRS3 || 3 || new", sealed[:8])
+	}
+
+	tests := []struct {
+		name    string
+		value   []byte
+		current bool
+	}{
+		{"current key", sealed, true},
+		{"older key", mustEncrypt(t, before, "key"), false},
+		// Values encrypted before the key ring carry no key ID.
+		{"static key", mustEncrypt(t, static, "key"), false},
+	}
+	for _, test := range tests {
+		plaintext, current, err := ring.decrypt(ctx, "key", test.value)
+		if err != nil {
+			t.Errorf("%s: decrypt: %v", test.name, err)
+			continue
+		}
+		if string(plaintext) != "value of key" || current != test.current {
+			t.Errorf("%s: decrypt returned %q, current %t", test.name, plaintext, current)
+		}
+	}
+
+	// The key ID can't be swapped for another key of the ring.
+	swapped := bytes.Clone(sealed)
+	copy(swapped[5:8], "old")
+	if _, _, err := ring.decrypt(ctx, "key", swapped); err == nil {
+		t.Error("decrypt with a swapped key ID succeeded")
+	}
+
+	unknown := mustEncrypt(t, provisionEncryption(t, &EncryptionConfig{Keys: []EncryptionKey{{ID: "gone", Key: testEncryptionKey(t)}}}), "key")
+	if _, _, err := ring.decrypt(ctx, "key", unknown); err == nil || !strings.Contains(err.Error(), `unknown key "gone"`) {
+		t.Errorf("decrypt with an unknown key ID returned %v", err)
+	}
+}
+
+func TestEncryptionValidate(t *testing.T) {
+	key := testEncryptionKey(t)
+
+	tests := []struct {
+		name string
+		e    *EncryptionConfig
+		ok   bool
+	}{
+		{"key", &EncryptionConfig{Key: key}, true},
+		{"nothing", &EncryptionConfig{}, false},
+		{"key and keys", &EncryptionConfig{Key: key, Keys: []EncryptionKey{{ID: "a", Key: key}}}, false},
+		{"key ring", &EncryptionConfig{Keys: []EncryptionKey{{ID: "a", Key: key}, {ID: "b", Key: key}}}, true},
+		{"duplicate ID", &EncryptionConfig{Keys: []EncryptionKey{{ID: "a", Key: key}, {ID: "a", Key: key}}}, false},
+		{"empty ID", &EncryptionConfig{Keys: []EncryptionKey{{Key: key}}}, false},
+		{"long ID", &EncryptionConfig{Keys: []EncryptionKey{{ID: strings.Repeat("a", 256), Key: key}}}, false},
+		{"ring key without key", &EncryptionConfig{Keys: []EncryptionKey{{ID: "a"}}}, false},
+	}
+	for _, test := range tests {
+		if err := test.e.validate(); (err == nil) != test.ok {
+			t.Errorf("%s: validate returned %v", test.name, err)
+		}
+	}
+
+	for _, encoded := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		e := &EncryptionConfig{Key: encoded}
+		if err := e.provision(context.Background()); err == nil {
+			t.Errorf("provision with key %q succeeded", encoded)
+		}
+	}
+}
+
+// fakeVaultTransit implements the encrypt and decrypt endpoints of Vault's
+// transit engine, and counts the decryptions. Its token doesn't expire.
+type fakeVaultTransit struct {
+	mu       sync.Mutex
+	keys     map[string]string
+	decrypts int
+}
+
+func (f *fakeVaultTransit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("X-Vault-Token") != "token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if req.URL.Path == "/v1/auth/token/lookup-self" {
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"ttl": 0}})
+		return
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var data map[string]string
+	switch req.URL.Path {
+	case "/v1/transit/encrypt/caddy":
+		ciphertext := "vault:v1:" + strconv.Itoa(len(f.keys))
+		f.keys[ciphertext] = body["plaintext"]
+		data = map[string]string{"ciphertext": ciphertext}
+	case "/v1/transit/decrypt/caddy":
+		f.decrypts++
+		plaintext, ok := f.keys[body["ciphertext"]]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data = map[string]string{"plaintext": plaintext}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func TestEncryptionKMS(t *testing.T) {
+	vault := &fakeVaultTransit{keys: make(map[string]string)}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	newConfig := func() *EncryptionConfig {
+		return provisionEncryption(t, &EncryptionConfig{KMS: &KMSConfig{Vault: &VaultTransitConfig{
+			VaultConfig: VaultConfig{Address: server.URL, AuthMethod: "token", Token: "token"},
+			KeyName:     "caddy",
+		}}})
+	}
+	a, b := newConfig(), newConfig()
+	ctx := context.Background()
+
+	sealed := mustEncrypt(t, a, "key")
+	wrappedKey := []byte("vault:v1:0")
+	want := append(append([]byte("CRS2"), binary.BigEndian.AppendUint16(nil, uint16(len(wrappedKey)))...), wrappedKey...)
+	if !bytes.HasPrefix(sealed, want) {
+		t.Errorf("encrypted value %q doesn't start with CRS2 || length || wrapped key", sealed[:len(want)])
+	}
+
+	// Each instance has its own data key; the other's is unwrapped once.
+	for i := 0; i < 3; i++ {
+		plaintext, current, err := b.decrypt(ctx, "key", sealed)
+		if err != nil {
+			t.Fatalf("decrypt of another instance's value: %v", err)
+		}
+		if string(plaintext) != "value of key" || !current {
+			t.Errorf("decrypt returned %q, current %t", plaintext, current)
+		}
+	}
+	if vault.decrypts != 1 {
+		t.Errorf("the data key was unwrapped %d times, want once", vault.decrypts)
+	}
+
+	if _, _, err := b.decrypt(ctx, "other", sealed); err == nil {
+		t.Error("decrypt under another storage key succeeded")
+	}
+
+	static := mustEncrypt(t, provisionEncryption(t, &EncryptionConfig{Key: testEncryptionKey(t)}), "key")
+	if _, _, err := a.decrypt(ctx, "key", static); err == nil {
+		t.Error("decrypt of a CRS1 value with a KMS succeeded")
+	}
+	withoutKMS := provisionEncryption(t, &EncryptionConfig{Key: testEncryptionKey(t)})
+	if _, _, err := withoutKMS.decrypt(ctx, "key", sealed); err == nil {
+		t.Error("decrypt of a CRS2 value without a KMS succeeded")
+	}
+
+	truncated := append([]byte("CRS2"), 0xff, 0xff, 'x')
+	if _, _, err := a.decrypt(ctx, "key", truncated); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("decrypt of a truncated value returned %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// normalizeEndpoint cleans the path of endpoint and makes sure it ends with
+// a slash, so request paths can be appended to it. Endpoints that can't be
+// parsed are returned with a slash appended; validateEndpoint reports them.
+func normalizeEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		if !strings.HasSuffix(endpoint, "/") {
+			endpoint += "/"
+		}
+		return endpoint
+	}
+
+	// Clean the escaped path, so escaped slashes stay escaped.
+	escaped := path.Clean("/" + u.EscapedPath())
+	if !strings.HasSuffix(escaped, "/") {
+		escaped += "/"
+	}
+	if unescaped, err := url.PathUnescape(escaped); err == nil {
+		u.Path, u.RawPath = unescaped, escaped
+	}
+	return u.String()
+}
+
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" || endpoint == "/" {
+		return errors.New("endpoint must be specified")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "grpc", "grpcs":
+	case "unix":
+		if u.Host != "" {
+			return fmt.Errorf("unix endpoint %q must have the absolute path of the socket, e.g. unix:///run/storage.sock", endpoint)
+		}
+		if u.Path == "/" {
+			return fmt.Errorf("unix endpoint %q has no socket path", endpoint)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("endpoint %q must not have a query or fragment", endpoint)
+		}
+		return nil
+	default:
+		return fmt.Errorf("endpoint %q must start with http://, https://, grpc://, grpcs:// or unix://", endpoint)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("endpoint %q has no host", endpoint)
+	}
+	if u.User != nil {
+		return fmt.Errorf("endpoint %s must not contain credentials; use api_key or an auth option instead", u.Redacted())
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("endpoint %q must not have a query or fragment", endpoint)
+	}
+	if isGRPCEndpoint(endpoint) && u.Path != "/" {
+		return fmt.Errorf("grpc endpoint %q must not have a path", endpoint)
+	}
+
+	return nil
+}
+
+// unixSocket returns the path of the socket of a unix:// endpoint, e.g.
+// /run/storage.sock of unix:///run/storage.sock.
+func unixSocket(endpoint string) (string, bool) {
+	socket, ok := strings.CutPrefix(endpoint, "unix://")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(socket, "/"), true
+}
+
+// baseURL returns the URL request paths are appended to: the endpoint, or,
+// for unix:// endpoints, whose connections are dialed to the socket, the
+// root of an http:// URL.
+func (r *RestStorage) baseURL() string {
+	if _, ok := unixSocket(r.Endpoint); ok {
+		return "http://localhost/"
+	}
+	return r.Endpoint
+}
+
+// dialUnix returns a DialContext function that connects to socket, whatever
+// the address.
+func dialUnix(socket string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+}
@@ -0,0 +1,110 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+)
+
+// StatusError is returned when the backend responds with an unexpected
+// status code. Message and Code are read from the response body if it
+// contains the configured error fields.
+type StatusError struct {
+	StatusCode int
+	Message    string
+	Code       string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("unknown status code received: %v", e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	return msg
+}
+
+// Error bodies larger than this are not decoded.
+const maxErrorBodySize = 64 << 10
+
+// statusError returns a *StatusError for resp. The body is decoded with the
+// codec of its Content-Type; bodies that aren't objects are ignored.
+func (r *RestStorage) statusError(resp *http.Response) error {
+	statusErr := &StatusError{StatusCode: resp.StatusCode}
+	if resp.Body == nil {
+		return statusErr
+	}
+
+	limited := *resp
+	limited.Body = io.NopCloser(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	var body map[string]any
+	if err := decode(&limited, &body); err != nil {
+		return statusErr
+	}
+
+	statusErr.Message = errorField(body, r.ErrorMessageField)
+	statusErr.Code = errorField(body, r.ErrorCodeField)
+
+	return statusErr
+}
+
+// errorField returns the scalar value at the dot-separated path in body.
+func errorField(body map[string]any, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	var value any = body
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = object[name]
+	}
+
+	switch value := value.(type) {
+	case nil, map[string]any, []any:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// logFailure logs the failure of op on key with what is needed to tell
+// backend issues apart: the endpoint, the status and how long the operation
+// took. Keys that don't exist and canceled operations aren't failures.
+func (r *RestStorage) logFailure(op, key string, start time.Time, err error) {
+	if err == nil || errors.Is(err, fs.ErrNotExist) || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("operation", op),
+		zap.String("key", key),
+		zap.String("endpoint", r.Endpoint),
+		zap.Duration("duration", time.Since(start)),
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		fields = append(fields, zap.Int("status", statusErr.StatusCode))
+	} else if s, ok := status.FromError(err); ok {
+		fields = append(fields, zap.String("status", s.Code().String()))
+	}
+
+	r.logger.Error("Storage operation failed", append(fields, zap.Error(err))...)
+}
@@ -0,0 +1,132 @@
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// ConflictError is returned by Store with optimistic concurrency when the
+// value was changed by someone else since it was loaded.
+type ConflictError struct {
+	Key string
+	// The ETag the Store was conditional on.
+	Version string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("key %v was changed since version %v was loaded", e.Key, e.Version)
+}
+
+// etagEntry is the ETag of a loaded or stored value, and with conditional
+// loads the value itself, so it can be served when the backend responds to
+// a conditional Load with 304 Not Modified. They are kept in an lruCache
+// bounded by cache.max_entries, without expiry, since they are revalidated
+// by the backend anyway.
+type etagEntry struct {
+	etag string
+	// nil unless conditional loads are enabled.
+	value []byte
+}
+
+func newETagCache(maxEntries int) *lruCache[etagEntry] {
+	return newLRUCache[etagEntry]("etags", maxEntries, 0)
+}
+
+// loadHeader returns the headers of a Load of key, with If-None-Match set
+// to the ETag of the cached value, if any. S3 only returns checksums when
+// asked to.
+func (r *RestStorage) loadHeader(key string) http.Header {
+	header := http.Header{}
+	if r.Checksums && r.Dialect == DialectS3 {
+		header.Set(s3ChecksumModeHeader, "ENABLED")
+	}
+
+	if r.etags == nil || !r.ConditionalLoad {
+		return header
+	}
+
+	if entry, ok := r.etags.lookup(key); ok && entry.value != nil {
+		header.Set("If-None-Match", entry.etag)
+	}
+	return header
+}
+
+// ifMatch returns the ETag of the value of key last seen by this instance,
+// if optimistic concurrency is enabled.
+func (r *RestStorage) ifMatch(key string) string {
+	if r.etags == nil || !r.OptimisticConcurrency {
+		return ""
+	}
+
+	entry, _ := r.etags.lookup(key)
+	return entry.etag
+}
+
+// notModified returns the cached value of key if resp is a 304 response to
+// a conditional Load.
+func (r *RestStorage) notModified(key string, resp *http.Response) ([]byte, bool) {
+	if r.etags == nil || !r.ConditionalLoad || resp.StatusCode != http.StatusNotModified {
+		return nil, false
+	}
+
+	entry, ok := r.etags.lookup(key)
+	if !ok || entry.value == nil {
+		return nil, false
+	}
+	return bytes.Clone(entry.value), true
+}
+
+// rememberETag records the ETag of value, which was just loaded or stored
+// as the value of key. The version field of a LoadResponse is used as the
+// ETag if the response has no ETag header.
+func (r *RestStorage) rememberETag(key string, resp *http.Response, version string, value []byte) {
+	if r.etags == nil {
+		return
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		etag = versionETag(version)
+	}
+
+	r.setETag(key, etag, value)
+}
+
+// versionETag returns the ETag of a value with the given version, if any.
+func versionETag(version string) string {
+	if version == "" {
+		return ""
+	}
+	return `"` + version + `"`
+}
+
+// setETag records etag as the ETag of value, or forgets the value of key
+// if etag is empty.
+func (r *RestStorage) setETag(key, etag string, value []byte) {
+	if r.etags == nil {
+		return
+	}
+
+	if etag == "" {
+		r.etags.remove(key)
+		return
+	}
+
+	entry := etagEntry{etag: etag}
+	if r.ConditionalLoad {
+		entry.value = bytes.Clone(value)
+	}
+	r.etags.add(key, entry)
+}
+
+// forgetETag drops what is known about the value of key after it was
+// changed.
+func (r *RestStorage) forgetETag(key string) {
+	r.etags.remove(key)
+}
+
+// forgetETagPrefix forgets the values of prefix and the keys below it.
+func (r *RestStorage) forgetETagPrefix(prefix string) {
+	r.etags.removePrefix(prefix)
+}
@@ -0,0 +1,75 @@
+package rest
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestETagsBounded(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, &RestStorage{
+		ConditionalLoad:       true,
+		OptimisticConcurrency: true,
+		Cache:                 &CacheConfig{MaxEntries: 3},
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		if err := r.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		r.invalidate(key)
+		if _, err := r.Load(ctx, key); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+	}
+	if n := r.etags.len(); n > 3 {
+		t.Errorf("%d ETags are remembered, more than max_entries", n)
+	}
+
+	// Recently loaded keys are served from 304 responses; evicted ones
+	// are loaded again.
+	for _, key := range []string{"key9", "key0"} {
+		r.invalidate(key)
+		value, err := r.Load(ctx, key)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if string(value) != key {
+			t.Errorf("Load of %s returned %q", key, value)
+		}
+	}
+}
+
+func TestETagsDefaultBound(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, &RestStorage{ConditionalLoad: true})
+
+	if r.etags.maxEntries != defaultCacheMaxEntries {
+		t.Errorf("ETags are bounded by %d without a cache, want %d", r.etags.maxEntries, defaultCacheMaxEntries)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache[int]("test", 2, 0)
+	c.add("a", 1)
+	c.add("b", 2)
+	c.lookup("a")
+	c.add("c", 3)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.lookup(key); ok != want {
+			t.Errorf("lookup(%q) found %t, want %t", key, ok, want)
+		}
+	}
+
+	expiring := newLRUCache[int]("test", 2, time.Millisecond)
+	expiring.add("a", 1)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := expiring.lookup("a"); ok {
+		t.Error("an expired entry was found")
+	}
+}
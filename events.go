@@ -0,0 +1,41 @@
+package rest
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// The events emitted through Caddy's events app.
+const (
+	// A value was stored. Data: key, backend_key.
+	EventStored = "rest_storage.stored"
+	// A key, or a prefix and the keys below it, was deleted. Data: key,
+	// backend_key.
+	EventDeleted = "rest_storage.deleted"
+	// A lock is held elsewhere. Data: key, backend_key, holder, attempt.
+	EventLockContended = "rest_storage.lock_contended"
+	// The health check found the backend down. Data: endpoint, error.
+	EventBackendDown = "rest_storage.backend_down"
+)
+
+// emit emits the event name if the events app is running, which it is
+// whenever the tls app is.
+func (r *RestStorage) emit(name string, data map[string]any) {
+	events, _ := r.ctx.AppIfConfigured("events").(*caddyevents.App)
+	if events == nil {
+		return
+	}
+	events.Emit(r.ctx, name, data)
+}
+
+// emitKey emits the event name about the backend key, with more data as
+// key-value pairs. Hashed keys are only reported as backend_key.
+func (r *RestStorage) emitKey(name, backendKey string, more ...any) {
+	data := map[string]any{"backend_key": backendKey}
+	if key, ok := r.storageKey(backendKey); ok {
+		data["key"] = key
+	}
+	for i := 0; i+1 < len(more); i += 2 {
+		data[more[i].(string)] = more[i+1]
+	}
+	r.emit(name, data)
+}
@@ -0,0 +1,413 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// legacyPendingKey is where earlier versions kept the pending writes: in
+// the fallback storage, among the keys served from it.
+const legacyPendingKey = "rest_storage_pending.json"
+
+// FallbackConfig writes values through to another storage module, e.g.
+// file_system, which is read while the backend is unavailable. Stores and
+// Deletes made while the backend is unavailable only go to the fallback
+// storage and are synced to the backend once it recovers.
+type FallbackConfig struct {
+	// The storage module, e.g. {"module": "file_system", "root": "..."}.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	// How often to try syncing writes made during an outage to the
+	// backend. Defaults to 30s.
+	SyncInterval caddy.Duration `json:"sync_interval,omitempty"`
+	// The file the writes still to be synced are recorded in, so they
+	// survive restarts. Defaults to a file in rest_storage_pending in
+	// Caddy's data directory named after the endpoint, namespace and
+	// fallback storage.
+	PendingPath string `json:"pending_path,omitempty"`
+}
+
+// provision sets up the fallback storage of the module identified by id,
+// its endpoint and namespace.
+func (c *FallbackConfig) provision(ctx caddy.Context, id string) (*fallback, error) {
+	if c.SyncInterval == 0 {
+		c.SyncInterval = caddy.Duration(30 * time.Second)
+	}
+	if c.PendingPath == "" {
+		name := sha256Hex([]byte(id + " " + string(c.StorageRaw)))[:16] + ".json"
+		c.PendingPath = filepath.Join(caddy.AppDataDir(), "rest_storage_pending", name)
+	}
+
+	storage, err := loadStorageModule(ctx, c.StorageRaw)
+	if err != nil {
+		return nil, fmt.Errorf("fallback: %v", err)
+	}
+
+	f := &fallback{storage: storage, path: c.PendingPath, pending: make(map[string]string)}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("fallback: loading pending writes: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &f.pending); err != nil {
+			return nil, fmt.Errorf("fallback: decoding pending writes: %v", err)
+		}
+	}
+
+	if err := f.migratePending(ctx); err != nil {
+		return nil, fmt.Errorf("fallback: migrating pending writes: %v", err)
+	}
+
+	return f, nil
+}
+
+func (c *FallbackConfig) validate() error {
+	if len(c.StorageRaw) == 0 {
+		return errors.New("fallback: storage must be specified")
+	}
+	if c.SyncInterval < 0 {
+		return errors.New("fallback: sync_interval must not be negative")
+	}
+	return nil
+}
+
+// loadStorageModule loads the storage module configured in raw, e.g.
+// {"module": "file_system", "root": "..."}.
+func loadStorageModule(ctx caddy.Context, raw json.RawMessage) (certmagic.Storage, error) {
+	mod, err := loadInlineModule(ctx, "caddy.storage", raw)
+	if err != nil {
+		return nil, fmt.Errorf("loading storage module: %v", err)
+	}
+	converter, ok := mod.(caddy.StorageConverter)
+	if !ok {
+		return nil, fmt.Errorf("module %T is not a storage module", mod)
+	}
+	return converter.CertMagicStorage()
+}
+
+// loadInlineModule loads the module of namespace named by the "module" key
+// of raw. ctx.LoadModule would do the same, but doesn't recognize
+// json.RawMessage fields with Go versions where it is an alias of
+// jsontext.Value.
+func loadInlineModule(ctx caddy.Context, namespace string, raw json.RawMessage) (any, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	var name string
+	if err := json.Unmarshal(fields["module"], &name); err != nil || name == "" {
+		return nil, errors.New("module name missing")
+	}
+	delete(fields, "module")
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.LoadModuleByID(namespace+"."+name, raw)
+}
+
+// fallback is the storage values are written through to.
+type fallback struct {
+	storage certmagic.Storage
+	// the file the pending writes are recorded in
+	path string
+
+	mu sync.Mutex
+	// The operation, opStore, opDelete or opDeletePrefix, to sync to the
+	// backend, by key.
+	pending map[string]string
+}
+
+// migratePending moves the pending writes recorded by earlier versions in
+// the fallback storage to the file.
+func (f *fallback) migratePending(ctx context.Context) error {
+	data, err := f.storage.Load(ctx, legacyPendingKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, op := range legacy {
+		if _, ok := f.pending[key]; !ok {
+			f.pending[key] = op
+		}
+	}
+	if err := f.savePending(); err != nil {
+		return err
+	}
+	return f.storage.Delete(ctx, legacyPendingKey)
+}
+
+// setPending records op on key to be synced, or, with an empty op, that it
+// doesn't need to be synced anymore.
+func (f *fallback) setPending(key, op string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.pending[key] == op {
+		return nil
+	}
+	if op == "" {
+		delete(f.pending, key)
+	} else {
+		f.pending[key] = op
+	}
+
+	return f.savePending()
+}
+
+func (f *fallback) savePending() error {
+	data, err := json.Marshal(f.pending)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+func (f *fallback) pendingWrites() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pending := make(map[string]string, len(f.pending))
+	for key, op := range f.pending {
+		pending[key] = op
+	}
+	return pending
+}
+
+// fallbackKey marks the context of the Stores and Deletes that sync
+// pending writes, which must not fall back themselves.
+type fallbackKey struct{}
+
+func withoutFallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fallbackKey{}, true)
+}
+
+// usingFallback reports whether op on key should be served by the
+// fallback storage after the backend failed with err. Requests that failed
+// because ctx was canceled or timed out don't fall back.
+func (r *RestStorage) usingFallback(ctx context.Context, op, key string, err error) bool {
+	if r.fallback == nil || ctx.Value(fallbackKey{}) != nil || ctx.Err() != nil || !unavailable(err) {
+		return false
+	}
+
+	r.logger.Warn("Backend unavailable; using fallback storage",
+		zap.String("operation", op),
+		zap.String("key", key),
+		zap.Error(err))
+	return true
+}
+
+// fallbackStore writes value through to the fallback storage after the
+// backend returned err for it. If the backend was unavailable, the value
+// is synced later and the Store succeeds.
+func (r *RestStorage) fallbackStore(ctx context.Context, key string, value []byte, err error) error {
+	if r.fallback == nil || ctx.Value(fallbackKey{}) != nil {
+		return err
+	}
+	outage := r.usingFallback(ctx, opStore, key, err)
+	if err != nil && !outage {
+		return err
+	}
+
+	if fallbackErr := r.fallback.storage.Store(ctx, key, value); fallbackErr != nil {
+		r.logger.Error("Unable to store in fallback storage", zap.String("key", key), zap.Error(fallbackErr))
+		return err
+	}
+
+	if outage {
+		r.syncLater(key, opStore)
+		return nil
+	}
+	r.syncLater(key, "")
+	return nil
+}
+
+// fallbackCreate writes value through to the fallback storage after a
+// create-only Store of key succeeded. Unlike fallbackStore, it doesn't take
+// over during an outage: whether the key exists can't be checked then, and
+// syncing the value later would overwrite the value of whoever created the
+// key in the meantime.
+func (r *RestStorage) fallbackCreate(ctx context.Context, key string, value []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	return r.fallbackStore(ctx, key, value, nil)
+}
+
+// fallbackDelete deletes key from the fallback storage after the backend
+// returned err for it, like fallbackStore.
+func (r *RestStorage) fallbackDelete(ctx context.Context, key string, err error) error {
+	if r.fallback == nil || ctx.Value(fallbackKey{}) != nil {
+		return err
+	}
+	outage := r.usingFallback(ctx, opDelete, key, err)
+	if err != nil && !outage && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	fallbackErr := r.fallback.storage.Delete(ctx, key)
+	if fallbackErr != nil && !errors.Is(fallbackErr, fs.ErrNotExist) {
+		r.logger.Error("Unable to delete from fallback storage", zap.String("key", key), zap.Error(fallbackErr))
+		return err
+	}
+
+	if outage {
+		r.syncLater(key, opDelete)
+		return nil
+	}
+	r.syncLater(key, "")
+	return err
+}
+
+// fallbackDeletePrefix deletes prefix and the keys below it from the
+// fallback storage after the backend returned err for DeletePrefix, like
+// fallbackDelete.
+func (r *RestStorage) fallbackDeletePrefix(ctx context.Context, prefix string, err error) error {
+	if r.fallback == nil || ctx.Value(fallbackKey{}) != nil {
+		return err
+	}
+	outage := r.usingFallback(ctx, opDeletePrefix, prefix, err)
+	if err != nil && !outage {
+		return err
+	}
+
+	if fallbackErr := deleteStoragePrefix(ctx, r.fallback.storage, prefix); fallbackErr != nil {
+		r.logger.Error("Unable to delete prefix from fallback storage", zap.String("prefix", prefix), zap.Error(fallbackErr))
+		return err
+	}
+
+	// Writes below the prefix that are still to be synced would bring
+	// deleted keys back.
+	for key := range r.fallback.pendingWrites() {
+		if key != prefix && underPrefix(key, prefix) {
+			r.syncLater(key, "")
+		}
+	}
+
+	if outage {
+		r.syncLater(prefix, opDeletePrefix)
+		return nil
+	}
+	r.syncLater(prefix, "")
+	return err
+}
+
+// deleteStoragePrefix deletes prefix and the keys below it from storage.
+// Storages like file_system list directories as keys and only delete them
+// once they are empty, so the deepest keys are deleted first.
+func deleteStoragePrefix(ctx context.Context, storage certmagic.Storage, prefix string) error {
+	keys, err := storage.List(ctx, prefix, true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	for _, key := range append(keys, prefix) {
+		if err := storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncLater records op on key to be synced to the backend; an empty op
+// records that key is in sync.
+func (r *RestStorage) syncLater(key, op string) {
+	if err := r.fallback.setPending(key, op); err != nil {
+		r.logger.Error("Unable to record pending write", zap.String("key", key), zap.String("path", r.fallback.path), zap.Error(err))
+	}
+}
+
+// syncFallback syncs the writes made while the backend was unavailable
+// every sync_interval.
+func (r *RestStorage) syncFallback(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.Fallback.SyncInterval))
+	defer ticker.Stop()
+
+	for {
+		r.syncPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *RestStorage) syncPending(ctx context.Context) {
+	pending := r.fallback.pendingWrites()
+	if len(pending) == 0 {
+		return
+	}
+
+	synced := 0
+	for key, op := range pending {
+		err := r.syncKey(withoutFallback(ctx), key, op)
+		if unavailable(err) || ctx.Err() != nil {
+			// Try again later.
+			break
+		}
+		if err != nil {
+			r.logger.Error("Unable to sync write from fallback storage; dropping it",
+				zap.String("operation", op),
+				zap.String("key", key),
+				zap.Error(err))
+		}
+		r.syncLater(key, "")
+		synced++
+	}
+
+	if synced > 0 {
+		r.logger.Info("Synced writes from fallback storage",
+			zap.Int("synced", synced),
+			zap.Int("remaining", len(pending)-synced))
+	}
+}
+
+func (r *RestStorage) syncKey(ctx context.Context, key, op string) error {
+	switch op {
+	case opDelete:
+		err := r.Delete(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	case opDeletePrefix:
+		return r.DeletePrefix(ctx, key)
+	}
+
+	value, err := r.fallback.storage.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("loading from fallback storage: %w", err)
+	}
+	return r.Store(ctx, key, value)
+}
@@ -0,0 +1,59 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"testing"
+)
+
+// TestFallbackPendingFile checks that pending writes are recorded outside
+// of the fallback storage, so they aren't listed with the keys served from
+// it, and that those recorded in it by earlier versions are moved.
+func TestFallbackPendingFile(t *testing.T) {
+	server := newTestServer(t)
+	config := testFallback(t)
+	r := server.storage(t, &RestStorage{Fallback: config})
+	ctx := context.Background()
+
+	server.Close()
+	if err := r.Store(ctx, "certificates/a.crt", []byte("value")); err != nil {
+		t.Fatalf("Store during an outage: %v", err)
+	}
+
+	data, err := os.ReadFile(config.PendingPath)
+	if err != nil {
+		t.Fatalf("reading the pending writes: %v", err)
+	}
+	var pending map[string]string
+	if err := json.Unmarshal(data, &pending); err != nil || pending["certificates/a.crt"] != opStore {
+		t.Errorf("the pending writes file has %s, %v", data, err)
+	}
+
+	keys, err := r.List(ctx, "", true)
+	if err != nil {
+		t.Fatalf("List during an outage: %v", err)
+	}
+	if slices.Contains(keys, legacyPendingKey) || !slices.Contains(keys, "certificates/a.crt") {
+		t.Errorf("List during an outage returned %q", keys)
+	}
+
+	// A restart with the pending writes of an earlier version.
+	if err := os.Remove(config.PendingPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.fallback.storage.Store(ctx, legacyPendingKey, []byte(`{"certificates/b.crt":"delete"}`)); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newTestServer(t).storage(t, &RestStorage{Fallback: config})
+
+	if op := restarted.fallback.pendingWrites()["certificates/b.crt"]; op != opDelete {
+		t.Errorf("the migrated pending write is %q", op)
+	}
+	if _, err := restarted.fallback.storage.Load(ctx, legacyPendingKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the pending writes of the earlier version weren't removed: %v", err)
+	}
+}
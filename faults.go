@@ -0,0 +1,144 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// FaultInjectionConfig makes requests to the backend fail or slow down at
+// random, to verify before a real incident that Caddy copes with an
+// unreliable backend: that retries, the fallback storage and lock recovery
+// work. Never enable it in production.
+//
+// Each rate is the fraction of requests, between 0 and 1, the fault is
+// injected into. A request gets at most one of the failures, and may be
+// delayed as well.
+type FaultInjectionConfig struct {
+	// The operations whose requests faults are injected into, e.g. "load"
+	// or "lock". Defaults to all.
+	Operations []string `json:"operations,omitempty"`
+
+	// The fraction of requests delayed by Latency before they are sent.
+	LatencyRate float64 `json:"latency_rate,omitempty"`
+	// Defaults to 1s.
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// The fraction of requests failed as if the connection dropped,
+	// without sending them.
+	DropRate float64 `json:"drop_rate,omitempty"`
+
+	// The fraction of requests answered with ErrorStatus, without sending
+	// them.
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	// Defaults to 503.
+	ErrorStatus int `json:"error_status,omitempty"`
+
+	// The fraction of lock requests answered with 423 Locked, as if
+	// another instance held the lock, without sending them.
+	LockedRate float64 `json:"locked_rate,omitempty"`
+}
+
+func (c *FaultInjectionConfig) provision() {
+	if c.Latency == 0 {
+		c.Latency = caddy.Duration(time.Second)
+	}
+	if c.ErrorStatus == 0 {
+		c.ErrorStatus = http.StatusServiceUnavailable
+	}
+}
+
+func (c *FaultInjectionConfig) validate() error {
+	rates := map[string]float64{
+		"latency_rate": c.LatencyRate,
+		"drop_rate":    c.DropRate,
+		"error_rate":   c.ErrorRate,
+		"locked_rate":  c.LockedRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("fault_injection: %s must be between 0 and 1", name)
+		}
+	}
+	if c.Latency < 0 {
+		return errors.New("fault_injection: latency must not be negative")
+	}
+	if c.ErrorStatus < 400 || c.ErrorStatus > 599 {
+		return fmt.Errorf("fault_injection: error_status %d is not an error status", c.ErrorStatus)
+	}
+	for _, op := range c.Operations {
+		if _, ok := rpcRoutes[op]; !ok {
+			return fmt.Errorf("fault_injection: unknown operation %q", op)
+		}
+	}
+	return nil
+}
+
+// errFaultInjected is the cause of requests failed by fault injection as if
+// the connection dropped.
+var errFaultInjected = errors.New("connection dropped by fault injection")
+
+// injectFault delays the request for op to target, or fails it, as
+// configured in FaultInjection. If it returns neither a response nor an
+// error, the request is sent.
+func (r *RestStorage) injectFault(ctx context.Context, op, method, target string) (*http.Response, error) {
+	c := r.FaultInjection
+	if c == nil || (len(c.Operations) > 0 && !slices.Contains(c.Operations, op)) {
+		return nil, nil
+	}
+
+	if c.LatencyRate > 0 && rand.Float64() < c.LatencyRate {
+		r.recordFault(op, "latency")
+		select {
+		case <-time.After(time.Duration(c.Latency)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The failures are mutually exclusive, so their rates add up.
+	roll := rand.Float64()
+	if roll < c.DropRate {
+		r.recordFault(op, "drop")
+		return nil, &url.Error{Op: method, URL: target, Err: errFaultInjected}
+	}
+	roll -= c.DropRate
+
+	status := 0
+	if roll < c.ErrorRate {
+		r.recordFault(op, "error")
+		status = c.ErrorStatus
+	} else if op == opLock && roll-c.ErrorRate < c.LockedRate {
+		r.recordFault(op, "locked")
+		status = http.StatusLocked
+		if configured := r.StatusCodes[opLock].Locked; len(configured) > 0 {
+			status = configured[0]
+		}
+	}
+	if status == 0 {
+		return nil, nil
+	}
+
+	return &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+		Request:    &http.Request{Method: method},
+	}, nil
+}
+
+func (r *RestStorage) recordFault(op, fault string) {
+	restMetrics.faultsInjected.WithLabelValues(op, fault).Inc()
+	r.logger.Debug("Injecting fault", zap.String("operation", op), zap.String("fault", fault))
+}
@@ -0,0 +1,74 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+)
+
+// ListFilter narrows down the keys listed by ListFiltered.
+type ListFilter struct {
+	// Only list keys matching this pattern, as in path.Match, e.g.
+	// "certificates/*/*/*.crt".
+	Pattern string
+	// Only list keys modified after this time.
+	ModifiedAfter time.Time
+}
+
+// ListFiltered lists the keys below prefix that match filter. The filter
+// is sent to the backend, so it doesn't have to return every key, but is
+// also applied to the keys returned: patterns are matched locally, and
+// unless the backend reports the list_filters capability, the keys are
+// stat'ed to compare their modification time.
+func (r *RestStorage) ListFiltered(ctx context.Context, prefix string, recursive bool, filter ListFilter) ([]string, error) {
+	if filter.Pattern != "" {
+		if _, err := path.Match(filter.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", filter.Pattern, err)
+		}
+	}
+
+	var keys []string
+	var err error
+	encoded := r.KeyEncoding != "" && r.KeyEncoding != KeyEncodingNone
+	if encoded {
+		keys, err = r.listEncoded(ctx, prefix, recursive)
+	} else {
+		backendFilter := filter
+		if filter.Pattern != "" {
+			backendFilter.Pattern = r.namespaced(filter.Pattern)
+		}
+		keys, err = r.list(ctx, r.backendKey(prefix), recursive, backendFilter)
+		keys = r.storageKeys(keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Pattern != "" {
+		matching := keys[:0]
+		for _, key := range keys {
+			if matched, _ := path.Match(filter.Pattern, key); matched {
+				matching = append(matching, key)
+			}
+		}
+		keys = matching
+	}
+
+	if filter.ModifiedAfter.IsZero() || (r.capabilities[CapabilityListFilters] && !encoded) {
+		return keys, nil
+	}
+
+	infos, err := r.StatBatch(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	modified := keys[:0]
+	for _, key := range keys {
+		if info, ok := infos[key]; ok && info.Modified.After(filter.ModifiedAfter) {
+			modified = append(modified, key)
+		}
+	}
+	return modified, nil
+}
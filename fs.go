@@ -0,0 +1,241 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// FS returns a read-only view of the storage as an fs.FS, which also
+// implements fs.ReadDirFS, fs.ReadFileFS and fs.StatFS, so other modules
+// and fs-based tooling can read stored values, e.g. to serve a trust bundle.
+// RestStorage can't implement these interfaces itself, since its Stat
+// method is that of certmagic.Storage. Requests are made with ctx.
+//
+// Keys are paths, with the prefixes of other keys as directories. Backends
+// that don't report directories in Stat are supported by listing them.
+func (r *RestStorage) FS(ctx context.Context) fs.FS {
+	return &storageFS{r: r, ctx: ctx}
+}
+
+type storageFS struct {
+	r   *RestStorage
+	ctx context.Context
+}
+
+func (f *storageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	info, err := f.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if info.IsDir() {
+		return &storageDir{fsys: f, name: name, info: info}, nil
+	}
+
+	value, err := f.r.Load(f.ctx, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &storageFile{Reader: bytes.NewReader(value), info: info}, nil
+}
+
+func (f *storageFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	info, err := f.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+func (f *storageFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+
+	info, err := f.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errIsDir}
+	}
+
+	value, err := f.r.Load(f.ctx, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return value, nil
+}
+
+func (f *storageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, err := f.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+var errIsDir = errors.New("is a directory")
+
+// stat returns the info of the key name, or of the directory name if keys
+// are stored below it.
+func (f *storageFS) stat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return storageFileInfo{certmagic.KeyInfo{Key: "."}}, nil
+	}
+
+	info, err := f.r.Stat(f.ctx, name)
+	if err == nil {
+		return storageFileInfo{info}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	keys, listErr := f.r.List(f.ctx, name, false)
+	if listErr != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return storageFileInfo{certmagic.KeyInfo{Key: name}}, nil
+}
+
+// readDir returns the entries of the directory name, sorted by name.
+func (f *storageFS) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := name
+	if name == "." {
+		prefix = ""
+	}
+
+	keys, err := f.r.List(f.ctx, prefix, false)
+	if errors.Is(err, fs.ErrNotExist) && name == "." {
+		return []fs.DirEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := f.r.StatBatch(f.ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(keys))
+	for _, key := range keys {
+		info, ok := infos[key]
+		if !ok {
+			// Directories the backend doesn't stat.
+			info = certmagic.KeyInfo{Key: key}
+		}
+		info.Key = key
+		entries = append(entries, fs.FileInfoToDirEntry(storageFileInfo{info}))
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// storageFileInfo is the fs.FileInfo of a key. Keys that aren't terminal
+// are directories.
+type storageFileInfo struct {
+	info certmagic.KeyInfo
+}
+
+func (i storageFileInfo) Name() string { return path.Base(i.info.Key) }
+
+func (i storageFileInfo) Size() int64 { return i.info.Size }
+
+func (i storageFileInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func (i storageFileInfo) ModTime() time.Time { return i.info.Modified }
+
+func (i storageFileInfo) IsDir() bool { return !i.info.IsTerminal }
+
+func (i storageFileInfo) Sys() any { return i.info }
+
+// storageFile is an opened value.
+type storageFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *storageFile) Close() error { return nil }
+
+// storageDir is an opened directory. Its entries are listed on the first
+// call of ReadDir.
+type storageDir struct {
+	fsys    *storageFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *storageDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *storageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+func (d *storageDir) Close() error { return nil }
+
+func (d *storageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.readDir(d.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		d.entries, d.read = entries, true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// Interface guards
+var (
+	_ fs.ReadDirFS   = (*storageFS)(nil)
+	_ fs.ReadFileFS  = (*storageFS)(nil)
+	_ fs.StatFS      = (*storageFS)(nil)
+	_ fs.ReadDirFile = (*storageDir)(nil)
+)
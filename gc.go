@@ -0,0 +1,204 @@
+package rest
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/certmagic"
+	"github.com/spf13/cobra"
+)
+
+func gcCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc [--config <path>] [--adapter <name>] [--expired-for <duration>] [--lock-age <duration>] [--dry-run]",
+		Short: "Deletes expired certificates, orphaned OCSP staples and stale locks",
+		Long: `
+Deletes the keys in the rest backend that Caddy doesn't need anymore:
+
+- certificates that expired longer than --expired-for ago (default 720h),
+  with their private keys and metadata,
+- OCSP staples of certificates that aren't stored anymore; Caddy fetches
+  staples again when it needs them, and
+- lock files below locks/ not modified for --lock-age (default 24h), e.g.
+  left behind by the file_system storage before a migration.
+
+With --dry-run, the keys are only printed.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdGC),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().Duration("expired-for", 30*24*time.Hour, "How long certificates must be expired to be deleted")
+	cmd.Flags().Duration("lock-age", 24*time.Hour, "How long lock files must be unmodified to be deleted")
+	cmd.Flags().Bool("dry-run", false, "Print the keys to delete without deleting them")
+	return cmd
+}
+
+// garbage is a key to delete, and why.
+type garbage struct {
+	key    string
+	reason string
+}
+
+func cmdGC(fl caddycmd.Flags) (int, error) {
+	expiredFor, _ := fl.GetDuration("expired-for")
+	lockAge, _ := fl.GetDuration("lock-age")
+	dryRun := fl.Bool("dry-run")
+
+	r, cancel, err := storageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	ctx := context.Background()
+
+	certs, staples, err := certificateGarbage(ctx, r, expiredFor)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	locks, err := lockGarbage(ctx, r, lockAge)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	failed := 0
+	all := append(append(certs, staples...), locks...)
+	for _, g := range all {
+		if dryRun {
+			fmt.Printf("Would delete %s (%s)\n", g.key, g.reason)
+			continue
+		}
+		fmt.Printf("Deleting %s (%s)\n", g.key, g.reason)
+		if err := r.Delete(ctx, g.key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("%s: %v\n", g.key, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d of %d keys couldn't be deleted", failed, len(all))
+	}
+
+	fmt.Printf("%d keys to delete\n", len(all))
+	return caddy.ExitCodeSuccess, nil
+}
+
+// certificateGarbage returns the keys of the certificates, as stored by
+// certmagic, that expired longer than expiredFor ago, and of the OCSP
+// staples of no remaining certificate.
+func certificateGarbage(ctx context.Context, storage certmagic.Storage, expiredFor time.Duration) (certs, staples []garbage, err error) {
+	keys, err := storedKeys(ctx, storage, "certificates")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("listing certificates: %v", err)
+	}
+
+	// The staples of the certificates that are kept.
+	wanted := make(map[string]bool)
+	unreadable := 0
+
+	for _, key := range keys {
+		if path.Ext(key) != ".crt" {
+			continue
+		}
+
+		bundle, err := storage.Load(ctx, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading %s: %v", key, err)
+		}
+		block, _ := pem.Decode(bundle)
+		if block == nil {
+			fmt.Printf("%s: no PEM certificate; skipping\n", key)
+			unreadable++
+			continue
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			fmt.Printf("%s: %v; skipping\n", key, err)
+			unreadable++
+			continue
+		}
+
+		if expired := time.Since(leaf.NotAfter); expired > expiredFor {
+			reason := fmt.Sprintf("expired %s", leaf.NotAfter.Format(time.DateOnly))
+			base := strings.TrimSuffix(key, ".crt")
+			for _, ext := range []string{".crt", ".key", ".json"} {
+				certs = append(certs, garbage{key: base + ext, reason: reason})
+			}
+			continue
+		}
+
+		cert := &certmagic.Certificate{Names: []string{firstCertName(leaf)}}
+		wanted[certmagic.StorageKeys.OCSPStaple(cert, bundle)] = true
+	}
+
+	// Staples of certificates that couldn't be read would look orphaned.
+	if unreadable > 0 {
+		fmt.Printf("Not deleting OCSP staples, since %d certificates couldn't be read\n", unreadable)
+		return certs, nil, nil
+	}
+
+	keys, err = storedKeys(ctx, storage, "ocsp")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("listing OCSP staples: %v", err)
+	}
+	for _, key := range keys {
+		if !wanted[key] {
+			staples = append(staples, garbage{key: key, reason: "orphaned OCSP staple"})
+		}
+	}
+
+	return certs, staples, nil
+}
+
+// firstCertName returns the name certmagic names the OCSP staple of leaf
+// after.
+func firstCertName(leaf *x509.Certificate) string {
+	switch {
+	case leaf.Subject.CommonName != "":
+		return strings.ToLower(leaf.Subject.CommonName)
+	case len(leaf.DNSNames) > 0:
+		return strings.ToLower(leaf.DNSNames[0])
+	case len(leaf.IPAddresses) > 0:
+		return leaf.IPAddresses[0].String()
+	case len(leaf.EmailAddresses) > 0:
+		return strings.ToLower(leaf.EmailAddresses[0])
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	}
+	return ""
+}
+
+// lockGarbage returns the keys below locks/ not modified for age.
+func lockGarbage(ctx context.Context, storage certmagic.Storage, age time.Duration) ([]garbage, error) {
+	keys, err := storage.List(ctx, "locks", true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing locks: %v", err)
+	}
+
+	var locks []garbage
+	for _, key := range keys {
+		info, err := storage.Stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stat %s: %v", key, err)
+		}
+		if info.IsTerminal && time.Since(info.Modified) > age {
+			locks = append(locks, garbage{key: key, reason: fmt.Sprintf("lock unmodified since %s", info.Modified.Format(time.RFC3339))})
+		}
+	}
+
+	return locks, nil
+}
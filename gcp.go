@@ -0,0 +1,195 @@
+package rest
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const gcpMetadataIdentityURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+
+// GCPIDTokenConfig authenticates with Google-signed ID tokens, as required
+// by IAM-protected Cloud Run services. Tokens are fetched from the metadata
+// server, or minted from a service account key when CredentialsFile is set.
+type GCPIDTokenConfig struct {
+	// Usually the URL of the Cloud Run service.
+	Audience        string `json:"audience"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+}
+
+func (g *GCPIDTokenConfig) validate() error {
+	if g.Audience == "" {
+		return errors.New("gcp_id_token: audience must be specified")
+	}
+	return nil
+}
+
+func (g *GCPIDTokenConfig) tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	src := &gcpIDTokenSource{
+		ctx:        ctx,
+		audience:   g.Audience,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if g.CredentialsFile != "" {
+		key, err := loadGCPServiceAccountKey(g.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("gcp_id_token: %v", err)
+		}
+		src.key = key
+	}
+
+	return oauth2.ReuseTokenSource(nil, src), nil
+}
+
+type gcpServiceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	signer *rsa.PrivateKey
+}
+
+func loadGCPServiceAccountKey(path string) (*gcpServiceAccountKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key gcpServiceAccountKey
+	if err := json.Unmarshal(contents, &key); err != nil {
+		return nil, fmt.Errorf("parsing service account key: %v", err)
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account key contains no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing service account private key: %v", err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not an RSA key")
+	}
+	key.signer = rsaKey
+
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &key, nil
+}
+
+type gcpIDTokenSource struct {
+	ctx        context.Context
+	audience   string
+	key        *gcpServiceAccountKey
+	httpClient *http.Client
+}
+
+func (s *gcpIDTokenSource) Token() (*oauth2.Token, error) {
+	var idToken string
+	var err error
+	if s.key != nil {
+		idToken, err = s.exchangeServiceAccountKey()
+	} else {
+		idToken, err = s.fetchFromMetadata()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expiry, err := jwtExpiry(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ID token: %v", err)
+	}
+
+	return &oauth2.Token{AccessToken: idToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+func (s *gcpIDTokenSource) fetchFromMetadata() (string, error) {
+	query := url.Values{"audience": {s.audience}, "format": {"full"}}
+	req, err := http.NewRequestWithContext(s.ctx, "GET", gcpMetadataIdentityURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	body, err := s.do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching ID token from metadata server: %v", err)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (s *gcpIDTokenSource) exchangeServiceAccountKey() (string, error) {
+	now := time.Now()
+	assertion, err := encodeJWT("RS256", s.key.PrivateKeyID, map[string]any{
+		"iss":             s.key.ClientEmail,
+		"sub":             s.key.ClientEmail,
+		"aud":             s.key.TokenURI,
+		"target_audience": s.audience,
+		"iat":             now.Unix(),
+		"exp":             now.Add(time.Hour).Unix(),
+	}, s.key.signer)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(s.ctx, "POST", s.key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	body, err := s.do(req)
+	if err != nil {
+		return "", fmt.Errorf("exchanging service account key for ID token: %v", err)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.IDToken == "" {
+		return "", errors.New("token response contains no id_token")
+	}
+
+	return tokenResp.IDToken, nil
+}
+
+func (s *gcpIDTokenSource) do(req *http.Request) ([]byte, error) {
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,218 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The methods of the Storage service in proto/storage.proto, by operation.
+var grpcMethods = map[string]string{
+	opStore:  "/caddy.storage.rest.Storage/Store",
+	opLoad:   "/caddy.storage.rest.Storage/Load",
+	opDelete: "/caddy.storage.rest.Storage/Delete",
+	opExists: "/caddy.storage.rest.Storage/Exists",
+	opList:   "/caddy.storage.rest.Storage/List",
+	opStat:   "/caddy.storage.rest.Storage/Stat",
+	opLock:   "/caddy.storage.rest.Storage/Lock",
+	opUnlock: "/caddy.storage.rest.Storage/Unlock",
+	opRenew:  "/caddy.storage.rest.Storage/Renew",
+	opInfo:   "/caddy.storage.rest.Storage/Info",
+
+	opUploadInit:   "/caddy.storage.rest.Storage/UploadInit",
+	opUploadAppend: "/caddy.storage.rest.Storage/UploadAppend",
+	opUploadStatus: "/caddy.storage.rest.Storage/UploadStatus",
+	opUploadCommit: "/caddy.storage.rest.Storage/UploadCommit",
+
+	opStoreBatch:  "/caddy.storage.rest.Storage/StoreBatch",
+	opDeleteBatch: "/caddy.storage.rest.Storage/DeleteBatch",
+	opLoadBatch:   "/caddy.storage.rest.Storage/LoadBatch",
+	opStatBatch:   "/caddy.storage.rest.Storage/StatBatch",
+
+	opDeletePrefix: "/caddy.storage.rest.Storage/DeletePrefix",
+
+	opWatch: "/caddy.storage.rest.Storage/Watch",
+
+	opListValues: "/caddy.storage.rest.Storage/ListValues",
+}
+
+// The HTTP status codes the RPC dialect uses for success, by operation.
+var grpcSuccessCodes = map[string]int{
+	opStore:  201,
+	opLoad:   200,
+	opDelete: 204,
+	opExists: 200,
+	opList:   200,
+	opStat:   200,
+	opLock:   201,
+	opUnlock: 204,
+	opRenew:  200,
+	opInfo:   200,
+
+	opUploadInit:   201,
+	opUploadAppend: 204,
+	opUploadStatus: 200,
+	opUploadCommit: 201,
+
+	opStoreBatch:  200,
+	opDeleteBatch: 200,
+	opLoadBatch:   200,
+	opStatBatch:   200,
+
+	opDeletePrefix: 204,
+
+	opWatch: 200,
+
+	opListValues: 200,
+}
+
+// The HTTP status codes equivalent to gRPC status codes with a meaning in
+// the storage API.
+var grpcStatusCodes = map[codes.Code]int{
+	codes.NotFound:           404,
+	codes.AlreadyExists:      409,
+	codes.FailedPrecondition: 412,
+	codes.Aborted:            423,
+	codes.Unauthenticated:    401,
+	codes.PermissionDenied:   403,
+}
+
+func isGRPCEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "grpc://") || strings.HasPrefix(endpoint, "grpcs://")
+}
+
+// dialGRPC connects to a grpc:// (plaintext) or grpcs:// (TLS) endpoint.
+// The connection is established lazily.
+func dialGRPC(endpoint string) (*grpc.ClientConn, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %v", err)
+	}
+
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+
+	return grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+}
+
+// callGRPC invokes the Storage method of op on key. The reply is returned as an
+// application/x-protobuf response with the status code the RPC dialect
+// would use, so callers can treat both transports alike.
+func (r *RestStorage) callGRPC(ctx context.Context, op, key string, dataStruct any) (*http.Response, error) {
+	requestBody, err := protobufCodec{}.marshal(dataStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := r.startSpan(ctx, op, key)
+	start := time.Now()
+	resp, err := r.injectFault(ctx, op, http.MethodPost, r.Endpoint+grpcMethods[op])
+	if resp == nil && err == nil {
+		resp, err = r.callGRPCWithApiKey(ctx, op, requestBody)
+	}
+	observeRequest(op, start, len(requestBody), resp, err)
+	r.logSlowRequest(op, key, start, nil, resp, err)
+	endSpan(span, resp, err)
+	return resp, err
+}
+
+// callGRPCWithApiKey invokes the method of op with the current api key.
+func (r *RestStorage) callGRPCWithApiKey(ctx context.Context, op string, requestBody []byte) (*http.Response, error) {
+	return r.withApiKey(op, func(apiKey string) (*http.Response, error) {
+		md, err := r.grpcMetadata(apiKey)
+		if err != nil {
+			return nil, err
+		}
+
+		traceHeader := http.Header{}
+		injectTraceContext(ctx, traceHeader)
+		for name, values := range traceHeader {
+			md.Set(name, values...)
+		}
+
+		release, err := r.limiter.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var reply []byte
+		invoked := time.Now()
+		err = r.grpcConn.Invoke(metadata.NewOutgoingContext(ctx, md), grpcMethods[op], requestBody, &reply, grpc.ForceCodec(rawCodec{}))
+		release()
+		r.logGRPCRequest(op, requestBody, reply, err, time.Since(invoked))
+
+		code := grpcSuccessCodes[op]
+		if err != nil {
+			var ok bool
+			code, ok = grpcStatusCodes[status.Code(err)]
+			if !ok {
+				return nil, err
+			}
+		}
+
+		return &http.Response{
+			Status:     http.StatusText(code),
+			StatusCode: code,
+			Header:     http.Header{"Content-Type": {protobufCodec{}.contentType()}},
+			Body:       io.NopCloser(bytes.NewReader(reply)),
+			// gRPC calls are POST requests over HTTP/2.
+			Request: &http.Request{Method: "POST"},
+		}, nil
+	})
+}
+
+// grpcMetadata returns apiKey and the bearer token, if any, as metadata.
+func (r *RestStorage) grpcMetadata(apiKey string) (metadata.MD, error) {
+	md := metadata.MD{}
+	if apiKey != "" {
+		md.Set("x-api-key", apiKey)
+	}
+
+	if r.tokenSource != nil {
+		token, err := r.tokenSource.Token()
+		if err != nil {
+			return nil, fmt.Errorf("obtaining access token: %v", err)
+		}
+		md.Set("authorization", token.Type()+" "+token.AccessToken)
+	}
+
+	return md, nil
+}
+
+// rawCodec passes messages that are already encoded through to gRPC.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: cannot encode %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: cannot decode into %T", v)
+	}
+	*b = append([]byte(nil), data...)
+	return nil
+}
+
+// Name is the content subtype, sent as application/grpc+proto.
+func (rawCodec) Name() string { return "proto" }
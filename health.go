@@ -0,0 +1,194 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// The health of the backend, as seen by the health check.
+const (
+	// HealthUnknown is reported without health_check and until the first
+	// probe completed.
+	HealthUnknown = "unknown"
+	// HealthHealthy means the last probe succeeded in time.
+	HealthHealthy = "healthy"
+	// HealthDegraded means the last probe was slow, or failed fewer than
+	// failures times in a row.
+	HealthDegraded = "degraded"
+	// HealthDown means the probe failed failures times in a row.
+	HealthDown = "down"
+)
+
+// probeKey is the key stat'ed by default to check that the backend is
+// reachable. It needn't exist.
+const probeKey = ".health_check"
+
+var healthStates = []string{HealthUnknown, HealthHealthy, HealthDegraded, HealthDown}
+
+// HealthCheckConfig probes the backend in the background, so that storage
+// problems show up in the logs and metrics before renewals start failing.
+type HealthCheckConfig struct {
+	// How often to probe the backend. Defaults to 30s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// How long a probe may take before it fails. Defaults to 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// Probes taking longer than this mark the backend as degraded.
+	// Defaults to 1s.
+	DegradedLatency caddy.Duration `json:"degraded_latency,omitempty"`
+	// How many probes in a row must fail before the backend is down.
+	// Defaults to 3.
+	Failures int `json:"failures,omitempty"`
+	// The key probed with a Stat request; it needn't exist. Defaults to
+	// .health_check.
+	Key string `json:"key,omitempty"`
+}
+
+func (c *HealthCheckConfig) provision() {
+	if c.Interval == 0 {
+		c.Interval = caddy.Duration(30 * time.Second)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = caddy.Duration(5 * time.Second)
+	}
+	if c.DegradedLatency == 0 {
+		c.DegradedLatency = caddy.Duration(time.Second)
+	}
+	if c.Failures == 0 {
+		c.Failures = 3
+	}
+	if c.Key == "" {
+		c.Key = probeKey
+	}
+}
+
+func (c *HealthCheckConfig) validate() error {
+	if c.Interval < 0 || c.Timeout < 0 || c.DegradedLatency < 0 {
+		return errors.New("health_check: durations must not be negative")
+	}
+	if c.Failures < 0 {
+		return errors.New("health_check: failures must not be negative")
+	}
+	return nil
+}
+
+// healthState is the health of the backend and the number of probes that
+// failed in a row.
+type healthState struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+}
+
+// Health returns the health of the backend as of the last probe of the
+// health check: one of HealthUnknown, HealthHealthy, HealthDegraded or
+// HealthDown.
+func (r *RestStorage) Health() string {
+	if r.health == nil {
+		return HealthUnknown
+	}
+
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+	return r.health.state
+}
+
+// monitorHealth probes the backend every interval until ctx is done.
+func (r *RestStorage) monitorHealth(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.HealthCheck.Interval))
+	defer ticker.Stop()
+
+	for {
+		r.probeHealth(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeHealth stats the probe key and updates the health accordingly. Not
+// finding the key counts as success.
+func (r *RestStorage) probeHealth(ctx context.Context) {
+	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(r.HealthCheck.Timeout))
+	defer cancel()
+
+	// Probes measure the backend, so they don't queue for one of the
+	// max_concurrent_requests.
+	start := time.Now()
+	_, err := r.stat(withoutLimit(probeCtx), r.backendKey(r.HealthCheck.Key))
+	latency := time.Since(start)
+	if ctx.Err() != nil {
+		return
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+
+	r.health.mu.Lock()
+	state := HealthHealthy
+	if err != nil {
+		r.health.failures++
+		state = HealthDegraded
+		if r.health.failures >= r.HealthCheck.Failures {
+			state = HealthDown
+		}
+	} else {
+		r.health.failures = 0
+		if latency > time.Duration(r.HealthCheck.DegradedLatency) {
+			state = HealthDegraded
+		}
+	}
+
+	if state == r.health.state {
+		r.health.mu.Unlock()
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("endpoint", r.Endpoint),
+		zap.String("previous", r.health.state),
+		zap.String("state", state),
+		zap.Duration("latency", latency),
+		zap.Int("failures", r.health.failures),
+	}
+	switch state {
+	case HealthHealthy:
+		r.logger.Info("Storage backend is healthy", fields...)
+	case HealthDegraded:
+		r.logger.Warn("Storage backend is degraded", append(fields, zap.Error(err))...)
+	case HealthDown:
+		r.logger.Error("Storage backend is down", append(fields, zap.Error(err))...)
+	}
+
+	r.health.state = state
+	setHealthMetric(r.Endpoint, state)
+	r.health.mu.Unlock()
+
+	// Handlers may call Health, so the state must be unlocked.
+	if state == HealthDown {
+		r.emit(EventBackendDown, map[string]any{
+			"endpoint": r.Endpoint,
+			"error":    err.Error(),
+		})
+	}
+}
+
+// setHealthMetric sets the health gauge of endpoint to 1 for state and to
+// 0 for the other states.
+func setHealthMetric(endpoint, state string) {
+	for _, s := range healthStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		restMetrics.health.WithLabelValues(endpoint, s).Set(value)
+	}
+}
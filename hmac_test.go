@@ -0,0 +1,83 @@
+package rest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHMACSign(t *testing.T) {
+	h := &HMACConfig{Secret: "secret"}
+	h.provision()
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		method, url string
+		body        string
+		// The message the signature must be computed from.
+		message string
+	}{
+		{
+			method:  "POST",
+			url:     "https://api.example.com/storage/load",
+			body:    `{"key":"a"}`,
+			message: "POST\n/storage/load\n\n" + sha256Hex([]byte(`{"key":"a"}`)) + "\n1700000000",
+		},
+		{
+			method:  "GET",
+			url:     "https://api.example.com/keys?recursive=true&prefix=certs/a",
+			message: "GET\n/keys\nprefix=certs%2Fa&recursive=true\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n1700000000",
+		},
+		{
+			method:  "GET",
+			url:     "https://api.example.com/keys/certs%2Fa%20b?b=2&a=3&a=1&c=x+y",
+			message: "GET\n/keys/certs%2Fa%20b\na=1&a=3&b=2&c=x%20y\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n1700000000",
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.sign(req, []byte(test.body), now)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(test.message))
+		if want := hex.EncodeToString(mac.Sum(nil)); req.Header.Get(signatureHeader) != want {
+			t.Errorf("%s %s: signature %s, want the HMAC of %q", test.method, test.url, req.Header.Get(signatureHeader), test.message)
+		}
+		if req.Header.Get(timestampHeader) != "1700000000" {
+			t.Errorf("%s %s: timestamp %s", test.method, test.url, req.Header.Get(timestampHeader))
+		}
+	}
+}
+
+func TestHMACSignCoversQuery(t *testing.T) {
+	h := &HMACConfig{Secret: "secret"}
+	h.provision()
+	now := time.Unix(1700000000, 0)
+
+	signature := func(url string) string {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.sign(req, nil, now)
+		return req.Header.Get(signatureHeader)
+	}
+
+	signed := signature("https://api.example.com/keys?prefix=certs&recursive=false")
+	for _, tampered := range []string{
+		"https://api.example.com/keys?prefix=certs&recursive=true",
+		"https://api.example.com/keys?prefix=&recursive=false",
+		"https://api.example.com/keys?prefix=certs",
+		"https://api.example.com/keys",
+	} {
+		if signature(tampered) == signed {
+			t.Errorf("%s has the same signature as the original request", tampered)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// encodeJWT builds and signs a compact JWT using RS256, ES256 or EdDSA.
+func encodeJWT(alg, kid string, claims any, key crypto.Signer) (string, error) {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", errors.New("ES256 requires an ECDSA key")
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		// JWS uses the fixed-size r || s encoding rather than ASN.1.
+		signature = make([]byte, 64)
+		if err == nil {
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	case "EdDSA":
+		signature, err = key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	default:
+		return "", fmt.Errorf("unsupported JWT algorithm: %s", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwtExpiry returns the exp claim of a JWT without verifying its signature.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("malformed JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
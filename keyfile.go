@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How often a secret file is checked for changes.
+const keyFilePollInterval = 10 * time.Second
+
+// keyFile holds the contents of a secret file (e.g. a Kubernetes secret
+// mount or a Vault agent sink) and re-reads it whenever it changes on disk.
+type keyFile struct {
+	path string
+
+	mu      sync.RWMutex
+	value   string
+	modTime time.Time
+	size    int64
+}
+
+func newKeyFile(path string) (*keyFile, error) {
+	k := &keyFile{path: path}
+
+	if _, err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (k *keyFile) get() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.value
+}
+
+// reload reads the file if its modification time or size changed since the
+// last read. It reports whether a new value was loaded.
+func (k *keyFile) reload() (bool, error) {
+	info, err := os.Stat(k.path)
+
+	if err != nil {
+		return false, err
+	}
+
+	k.mu.RLock()
+	unchanged := info.ModTime().Equal(k.modTime) && info.Size() == k.size
+	k.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	contents, err := os.ReadFile(k.path)
+
+	if err != nil {
+		return false, err
+	}
+
+	value := strings.TrimSpace(string(contents))
+
+	if value == "" {
+		return false, errors.New("secret file " + k.path + " is empty")
+	}
+
+	k.mu.Lock()
+	k.value = value
+	k.modTime = info.ModTime()
+	k.size = info.Size()
+	k.mu.Unlock()
+
+	return true, nil
+}
+
+// watch polls the file until ctx is done. Read errors keep the last good value.
+func (k *keyFile) watch(ctx context.Context, logger *zap.Logger) {
+	ticker := time.NewTicker(keyFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := k.reload()
+
+			if err != nil {
+				logger.Error("Error reloading secret file; keeping previous value", zap.String("path", k.path), zap.Error(err))
+			} else if changed {
+				logger.Info("Secret file changed; reloaded", zap.String("path", k.path))
+			}
+		}
+	}
+}
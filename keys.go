@@ -0,0 +1,144 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+const (
+	KeyEncodingNone      = "none"
+	KeyEncodingBase64URL = "base64url"
+	KeyEncodingSHA256    = "sha256"
+	KeyEncodingPercent   = "percent"
+)
+
+var errListHashedKeys = errors.New("keys encoded with sha256 can't be listed")
+
+// backendKey returns the key as sent to the backend: in the namespace, and
+// encoded.
+func (r *RestStorage) backendKey(key string) string {
+	key = r.namespaced(key)
+
+	switch r.KeyEncoding {
+	case KeyEncodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString([]byte(key))
+	case KeyEncodingSHA256:
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	case KeyEncodingPercent:
+		return percentEncode(key)
+	default:
+		return key
+	}
+}
+
+// storageKey returns the key of a key returned by the backend, and false if
+// it can't be decoded or isn't in the namespace.
+func (r *RestStorage) storageKey(backendKey string) (string, bool) {
+	key := backendKey
+
+	switch r.KeyEncoding {
+	case KeyEncodingBase64URL:
+		decoded, err := base64.RawURLEncoding.DecodeString(backendKey)
+		if err != nil {
+			return "", false
+		}
+		key = string(decoded)
+	case KeyEncodingSHA256:
+		return "", false
+	case KeyEncodingPercent:
+		decoded, err := url.PathUnescape(backendKey)
+		if err != nil {
+			return "", false
+		}
+		key = decoded
+	}
+
+	return r.stripNamespace(key)
+}
+
+// storageKeys returns the keys of keys listed by the backend, dropping keys
+// outside of the namespace, e.g. "prod-eu/..." when listing "prod".
+func (r *RestStorage) storageKeys(backendKeys []string) []string {
+	if r.Namespace == "" && (r.KeyEncoding == "" || r.KeyEncoding == KeyEncodingNone) {
+		return backendKeys
+	}
+
+	keys := make([]string, 0, len(backendKeys))
+	for _, backendKey := range backendKeys {
+		if key, ok := r.storageKey(backendKey); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// listEncoded lists the keys below prefix when keys are encoded. Encoded
+// keys have no slashes, so the backend can't tell directories apart: all
+// keys are listed recursively from the root and the directories derived from
+// the decoded keys. The prefix isn't sent either: base64url prefixes aren't
+// prefixes of the encoded keys, and backends that store keys as paths can't
+// list a percent-encoded prefix, which they see as a single file name.
+func (r *RestStorage) listEncoded(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if r.KeyEncoding == KeyEncodingSHA256 {
+		return nil, errListHashedKeys
+	}
+
+	prefix = strings.Trim(prefix, "/")
+
+	backendKeys, err := r.list(ctx, "", true, ListFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range r.storageKeys(backendKeys) {
+		below := key
+		if prefix != "" {
+			var ok bool
+			if below, ok = strings.CutPrefix(key, prefix+"/"); !ok {
+				continue
+			}
+		}
+
+		if !recursive {
+			if i := strings.Index(below, "/"); i >= 0 {
+				key = key[:len(key)-len(below)+i]
+			}
+		}
+
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 && prefix != "" {
+		return nil, fs.ErrNotExist
+	}
+
+	return keys, nil
+}
+
+// percentEncode escapes every byte of key except the unreserved characters
+// of RFC 3986, including slashes.
+func percentEncode(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,76 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"testing"
+)
+
+func TestListKeyEncodings(t *testing.T) {
+	keys := []string{
+		"certificates/acme/*.example.com/*.example.com.crt",
+		"certificates/acme/*.example.com/*.example.com.key",
+		"certificates/acme/b.example.com/b.example.com.crt",
+		"ocsp/b.example.com-abc",
+		"last_clean.json",
+	}
+
+	tests := []struct {
+		prefix    string
+		recursive bool
+		want      []string
+	}{
+		{"", false, []string{"certificates", "last_clean.json", "ocsp"}},
+		{"", true, keys},
+		{"certificates/acme", false, []string{"certificates/acme/*.example.com", "certificates/acme/b.example.com"}},
+		{"certificates/acme", true, keys[:3]},
+		{"certificates/acme/*.example.com", false, keys[:2]},
+		{"ocsp", true, keys[3:4]},
+	}
+
+	for _, encoding := range []string{KeyEncodingNone, KeyEncodingBase64URL, KeyEncodingPercent} {
+		server := newTestServer(t)
+		r := server.storage(t, &RestStorage{KeyEncoding: encoding, Namespace: "staging"})
+		ctx := context.Background()
+
+		for _, key := range keys {
+			if err := r.Store(ctx, key, []byte(key)); err != nil {
+				t.Fatalf("%s: Store: %v", encoding, err)
+			}
+		}
+		// Keys outside of the namespace aren't listed.
+		other := server.storage(t, &RestStorage{KeyEncoding: encoding, Namespace: "staging-eu"})
+		if err := other.Store(ctx, "certificates/acme/c.example.com/c.example.com.crt", nil); err != nil {
+			t.Fatalf("%s: Store: %v", encoding, err)
+		}
+
+		for _, test := range tests {
+			got, err := r.List(ctx, test.prefix, test.recursive)
+			if err != nil {
+				t.Errorf("%s: List(%q, %t): %v", encoding, test.prefix, test.recursive, err)
+				continue
+			}
+			slices.Sort(got)
+			want := slices.Clone(test.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: List(%q, %t) = %q, want %q", encoding, test.prefix, test.recursive, got, want)
+			}
+		}
+
+		if _, err := r.List(ctx, "missing", true); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: List of a missing prefix returned %v", encoding, err)
+		}
+	}
+}
+
+func TestListHashedKeys(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, &RestStorage{KeyEncoding: KeyEncodingSHA256})
+
+	if _, err := r.List(context.Background(), "", true); !errors.Is(err, errListHashedKeys) {
+		t.Errorf("List with sha256 keys returned %v", err)
+	}
+}
@@ -0,0 +1,423 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// KMSConfig wraps the data key that encrypts values with a master key held
+// by a key management service, so the master key never appears in the
+// Caddy config and its use is audited centrally. Exactly one provider must
+// be configured.
+type KMSConfig struct {
+	AWS   *AWSKMSConfig       `json:"aws,omitempty"`
+	GCP   *GCPKMSConfig       `json:"gcp,omitempty"`
+	Vault *VaultTransitConfig `json:"vault,omitempty"`
+}
+
+// keyWrapper encrypts and decrypts data keys with a master key.
+type keyWrapper interface {
+	wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+func (k *KMSConfig) validate() error {
+	providers := 0
+	for _, configured := range []bool{k.AWS != nil, k.GCP != nil, k.Vault != nil} {
+		if configured {
+			providers++
+		}
+	}
+	if providers != 1 {
+		return errors.New("kms: exactly one of aws, gcp and vault must be configured")
+	}
+
+	switch {
+	case k.AWS != nil:
+		return k.AWS.validate()
+	case k.GCP != nil:
+		return k.GCP.validate()
+	default:
+		return k.Vault.validate()
+	}
+}
+
+func (k *KMSConfig) wrapper(ctx context.Context) (keyWrapper, error) {
+	switch {
+	case k.AWS != nil:
+		k.AWS.provision()
+		return k.AWS, nil
+	case k.GCP != nil:
+		return k.GCP.provision(ctx)
+	default:
+		return k.Vault.provision(), nil
+	}
+}
+
+// kmsResponse reads the body of a successful response from a KMS API.
+func kmsResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unknown status code received: %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// AWSKMSConfig wraps data keys with an AWS KMS key. Credentials are
+// resolved as for aws_sigv4.
+type AWSKMSConfig struct {
+	// The key ID, key ARN or alias (alias/...).
+	KeyID string `json:"key_id"`
+	// Defaults to https://kms.<region>.amazonaws.com, e.g. for VPC
+	// endpoints.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	AWSSigV4Config
+
+	httpClient *http.Client
+}
+
+func (a *AWSKMSConfig) validate() error {
+	if a.KeyID == "" {
+		return errors.New("kms: aws key_id must be specified")
+	}
+	return a.AWSSigV4Config.validate()
+}
+
+func (a *AWSKMSConfig) provision() {
+	a.Service = "kms"
+	a.AWSSigV4Config.provision()
+	if a.Endpoint == "" {
+		a.Endpoint = "https://kms." + a.Region + ".amazonaws.com"
+	}
+	a.httpClient = &http.Client{Timeout: 10 * time.Second}
+}
+
+func (a *AWSKMSConfig) wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	err := a.call(ctx, "TrentService.Encrypt", map[string]any{
+		"KeyId":     a.KeyID,
+		"Plaintext": dataKey,
+	}, &out)
+	return out.CiphertextBlob, err
+}
+
+func (a *AWSKMSConfig) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	err := a.call(ctx, "TrentService.Decrypt", map[string]any{
+		"KeyId":          a.KeyID,
+		"CiphertextBlob": wrapped,
+	}, &out)
+	return out.Plaintext, err
+}
+
+// call invokes a KMS action. Blobs are base64-encoded in the JSON bodies,
+// as encoding/json does for []byte.
+func (a *AWSKMSConfig) call(ctx context.Context, target string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+
+	if err := a.sign(req, body, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if err := kmsResponse(resp, out); err != nil {
+		return fmt.Errorf("aws kms %s: %v", target, err)
+	}
+	return nil
+}
+
+const (
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpKMSScope         = "https://www.googleapis.com/auth/cloudkms"
+)
+
+// GCPKMSConfig wraps data keys with a Google Cloud KMS key. Access tokens
+// are fetched from the metadata server, or minted from a service account
+// key when CredentialsFile is set.
+type GCPKMSConfig struct {
+	// projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+	KeyName         string `json:"key_name"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	// Defaults to https://cloudkms.googleapis.com.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	tokenSource oauth2.TokenSource
+	httpClient  *http.Client
+}
+
+func (g *GCPKMSConfig) validate() error {
+	if g.KeyName == "" {
+		return errors.New("kms: gcp key_name must be specified")
+	}
+	return nil
+}
+
+func (g *GCPKMSConfig) provision(ctx context.Context) (*GCPKMSConfig, error) {
+	g.KeyName = strings.Trim(g.KeyName, "/")
+	if g.Endpoint == "" {
+		g.Endpoint = "https://cloudkms.googleapis.com"
+	}
+	g.httpClient = &http.Client{Timeout: 10 * time.Second}
+
+	src := &gcpAccessTokenSource{ctx: ctx, httpClient: g.httpClient}
+	if g.CredentialsFile != "" {
+		key, err := loadGCPServiceAccountKey(g.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("kms: %v", err)
+		}
+		src.key = key
+	}
+	g.tokenSource = oauth2.ReuseTokenSource(nil, src)
+
+	return g, nil
+}
+
+func (g *GCPKMSConfig) wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var out struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	err := g.call(ctx, "encrypt", map[string]any{"plaintext": dataKey}, &out)
+	return out.Ciphertext, err
+}
+
+func (g *GCPKMSConfig) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	err := g.call(ctx, "decrypt", map[string]any{"ciphertext": wrapped}, &out)
+	return out.Plaintext, err
+}
+
+func (g *GCPKMSConfig) call(ctx context.Context, method string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	token, err := g.tokenSource.Token()
+	if err != nil {
+		return fmt.Errorf("gcp kms: obtaining access token: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", g.Endpoint+"/v1/"+g.KeyName+":"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token.SetAuthHeader(req)
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if err := kmsResponse(resp, out); err != nil {
+		return fmt.Errorf("gcp kms %s: %v", method, err)
+	}
+	return nil
+}
+
+// gcpAccessTokenSource provides OAuth2 access tokens for Cloud KMS.
+type gcpAccessTokenSource struct {
+	ctx        context.Context
+	key        *gcpServiceAccountKey
+	httpClient *http.Client
+}
+
+func (s *gcpAccessTokenSource) Token() (*oauth2.Token, error) {
+	var req *http.Request
+	var err error
+	if s.key != nil {
+		req, err = s.serviceAccountRequest()
+	} else {
+		req, err = http.NewRequestWithContext(s.ctx, "GET", gcpMetadataTokenURL, nil)
+		if req != nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := kmsResponse(resp, &tokenResp); err != nil {
+		return nil, fmt.Errorf("fetching access token: %v", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return nil, errors.New("token response contains no access_token")
+	}
+
+	return &oauth2.Token{
+		AccessToken: tokenResp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (s *gcpAccessTokenSource) serviceAccountRequest() (*http.Request, error) {
+	now := time.Now()
+	assertion, err := encodeJWT("RS256", s.key.PrivateKeyID, map[string]any{
+		"iss":   s.key.ClientEmail,
+		"scope": gcpKMSScope,
+		"aud":   s.key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, s.key.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(s.ctx, "POST", s.key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return req, nil
+}
+
+// VaultTransitConfig wraps data keys with a key of Vault's transit secrets
+// engine. It authenticates like the vault api key source; secret_path and
+// field are not used.
+type VaultTransitConfig struct {
+	VaultConfig
+
+	// The mount path of the transit engine. Defaults to transit.
+	Mount string `json:"mount,omitempty"`
+	// The name of the transit key.
+	KeyName string `json:"key_name"`
+
+	client *vaultSecret
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func (v *VaultTransitConfig) validate() error {
+	if v.Address == "" {
+		return errors.New("kms: vault address must be specified")
+	}
+	if v.KeyName == "" {
+		return errors.New("kms: vault key_name must be specified")
+	}
+	return v.validateAuth()
+}
+
+func (v *VaultTransitConfig) provision() *VaultTransitConfig {
+	if v.Mount == "" {
+		v.Mount = "transit"
+	}
+	v.Mount = strings.Trim(v.Mount, "/")
+	v.client = &vaultSecret{cfg: v.VaultConfig.normalized(), httpClient: &http.Client{Timeout: 10 * time.Second}}
+	return v
+}
+
+func (v *VaultTransitConfig) wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var resp vaultResponse
+	err := v.call(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, ok := resp.Data["ciphertext"].(string)
+	if !ok {
+		return nil, errors.New("vault transit: response contains no ciphertext")
+	}
+	return []byte(ciphertext), nil
+}
+
+func (v *VaultTransitConfig) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp vaultResponse
+	err := v.call(ctx, "decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := resp.Data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("vault transit: response contains no plaintext")
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+func (v *VaultTransitConfig) call(ctx context.Context, operation string, body any, out *vaultResponse) error {
+	token, err := v.vaultToken(ctx)
+	if err != nil {
+		return fmt.Errorf("vault login: %v", err)
+	}
+
+	if err := v.client.call(ctx, "POST", v.Mount+"/"+operation+"/"+v.KeyName, token, body, out); err != nil {
+		return fmt.Errorf("vault transit %s: %v", operation, err)
+	}
+	return nil
+}
+
+// vaultToken returns the token of the last login or renewal, and logs in or
+// renews the token again when it is about to expire.
+func (v *VaultTransitConfig) vaultToken(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.token != "" && time.Until(v.tokenExpiry) > time.Minute {
+		return v.token, nil
+	}
+
+	token, lease, err := v.client.token(ctx)
+	if err != nil {
+		return "", err
+	}
+	if lease == 0 {
+		lease = vaultDefaultRefresh
+	}
+
+	v.token = token
+	v.tokenExpiry = time.Now().Add(lease)
+	return token, nil
+}
@@ -0,0 +1,296 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func kvCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kv <get|put|delete|list|stat|lock|unlock> [flags]",
+		Short: "Reads and changes single keys in the rest backend",
+		Long: `
+Commands to inspect and fix the keys in the rest backend by hand, through
+the rest storage module configured in the Caddy config (--config, the
+Caddyfile in the current directory by default), so namespaces, key encoding
+and encryption apply as they do for Caddy. Values are read and written as
+they are, not base64-encoded. The fallback storage is bypassed.`,
+	}
+	cmd.AddCommand(kvGetCommand())
+	cmd.AddCommand(kvPutCommand())
+	cmd.AddCommand(kvDeleteCommand())
+	cmd.AddCommand(kvListCommand())
+	cmd.AddCommand(kvStatCommand())
+	cmd.AddCommand(kvLockCommand())
+	cmd.AddCommand(kvUnlockCommand())
+	return cmd
+}
+
+func kvGetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "get <key> [--output <file>]",
+		Short: "Writes the value of a key to stdout or a file",
+		Args:  cobra.ExactArgs(1),
+		RunE:  caddycmd.WrapCommandFuncForCobra(cmdKVGet),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().StringP("output", "o", "-", "The file to write the value to, or - for stdout")
+	return cmd
+}
+
+func kvPutCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "put <key> [<value>] [--input <file>] [--create-only]",
+		Short: "Stores a value given as an argument, in a file or on stdin",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  caddycmd.WrapCommandFuncForCobra(cmdKVPut),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().StringP("input", "i", "-", "The file to read the value from, or - for stdin, unless the value is given")
+	cmd.Flags().Bool("create-only", false, "Fail if the key exists")
+	return cmd
+}
+
+func kvDeleteCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete <key>",
+		Short: "Deletes a key",
+		Args:  cobra.ExactArgs(1),
+		RunE:  caddycmd.WrapCommandFuncForCobra(cmdKVDelete),
+	}
+	addConfigFlags(cmd)
+	return cmd
+}
+
+func kvListCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list [<prefix>] [--recursive]",
+		Short: "Prints the keys below a prefix",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  caddycmd.WrapCommandFuncForCobra(cmdKVList),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().BoolP("recursive", "r", false, "Print all keys below the prefix, not only those directly below it")
+	return cmd
+}
+
+func kvStatCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stat <key>",
+		Short: "Prints the size and modification time of a key",
+		Args:  cobra.ExactArgs(1),
+		RunE:  caddycmd.WrapCommandFuncForCobra(cmdKVStat),
+	}
+	addConfigFlags(cmd)
+	return cmd
+}
+
+func kvLockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lock <key> [--wait]",
+		Short: "Acquires the lock on a key and keeps it after exiting",
+		Long: `
+Acquires the lock on a key, e.g. to keep Caddy from renewing a certificate
+while fixing it, and exits without releasing it; release it with
+kv unlock. The lock is held as the instance_id of the configured module.
+With lock_ttl, the lease isn't renewed, so the lock expires after lock_ttl.
+
+Fails if the lock is held elsewhere, unless --wait is given.`,
+		Args: cobra.ExactArgs(1),
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdKVLock),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().Bool("wait", false, "Wait until the lock is free")
+	return cmd
+}
+
+func kvUnlockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "unlock <key> [--force]",
+		Short: "Releases the lock on a key",
+		Long: `
+Releases the lock on a key acquired with kv lock, or, with --force,
+whoever holds it, e.g. an instance that crashed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdKVUnlock),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().Bool("force", false, "Release the lock even if another instance holds it")
+	return cmd
+}
+
+// kvStorage provisions the configured module for a kv command.
+func kvStorage(fl caddycmd.Flags) (*RestStorage, context.Context, context.CancelFunc, error) {
+	r, cancel, err := storageFromConfig(fl)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return r, withoutFallback(context.Background()), cancel, nil
+}
+
+func cmdKVGet(fl caddycmd.Flags) (int, error) {
+	r, ctx, cancel, err := kvStorage(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	value, err := r.Load(ctx, fl.Arg(0))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if output := fl.String("output"); output != "-" {
+		if err := os.WriteFile(output, value, 0o600); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+	if _, err := os.Stdout.Write(value); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdKVPut(fl caddycmd.Flags) (int, error) {
+	var value []byte
+	if fl.NArg() == 2 {
+		value = []byte(fl.Arg(1))
+	} else {
+		var err error
+		if input := fl.String("input"); input != "-" {
+			value, err = os.ReadFile(input)
+		} else {
+			value, err = io.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	r, ctx, cancel, err := kvStorage(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	if fl.Bool("create-only") {
+		err = r.Create(ctx, fl.Arg(0), value)
+	} else {
+		err = r.Store(ctx, fl.Arg(0), value)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdKVDelete(fl caddycmd.Flags) (int, error) {
+	r, ctx, cancel, err := kvStorage(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	if err := r.Delete(ctx, fl.Arg(0)); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdKVList(fl caddycmd.Flags) (int, error) {
+	r, ctx, cancel, err := kvStorage(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	keys, err := r.List(ctx, fl.Arg(0), fl.Bool("recursive"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdKVStat(fl caddycmd.Flags) (int, error) {
+	r, ctx, cancel, err := kvStorage(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	info, err := r.Stat(ctx, fl.Arg(0))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Printf("Key:       %s\n", info.Key)
+	fmt.Printf("Size:      %d\n", info.Size)
+	fmt.Printf("Modified:  %s\n", info.Modified.Format(time.RFC3339))
+	fmt.Printf("Terminal:  %t\n", info.IsTerminal)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdKVLock(fl caddycmd.Flags) (int, error) {
+	r, ctx, cancel, err := kvStorage(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	if r.DryRun {
+		return caddy.ExitCodeFailedStartup, errors.New("the configured storage is in dry run mode, so locks are only held locally")
+	}
+	if !fl.Bool("wait") {
+		r.LockMode = LockModeFailFast
+		r.LockAttempts = 1
+	}
+
+	key := fl.Arg(0)
+	if err := r.Lock(ctx, key); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	// Keep the lock when the module is cleaned up, which releases the
+	// locks it holds.
+	lock := r.locks.remove(r.backendKey(key))
+	r.localLocks.unlock(r.backendKey(key))
+
+	fmt.Printf("Locked %s as %s\n", key, r.InstanceID)
+	if lock != nil && lock.fencingToken != 0 {
+		fmt.Printf("Fencing token: %d\n", lock.fencingToken)
+	}
+	if r.LockTTL > 0 {
+		fmt.Printf("The lock expires in %v\n", time.Duration(r.LockTTL))
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdKVUnlock(fl caddycmd.Flags) (int, error) {
+	r, ctx, cancel, err := kvStorage(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	key := fl.Arg(0)
+	if fl.Bool("force") {
+		err = r.forceUnlock(ctx, r.backendKey(key))
+	} else {
+		err = r.Unlock(ctx, key)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
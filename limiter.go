@@ -0,0 +1,61 @@
+package rest
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// requestLimiter bounds the number of requests to the backend in flight,
+// so that a burst of handshakes or renewals queues instead of opening
+// hundreds of connections. A nil *requestLimiter doesn't limit.
+type requestLimiter struct {
+	slots chan struct{}
+}
+
+func newRequestLimiter(maxConcurrent int) *requestLimiter {
+	return &requestLimiter{slots: make(chan struct{}, maxConcurrent)}
+}
+
+// unlimitedKey marks the context of requests that don't take a slot, such
+// as watch requests, which are held open by the backend.
+type unlimitedKey struct{}
+
+func withoutLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unlimitedKey{}, true)
+}
+
+// acquire waits for a free slot until ctx is done, and returns the function
+// that frees it again.
+func (l *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil || ctx.Value(unlimitedKey{}) != nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		restMetrics.requestsQueued.Inc()
+		defer restMetrics.requestsQueued.Dec()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case l.slots <- struct{}{}:
+		}
+	}
+
+	return sync.OnceFunc(func() { <-l.slots }), nil
+}
+
+// releasingBody frees the slot of a request once its response body is
+// closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
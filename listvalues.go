@@ -0,0 +1,173 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+type ListValuesRequest struct {
+	Prefix string `json:"prefix" protobuf:"1"`
+	// The next_cursor of the previous page, if any.
+	Cursor string `json:"cursor,omitempty" protobuf:"2"`
+	// The maximum number of values per page; zero leaves it to the backend.
+	Limit int64 `json:"limit,omitempty" protobuf:"3"`
+}
+
+type ListValuesResponse struct {
+	// The keys below the prefix that have values, with their values.
+	Values []BatchResult `json:"values" protobuf:"1"`
+	// Set if there are more values, to be requested with this cursor.
+	NextCursor string `json:"next_cursor,omitempty" protobuf:"2"`
+}
+
+// LoadPrefix calls fn with each key below prefix and its value. If the
+// backend reports the list_values capability, all values are loaded with
+// one (possibly streamed or paginated) request; otherwise, the keys are
+// listed and loaded one by one. An error returned by fn stops the walk.
+func (r *RestStorage) LoadPrefix(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	prefix = strings.Trim(prefix, "/")
+
+	if !r.canListValues() {
+		keys, err := r.List(ctx, prefix, true)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			value, err := r.Load(ctx, key)
+			// Directories are listed too, but have no value.
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("loading %v: %w", key, err)
+			}
+			if err := fn(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	backendPrefix := r.backendKey(prefix)
+
+	var cursor string
+	for {
+		next, err := r.listValuesPage(ctx, backendPrefix, cursor, func(result BatchResult) error {
+			key, ok := r.storageKey(result.Key)
+			if !ok || (prefix != "" && !underPrefix(key, prefix)) {
+				return nil
+			}
+			if result.failed() {
+				return fmt.Errorf("loading %v: %w", key, result.statusError())
+			}
+
+			if r.Checksums {
+				if err := compareChecksum(result.Key, result.Checksum, result.Value); err != nil {
+					return err
+				}
+			}
+			r.setETag(result.Key, versionETag(result.Version), result.Value)
+			r.diskCache.put(result.Key, result.Value, r.logger)
+
+			value, err := r.openValue(ctx, result.Key, result.Value, r.keyTTL(key))
+			if err != nil {
+				return err
+			}
+			r.values.add(result.Key, bytes.Clone(value))
+			return fn(key, value)
+		})
+		if err != nil {
+			return err
+		}
+
+		if next == "" {
+			return nil
+		}
+		if next == cursor {
+			return fmt.Errorf("listing values of %v: backend returned cursor %q again", prefix, next)
+		}
+		cursor = next
+	}
+}
+
+// canListValues reports whether the values below a prefix can be loaded
+// with list_values requests. Encoded keys have no hierarchy the backend
+// could list by.
+func (r *RestStorage) canListValues() bool {
+	return r.capabilities[CapabilityListValues] &&
+		(r.KeyEncoding == "" || r.KeyEncoding == KeyEncodingNone) &&
+		r.Dialect != DialectWebDAV && r.Dialect != DialectS3
+}
+
+// listValuesPage calls fn with each value of the page at cursor, and
+// returns the cursor of the next page if there is one.
+func (r *RestStorage) listValuesPage(ctx context.Context, prefix, cursor string, fn func(BatchResult) error) (string, error) {
+	header := http.Header{}
+	header.Set("Accept", r.listAccept())
+
+	// The response stays open while values are handled, which may store
+	// them again (to re-encrypt them), so it mustn't take up one of the
+	// max_concurrent_requests.
+	resp, err := r.call(withoutLimit(ctx), opListValues, prefix, header, ListValuesRequest{
+		Prefix: prefix,
+		Cursor: cursor,
+		Limit:  int64(r.ListPageSize),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if r.notFound(opListValues, resp) {
+		return "", fs.ErrNotExist
+	}
+
+	if !r.succeeded(opListValues, resp, 200) {
+		return "", r.statusError(resp)
+	}
+
+	// Streamed responses carry one value per line and are never
+	// paginated.
+	if isNDJSON(resp) {
+		dec := json.NewDecoder(resp.Body)
+		for i := 1; ; i++ {
+			var result BatchResult
+			err := dec.Decode(&result)
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", fmt.Errorf("decoding value %d of list_values response: %v", i, err)
+			}
+			if err := fn(result); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	var listResp ListValuesResponse
+
+	err = decode(resp, &listResp)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, result := range listResp.Values {
+		if err := fn(result); err != nil {
+			return "", err
+		}
+	}
+
+	return listResp.NextCursor, nil
+}
@@ -0,0 +1,626 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type LockRequest struct {
+	Key string `json:"key" protobuf:"1"`
+	// Lease duration in seconds; omitted when leases are disabled.
+	TTL int64 `json:"ttl,omitempty" protobuf:"2"`
+	// Identifies the requesting Caddy instance.
+	Holder string `json:"holder" protobuf:"3"`
+	// When the request was made, in RFC 3339 format.
+	Timestamp string `json:"timestamp" protobuf:"4"`
+}
+
+type LockResponse struct {
+	// Increases every time the lock is granted.
+	FencingToken uint64 `json:"fencing_token,omitempty" protobuf:"1"`
+}
+
+const (
+	// Lock polls until the lock is acquired. This is the default.
+	LockModeWait = "wait"
+	// Lock gives up after lock_attempts attempts and returns a *LockedError.
+	LockModeFailFast = "fail_fast"
+)
+
+// LockedError is returned by Lock in fail-fast mode when the key is locked
+// by someone else.
+type LockedError struct {
+	Key string
+	// Empty if the backend doesn't report lock holders.
+	Holder string
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder != "" {
+		return fmt.Sprintf("key %v is already locked by %v", e.Key, e.Holder)
+	}
+	return fmt.Sprintf("key %v is already locked", e.Key)
+}
+
+// errLockTimeout is the cancellation cause when lock_timeout elapses.
+var errLockTimeout = errors.New("timed out waiting for lock")
+
+func (r *RestStorage) Lock(ctx context.Context, key string) (err error) {
+	if err := r.checkWritable(opLock, key); err != nil {
+		return err
+	}
+
+	key = r.backendKey(key)
+	start := time.Now()
+	attempts := 0
+	defer func() {
+		r.recordLockWait(key, start, attempts, err)
+		r.audit(opLock, key, err)
+	}()
+
+	if r.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, time.Duration(r.LockTimeout), errLockTimeout)
+		defer cancel()
+	}
+
+	// Goroutines of this process wait for each other locally instead of
+	// all polling the backend.
+	if err := r.localLocks.lock(ctx, key, r.LockMode == LockModeFailFast); err != nil {
+		if err == errLocalLockBusy {
+			return &LockedError{Key: key, Holder: r.InstanceID}
+		}
+		return r.lockCanceled(ctx, key)
+	}
+	defer func() {
+		if err != nil {
+			r.localLocks.unlock(key)
+		}
+	}()
+
+	// Locking in the backend would leave locks behind, since Unlock isn't
+	// sent either.
+	if r.DryRun {
+		r.logDryRun(opLock, key)
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		attempts = attempt
+		var resp *http.Response
+		switch r.Dialect {
+		case DialectWebDAV:
+			resp, err = r.webdavLock(ctx, key, "")
+		case DialectS3:
+			resp, err = r.s3Lock(ctx, key)
+		default:
+			resp, err = r.call(ctx, opLock, key, nil, LockRequest{
+				Key:       key,
+				TTL:       int64(time.Duration(r.LockTTL) / time.Second),
+				Holder:    r.InstanceID,
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The key was successfully locked
+		if r.succeeded(opLock, resp, 201) {
+			// The body is optional; backends without fencing send none.
+			var lockResp LockResponse
+			decode(resp, &lockResp)
+			resp.Body.Close()
+
+			lock := &heldLock{
+				fencingToken: lockResp.FencingToken,
+				lockToken:    resp.Header.Get("Lock-Token"),
+			}
+			if r.LockTTL > 0 {
+				lock.cancel = r.startLease(key)
+			}
+			r.locks.add(key, lock)
+			return nil
+		}
+
+		if r.locked(resp) {
+			// 423: The key is already locked
+			var lockedResp LockedResponse
+			decode(resp, &lockedResp)
+			resp.Body.Close()
+			restMetrics.lockContended.Inc()
+			r.emitKey(EventLockContended, key, "holder", lockedResp.Holder, "attempt", attempt)
+
+			r.logger.Info("Key is already locked",
+				zap.String("operation", opLock),
+				zap.String("key", key),
+				zap.String("holder", lockedResp.Holder),
+				zap.Int("attempt", attempt),
+				zap.Duration("duration", time.Since(start)))
+
+			if r.breakStaleLock(ctx, key, lockedResp) {
+				continue
+			}
+
+			if r.LockMode == LockModeFailFast && attempt >= r.lockAttempts() {
+				return &LockedError{Key: key, Holder: lockedResp.Holder}
+			}
+		} else if resp.StatusCode == 412 {
+			// 412: An error occurred
+			statusErr := r.statusError(resp)
+			resp.Body.Close()
+
+			if r.LockMode == LockModeFailFast && attempt >= r.lockAttempts() {
+				return fmt.Errorf("error locking key %v: %w", key, statusErr)
+			}
+
+			r.logger.Error("Error locking key; will try again",
+				zap.String("operation", opLock),
+				zap.String("key", key),
+				zap.String("endpoint", r.Endpoint),
+				zap.Int("status", resp.StatusCode),
+				zap.Int("attempt", attempt),
+				zap.Duration("duration", time.Since(start)),
+				zap.Error(statusErr))
+		} else {
+			// unknown error. return it
+			defer resp.Body.Close()
+			return r.statusError(resp)
+		}
+
+		// Wait before trying again
+		select {
+		case <-ctx.Done():
+			return r.lockCanceled(ctx, key)
+		case <-time.After(r.lockBackoff(attempt)):
+		}
+	}
+}
+
+func (r *RestStorage) lockCanceled(ctx context.Context, key string) error {
+	if context.Cause(ctx) == errLockTimeout {
+		return fmt.Errorf("locking key %v: %w after %v", key, errLockTimeout, time.Duration(r.LockTimeout))
+	}
+	return ctx.Err()
+}
+
+// recordLockWait logs and records metrics about a finished Lock call.
+func (r *RestStorage) recordLockWait(key string, start time.Time, attempts int, err error) {
+	wait := time.Since(start)
+
+	outcome := "acquired"
+	var lockedErr *LockedError
+	switch {
+	case err == nil:
+	case errors.As(err, &lockedErr):
+		outcome = "locked"
+	case errors.Is(err, errLockTimeout):
+		outcome = "timeout"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		outcome = "canceled"
+	default:
+		outcome = "error"
+	}
+
+	restMetrics.lockWaitDuration.WithLabelValues(outcome).Observe(wait.Seconds())
+	restMetrics.lockAttempts.Observe(float64(attempts))
+
+	fields := []zap.Field{
+		zap.String("key", key),
+		zap.String("outcome", outcome),
+		zap.Duration("wait", wait),
+		zap.Int("attempts", attempts),
+	}
+	if attempts > 1 || err != nil {
+		r.logger.Info("Lock wait finished", fields...)
+	} else {
+		r.logger.Debug("Lock acquired", fields...)
+	}
+}
+
+func (r *RestStorage) lockAttempts() int {
+	if r.LockAttempts > 0 {
+		return r.LockAttempts
+	}
+	return 1
+}
+
+// lockBackoff returns how long to wait after the given failed attempt: the
+// poll interval doubled for every attempt up to the maximum, with equal
+// jitter so that contending instances don't retry in lockstep.
+func (r *RestStorage) lockBackoff(attempt int) time.Duration {
+	floor := 5 * time.Second
+	if r.LockPollInterval > 0 {
+		floor = time.Duration(r.LockPollInterval)
+	}
+
+	ceiling := time.Minute
+	if r.LockPollMaxInterval > 0 {
+		ceiling = time.Duration(r.LockPollMaxInterval)
+	}
+	if ceiling < floor {
+		ceiling = floor
+	}
+
+	backoff := floor
+	for i := 1; i < attempt && backoff < ceiling; i++ {
+		backoff *= 2
+	}
+	if backoff > ceiling {
+		backoff = ceiling
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// LockedResponse is the optional body of a 423 response to a lock request.
+type LockedResponse struct {
+	Holder string `json:"holder,omitempty" protobuf:"1"`
+	// RFC 3339, or any other format Stat accepts
+	AcquiredAt Timestamp `json:"acquired_at,omitempty" protobuf:"2"`
+}
+
+// breakStaleLock force-unlocks key if the lock described by info is older
+// than the stale lock threshold. It reports whether the lock was released.
+func (r *RestStorage) breakStaleLock(ctx context.Context, key string, info LockedResponse) bool {
+	if r.StaleLockThreshold <= 0 || info.AcquiredAt == "" {
+		return false
+	}
+
+	acquiredAt, err := r.parseTimestamp(string(info.AcquiredAt))
+	if err != nil {
+		r.logger.Warn("Unable to parse lock acquisition time", zap.String("key", key), zap.String("acquired_at", string(info.AcquiredAt)), zap.Error(err))
+		return false
+	}
+
+	age := time.Since(acquiredAt)
+	if age < time.Duration(r.StaleLockThreshold) {
+		return false
+	}
+
+	r.logger.Warn("Force-unlocking stale lock",
+		zap.String("key", key),
+		zap.String("holder", info.Holder),
+		zap.Time("acquired_at", acquiredAt),
+		zap.Duration("age", age))
+
+	if err := r.forceUnlock(ctx, key); err != nil {
+		r.logger.Error("Error force-unlocking stale lock", zap.String("key", key), zap.Error(err))
+		return false
+	}
+
+	return true
+}
+
+// forceUnlock releases the lock on key as named in the backend, whoever
+// holds it.
+func (r *RestStorage) forceUnlock(ctx context.Context, key string) (err error) {
+	if err := r.checkWritable("force_unlock", key); err != nil {
+		return err
+	}
+	if r.DryRun {
+		r.logDryRun("force_unlock", key)
+		return nil
+	}
+
+	defer func() { r.audit("force_unlock", key, err) }()
+
+	if r.Dialect == DialectS3 {
+		return r.s3Unlock(ctx, key)
+	}
+
+	resp, err := r.call(ctx, opUnlock, key, nil, UnlockRequest{
+		Key:       key,
+		Force:     true,
+		Holder:    r.InstanceID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opUnlock, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	return nil
+}
+
+type UnlockRequest struct {
+	Key string `json:"key" protobuf:"1"`
+	// Release the lock even if another instance holds it.
+	Force     bool   `json:"force,omitempty" protobuf:"2"`
+	Holder    string `json:"holder" protobuf:"3"`
+	Timestamp string `json:"timestamp" protobuf:"4"`
+}
+
+func (r *RestStorage) Unlock(ctx context.Context, key string) error {
+	if err := r.checkWritable(opUnlock, key); err != nil {
+		return err
+	}
+
+	return r.unlock(ctx, r.backendKey(key))
+}
+
+// unlock releases the lock on key as named in the backend.
+func (r *RestStorage) unlock(ctx context.Context, key string) (err error) {
+	defer func() { r.audit(opUnlock, key, err) }()
+
+	lock := r.locks.remove(key)
+	defer r.localLocks.unlock(key)
+
+	if r.DryRun {
+		r.logDryRun(opUnlock, key)
+		return nil
+	}
+
+	if r.Dialect == DialectS3 {
+		return r.s3Unlock(ctx, key)
+	}
+
+	if r.Dialect == DialectWebDAV {
+		var token string
+		if lock != nil {
+			token = lock.lockToken
+		}
+		return r.webdavUnlock(ctx, key, token)
+	}
+
+	resp, err := r.call(ctx, opUnlock, key, nil, UnlockRequest{
+		Key:       key,
+		Holder:    r.InstanceID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opUnlock, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	return nil
+}
+
+type RenewRequest struct {
+	Key    string `json:"key" protobuf:"1"`
+	TTL    int64  `json:"ttl" protobuf:"2"`
+	Holder string `json:"holder" protobuf:"3"`
+}
+
+// heldLocks tracks the locks this instance currently holds.
+type heldLocks struct {
+	mu    sync.Mutex
+	locks map[string]*heldLock
+}
+
+type heldLock struct {
+	// stops the lease renewal, if any
+	cancel context.CancelFunc
+	// zero if the backend doesn't issue fencing tokens
+	fencingToken uint64
+	// the WebDAV lock token, including the angle brackets
+	lockToken string
+}
+
+func newHeldLocks() *heldLocks {
+	return &heldLocks{locks: make(map[string]*heldLock)}
+}
+
+func (h *heldLocks) add(key string, lock *heldLock) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if previous, ok := h.locks[key]; ok && previous.cancel != nil {
+		previous.cancel()
+	}
+	h.locks[key] = lock
+}
+
+// remove stops tracking the lock on key and returns it, or nil if it isn't
+// held.
+func (h *heldLocks) remove(key string) *heldLock {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lock, ok := h.locks[key]
+	if !ok {
+		return nil
+	}
+	if lock.cancel != nil {
+		lock.cancel()
+	}
+	delete(h.locks, key)
+	return lock
+}
+
+// lockToken returns the WebDAV lock token of the lock on key, if held.
+func (h *heldLocks) lockToken(key string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if lock, ok := h.locks[key]; ok {
+		return lock.lockToken
+	}
+	return ""
+}
+
+func (h *heldLocks) keys() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.locks))
+	for key := range h.locks {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// fencingTokens returns the fencing tokens of all held locks, or nil if
+// there are none.
+func (h *heldLocks) fencingTokens() map[string]uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var tokens map[string]uint64
+	for key, lock := range h.locks {
+		if lock.fencingToken == 0 {
+			continue
+		}
+		if tokens == nil {
+			tokens = make(map[string]uint64)
+		}
+		tokens[key] = lock.fencingToken
+	}
+	return tokens
+}
+
+// startLease begins renewing the lease on key in the background every third
+// of the lock TTL, until the lock is released or the last module sharing
+// the client is unloaded.
+func (r *RestStorage) startLease(key string) context.CancelFunc {
+	ctx, cancel := context.WithCancel(r.leaseCtx)
+	go r.renewLease(ctx, key)
+	return cancel
+}
+
+func (r *RestStorage) renewLease(ctx context.Context, key string) {
+	ttl := time.Duration(r.LockTTL)
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var resp *http.Response
+		var err error
+		if r.Dialect == DialectWebDAV {
+			resp, err = r.webdavLock(ctx, key, r.locks.lockToken(key))
+		} else {
+			resp, err = r.call(ctx, opRenew, key, nil, RenewRequest{
+				Key:    key,
+				TTL:    int64(ttl / time.Second),
+				Holder: r.InstanceID,
+			})
+		}
+
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Error("Error renewing lock lease; will try again", zap.String("key", key), zap.Error(err))
+			}
+			continue
+		}
+
+		if r.succeeded(opRenew, resp, 200, 204) {
+			resp.Body.Close()
+			continue
+		}
+
+		statusErr := r.statusError(resp)
+		resp.Body.Close()
+
+		switch {
+		case r.notFound(opRenew, resp), resp.StatusCode == 409, resp.StatusCode == 410, resp.StatusCode == 412:
+			// The lease already expired and the lock may be held elsewhere.
+			// WebDAV servers respond with 412 to an expired lock token.
+			r.logger.Error("Lock lease lost; stopping renewal", zap.String("key", key), zap.Error(statusErr))
+			return
+		default:
+			r.logger.Error("Error renewing lock lease; will try again", zap.String("key", key), zap.Error(statusErr))
+		}
+	}
+}
+
+var errLocalLockBusy = errors.New("lock is held by another goroutine")
+
+// localLocks serializes the goroutines of this process that lock the same key.
+type localLocks struct {
+	mu    sync.Mutex
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	// holds a value while the lock is held
+	sem  chan struct{}
+	refs int
+}
+
+func newLocalLocks() *localLocks {
+	return &localLocks{locks: make(map[string]*localLock)}
+}
+
+// lock waits until key is free in this process or ctx is done. With
+// tryOnly, it returns errLocalLockBusy instead of waiting.
+func (l *localLocks) lock(ctx context.Context, key string, tryOnly bool) error {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &localLock{sem: make(chan struct{}, 1)}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	if tryOnly {
+		select {
+		case lock.sem <- struct{}{}:
+			return nil
+		default:
+			l.release(key, lock)
+			return errLocalLockBusy
+		}
+	}
+
+	select {
+	case lock.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.release(key, lock)
+		return ctx.Err()
+	}
+}
+
+// unlock frees key. It does nothing if key isn't locked.
+func (l *localLocks) unlock(key string) {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	l.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case <-lock.sem:
+		l.release(key, lock)
+	default:
+	}
+}
+
+func (l *localLocks) release(key string, lock *localLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, key)
+	}
+}
@@ -0,0 +1,169 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+)
+
+// LogRequestsConfig logs every request to the backend, to troubleshoot
+// protocol mismatches. Credentials are never logged.
+type LogRequestsConfig struct {
+	// Bodies also logs request and response bodies, truncated to
+	// MaxBodySize. Values, anything that looks like a certificate or
+	// private key, and the api keys are redacted, and bodies other than
+	// JSON, XML or text are only logged by size.
+	Bodies bool `json:"bodies,omitempty"`
+	// The number of bytes of each body logged. Defaults to 1024.
+	MaxBodySize int `json:"max_body_size,omitempty"`
+}
+
+func (c *LogRequestsConfig) provision() {
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = 1024
+	}
+}
+
+func (c *LogRequestsConfig) validate() error {
+	if c.MaxBodySize < 0 {
+		return errors.New("log_requests: max_body_size must not be negative")
+	}
+	return nil
+}
+
+var (
+	// JSON fields that carry values or secrets, with their (possibly
+	// truncated) string values.
+	secretFieldPattern = regexp.MustCompile(`"(value|data|api_key|apikey|secret|password|token|access_token|private_key)"(\s*:\s*)"(?:[^"\\]|\\.)*("|$)`)
+	pemPattern         = regexp.MustCompile(`(?s)-----BEGIN [^-]*-----.*?(-----END [^-]*-----|$)`)
+)
+
+// logRequest logs a request sent to the backend and its response. With
+// bodies, the response body is logged once it has been read and closed.
+func (r *RestStorage) logRequest(req *http.Request, requestBody []byte, resp *http.Response, err error, duration time.Duration) {
+	if r.LogRequests == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("method", req.Method),
+		zap.String("path", req.URL.Path),
+		zap.String("query", req.URL.RawQuery),
+		zap.Duration("duration", duration),
+	}
+	if r.LogRequests.Bodies {
+		fields = append(fields, zap.String("request_body", r.redactBody(req.Header.Get("Content-Type"), requestBody, len(requestBody))))
+	}
+
+	if err != nil {
+		r.logger.Info("Storage request failed", append(fields, zap.Error(err))...)
+		return
+	}
+
+	fields = append(fields, zap.Int("status", resp.StatusCode))
+	r.logger.Info("Storage request", fields...)
+
+	if r.LogRequests.Bodies {
+		resp.Body = &loggedBody{
+			ReadCloser: resp.Body,
+			storage:    r,
+			method:     req.Method,
+			path:       req.URL.Path,
+			mediaType:  resp.Header.Get("Content-Type"),
+			limit:      r.LogRequests.MaxBodySize,
+		}
+	}
+}
+
+// logGRPCRequest logs an invocation of the Storage method of op.
+func (r *RestStorage) logGRPCRequest(op string, requestBody, reply []byte, err error, duration time.Duration) {
+	if r.LogRequests == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("method", grpcMethods[op]),
+		zap.Duration("duration", duration),
+		zap.String("status", status.Code(err).String()),
+	}
+	if r.LogRequests.Bodies {
+		fields = append(fields,
+			zap.String("request_body", r.redactBody(protobufCodec{}.contentType(), requestBody, len(requestBody))),
+			zap.String("response_body", r.redactBody(protobufCodec{}.contentType(), reply, len(reply))))
+	}
+	r.logger.Info("Storage request", fields...)
+}
+
+// redactBody returns the loggable form of a body of size bytes, of which
+// body is the beginning.
+func (r *RestStorage) redactBody(contentType string, body []byte, size int) string {
+	if size == 0 {
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !strings.HasPrefix(mediaType, "text/") && !strings.Contains(mediaType, "json") && !strings.Contains(mediaType, "xml") {
+		return fmt.Sprintf("[%d bytes of %s]", size, mediaType)
+	}
+
+	limit := r.LogRequests.MaxBodySize
+	truncated := len(body) > limit || size > len(body)
+	if len(body) > limit {
+		body = body[:limit]
+	}
+
+	text := secretFieldPattern.ReplaceAllString(string(body), `"$1"$2"[redacted]"`)
+	text = pemPattern.ReplaceAllString(text, "[redacted PEM]")
+	for _, apiKey := range []string{r.apiKey(false), r.ApiKeySecondary} {
+		if apiKey != "" {
+			text = strings.ReplaceAll(text, apiKey, "[redacted]")
+		}
+	}
+
+	if truncated {
+		text += fmt.Sprintf("... (%d bytes)", size)
+	}
+	return text
+}
+
+// loggedBody keeps the beginning of a response body and logs it when the
+// body is closed.
+type loggedBody struct {
+	io.ReadCloser
+	storage      *RestStorage
+	method, path string
+	mediaType    string
+	limit        int
+
+	head []byte
+	size int
+	once sync.Once
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.limit + 1 - len(b.head); room > 0 {
+		b.head = append(b.head, p[:min(n, room)]...)
+	}
+	b.size += n
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	b.once.Do(func() {
+		b.storage.logger.Info("Storage response body",
+			zap.String("method", b.method),
+			zap.String("path", b.path),
+			zap.String("response_body", b.storage.redactBody(b.mediaType, b.head, b.size)))
+	})
+	return b.ReadCloser.Close()
+}
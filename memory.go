@@ -0,0 +1,212 @@
+package rest
+
+import (
+	"context"
+	"io/fs"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+// MemoryStorage is a storage module that keeps the keys in memory, e.g. to
+// serve them with rest_storage_server in tests. The keys are lost when the
+// last module with the name is cleaned up, but survive config reloads.
+type MemoryStorage struct {
+	// Modules with the same name share their keys and locks.
+	Name string `json:"name,omitempty"`
+
+	keys *memoryKeys
+}
+
+func (*MemoryStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.rest_memory",
+		New: func() caddy.Module { return new(MemoryStorage) },
+	}
+}
+
+// memoryStorages are the keys of the memory storages, by name.
+var memoryStorages = caddy.NewUsagePool()
+
+// memoryKeys are the keys of a memory storage.
+type memoryKeys struct {
+	mu     sync.RWMutex
+	values map[string]memoryValue
+	locks  *localLocks
+}
+
+type memoryValue struct {
+	value    []byte
+	modified time.Time
+}
+
+func (*memoryKeys) Destruct() error {
+	return nil
+}
+
+func (s *MemoryStorage) Provision(ctx caddy.Context) error {
+	expandPlaceholders(caddy.NewReplacer(), reflect.ValueOf(s).Elem())
+
+	keys, _, err := memoryStorages.LoadOrNew(s.Name, func() (caddy.Destructor, error) {
+		return &memoryKeys{
+			values: make(map[string]memoryValue),
+			locks:  newLocalLocks(),
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.keys = keys.(*memoryKeys)
+
+	return nil
+}
+
+func (s *MemoryStorage) Cleanup() error {
+	if s.keys == nil {
+		return nil
+	}
+	_, err := memoryStorages.Delete(s.Name)
+	return err
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens:
+//
+//	storage rest_memory [<name>]
+func (s *MemoryStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the module name
+	if d.NextArg() {
+		s.Name = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		if err := unmarshalField(d, reflect.ValueOf(s).Elem(), d.Val(), d.Val()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return s, nil
+}
+
+func (s *MemoryStorage) Store(_ context.Context, key string, value []byte) error {
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	s.keys.values[key] = memoryValue{value: append([]byte{}, value...), modified: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) Load(_ context.Context, key string) ([]byte, error) {
+	s.keys.mu.RLock()
+	defer s.keys.mu.RUnlock()
+
+	value, ok := s.keys.values[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return append([]byte{}, value.value...), nil
+}
+
+// Delete deletes key, and the keys below it if it is a directory.
+func (s *MemoryStorage) Delete(_ context.Context, key string) error {
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	deleted := false
+	for k := range s.keys.values {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(s.keys.values, k)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+// Stat returns the info of key, or of the directory key if keys are stored
+// below it. The modification time of a directory is that of the last key
+// modified below it.
+func (s *MemoryStorage) Stat(_ context.Context, key string) (certmagic.KeyInfo, error) {
+	s.keys.mu.RLock()
+	defer s.keys.mu.RUnlock()
+
+	if value, ok := s.keys.values[key]; ok {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   value.modified,
+			Size:       int64(len(value.value)),
+			IsTerminal: true,
+		}, nil
+	}
+
+	info := certmagic.KeyInfo{Key: key}
+	for k, value := range s.keys.values {
+		if strings.HasPrefix(k, key+"/") && value.modified.After(info.Modified) {
+			info.Modified = value.modified
+		}
+	}
+	if info.Modified.IsZero() {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	return info, nil
+}
+
+// List returns the keys and directories directly below prefix, or all keys
+// below it if recursive is set.
+func (s *MemoryStorage) List(_ context.Context, prefix string, recursive bool) ([]string, error) {
+	dir := prefix + "/"
+	if prefix == "" {
+		dir = ""
+	}
+
+	s.keys.mu.RLock()
+	var keys []string
+	for k := range s.keys.values {
+		if strings.HasPrefix(k, dir) {
+			keys = append(keys, k)
+		}
+	}
+	s.keys.mu.RUnlock()
+
+	if len(keys) == 0 && prefix != "" {
+		return nil, fs.ErrNotExist
+	}
+	return storageChildren(keys, dir, recursive), nil
+}
+
+// Lock acquires the lock on key, which is only shared within this process.
+func (s *MemoryStorage) Lock(ctx context.Context, key string) error {
+	return s.keys.locks.lock(ctx, key, false)
+}
+
+func (s *MemoryStorage) Unlock(_ context.Context, key string) error {
+	s.keys.locks.unlock(key)
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*MemoryStorage)(nil)
+	_ caddy.CleanerUpper     = (*MemoryStorage)(nil)
+	_ caddy.StorageConverter = (*MemoryStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*MemoryStorage)(nil)
+	_ certmagic.Storage      = (*MemoryStorage)(nil)
+)
@@ -0,0 +1,156 @@
+package rest
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// define and register the metrics used in this package.
+func init() {
+	const ns, sub = "caddy", "storage_rest"
+
+	restMetrics.lockWaitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent in Lock, by outcome.",
+		Buckets:   []float64{.05, .25, 1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"outcome"})
+	restMetrics.lockAttempts = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lock_attempts",
+		Help:      "Number of lock requests made per Lock call.",
+		Buckets:   []float64{1, 2, 3, 5, 10, 20, 50, 100},
+	})
+	restMetrics.lockContended = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lock_contended_total",
+		Help:      "Number of lock requests answered with 423 Locked.",
+	})
+	restMetrics.requestsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_queued",
+		Help:      "Number of requests waiting for one of max_concurrent_requests.",
+	})
+	restMetrics.requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_total",
+		Help:      "Number of requests to the backend, by operation and status code class.",
+	}, []string{"operation", "code"})
+	restMetrics.requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "request_duration_seconds",
+		Help:      "Time until the backend responded, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	restMetrics.requestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "request_size_bytes",
+		Help:      "Size of request bodies, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 9),
+	}, []string{"operation"})
+	restMetrics.responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_size_bytes",
+		Help:      "Size of response bodies, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 9),
+	}, []string{"operation"})
+	restMetrics.retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "retries_total",
+		Help:      "Number of requests repeated after a failure, by operation.",
+	}, []string{"operation"})
+	restMetrics.cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_lookups_total",
+		Help:      "Number of lookups in the local caches, by cache and result.",
+	}, []string{"cache", "result"})
+	restMetrics.health = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "health",
+		Help:      "1 for the current health state of each endpoint, 0 for the others.",
+	}, []string{"endpoint", "state"})
+	restMetrics.faultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "faults_injected_total",
+		Help:      "Number of faults injected into requests, by operation and fault.",
+	}, []string{"operation", "fault"})
+}
+
+// restMetrics is a collection of metrics that can be tracked for the storage module.
+var restMetrics = struct {
+	lockWaitDuration *prometheus.HistogramVec
+	lockAttempts     prometheus.Histogram
+	lockContended    prometheus.Counter
+	requestsQueued   prometheus.Gauge
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestSize      *prometheus.HistogramVec
+	responseSize     *prometheus.HistogramVec
+	retries          *prometheus.CounterVec
+	cacheLookups     *prometheus.CounterVec
+	health           *prometheus.GaugeVec
+	faultsInjected   *prometheus.CounterVec
+}{}
+
+// observeRequest records a request of op sent at start. The size of the
+// response is recorded once its body is closed.
+func observeRequest(op string, start time.Time, requestSize int, resp *http.Response, err error) {
+	restMetrics.requestDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	restMetrics.requestSize.WithLabelValues(op).Observe(float64(requestSize))
+
+	if err != nil {
+		restMetrics.requests.WithLabelValues(op, "error").Inc()
+		return
+	}
+
+	restMetrics.requests.WithLabelValues(op, strconv.Itoa(resp.StatusCode/100)+"xx").Inc()
+	resp.Body = &countingBody{ReadCloser: resp.Body, op: op}
+}
+
+// countingBody records the number of bytes read from a response body when
+// it is closed.
+type countingBody struct {
+	io.ReadCloser
+	op   string
+	n    int64
+	once sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() {
+		restMetrics.responseSize.WithLabelValues(b.op).Observe(float64(b.n))
+	})
+	return b.ReadCloser.Close()
+}
+
+func observeCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	restMetrics.cacheLookups.WithLabelValues(cache, result).Inc()
+}
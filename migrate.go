@@ -0,0 +1,166 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/certmagic"
+	"github.com/spf13/cobra"
+)
+
+func migrateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate [--config <path>] [--adapter <name>] [--from <storage-json>] [--concurrency <n>] [--verify]",
+		Short: "Copies all keys from another storage module into the rest backend",
+		Long: `
+Copies all keys from another storage module into the rest backend, e.g. to
+move an existing Caddy instance to the rest storage module without
+obtaining its certificates again.
+
+--from is the JSON config of the storage module to copy from, like
+'{"module": "file_system", "root": "/var/lib/caddy"}'. It defaults to
+Caddy's default storage, the file system in Caddy's data directory. Locks
+are not copied.
+
+With --verify, every key is loaded from the rest backend again after
+copying and compared with the source.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdMigrate),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().String("from", "", "JSON config of the storage module to copy from")
+	cmd.Flags().Int("concurrency", 8, "Number of keys to copy at a time")
+	cmd.Flags().Bool("verify", false, "Compare the copied keys with the source")
+	return cmd
+}
+
+func cmdMigrate(fl caddycmd.Flags) (int, error) {
+	concurrency := fl.Int("concurrency")
+	if concurrency < 1 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--concurrency must be at least 1")
+	}
+
+	r, cancel, err := storageFromConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	var from certmagic.Storage = caddy.DefaultStorage
+	if raw := fl.String("from"); raw != "" {
+		from, err = loadStorageModule(r.ctx, json.RawMessage(raw))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("--from: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+
+	keys, err := storedKeys(ctx, from, "")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("listing keys to migrate: %v", err)
+	}
+	fmt.Printf("Migrating %d keys to %s\n", len(keys), r.Endpoint)
+
+	failed := forEachKey(keys, concurrency, "Copied", func(key string) error {
+		value, err := from.Load(ctx, key)
+		if err != nil {
+			return fmt.Errorf("loading: %v", err)
+		}
+		return r.Store(ctx, key, value)
+	})
+
+	if fl.Bool("verify") && failed == 0 {
+		fmt.Println("Verifying")
+		failed = forEachKey(keys, concurrency, "Verified", func(key string) error {
+			want, err := from.Load(ctx, key)
+			if err != nil {
+				return fmt.Errorf("loading from source: %v", err)
+			}
+			r.invalidate(r.backendKey(key))
+			got, err := r.Load(ctx, key)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, want) {
+				return fmt.Errorf("value differs from source")
+			}
+			return nil
+		})
+	}
+
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d of %d keys failed", failed, len(keys))
+	}
+
+	fmt.Println("Done")
+	return caddy.ExitCodeSuccess, nil
+}
+
+// storedKeys returns the keys below prefix with values in storage, without
+// directories and locks.
+func storedKeys(ctx context.Context, storage certmagic.Storage, prefix string) ([]string, error) {
+	listed, err := storage.List(ctx, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, key := range listed {
+		if key == "locks" || strings.HasPrefix(key, "locks/") {
+			continue
+		}
+		info, err := storage.Stat(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if info.IsTerminal {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// forEachKey calls fn for each key, concurrency at a time, prints the
+// progress and the keys fn fails for, and returns how many failed.
+func forEachKey(keys []string, concurrency int, verb string, fn func(key string) error) int {
+	var done, failed atomic.Int64
+	var mu sync.Mutex
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				err := fn(key)
+
+				mu.Lock()
+				if err != nil {
+					failed.Add(1)
+					fmt.Printf("%s: %v\n", key, err)
+				}
+				if n := done.Add(1); n%100 == 0 || n == int64(len(keys)) {
+					fmt.Printf("%s %d of %d keys\n", verb, n, len(keys))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+
+	return int(failed.Load())
+}
@@ -0,0 +1,164 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// MirrorConfig applies every change made through the module to another
+// storage module as well, e.g. to migrate to it or to keep a backup. Changes
+// the mirror fails to apply are retried in the background.
+type MirrorConfig struct {
+	// The storage module, e.g. {"module": "file_system", "root": "..."}.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	// How often to retry changes the mirror failed to apply. Defaults to
+	// 30s.
+	RetryInterval caddy.Duration `json:"retry_interval,omitempty"`
+}
+
+func (c *MirrorConfig) provision(ctx caddy.Context) (*mirror, error) {
+	if c.RetryInterval == 0 {
+		c.RetryInterval = caddy.Duration(30 * time.Second)
+	}
+
+	storage, err := loadStorageModule(ctx, c.StorageRaw)
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %v", err)
+	}
+
+	return &mirror{
+		storage: storage,
+		dirty:   make(map[string]struct{}),
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+func (c *MirrorConfig) validate() error {
+	if len(c.StorageRaw) == 0 {
+		return errors.New("mirror: storage must be specified")
+	}
+	if c.RetryInterval < 0 {
+		return errors.New("mirror: retry_interval must not be negative")
+	}
+	return nil
+}
+
+// mirror is the storage changes are mirrored to.
+type mirror struct {
+	storage certmagic.Storage
+
+	mu sync.Mutex
+	// Keys whose value in the mirror may differ from the backend.
+	dirty map[string]struct{}
+	// Signals that keys were marked dirty.
+	wake chan struct{}
+}
+
+// mirrorStore stores value at key in the mirror after it was stored in the
+// backend.
+func (r *RestStorage) mirrorStore(ctx context.Context, key string, value []byte) {
+	if r.mirror == nil {
+		return
+	}
+
+	if err := r.mirror.storage.Store(ctx, key, value); err != nil {
+		r.logger.Error("Unable to store in mirror; will try again", zap.String("key", key), zap.Error(err))
+		r.mirrorLater(key)
+	}
+}
+
+// mirrorDelete deletes key from the mirror after it was deleted from the
+// backend.
+func (r *RestStorage) mirrorDelete(ctx context.Context, key string) {
+	if r.mirror == nil {
+		return
+	}
+
+	if err := r.mirror.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		r.logger.Error("Unable to delete from mirror; will try again", zap.String("key", key), zap.Error(err))
+		r.mirrorLater(key)
+	}
+}
+
+// mirrorLater marks keys to be copied from the backend to the mirror in the
+// background.
+func (r *RestStorage) mirrorLater(keys ...string) {
+	if r.mirror == nil {
+		return
+	}
+
+	r.mirror.mu.Lock()
+	for _, key := range keys {
+		r.mirror.dirty[key] = struct{}{}
+	}
+	r.mirror.mu.Unlock()
+
+	select {
+	case r.mirror.wake <- struct{}{}:
+	default:
+	}
+}
+
+// syncMirror copies the keys marked dirty to the mirror as soon as they are
+// marked, and retries those that fail every retry_interval.
+func (r *RestStorage) syncMirror(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.Mirror.RetryInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.mirror.wake:
+		}
+
+		r.mirror.mu.Lock()
+		keys := make([]string, 0, len(r.mirror.dirty))
+		for key := range r.mirror.dirty {
+			keys = append(keys, key)
+		}
+		clear(r.mirror.dirty)
+		r.mirror.mu.Unlock()
+
+		for _, key := range keys {
+			if err := r.mirrorKey(ctx, key); err != nil {
+				r.logger.Error("Unable to mirror key; will try again",
+					zap.String("key", key),
+					zap.Duration("retry_interval", time.Duration(r.Mirror.RetryInterval)),
+					zap.Error(err))
+
+				r.mirror.mu.Lock()
+				r.mirror.dirty[key] = struct{}{}
+				r.mirror.mu.Unlock()
+			}
+		}
+	}
+}
+
+// mirrorKey copies the current value of key, or its absence, from the
+// backend to the mirror.
+func (r *RestStorage) mirrorKey(ctx context.Context, key string) error {
+	value, err := r.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = r.mirror.storage.Delete(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("loading from backend: %w", err)
+	}
+
+	return r.mirror.storage.Store(ctx, key, value)
+}
@@ -0,0 +1,35 @@
+package rest
+
+import (
+	"errors"
+	"strings"
+)
+
+// namespaced returns the key under which key is stored in the backend.
+func (r *RestStorage) namespaced(key string) string {
+	if r.Namespace == "" {
+		return key
+	}
+	if key == "" {
+		return r.Namespace
+	}
+	return r.Namespace + "/" + key
+}
+
+// stripNamespace returns the key stored at a backend key, and whether the
+// backend key is in the namespace at all.
+func (r *RestStorage) stripNamespace(key string) (string, bool) {
+	if r.Namespace == "" {
+		return key, true
+	}
+	return strings.CutPrefix(key, r.Namespace+"/")
+}
+
+func validateNamespace(namespace string) error {
+	for _, segment := range strings.Split(namespace, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return errors.New("namespace: must not contain empty, \".\" or \"..\" segments")
+		}
+	}
+	return nil
+}
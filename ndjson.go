@@ -0,0 +1,67 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// listAccept is the Accept header of list requests. Backends may stream
+// the keys as NDJSON instead of returning a ListResponse.
+func (r *RestStorage) listAccept() string {
+	c := r.codec()
+	accept := ndjsonContentType + ", " + c.contentType() + ";q=0.9"
+	if c.contentType() != "application/json" {
+		accept += ", application/json;q=0.5"
+	}
+	return accept
+}
+
+func isNDJSON(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == ndjsonContentType || mediaType == "application/jsonl"
+}
+
+// listEntry is a line of an NDJSON list response: either the key as a JSON
+// string, or an object with a key field.
+type listEntry struct {
+	Key string
+}
+
+func (e *listEntry) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &e.Key)
+	}
+
+	var object struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(b, &object); err != nil {
+		return err
+	}
+	e.Key = object.Key
+	return nil
+}
+
+// decodeKeyLines decodes keys from body one line at a time, so the
+// response is never held in memory as a whole.
+func decodeKeyLines(body io.Reader) ([]string, error) {
+	dec := json.NewDecoder(body)
+
+	var keys []string
+	for {
+		var entry listEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %d of list response: %v", len(keys)+1, err)
+		}
+		keys = append(keys, entry.Key)
+	}
+}
@@ -0,0 +1,44 @@
+package rest
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAuth2Config obtains access tokens using the OAuth2 client credentials
+// flow. Tokens are cached and refreshed shortly before they expire.
+type OAuth2Config struct {
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+func (o *OAuth2Config) validate() error {
+	if o.TokenURL == "" {
+		return errors.New("oauth2: token_url must be specified")
+	}
+
+	if o.ClientID == "" {
+		return errors.New("oauth2: client_id must be specified")
+	}
+
+	if o.ClientSecret == "" {
+		return errors.New("oauth2: client_secret must be specified")
+	}
+
+	return nil
+}
+
+func (o *OAuth2Config) tokenSource(ctx context.Context) oauth2.TokenSource {
+	cfg := clientcredentials.Config{
+		TokenURL:     o.TokenURL,
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		Scopes:       o.Scopes,
+	}
+	return cfg.TokenSource(ctx)
+}
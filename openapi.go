@@ -0,0 +1,415 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func openAPICommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "openapi [--config <path>] [--adapter <name>] [--output <file>]",
+		Short: "Writes an OpenAPI document describing the API the rest module speaks",
+		Long: `
+Generates an OpenAPI 3.1 document of the default dialect from the request
+and response types this module is built with, so backend teams can scaffold
+servers and validate payloads against the same definitions the client uses.
+
+With --config, the routes and status codes configured in the rest storage
+module are used, and its endpoint is listed as the server; otherwise the
+defaults are. The document is written to --output, or to stdout.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdOpenAPI),
+	}
+	addConfigFlags(cmd)
+	cmd.Flags().StringP("output", "o", "", "The file to write the document to, instead of stdout")
+	return cmd
+}
+
+func cmdOpenAPI(fl caddycmd.Flags) (int, error) {
+	r := new(RestStorage)
+	if fl.String("config") != "" {
+		configured, cancel, err := storageFromConfig(fl)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer cancel()
+		r = configured
+	}
+
+	doc, err := r.openAPIDocument()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	encoded, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	encoded = append(encoded, '\n')
+
+	if output := fl.String("output"); output != "" {
+		if err := os.WriteFile(output, encoded, 0o644); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+	if _, err := os.Stdout.Write(encoded); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// openAPIOperation describes an operation of the default dialect.
+type openAPIOperation struct {
+	op      string
+	summary string
+	// The bodies, as zero values of their types, or nil if there is none.
+	request, response any
+	// The default status codes of success.
+	success []int
+	// The meaning of the not found status code, if op has one.
+	notFound string
+	// Other results, by status code.
+	results map[int]string
+}
+
+var openAPIOperations = []openAPIOperation{
+	{
+		op: opStore, summary: "Store a value",
+		request: StoreRequest{}, success: []int{201},
+		results: map[int]string{
+			409: "The key exists and the store is create-only.",
+			412: "The version of the value doesn't match if_match.",
+		},
+	},
+	{
+		op: opLoad, summary: "Load a value",
+		request: LoadRequest{}, response: LoadResponse{}, success: []int{200},
+		notFound: "The key doesn't exist.",
+		results:  map[int]string{304: "The value matches the version in If-None-Match."},
+	},
+	{
+		op: opDelete, summary: "Delete a key, and the keys below it",
+		request: DeleteRequest{}, success: []int{204},
+		notFound: "The key doesn't exist.",
+	},
+	{
+		op: opExists, summary: "Report whether a key exists",
+		request: ExistsRequest{}, response: ExistsResponse{}, success: []int{200},
+		notFound: "The key doesn't exist.",
+	},
+	{
+		op: opList, summary: "List the keys below a prefix",
+		request: ListRequest{}, response: ListResponse{}, success: []int{200},
+		notFound: "No keys exist below the prefix.",
+	},
+	{
+		op: opStat, summary: "Describe a key",
+		request: StatRequest{}, response: StatResponse{}, success: []int{200},
+		notFound: "The key doesn't exist.",
+	},
+	{
+		op: opLock, summary: "Acquire a lock",
+		request: LockRequest{}, response: LockResponse{}, success: []int{201},
+	},
+	{
+		op: opUnlock, summary: "Release a lock",
+		request: UnlockRequest{}, success: []int{204},
+	},
+	{
+		op: opRenew, summary: "Renew the lease of a lock",
+		request: RenewRequest{}, success: []int{200, 204},
+		notFound: "The lock isn't held by the holder anymore.",
+		results: map[int]string{
+			409: "The lock is held by another holder.",
+			410: "The lease expired.",
+		},
+	},
+	{
+		op: opInfo, summary: "Report the protocol version and capabilities",
+		request: InfoRequest{}, response: InfoResponse{}, success: []int{200},
+		notFound: "The backend doesn't report its version.",
+	},
+	{
+		op: opUploadInit, summary: "Start a chunked upload",
+		request: UploadInitRequest{}, response: UploadInitResponse{}, success: []int{201},
+	},
+	{
+		op: opUploadAppend, summary: "Append a chunk to an upload",
+		request: UploadAppendRequest{}, success: []int{204},
+		results: map[int]string{
+			404: "The upload doesn't exist.",
+			409: "The offset isn't the number of bytes received.",
+		},
+	},
+	{
+		op: opUploadStatus, summary: "Report the bytes received of an upload",
+		request: UploadStatusRequest{}, response: UploadStatusResponse{}, success: []int{200},
+		results: map[int]string{404: "The upload doesn't exist."},
+	},
+	{
+		op: opUploadCommit, summary: "Store the value of a complete upload",
+		request: UploadCommitRequest{}, success: []int{201},
+		results: map[int]string{
+			404: "The upload doesn't exist.",
+			409: "The key exists and the store is create-only.",
+			412: "The version of the value doesn't match if_match.",
+		},
+	},
+	{
+		op: opStoreBatch, summary: "Store several values",
+		request: StoreBatchRequest{}, response: BatchResponse{}, success: []int{200},
+	},
+	{
+		op: opDeleteBatch, summary: "Delete several keys",
+		request: DeleteBatchRequest{}, response: BatchResponse{}, success: []int{200},
+	},
+	{
+		op: opLoadBatch, summary: "Load several values",
+		request: LoadBatchRequest{}, response: BatchResponse{}, success: []int{200},
+	},
+	{
+		op: opStatBatch, summary: "Describe several keys",
+		request: StatBatchRequest{}, response: StatBatchResponse{}, success: []int{200},
+	},
+	{
+		op: opDeletePrefix, summary: "Delete all keys below a prefix",
+		request: DeletePrefixRequest{}, success: []int{204},
+		notFound: "No keys exist below the prefix.",
+	},
+	{
+		op: opWatch, summary: "Wait for changes to keys",
+		request: WatchRequest{}, response: WatchResponse{}, success: []int{200},
+		results: map[int]string{410: "The cursor is too old; start over without one."},
+	},
+	{
+		op: opListValues, summary: "List the keys below a prefix with their values",
+		request: ListValuesRequest{}, response: ListValuesResponse{}, success: []int{200},
+		notFound: "No keys exist below the prefix.",
+	},
+}
+
+// openAPIDocument returns the OpenAPI 3.1 document of the API r speaks,
+// with its routes and status codes.
+func (r *RestStorage) openAPIDocument() (map[string]any, error) {
+	if r.Dialect != "" && r.Dialect != DialectRPC {
+		return nil, fmt.Errorf("only the default dialect can be described, not %s", r.Dialect)
+	}
+	if isGRPCEndpoint(r.Endpoint) {
+		return nil, errors.New("gRPC endpoints are described by the protobuf definitions, not OpenAPI")
+	}
+
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	for _, op := range openAPIOperations {
+		rt := r.routeTemplate(op.op)
+		path := "/" + rt.Path
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.Method)] = r.openAPIOperation(op, rt, schemas)
+	}
+
+	doc := map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Caddy rest storage",
+			"version": strconv.Itoa(ProtocolVersion),
+			"description": "The API the rest storage module of Caddy speaks in its default dialect. " +
+				"Values are base64-encoded. Bodies may also be encoded as configured with encoding, with the same fields.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "x-api-key"},
+			},
+		},
+		"security": []any{map[string]any{"apiKey": []string{}}},
+	}
+	if r.Endpoint != "" {
+		doc["servers"] = []any{map[string]any{"url": strings.TrimSuffix(r.Endpoint, "/")}}
+	}
+	return doc, nil
+}
+
+// openAPIOperation describes op at rt. GET and HEAD requests carry the
+// fields of the request as query parameters, as sent by call.
+func (r *RestStorage) openAPIOperation(op openAPIOperation, rt Route, schemas map[string]any) map[string]any {
+	operation := map[string]any{
+		"operationId": op.op,
+		"summary":     op.summary,
+	}
+
+	keyInPath := strings.Contains(rt.Path, "{key}")
+	var parameters []any
+	if keyInPath {
+		parameters = append(parameters, map[string]any{
+			"name": "key", "in": "path", "required": true,
+			"schema": map[string]any{"type": "string"},
+		})
+	}
+
+	if rt.Method == http.MethodGet || rt.Method == http.MethodHead {
+		names, fields := openAPIFields(reflect.TypeOf(op.request))
+		for _, name := range names {
+			if keyInPath && name == "key" {
+				continue
+			}
+			parameters = append(parameters, map[string]any{
+				"name": name, "in": "query", "required": fields[name].required(),
+				"schema": openAPISchema(fields[name].value.Type(), schemas),
+			})
+		}
+	} else if op.request != nil {
+		operation["requestBody"] = map[string]any{
+			"required": true,
+			"content":  jsonContent(openAPISchema(reflect.TypeOf(op.request), schemas)),
+		}
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	responses := map[string]any{}
+	success := op.success
+	if configured := r.StatusCodes[op.op].Success; len(configured) > 0 {
+		success = configured
+	}
+	for _, code := range success {
+		response := map[string]any{"description": "Success."}
+		// HEAD responses have no body.
+		if op.response != nil && rt.Method != http.MethodHead {
+			response["content"] = jsonContent(openAPISchema(reflect.TypeOf(op.response), schemas))
+		}
+		responses[strconv.Itoa(code)] = response
+	}
+	if op.notFound != "" {
+		notFound := []int{http.StatusNotFound}
+		if configured := r.StatusCodes[op.op].NotFound; len(configured) > 0 {
+			notFound = configured
+		}
+		for _, code := range notFound {
+			responses[strconv.Itoa(code)] = map[string]any{"description": op.notFound}
+		}
+	}
+	if op.op == opLock {
+		locked := []int{http.StatusLocked}
+		if configured := r.StatusCodes[opLock].Locked; len(configured) > 0 {
+			locked = configured
+		}
+		for _, code := range locked {
+			responses[strconv.Itoa(code)] = map[string]any{
+				"description": "The lock is held by another holder.",
+				"content":     jsonContent(openAPISchema(reflect.TypeOf(LockedResponse{}), schemas)),
+			}
+		}
+	}
+	for code, description := range op.results {
+		if _, ok := responses[strconv.Itoa(code)]; !ok {
+			responses[strconv.Itoa(code)] = map[string]any{"description": description}
+		}
+	}
+	messageField, codeField := r.ErrorMessageField, r.ErrorCodeField
+	if messageField == "" {
+		messageField = "error"
+	}
+	if codeField == "" {
+		codeField = "code"
+	}
+	responses["default"] = map[string]any{
+		"description": fmt.Sprintf("An error, described by the %s and %s fields of an object.", messageField, codeField),
+	}
+	operation["responses"] = responses
+
+	return operation
+}
+
+func jsonContent(schema any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// openAPIFields returns the names of the JSON fields of the struct type t,
+// sorted, and the fields by name.
+func openAPIFields(t reflect.Type) ([]string, map[string]jsonField) {
+	fields := jsonFields(reflect.New(t).Elem())
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, fields
+}
+
+// required reports whether the field is always sent: fields with omitempty
+// are left out when empty.
+func (f jsonField) required() bool {
+	_, options, _ := strings.Cut(f.tag.Get("json"), ",")
+	return !strings.Contains(options, "omitempty")
+}
+
+// openAPISchema returns the JSON schema of t. Structs are added to schemas
+// by their name and referenced.
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	switch {
+	case t == reflect.TypeOf(Timestamp("")):
+		return map[string]any{
+			"type":        []string{"string", "number"},
+			"description": "RFC 3339, an HTTP date, or Unix epoch seconds or milliseconds.",
+		}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]any{"type": "string", "contentEncoding": "base64"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return openAPISchema(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		// Added before the fields, in case the struct contains itself.
+		schema := map[string]any{"type": "object"}
+		schemas[t.Name()] = schema
+
+		properties := map[string]any{}
+		var required []string
+		names, fields := openAPIFields(t)
+		for _, name := range names {
+			properties[name] = openAPISchema(fields[name].value.Type(), schemas)
+			if fields[name].required() {
+				required = append(required, name)
+			}
+		}
+		schema["properties"] = properties
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return ref
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,47 @@
+package rest
+
+import (
+	"reflect"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// expandPlaceholders replaces the global placeholders, such as {env.*} and
+// {file.*}, in all string options of v and the structs, lists and maps in
+// it. Other placeholders are kept, since route paths contain {key}.
+func expandPlaceholders(repl *caddy.Replacer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(repl.ReplaceKnown(v.String(), ""))
+		}
+
+	case reflect.Pointer:
+		if !v.IsNil() {
+			expandPlaceholders(repl, v.Elem())
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				expandPlaceholders(repl, v.Field(i))
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandPlaceholders(repl, v.Index(i))
+		}
+
+	case reflect.Map:
+		// Map values can't be set in place.
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			expandPlaceholders(repl, value)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// PrefetchConfig loads all keys below some prefixes when the module is
+// provisioned, so that the first TLS handshakes after a restart are served
+// from the cache instead of all waiting for the backend.
+type PrefetchConfig struct {
+	// The prefixes whose keys are loaded. Defaults to certificates.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// How many keys are loaded at once. Defaults to 8.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+func (c *PrefetchConfig) provision() {
+	if len(c.Prefixes) == 0 {
+		c.Prefixes = []string{"certificates"}
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 8
+	}
+}
+
+func (c *PrefetchConfig) validate() error {
+	if c.Concurrency < 0 {
+		return errors.New("prefetch: concurrency must not be negative")
+	}
+	return nil
+}
+
+// prefetch loads the keys below the prefixes to prefetch, filling the
+// caches. Keys that can't be loaded are left to be loaded on demand.
+func (r *RestStorage) prefetch(ctx context.Context) {
+	start := time.Now()
+
+	var group errgroup.Group
+	group.SetLimit(r.Prefetch.Concurrency)
+
+	var loaded, failed atomic.Int64
+	for _, prefix := range r.Prefetch.Prefixes {
+		prefix = strings.Trim(prefix, "/")
+
+		if r.canListValues() {
+			err := r.LoadPrefix(ctx, prefix, func(string, []byte) error {
+				loaded.Add(1)
+				return nil
+			})
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				r.logger.Warn("Unable to load values to prefetch", zap.String("prefix", prefix), zap.Error(err))
+			}
+			continue
+		}
+
+		keys, err := r.List(ctx, prefix, true)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			r.logger.Warn("Unable to list keys to prefetch", zap.String("prefix", prefix), zap.Error(err))
+			continue
+		}
+
+		for _, key := range keys {
+			key := key
+			group.Go(func() error {
+				if _, err := r.Load(ctx, key); err != nil {
+					// Directories are listed too, but can't be loaded.
+					if !errors.Is(err, fs.ErrNotExist) {
+						r.logger.Debug("Unable to prefetch key", zap.String("key", key), zap.Error(err))
+						failed.Add(1)
+					}
+					return nil
+				}
+				loaded.Add(1)
+				return nil
+			})
+		}
+	}
+	group.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	r.logger.Info("Prefetched keys",
+		zap.Strings("prefixes", r.Prefetch.Prefixes),
+		zap.Int64("loaded", loaded.Load()),
+		zap.Int64("failed", failed.Load()),
+		zap.Duration("duration", time.Since(start)))
+}
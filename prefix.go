@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+type DeletePrefixRequest struct {
+	Prefix        string            `json:"prefix" protobuf:"1"`
+	FencingTokens map[string]uint64 `json:"fencing_tokens,omitempty" protobuf:"2"`
+}
+
+// DeletePrefix deletes prefix and all keys below it, e.g. all assets of a
+// decommissioned domain. If the backend reports the delete_prefix
+// capability, this is a single request; otherwise, the keys are listed and
+// deleted with DeleteBatch. WebDAV and S3 delete directories recursively
+// anyway.
+func (r *RestStorage) DeletePrefix(ctx context.Context, prefix string) (err error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return errors.New("refusing to delete an empty prefix")
+	}
+	if err := r.checkWritable(opDeletePrefix, prefix); err != nil {
+		return err
+	}
+	if r.DryRun {
+		r.logDryRun(opDeletePrefix, r.backendKey(prefix))
+		return nil
+	}
+
+	if r.Dialect == DialectWebDAV || r.Dialect == DialectS3 {
+		if err := r.Delete(ctx, prefix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// Encoded keys have no hierarchy the backend could delete by.
+	if !r.capabilities[CapabilityDeletePrefix] || (r.KeyEncoding != "" && r.KeyEncoding != KeyEncodingNone) {
+		keys, err := r.List(ctx, prefix, true)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("listing %v: %w", prefix, err)
+		}
+		return r.DeleteBatch(ctx, append(keys, prefix))
+	}
+
+	defer func() { err = r.fallbackDeletePrefix(ctx, prefix, err) }()
+
+	backendPrefix := r.backendKey(prefix)
+	defer func() { r.audit(opDeletePrefix, backendPrefix, err) }()
+
+	r.forgetETagPrefix(backendPrefix)
+	r.invalidatePrefix(backendPrefix)
+	r.diskCache.removePrefix(backendPrefix)
+
+	resp, err := r.call(ctx, opDeletePrefix, backendPrefix, nil, DeletePrefixRequest{
+		Prefix:        backendPrefix,
+		FencingTokens: r.locks.fencingTokens(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if r.notFound(opDeletePrefix, resp) {
+		return nil
+	}
+
+	if !r.succeeded(opDeletePrefix, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	r.emitKey(EventDeleted, backendPrefix)
+	r.mirrorDelete(ctx, prefix)
+
+	return nil
+}
+
+// underPrefix reports whether key is prefix or below it.
+func underPrefix(key, prefix string) bool {
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
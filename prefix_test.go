@@ -0,0 +1,65 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+// TestDeletePrefixOutage checks that keys deleted with DeletePrefix aren't
+// served from the disk cache or the fallback storage once the backend is
+// down.
+func TestDeletePrefixOutage(t *testing.T) {
+	server := newTestServer(t)
+	r := server.storage(t, &RestStorage{
+		DetectCapabilities: true,
+		DiskCache:          &DiskCacheConfig{Path: t.TempDir()},
+		Fallback:           testFallback(t),
+	})
+	if !r.capabilities[CapabilityDeletePrefix] {
+		t.Fatal("the server doesn't report the delete_prefix capability")
+	}
+	ctx := context.Background()
+
+	deleted := []string{"certificates/example.com/example.com.crt", "certificates/example.com/example.com.key"}
+	kept := "certificates/example.org/example.org.crt"
+	for _, key := range append(deleted, kept) {
+		if err := r.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if _, err := r.Load(ctx, key); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+	}
+
+	if err := r.DeletePrefix(ctx, "certificates/example.com"); err != nil {
+		t.Fatalf("DeletePrefix: %v", err)
+	}
+	server.Close()
+
+	for _, key := range deleted {
+		if value, err := r.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Load of %s after DeletePrefix returned %q, %v", key, value, err)
+		}
+	}
+	if value, err := r.Load(ctx, kept); err != nil || string(value) != kept {
+		t.Errorf("Load of %s during the outage returned %q, %v", kept, value, err)
+	}
+
+	// During the outage, the prefix is deleted from the fallback storage,
+	// and the delete synced later instead of writes made below it.
+	if err := r.Store(ctx, "certificates/example.org/example.org.json", []byte("{}")); err != nil {
+		t.Fatalf("Store during the outage: %v", err)
+	}
+	if err := r.DeletePrefix(ctx, "certificates/example.org"); err != nil {
+		t.Fatalf("DeletePrefix during the outage: %v", err)
+	}
+	if value, err := r.Load(ctx, kept); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of %s after DeletePrefix during the outage returned %q, %v", kept, value, err)
+	}
+	pending := r.fallback.pendingWrites()
+	if len(pending) != 1 || pending["certificates/example.org"] != opDeletePrefix {
+		t.Errorf("pending writes are %v, want only the DeletePrefix", pending)
+	}
+}
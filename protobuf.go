@@ -0,0 +1,247 @@
+package rest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufCodec encodes the request and response types as the messages in
+// proto/storage.proto. The field numbers come from the protobuf struct tags,
+// which must be kept in sync with the .proto file.
+type protobufCodec struct{}
+
+func (protobufCodec) contentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) marshal(v any) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protobuf: cannot encode %T", v)
+	}
+
+	var b []byte
+	for i := 0; i < rv.NumField(); i++ {
+		num, ok := protoFieldNumber(rv.Type().Field(i))
+		if !ok {
+			continue
+		}
+
+		f := rv.Field(i)
+		switch {
+		case f.Kind() == reflect.String:
+			if f.Len() > 0 {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendString(b, f.String())
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8:
+			if f.Len() > 0 {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, f.Bytes())
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			for j := 0; j < f.Len(); j++ {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendString(b, f.Index(j).String())
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < f.Len(); j++ {
+				message, err := protobufCodec{}.marshal(f.Index(j).Interface())
+				if err != nil {
+					return nil, err
+				}
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, message)
+			}
+		case f.Kind() == reflect.Bool:
+			if f.Bool() {
+				b = protowire.AppendTag(b, num, protowire.VarintType)
+				b = protowire.AppendVarint(b, 1)
+			}
+		case f.Kind() == reflect.Int64:
+			if f.Int() != 0 {
+				b = protowire.AppendTag(b, num, protowire.VarintType)
+				b = protowire.AppendVarint(b, uint64(f.Int()))
+			}
+		case f.Kind() == reflect.Uint64:
+			if f.Uint() != 0 {
+				b = protowire.AppendTag(b, num, protowire.VarintType)
+				b = protowire.AppendVarint(b, f.Uint())
+			}
+		case f.Kind() == reflect.Map && f.Type() == reflect.TypeOf(map[string]uint64(nil)):
+			// Sorted so that encoding is deterministic.
+			m := f.Interface().(map[string]uint64)
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				var entry []byte
+				entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+				entry = protowire.AppendString(entry, k)
+				entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+				entry = protowire.AppendVarint(entry, m[k])
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, entry)
+			}
+		default:
+			return nil, fmt.Errorf("protobuf: unsupported field type %s", f.Type())
+		}
+	}
+
+	return b, nil
+}
+
+func (protobufCodec) decode(r io.Reader, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("protobuf: cannot decode into %T", v)
+	}
+	rv = rv.Elem()
+
+	fields := map[protowire.Number]reflect.Value{}
+	for i := 0; i < rv.NumField(); i++ {
+		if num, ok := protoFieldNumber(rv.Type().Field(i)); ok {
+			fields[num] = rv.Field(i)
+		}
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f, ok := fields[num]
+		if !ok {
+			// Skip fields added by newer versions of the schema.
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		n, err = decodeProtoField(f, typ, b)
+		if err != nil {
+			return fmt.Errorf("protobuf: field %d: %v", num, err)
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+var errProtoWireType = errors.New("unexpected wire type")
+
+// decodeProtoField decodes a single value of f from b and returns the number
+// of bytes consumed. Repeated and map fields are appended to.
+func decodeProtoField(f reflect.Value, typ protowire.Type, b []byte) (int, error) {
+	if f.Kind() == reflect.Bool || f.Kind() == reflect.Int64 || f.Kind() == reflect.Uint64 {
+		if typ != protowire.VarintType {
+			return 0, errProtoWireType
+		}
+		x, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		switch f.Kind() {
+		case reflect.Bool:
+			f.SetBool(x != 0)
+		case reflect.Int64:
+			f.SetInt(int64(x))
+		default:
+			f.SetUint(x)
+		}
+		return n, nil
+	}
+
+	if typ != protowire.BytesType {
+		return 0, errProtoWireType
+	}
+	data, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+
+	switch {
+	case f.Kind() == reflect.String:
+		f.SetString(string(data))
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8:
+		f.SetBytes(append([]byte(nil), data...))
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+		f.Set(reflect.Append(f, reflect.ValueOf(string(data))))
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct:
+		message := reflect.New(f.Type().Elem())
+		if err := (protobufCodec{}).decode(bytes.NewReader(data), message.Interface()); err != nil {
+			return 0, err
+		}
+		f.Set(reflect.Append(f, message.Elem()))
+	case f.Kind() == reflect.Map && f.Type() == reflect.TypeOf(map[string]uint64(nil)):
+		key, value, err := decodeProtoMapEntry(data)
+		if err != nil {
+			return 0, err
+		}
+		if f.IsNil() {
+			f.Set(reflect.MakeMap(f.Type()))
+		}
+		f.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
+	default:
+		return 0, fmt.Errorf("unsupported field type %s", f.Type())
+	}
+
+	return n, nil
+}
+
+func decodeProtoMapEntry(b []byte) (string, uint64, error) {
+	var key string
+	var value uint64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var k []byte
+			k, n = protowire.ConsumeBytes(b)
+			key = string(k)
+		case num == 2 && typ == protowire.VarintType:
+			value, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return key, value, nil
+}
+
+func protoFieldNumber(f reflect.StructField) (protowire.Number, bool) {
+	tag, ok := f.Tag.Lookup("protobuf")
+	if !ok {
+		return 0, false
+	}
+	num, err := strconv.Atoi(tag)
+	if err != nil || !protowire.Number(num).IsValid() {
+		return 0, false
+	}
+	return protowire.Number(num), true
+}
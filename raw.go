@@ -0,0 +1,108 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+
+	"github.com/caddyserver/certmagic"
+)
+
+const (
+	rawContentType      = "application/octet-stream"
+	keyHeader           = "x-storage-key"
+	fencingTokensHeader = "x-fencing-tokens"
+)
+
+// storeRaw sends value as the request body, with the key (and fencing
+// tokens, if any) in headers.
+func (r *RestStorage) storeRaw(ctx context.Context, key string, value []byte, header http.Header) (*http.Response, error) {
+	header.Set("Content-Type", rawContentType)
+	header.Set(keyHeader, key)
+
+	if tokens := r.locks.fencingTokens(); tokens != nil {
+		encoded, err := json.Marshal(tokens)
+		if err != nil {
+			return nil, err
+		}
+		header.Set(fencingTokensHeader, string(encoded))
+	}
+
+	method, path, _ := r.route(opStore, key)
+
+	return r.request(ctx, opStore, key, method, path, header, value)
+}
+
+// loadRaw asks for the value as raw bytes. Backends that don't support this
+// may still respond with a JSON LoadResponse.
+func (r *RestStorage) loadRaw(ctx context.Context, key string, header http.Header) (*http.Response, error) {
+	header.Set("Accept", rawContentType+", application/json;q=0.5")
+
+	return r.call(ctx, opLoad, key, header, LoadRequest{Key: key})
+}
+
+// loadBody returns the body of the response to the load route as the value,
+// for dialects that store values as plain files or objects.
+func (r *RestStorage) loadBody(ctx context.Context, key string) ([]byte, error) {
+	method, path, _ := r.route(opLoad, key)
+
+	resp, err := r.request(ctx, opLoad, key, method, path, r.loadHeader(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if r.notFound(opLoad, resp) {
+		return nil, fs.ErrNotExist
+	}
+
+	if value, ok := r.notModified(key, resp); ok {
+		return value, nil
+	}
+
+	if !r.succeeded(opLoad, resp, 200) {
+		return nil, r.statusError(resp)
+	}
+
+	value, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.verifyChecksum(key, resp, "", value); err != nil {
+		return nil, err
+	}
+
+	r.rememberETag(key, resp, "", value)
+
+	return value, nil
+}
+
+func isRawValue(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == rawContentType
+}
+
+// statFromHeaders builds the KeyInfo of key from the headers of a response
+// to a HEAD request. Keys are terminal unless the x-is-terminal header says
+// otherwise.
+func (r *RestStorage) statFromHeaders(key string, resp *http.Response) (certmagic.KeyInfo, error) {
+	info := certmagic.KeyInfo{
+		Key:        key,
+		Size:       resp.ContentLength,
+		IsTerminal: resp.Header.Get("x-is-terminal") != "false",
+	}
+
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		modified, err := r.parseTimestamp(lastModified)
+		if err != nil {
+			return certmagic.KeyInfo{}, fmt.Errorf("parsing Last-Modified: %v", err)
+		}
+		info.Modified = modified
+	}
+
+	return info, nil
+}
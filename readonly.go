@@ -0,0 +1,30 @@
+package rest
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// ReadOnlyError is returned by the operations that change the storage, or
+// lock keys, when read_only is set. It matches fs.ErrPermission.
+type ReadOnlyError struct {
+	Operation string
+	Key       string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("%v of %v rejected: storage is read-only", e.Operation, e.Key)
+}
+
+func (e *ReadOnlyError) Is(target error) bool {
+	return target == fs.ErrPermission
+}
+
+// checkWritable returns a *ReadOnlyError for op on key if the storage is
+// read-only.
+func (r *RestStorage) checkWritable(op, key string) error {
+	if r.ReadOnly {
+		return &ReadOnlyError{Operation: op, Key: key}
+	}
+	return nil
+}
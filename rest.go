@@ -3,44 +3,382 @@ package rest
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
+	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/certmagic"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
 )
 
 type RestStorage struct {
-	Endpoint string `json:"endpoint"`
-	ApiKey   string `json:"api_key"`
-	logger 	 *zap.Logger 
+	Endpoint   string `json:"endpoint"`
+	ApiKey     string `json:"api_key"`
+	ApiKeyFile string `json:"api_key_file,omitempty"`
+
+	// ApiKeySecondary is tried when the backend rejects the primary key with
+	// a 401 or 403, allowing zero-downtime key rotation.
+	ApiKeySecondary string `json:"api_key_secondary,omitempty"`
+
+	// Vault reads the api key from HashiCorp Vault.
+	Vault *VaultConfig `json:"vault,omitempty"`
+
+	// OAuth2 attaches a bearer token obtained via the client credentials flow.
+	OAuth2 *OAuth2Config `json:"oauth2,omitempty"`
+
+	// HMAC signs every request with a shared secret.
+	HMAC *HMACConfig `json:"hmac,omitempty"`
+
+	// GCPIDToken attaches a Google-signed ID token, e.g. for Cloud Run.
+	GCPIDToken *GCPIDTokenConfig `json:"gcp_id_token,omitempty"`
+
+	// AzureAD attaches a Microsoft Entra ID access token.
+	AzureAD *AzureADConfig `json:"azure_ad,omitempty"`
+
+	// JWT attaches short-lived JWTs signed with a private key.
+	JWT *JWTAuthConfig `json:"jwt,omitempty"`
+
+	// AWSSigV4 signs every request with AWS Signature Version 4.
+	AWSSigV4 *AWSSigV4Config `json:"aws_sigv4,omitempty"`
+
+	// Identifies this instance as the holder in lock requests. Defaults to
+	// the hostname.
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// Namespace is prepended to every key (as "<namespace>/<key>") and
+	// stripped from listed keys, so that several clusters (e.g. staging and
+	// production, or tenants) can share a backend without seeing each
+	// other's data.
+	Namespace string `json:"namespace,omitempty"`
+
+	// How keys are encoded before they are sent to the backend, for
+	// backends that don't accept slashes or other characters in keys:
+	// "none" (the default), "base64url", "sha256" or "percent".
+	KeyEncoding string `json:"key_encoding,omitempty"`
+
+	// RawValues sends values to /store as the raw request body and asks
+	// /load for raw bytes, instead of encoding them in the request and
+	// response bodies.
+	RawValues bool `json:"raw_values,omitempty"`
+
+	// The API dialect: "rpc" (the default), "rest", "webdav" or "s3".
+	Dialect string `json:"dialect,omitempty"`
+
+	// The encoding of request bodies: "json" (the default), "msgpack",
+	// "protobuf" or "cbor". Responses are decoded according to their
+	// Content-Type.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Routes overrides the method and/or path of individual operations
+	// (store, load, delete, exists, list, stat, lock, unlock, renew, info,
+	// upload_init, upload_append, upload_status, upload_commit, store_batch,
+	// delete_batch, load_batch, stat_batch, delete_prefix).
+	Routes map[string]Route `json:"routes,omitempty"`
+
+	// StatusCodes overrides the status codes that indicate success, a
+	// missing key or a held lock, by operation.
+	StatusCodes map[string]StatusCodes `json:"status_codes,omitempty"`
+
+	// The fields of error response bodies that hold the error message and
+	// code, as dot-separated paths. Default to "error" and "code".
+	ErrorMessageField string `json:"error_message_field,omitempty"`
+	ErrorCodeField    string `json:"error_code_field,omitempty"`
+
+	// Whether to check at startup that the backend implements a compatible
+	// protocol version, using the info endpoint: "off" (the default),
+	// "warn" or "require".
+	VersionCheck string `json:"version_check,omitempty"`
+
+	// Whether to check at startup that the endpoint is reachable and
+	// accepts the credentials: "off" (the default), "warn" or "require",
+	// as with VersionCheck.
+	StartupCheck string `json:"startup_check,omitempty"`
+
+	// DetectCapabilities asks the info endpoint at startup which optional
+	// features the backend supports, and enables or disables them
+	// accordingly.
+	DetectCapabilities bool `json:"detect_capabilities,omitempty"`
+
+	// The Go time layout of timestamps reported by the backend, tried
+	// before the default formats (RFC 3339, HTTP dates and Unix epoch
+	// seconds or milliseconds).
+	TimestampLayout string `json:"timestamp_layout,omitempty"`
+
+	// Checksums sends the SHA-256 hash of each value with Store and
+	// verifies values loaded against the hash reported by the backend,
+	// failing with a *CorruptionError on a mismatch.
+	Checksums bool `json:"checksums,omitempty"`
+
+	// Compression compresses values before they are encrypted and sent to
+	// the backend.
+	Compression *CompressionConfig `json:"compression,omitempty"`
+
+	// Encryption encrypts values before they are sent to the backend.
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+
+	// ConditionalLoad caches loaded values with their ETag (or version)
+	// and sends it as If-None-Match when loading them again. A 304 response
+	// is answered from the cache.
+	ConditionalLoad bool `json:"conditional_load,omitempty"`
+
+	// OptimisticConcurrency makes Store conditional on the ETag (or version)
+	// of the value last loaded or stored by this instance, by sending it as
+	// If-Match. If the backend responds with 412, Store returns a
+	// *ConflictError instead of overwriting a change made elsewhere.
+	OptimisticConcurrency bool `json:"optimistic_concurrency,omitempty"`
+
+	// Patterns (as in path.Match) of keys that are stored with create-only
+	// semantics: if the key already exists, Store returns an
+	// *AlreadyExistsError instead of overwriting it.
+	CreateOnly []string `json:"create_only,omitempty"`
+
+	// Store fails with a *ValueTooLargeError, without contacting the
+	// backend, if a value (as sent, i.e. after compression and encryption)
+	// is larger than MaxValueSize bytes, and logs a warning if it is larger
+	// than ValueSizeWarning bytes. Zero disables either check.
+	MaxValueSize     int `json:"max_value_size,omitempty"`
+	ValueSizeWarning int `json:"value_size_warning,omitempty"`
+
+	// TTLs of stored values, by key prefix, e.g. {"ocsp/": "168h"}. The
+	// longest matching prefix applies. The TTL is sent in seconds so that
+	// the backend can expire transient data; zero means no expiry.
+	TTLs map[string]caddy.Duration `json:"ttls,omitempty"`
+
+	// The maximum number of keys the backend should return per List
+	// request. Zero (the default) leaves the page size to the backend.
+	ListPageSize int `json:"list_page_size,omitempty"`
+
+	// The maximum number of requests to the backend in flight at once.
+	// Further requests wait for one to finish. Zero (the default) means no
+	// limit.
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+
+	// Requests taking longer than this are logged at warn level, with the
+	// time spent resolving, connecting, in the TLS handshake and until the
+	// first byte of the response. Zero (the default) disables this.
+	SlowRequestThreshold caddy.Duration `json:"slow_request_threshold,omitempty"`
+
+	// Cache caches loaded values in memory.
+	Cache *CacheConfig `json:"cache,omitempty"`
+
+	// DiskCache keeps copies of values on disk to serve while the backend
+	// is unreachable.
+	DiskCache *DiskCacheConfig `json:"disk_cache,omitempty"`
+
+	// Watch evicts keys changed by other instances from the caches as soon
+	// as the backend reports them.
+	Watch *WatchConfig `json:"watch,omitempty"`
+
+	// Prefetch loads keys into the caches when the module is provisioned.
+	Prefetch *PrefetchConfig `json:"prefetch,omitempty"`
+
+	// AdminActions allows deleting keys and force-unlocking them through
+	// the admin API.
+	AdminActions bool `json:"admin_actions,omitempty"`
+
+	// ReadOnly rejects Store, Delete and Lock, and the operations built on
+	// them, with a *ReadOnlyError, so passive instances never change the
+	// storage.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// DryRun logs Stores, Deletes and Unlocks instead of sending them, and
+	// only locks keys locally, while reads go to the backend as usual.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Fallback keeps a copy of the values in another storage module, which
+	// is used while the backend is unavailable.
+	Fallback *FallbackConfig `json:"fallback,omitempty"`
+
+	// Mirror applies every change to another storage module as well.
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+
+	// HealthCheck probes the backend in the background.
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+
+	// LogRequests logs every request to the backend.
+	LogRequests *LogRequestsConfig `json:"log_requests,omitempty"`
+
+	// Audit records every change made through the module.
+	Audit *AuditConfig `json:"audit,omitempty"`
+
+	// ChunkedUpload stores large values in chunks.
+	ChunkedUpload *ChunkedUploadConfig `json:"chunked_upload,omitempty"`
+
+	// FaultInjection fails or delays requests to the backend at random,
+	// for chaos testing.
+	FaultInjection *FaultInjectionConfig `json:"fault_injection,omitempty"`
+
+	// How long to wait after the first failed attempt to acquire a lock
+	// that is held elsewhere. The wait doubles (with jitter) after every
+	// further attempt, up to LockPollMaxInterval. Defaults to 5s.
+	LockPollInterval caddy.Duration `json:"lock_poll_interval,omitempty"`
+
+	// The upper bound of the wait between lock attempts. Defaults to 1m.
+	LockPollMaxInterval caddy.Duration `json:"lock_poll_max_interval,omitempty"`
+
+	// The maximum time Lock waits for a lock before failing. Zero (the
+	// default) waits until the operation is canceled.
+	LockTimeout caddy.Duration `json:"lock_timeout,omitempty"`
+
+	// Either "wait" (the default) or "fail_fast".
+	LockMode string `json:"lock_mode,omitempty"`
+
+	// Either "body" (the default) or "head", to send Exists requests as
+	// HEAD requests answered by status code alone.
+	ExistsMode string `json:"exists_mode,omitempty"`
+
+	// In fail_fast mode, how many times to try acquiring a lock before
+	// giving up. Defaults to 1.
+	LockAttempts int `json:"lock_attempts,omitempty"`
+
+	// When set, locks are requested as leases with this TTL and renewed in
+	// the background while held, so a crashed instance can't hold a lock
+	// forever. Requires the backend to support the renew endpoint.
+	LockTTL caddy.Duration `json:"lock_ttl,omitempty"`
+
+	// Locks reported (via acquired_at in a 423 response) as held for longer
+	// than this are force-unlocked. Zero (the default) disables this.
+	StaleLockThreshold caddy.Duration `json:"stale_lock_threshold,omitempty"`
+
+	ctx         caddy.Context
+	logger      *zap.Logger
+	keyFile     *keyFile
+	vaultSecret *vaultSecret
+	tokenSource oauth2.TokenSource
+	// reported by the backend, if detected
+	capabilities map[string]bool
+
+	// shared with the modules of other configs; see client
+	poolKey    string
+	httpClient *http.Client
+	grpcConn   *grpc.ClientConn
+	leaseCtx   context.Context
+
+	useSecondaryKey *atomic.Bool
+	locks           *heldLocks
+	localLocks      *localLocks
+	uploads         *uploads
+	etags           *lruCache[etagEntry]
+	batchLoads      *batchLoads
+	// loaded values, and keys found not to exist, if cached
+	values      *lruCache[[]byte]
+	missingKeys *lruCache[struct{}]
+	// Stat and Exists results, if cached
+	keyInfos  *lruCache[certmagic.KeyInfo]
+	existence *lruCache[bool]
+	loads     *singleflight.Group
+
+	// the invalidations of keys being loaded
+	loadGenerations *loadGenerations
+
+	diskCache *diskCache
+	fallback  *fallback
+	mirror    *mirror
+	limiter   *requestLimiter
+	health    *healthState
+	auditLog  *auditLog
 }
 
 func init() {
 	caddy.RegisterModule(new(RestStorage))
+	caddy.RegisterModule(new(LeaderElection))
+	caddy.RegisterModule(new(AdminAPI))
+	caddy.RegisterModule(new(StorageServer))
+	caddy.RegisterModule(new(SQLiteStorage))
+	caddy.RegisterModule(new(RedisStorage))
+	caddy.RegisterModule(new(MemoryStorage))
+	httpcaddyfile.RegisterHandlerDirective("rest_storage_server", parseStorageServer)
 }
 
-func (r RestStorage) client(ctx context.Context, method string, path string, dataStruct any) (*http.Response, error) {
-	httpClient := &http.Client{}
-	requestBody, err := json.Marshal(dataStruct)
+// request sends requestBody for op on key with the given headers and
+// credentials.
+func (r *RestStorage) request(ctx context.Context, op, key, method, path string, header http.Header, requestBody []byte) (*http.Response, error) {
+	ctx, span := r.startSpan(ctx, op, key)
+	var timing *requestTiming
+	if r.SlowRequestThreshold > 0 {
+		ctx, timing = traceTiming(ctx)
+	}
+	start := time.Now()
+	resp, err := r.injectFault(ctx, op, method, r.Endpoint+path)
+	if resp == nil && err == nil {
+		resp, err = r.withApiKey(op, func(apiKey string) (*http.Response, error) {
+			return r.send(ctx, method, path, header, requestBody, apiKey)
+		})
+	}
+	observeRequest(op, start, len(requestBody), resp, err)
+	r.logSlowRequest(op, key, start, timing, resp, err)
+	endSpan(span, resp, err)
+	return resp, err
+}
+
+// withApiKey calls send with the api key in use, and again with the other
+// key if the backend rejects it.
+func (r *RestStorage) withApiKey(op string, send func(apiKey string) (*http.Response, error)) (*http.Response, error) {
+	secondary := r.usingSecondaryKey()
+	resp, err := send(r.apiKey(secondary))
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, method, r.Endpoint+path, bytes.NewBuffer(requestBody))
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("x-api-key", r.ApiKey)
-	resp, err := httpClient.Do(req)
+
+	// During key rotation, the backend may only accept one of the two keys.
+	if r.ApiKeySecondary != "" && (resp.StatusCode == 401 || resp.StatusCode == 403) {
+		resp.Body.Close()
+		restMetrics.retries.WithLabelValues(op).Inc()
+
+		resp, err = send(r.apiKey(!secondary))
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != 401 && resp.StatusCode != 403 && r.useSecondaryKey.CompareAndSwap(secondary, !secondary) {
+			if secondary {
+				r.logger.Warn("Backend rejected the secondary api key; now using the primary api key")
+			} else {
+				r.logger.Warn("Backend rejected the primary api key; now using the secondary api key")
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+func (r *RestStorage) send(ctx context.Context, method string, path string, header http.Header, requestBody []byte, apiKey string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL()+path, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	injectTraceContext(ctx, req.Header)
+	if err := r.authorize(req, requestBody, apiKey); err != nil {
+		return nil, err
+	}
+
+	release, err := r.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := r.httpClient.Do(req)
+	r.logRequest(req, requestBody, resp, err, time.Since(start))
 	if err != nil {
+		release()
 		return nil, err
 	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
 	return resp, nil
 }
 
@@ -52,123 +390,602 @@ func (RestStorage) CaddyModule() caddy.ModuleInfo {
 }
 
 func (r *RestStorage) Provision(ctx caddy.Context) error {
-	if !strings.HasSuffix(r.Endpoint, "/") {
-		r.Endpoint = r.Endpoint + "/"
-	}
+	expandPlaceholders(caddy.NewReplacer(), reflect.ValueOf(r).Elem())
 
-	repl := caddy.NewReplacer()
-	r.ApiKey = repl.ReplaceAll(r.ApiKey, "")
+	r.Endpoint = normalizeEndpoint(r.Endpoint)
+	r.Namespace = strings.Trim(r.Namespace, "/")
+	r.ctx = ctx
 	r.logger = ctx.Logger(r)
-	return nil
-}
+	if r.MaxConcurrentRequests > 0 {
+		r.limiter = newRequestLimiter(r.MaxConcurrentRequests)
+	}
 
-func (r RestStorage) Validate() error {
-	if r.Endpoint == "" {
-		return errors.New("endpoint must be specified")
+	if r.ErrorMessageField == "" {
+		r.ErrorMessageField = "error"
+	}
+	if r.ErrorCodeField == "" {
+		r.ErrorCodeField = "code"
 	}
 
-	if r.ApiKey == "" {
-		return errors.New("api key must be defined")
+	if r.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("determining instance id: %v", err)
+		}
+		r.InstanceID = hostname
 	}
 
-	return nil
-}
+	if r.ApiKeyFile != "" {
+		keyFile, err := newKeyFile(r.ApiKeyFile)
+		if err != nil {
+			return fmt.Errorf("loading api key file: %v", err)
+		}
+		r.keyFile = keyFile
+		go keyFile.watch(ctx, r.logger)
+	}
 
-func (r *RestStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	for d.Next() {
-		var value string
+	if r.Vault != nil {
+		vaultSecret, refresh, err := newVaultSecret(ctx, *r.Vault)
+		if err != nil {
+			return err
+		}
+		r.vaultSecret = vaultSecret
+		go vaultSecret.renew(ctx, refresh, r.logger)
+	}
 
-		key := d.Val()
+	if r.OAuth2 != nil {
+		r.tokenSource = r.OAuth2.tokenSource(ctx)
+	}
 
-		if !d.Args(&value) {
-			continue
+	if r.GCPIDToken != nil {
+		tokenSource, err := r.GCPIDToken.tokenSource(ctx)
+		if err != nil {
+			return err
 		}
+		r.tokenSource = tokenSource
+	}
 
-		switch key {
-		case "endpoint":
-			r.Endpoint = value
-		case "apikey":
-		case "apiKey":
-		case "ApiKey":
-			r.ApiKey = value
+	if r.AzureAD != nil {
+		r.tokenSource = r.AzureAD.tokenSource(ctx)
+	}
+
+	if r.JWT != nil {
+		tokenSource, err := r.JWT.tokenSource(ctx)
+		if err != nil {
+			return err
 		}
+		r.tokenSource = tokenSource
 	}
 
-	return nil
-}
+	if r.HMAC != nil {
+		r.HMAC.provision()
+	}
 
-func (r *RestStorage) CertMagicStorage() (certmagic.Storage, error) {
-	return r, nil
-}
+	if r.Cache != nil {
+		r.Cache.provision()
+	}
 
-type LockRequest struct {
-	Key string `json:"key"`
-}
+	if err := r.useClient(); err != nil {
+		return err
+	}
 
-func (r *RestStorage) Lock(ctx context.Context, key string) error {
-	for {
-		resp, err := r.client(ctx, "POST", "lock", LockRequest{Key: key})
+	if r.LogRequests != nil {
+		r.LogRequests.provision()
+	}
+
+	if r.FaultInjection != nil {
+		r.FaultInjection.provision()
+		r.logger.Warn("Fault injection is enabled; requests to the backend fail at random")
+	}
 
+	if r.Audit != nil {
+		auditLog, err := r.Audit.provision()
 		if err != nil {
 			return err
 		}
+		r.auditLog = auditLog
+	}
 
-		resp.Body.Close()
+	if r.DiskCache != nil {
+		diskCache, err := r.DiskCache.provision()
+		if err != nil {
+			return err
+		}
+		r.diskCache = diskCache
+	}
 
-		// The key was successfully locked
-		if resp.StatusCode == 201 {
-			return nil
+	if r.ChunkedUpload != nil {
+		r.ChunkedUpload.provision()
+	}
+
+	if r.Fallback != nil {
+		fallback, err := r.Fallback.provision(ctx, r.Endpoint+" "+r.Namespace)
+		if err != nil {
+			return err
 		}
+		r.fallback = fallback
+		go r.syncFallback(ctx)
+	}
 
-		if resp.StatusCode == 423 {
-			// 423: The key is already locked
-			r.logger.Info(fmt.Sprintf("Key %v is already locked.", key))
-		} else if resp.StatusCode == 412 {
-			// 412: An error occurred
-			r.logger.Error(fmt.Sprintf("Error locking key %v: %v ; Will try again.\n", key, resp.StatusCode))
-		} else {
-			// unknown error. return it
-			return fmt.Errorf("Unknown status code received: %v", resp.StatusCode)
+	if r.Mirror != nil {
+		mirror, err := r.Mirror.provision(ctx)
+		if err != nil {
+			return err
 		}
+		r.mirror = mirror
+		go r.syncMirror(ctx)
+	}
 
-		// Wait 5 seconds before trying again
-		time.Sleep(5 * time.Second)
+	if r.Compression != nil {
+		if err := r.Compression.provision(); err != nil {
+			return err
+		}
+	}
+
+	if r.Encryption != nil {
+		if err := r.Encryption.provision(ctx); err != nil {
+			return err
+		}
 	}
+
+	if r.AWSSigV4 != nil {
+		if r.Dialect == DialectS3 && r.AWSSigV4.Service == "" {
+			r.AWSSigV4.Service = "s3"
+		}
+		r.AWSSigV4.provision()
+	}
+
+	if r.StartupCheck == VersionCheckWarn || r.StartupCheck == VersionCheckRequire {
+		if err := r.checkConnection(ctx); err != nil {
+			if r.StartupCheck == VersionCheckRequire {
+				return fmt.Errorf("startup check: %v", err)
+			}
+			r.logger.Warn("Startup check failed", zap.Error(err))
+		}
+	}
+
+	if r.VersionCheck == VersionCheckWarn || r.VersionCheck == VersionCheckRequire || r.DetectCapabilities {
+		if err := r.handshake(ctx); err != nil {
+			if r.VersionCheck == VersionCheckRequire {
+				return fmt.Errorf("backend handshake: %v", err)
+			}
+			r.logger.Warn("Backend handshake failed; using the configured protocol", zap.Error(err))
+		}
+	}
+
+	if r.Watch != nil {
+		r.Watch.provision()
+		go r.watch(ctx)
+	}
+
+	if r.Prefetch != nil {
+		r.Prefetch.provision()
+		go r.prefetch(ctx)
+	}
+
+	if r.HealthCheck != nil {
+		r.HealthCheck.provision()
+		r.health = &healthState{state: HealthUnknown}
+		setHealthMetric(r.Endpoint, HealthUnknown)
+		go r.monitorHealth(ctx)
+	}
+
+	registerInstance(r)
+
+	return nil
 }
 
-type UnlockRequest struct {
-	Key string `json:"key"`
+// Cleanup releases the locks still held by this instance, so that
+// restarts don't leave them blocking other cluster members. On reloads that
+// keep the storage config, the locks and connections are handed over to the
+// new config instead.
+func (r *RestStorage) Cleanup() error {
+	unregisterInstance(r)
+
+	if r.Compression != nil {
+		defer r.Compression.cleanup()
+	}
+
+	// Deferred since unlocking below is audited.
+	defer r.auditLog.close()
+
+	if r.poolKey == "" {
+		return nil
+	}
+	deleted, err := clients.Delete(r.poolKey)
+	if err != nil || !deleted {
+		// Another config still uses the client.
+		return err
+	}
+
+	defer r.httpClient.CloseIdleConnections()
+	if r.grpcConn != nil {
+		// Deferred since unlocking below still needs the connection.
+		defer r.grpcConn.Close()
+	}
+
+	keys := r.locks.keys()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// The module's context is already canceled at this point.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var errs []error
+	for _, key := range keys {
+		if err := r.unlock(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("unlocking %v: %w", key, err))
+			continue
+		}
+		r.logger.Info("Released lock on cleanup", zap.String("key", key))
+	}
+
+	return errors.Join(errs...)
 }
 
-func (r *RestStorage) Unlock(ctx context.Context, key string) error {
-	resp, err := r.client(ctx, "POST", "unlock", UnlockRequest{
-		Key: key,
-	})
+func (r *RestStorage) Validate() error {
+	if err := validateEndpoint(r.Endpoint); err != nil {
+		return err
+	}
 
-	if err != nil {
+	if r.apiKeySources() > 1 {
+		return errors.New("api key, api key file and vault are mutually exclusive")
+	}
+
+	if r.LockPollInterval < 0 || r.LockPollMaxInterval < 0 || r.LockTimeout < 0 || r.StaleLockThreshold < 0 {
+		return errors.New("lock durations must not be negative")
+	}
+
+	if r.SlowRequestThreshold < 0 {
+		return errors.New("slow_request_threshold must not be negative")
+	}
+
+	switch r.Dialect {
+	case "", DialectRPC, DialectREST, DialectWebDAV, DialectS3:
+	default:
+		return fmt.Errorf("unknown dialect %q", r.Dialect)
+	}
+
+	if isGRPCEndpoint(r.Endpoint) {
+		if r.Dialect != "" || r.Encoding != "" || r.RawValues || len(r.Routes) > 0 {
+			return errors.New("dialect, encoding, raw_values and routes don't apply to grpc endpoints")
+		}
+		if r.HMAC != nil || r.AWSSigV4 != nil {
+			return errors.New("hmac and aws_sigv4 are not supported with grpc endpoints")
+		}
+		if r.ConditionalLoad {
+			return errors.New("conditional_load is not supported with grpc endpoints")
+		}
+	}
+
+	if _, ok := codecs[r.Encoding]; r.Encoding != "" && !ok {
+		return fmt.Errorf("unknown encoding %q", r.Encoding)
+	}
+
+	if err := validateRoutes(r.Routes); err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
+	if err := validateStatusCodes(r.StatusCodes); err != nil {
+		return err
+	}
+
+	if err := validateCreateOnly(r.CreateOnly); err != nil {
+		return err
+	}
+
+	if err := validateValueSizes(r.MaxValueSize, r.ValueSizeWarning); err != nil {
+		return err
+	}
+
+	if err := validateTTLs(r.TTLs); err != nil {
+		return err
+	}
+
+	if r.ListPageSize < 0 {
+		return errors.New("list_page_size must not be negative")
+	}
+
+	if r.MaxConcurrentRequests < 0 {
+		return errors.New("max_concurrent_requests must not be negative")
+	}
+
+	if r.Namespace != "" {
+		if err := validateNamespace(r.Namespace); err != nil {
+			return err
+		}
+	}
+
+	switch r.KeyEncoding {
+	case "", KeyEncodingNone, KeyEncodingBase64URL, KeyEncodingSHA256, KeyEncodingPercent:
+	default:
+		return fmt.Errorf("unknown key_encoding %q", r.KeyEncoding)
+	}
+
+	switch r.VersionCheck {
+	case "", VersionCheckOff:
+	case VersionCheckWarn, VersionCheckRequire:
+	default:
+		return fmt.Errorf("unknown version_check %q", r.VersionCheck)
+	}
+
+	switch r.StartupCheck {
+	case "", VersionCheckOff:
+	case VersionCheckWarn, VersionCheckRequire:
+	default:
+		return fmt.Errorf("unknown startup_check %q", r.StartupCheck)
+	}
+
+	if (r.VersionCheck == VersionCheckWarn || r.VersionCheck == VersionCheckRequire || r.DetectCapabilities) &&
+		(r.Dialect == DialectWebDAV || r.Dialect == DialectS3) {
+		return fmt.Errorf("version_check and detect_capabilities are not supported by the %s dialect", r.Dialect)
+	}
+
+	if r.Cache != nil {
+		if err := r.Cache.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.DiskCache != nil {
+		if err := r.DiskCache.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Fallback != nil {
+		if err := r.Fallback.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Mirror != nil {
+		if err := r.Mirror.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Watch != nil {
+		if r.Dialect == DialectWebDAV || r.Dialect == DialectS3 {
+			return fmt.Errorf("watch is not supported by the %s dialect", r.Dialect)
+		}
+		if err := r.Watch.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Audit != nil {
+		if err := r.Audit.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.HealthCheck != nil {
+		if err := r.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.LogRequests != nil {
+		if err := r.LogRequests.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.FaultInjection != nil {
+		if err := r.FaultInjection.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Prefetch != nil {
+		if r.Cache == nil && r.DiskCache == nil {
+			return errors.New("prefetch requires cache or disk_cache")
+		}
+		if err := r.Prefetch.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.ChunkedUpload != nil {
+		if r.Dialect == DialectWebDAV || r.Dialect == DialectS3 {
+			return fmt.Errorf("chunked_upload is not supported by the %s dialect", r.Dialect)
+		}
+		if err := r.ChunkedUpload.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch r.LockMode {
+	case "", LockModeWait, LockModeFailFast:
+	default:
+		return fmt.Errorf("unknown lock_mode %q", r.LockMode)
+	}
+
+	switch r.ExistsMode {
+	case "", ExistsModeBody, ExistsModeHead:
+	default:
+		return fmt.Errorf("unknown exists_mode %q", r.ExistsMode)
+	}
+
+	if r.LockAttempts < 0 {
+		return errors.New("lock_attempts must not be negative")
+	}
+
+	if r.Dialect == DialectS3 && r.LockTTL != 0 {
+		return errors.New("lock_ttl is not supported by the s3 dialect; use stale_lock_threshold instead")
+	}
+
+	if r.LockTTL != 0 && time.Duration(r.LockTTL) < 3*time.Second {
+		return errors.New("lock_ttl must be at least 3s")
+	}
+
+	if r.ApiKeySecondary != "" && r.apiKeySources() == 0 {
+		return errors.New("a secondary api key requires a primary api key")
+	}
 
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	if r.Vault != nil {
+		if err := r.Vault.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.OAuth2 != nil {
+		if err := r.OAuth2.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.GCPIDToken != nil {
+		if err := r.GCPIDToken.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.AzureAD != nil {
+		if err := r.AzureAD.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.JWT != nil {
+		if err := r.JWT.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.bearerMethods() > 1 {
+		return errors.New("only one bearer token method may be configured")
+	}
+
+	if r.HMAC != nil {
+		if err := r.HMAC.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.AWSSigV4 != nil {
+		if err := r.AWSSigV4.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Compression != nil {
+		if err := r.Compression.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Encryption != nil {
+		if err := r.Encryption.validate(); err != nil {
+			return err
+		}
+	}
+
+	if !r.hasAuth() {
+		return errors.New("api key or another authentication method must be defined")
 	}
 
 	return nil
 }
 
+func (r *RestStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return r, nil
+}
+
 type StoreRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key string `json:"key" protobuf:"1"`
+	// Base64-encoded in JSON.
+	Value []byte `json:"value" protobuf:"2"`
+	// Fencing tokens of the locks held by this instance, keyed by lock name.
+	FencingTokens map[string]uint64 `json:"fencing_tokens,omitempty" protobuf:"3"`
+	// The ETag of the value this value replaces, with optimistic
+	// concurrency. Also sent as the If-Match header.
+	IfMatch string `json:"if_match,omitempty" protobuf:"4"`
+	// Requests that the value is only stored if the key doesn't exist.
+	// Also sent as the If-None-Match: * header.
+	CreateOnly bool `json:"create_only,omitempty" protobuf:"5"`
+	// The hex-encoded SHA-256 hash of the value, with checksums. Also sent
+	// as the x-checksum-sha256 header.
+	Checksum string `json:"checksum,omitempty" protobuf:"6"`
+	// Seconds after which the backend may delete the value; zero means
+	// never. Also sent as the x-storage-ttl header.
+	TTL int64 `json:"ttl,omitempty" protobuf:"7"`
 }
 
-func (r *RestStorage) Store(ctx context.Context, key string, value []byte) error {
-	valueEnc := base64.StdEncoding.EncodeToString(value)
-	resp, err := r.client(ctx, "POST", "store", StoreRequest{
-		Key:   key,
-		Value: valueEnc,
+func (r *RestStorage) Store(ctx context.Context, key string, value []byte) (err error) {
+	if err := r.checkWritable(opStore, key); err != nil {
+		return err
+	}
+	if r.DryRun {
+		r.logDryRun(opStore, r.backendKey(key), zap.Int("size", len(value)))
+		return nil
+	}
+
+	createOnly := r.createOnly(key)
+
+	defer func(start time.Time) { r.logFailure(opStore, key, start, err) }(time.Now())
+	defer func() {
+		if createOnly {
+			err = r.fallbackCreate(ctx, key, value, err)
+		} else {
+			err = r.fallbackStore(ctx, key, value, err)
+		}
+	}()
+	defer func() {
+		if err == nil {
+			r.mirrorStore(ctx, key, value)
+		}
+	}()
+
+	return r.store(ctx, r.backendKey(key), value, storeOptions{
+		createOnly: createOnly,
+		ttl:        r.keyTTL(key),
 	})
+}
+
+type storeOptions struct {
+	// Store only if the key doesn't exist.
+	createOnly bool
+	ttl        time.Duration
+}
+
+// store stores value at key, as named in the backend.
+func (r *RestStorage) store(ctx context.Context, key string, value []byte, opts storeOptions) (err error) {
+	r.invalidate(key)
+	defer func() {
+		r.audit(opStore, key, err)
+		if err == nil {
+			r.emitKey(EventStored, key)
+		}
+	}()
+
+	header, storeReq, err := r.storeRequest(key, value, opts)
+	if err != nil {
+		return err
+	}
+	value = storeReq.Value
+
+	switch r.Dialect {
+	case DialectWebDAV:
+		return r.webdavStore(ctx, key, value, header)
+	case DialectS3:
+		return r.s3Store(ctx, key, value, header)
+	}
+
+	if r.ChunkedUpload != nil && len(value) > r.ChunkedUpload.Threshold {
+		return r.storeChunked(ctx, key, value, header)
+	}
+
+	var resp *http.Response
+	if r.rawValues() {
+		resp, err = r.storeRaw(ctx, key, value, header)
+	} else {
+		storeReq.FencingTokens = r.locks.fencingTokens()
+		resp, err = r.call(ctx, opStore, key, header, storeReq)
+	}
 
 	if err != nil {
 		return err
@@ -176,64 +993,304 @@ func (r *RestStorage) Store(ctx context.Context, key string, value []byte) error
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	if !r.succeeded(opStore, resp, 201) {
+		return r.storeError(key, header, resp)
 	}
 
+	r.rememberETag(key, resp, "", value)
+	r.diskCache.put(key, value, r.logger)
+
 	return nil
 }
 
+// storeRequest prepares the Store of value at key: the value is compressed,
+// encrypted and checked against the size limit, and the conditions, checksum
+// and TTL are set in both the headers and the request.
+func (r *RestStorage) storeRequest(key string, value []byte, opts storeOptions) (http.Header, StoreRequest, error) {
+	if r.Compression != nil {
+		var err error
+		value, err = r.Compression.compress(value)
+		if err != nil {
+			return nil, StoreRequest{}, fmt.Errorf("compressing value of %v: %v", key, err)
+		}
+	}
+
+	if r.Encryption != nil {
+		var err error
+		value, err = r.Encryption.encrypt(key, value)
+		if err != nil {
+			return nil, StoreRequest{}, fmt.Errorf("encrypting value of %v: %v", key, err)
+		}
+	}
+
+	if err := r.checkValueSize(key, value); err != nil {
+		return nil, StoreRequest{}, err
+	}
+
+	header := http.Header{}
+	storeReq := StoreRequest{
+		Key:        key,
+		Value:      value,
+		CreateOnly: opts.createOnly,
+		TTL:        setTTL(header, opts.ttl),
+	}
+
+	if r.Checksums {
+		storeReq.Checksum = r.setChecksum(header, value)
+	}
+
+	if opts.createOnly {
+		header.Set("If-None-Match", "*")
+	} else if storeReq.IfMatch = r.ifMatch(key); storeReq.IfMatch != "" {
+		header.Set("If-Match", storeReq.IfMatch)
+	}
+
+	return header, storeReq, nil
+}
+
 type LoadRequest struct {
-	Key string `json:"key"`
+	Key string `json:"key" protobuf:"1"`
 }
 
 type LoadResponse struct {
-	Value string `json:"value"`
+	Value []byte `json:"value" protobuf:"1"`
+	// Used as the ETag of the value if the response has no ETag header.
+	Version string `json:"version,omitempty" protobuf:"2"`
+	// The hex-encoded SHA-256 hash of the value, verified with checksums.
+	Checksum string `json:"checksum,omitempty" protobuf:"3"`
 }
 
-func (r *RestStorage) Load(ctx context.Context, key string) ([]byte, error) {
-	resp, err := r.client(ctx, "POST", "load", LoadRequest{
-		Key: key,
+func (r *RestStorage) Load(ctx context.Context, key string) (value []byte, err error) {
+	defer func(key string, start time.Time) { r.logFailure(opLoad, key, start, err) }(key, time.Now())
+	defer func(key string) {
+		if r.usingFallback(ctx, opLoad, key, err) {
+			value, err = r.fallback.storage.Load(ctx, key)
+		}
+	}(key)
+
+	ttl := r.keyTTL(key)
+	related := r.relatedKeys(key)
+	key = r.backendKey(key)
+
+	if value, ok := r.values.get(key); ok {
+		return bytes.Clone(value), nil
+	}
+	if _, ok := r.missingKeys.get(key); ok {
+		return nil, fs.ErrNotExist
+	}
+
+	// Concurrent Loads of the same key, e.g. by TLS handshakes after a
+	// restart, share one backend request. It isn't canceled with the
+	// context of the Load that started it, which may not be the last one
+	// waiting for it.
+	result := r.loads.DoChan(key, func() (any, error) {
+		return r.loadValue(context.WithoutCancel(ctx), key, related, ttl)
 	})
 
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		value := res.Val.([]byte)
+		if res.Shared {
+			value = bytes.Clone(value)
+		}
+		return value, nil
+	}
+}
+
+// loadValue loads, decrypts and decompresses the value of key, as named in
+// the backend, and caches it unless key was invalidated in the meantime.
+func (r *RestStorage) loadValue(ctx context.Context, key string, related []string, ttl time.Duration) ([]byte, error) {
+	gen := r.loadGenerations.start(key)
+	defer r.loadGenerations.end(key)
+
+	value, err := r.load(ctx, key, related)
+	if errors.Is(err, fs.ErrNotExist) {
+		r.loadGenerations.fill(key, gen, func() { r.missingKeys.add(key, struct{}{}) })
+	}
+	if err != nil && unavailable(err) {
+		if cached, ok := r.diskCache.get(key, r.logger); ok {
+			value, err = cached, nil
+		}
+	} else if err == nil {
+		r.diskCache.put(key, value, r.logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value, err = r.openValue(ctx, key, value, ttl)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
+	r.loadGenerations.fill(key, gen, func() { r.values.add(key, bytes.Clone(value)) })
+	return value, nil
+}
 
-	if resp.StatusCode == 404 {
-		return nil, fs.ErrNotExist
+// openValue decrypts and decompresses value as loaded from the backend.
+func (r *RestStorage) openValue(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	var err error
+	current := true
+	if r.Encryption != nil {
+		value, current, err = r.Encryption.decrypt(ctx, key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Compression != nil {
+		value, err = r.Compression.decompress(value)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing value of %v: %v", key, err)
+		}
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	if !current && r.Encryption.ReencryptOnRead {
+		if err := r.store(ctx, key, value, storeOptions{ttl: ttl}); err != nil {
+			r.logger.Warn("Unable to re-encrypt value with the current key", zap.String("key", key), zap.Error(err))
+		} else {
+			r.logger.Debug("Re-encrypted value with the current key", zap.String("key", key))
+		}
 	}
 
-	var loadResp LoadResponse
+	return value, nil
+}
+
+// load returns the value of key as stored in the backend. The related keys,
+// if any, are loaded in the same batch request for their own Loads.
+func (r *RestStorage) load(ctx context.Context, key string, related []string) ([]byte, error) {
+	if value, ok := r.batchLoads.take(key); ok {
+		return value, nil
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&loadResp)
+	if len(related) > 0 {
+		values, err := r.loadBatch(ctx, append([]string{key}, related...))
+		if err == nil {
+			value, ok := values[key]
+			delete(values, key)
+			r.batchLoads.add(values)
+			if !ok {
+				return nil, fs.ErrNotExist
+			}
+			return value, nil
+		}
+		r.logger.Debug("Batch load failed; loading the key alone", zap.String("key", key), zap.Error(err))
+	}
+
+	if r.Dialect == DialectWebDAV || r.Dialect == DialectS3 {
+		return r.loadBody(ctx, key)
+	}
+
+	header := r.loadHeader(key)
+
+	var resp *http.Response
+	var err error
+	if r.rawValues() {
+		resp, err = r.loadRaw(ctx, key, header)
+	} else {
+		resp, err = r.call(ctx, opLoad, key, header, LoadRequest{
+			Key: key,
+		})
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	valueDec, err := base64.StdEncoding.DecodeString(loadResp.Value)
+	defer resp.Body.Close()
+
+	if r.notFound(opLoad, resp) {
+		return nil, fs.ErrNotExist
+	}
+
+	if value, ok := r.notModified(key, resp); ok {
+		return value, nil
+	}
+
+	if !r.succeeded(opLoad, resp, 200) {
+		return nil, r.statusError(resp)
+	}
+
+	if isRawValue(resp) {
+		value, err := readBody(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := r.verifyChecksum(key, resp, "", value); err != nil {
+			return nil, err
+		}
+
+		r.rememberETag(key, resp, "", value)
+
+		return value, nil
+	}
+
+	loadResp, err := decodeLoadResponse(resp)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return valueDec, nil
+	if err := r.verifyChecksum(key, resp, loadResp.Checksum, loadResp.Value); err != nil {
+		return nil, err
+	}
+
+	r.rememberETag(key, resp, loadResp.Version, loadResp.Value)
+
+	return loadResp.Value, nil
 }
 
 type DeleteRequest struct {
-	Key string `json:"key"`
+	Key           string            `json:"key" protobuf:"1"`
+	FencingTokens map[string]uint64 `json:"fencing_tokens,omitempty" protobuf:"2"`
 }
 
-func (r *RestStorage) Delete(ctx context.Context, key string) error {
-	resp, err := r.client(ctx, "DELETE", "delete", DeleteRequest{
-		Key: key,
+func (r *RestStorage) Delete(ctx context.Context, key string) (err error) {
+	if err := r.checkWritable(opDelete, key); err != nil {
+		return err
+	}
+	if r.DryRun {
+		r.logDryRun(opDelete, r.backendKey(key))
+		return nil
+	}
+
+	defer func(key string, start time.Time) { r.logFailure(opDelete, key, start, err) }(key, time.Now())
+	defer func(key string) { err = r.fallbackDelete(ctx, key, err) }(key)
+	defer func(key string) {
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			r.mirrorDelete(ctx, key)
+		}
+	}(key)
+
+	key = r.backendKey(key)
+	defer func() {
+		r.audit(opDelete, key, err)
+		if err == nil {
+			r.emitKey(EventDeleted, key)
+		}
+	}()
+
+	// Deleting a directory deletes the keys below it.
+	r.forgetETagPrefix(key)
+	r.invalidatePrefix(key)
+	r.diskCache.removePrefix(key)
+
+	switch r.Dialect {
+	case DialectWebDAV:
+		return r.webdavDelete(ctx, key)
+	case DialectS3:
+		return r.s3Delete(ctx, key)
+	}
+
+	resp, err := r.call(ctx, opDelete, key, nil, DeleteRequest{
+		Key:           key,
+		FencingTokens: r.locks.fencingTokens(),
 	})
 
 	if err != nil {
@@ -242,134 +1299,283 @@ func (r *RestStorage) Delete(ctx context.Context, key string) error {
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 {
+	if r.notFound(opDelete, resp) {
 		return fs.ErrNotExist
 	}
 
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	if !r.succeeded(opDelete, resp, 204) {
+		return r.statusError(resp)
 	}
 
 	return nil
 }
 
 type ExistsRequest struct {
-	Key string `json:"key"`
+	Key string `json:"key" protobuf:"1"`
 }
 
 type ExistsResponse struct {
-	Exists bool `json:"exists"`
+	Exists bool `json:"exists" protobuf:"1"`
 }
 
 func (r *RestStorage) Exists(ctx context.Context, key string) bool {
-	resp, err := r.client(ctx, "POST", "exists", ExistsRequest{
+	storageKey := key
+	key = r.backendKey(key)
+
+	if exists, ok := r.existence.get(key); ok {
+		return exists
+	}
+
+	start := time.Now()
+	exists, err := r.exists(ctx, key)
+	if err != nil {
+		if r.usingFallback(ctx, opExists, storageKey, err) {
+			return r.fallback.storage.Exists(ctx, storageKey)
+		}
+		r.logFailure(opExists, storageKey, start, err)
+		return false
+	}
+
+	r.existence.add(key, exists)
+
+	return exists
+}
+
+func (r *RestStorage) exists(ctx context.Context, key string) (bool, error) {
+	resp, err := r.call(ctx, opExists, key, nil, ExistsRequest{
 		Key: key,
 	})
 
 	if err != nil {
-		return false
+		return false, err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return false
+	if r.notFound(opExists, resp) {
+		return false, nil
+	}
+
+	if !r.succeeded(opExists, resp, 200) {
+		return false, r.statusError(resp)
+	}
+
+	// HEAD responses indicate existence by status code alone.
+	if resp.Request.Method == "HEAD" {
+		return true, nil
 	}
 
 	var existsResp ExistsResponse
 
-	err = json.NewDecoder(resp.Body).Decode(&existsResp)
+	err = decode(resp, &existsResp)
 
 	if err != nil {
-		return false
+		return false, err
 	}
 
-	return existsResp.Exists
+	return existsResp.Exists, nil
 }
 
 type ListRequest struct {
-	Prefix    string `json:"prefix"`
-	Recursive bool   `json:"recursive"`
+	Prefix    string `json:"prefix" protobuf:"1"`
+	Recursive bool   `json:"recursive" protobuf:"2"`
+	// The next_cursor of the previous page, if any.
+	Cursor string `json:"cursor,omitempty" protobuf:"3"`
+	// The maximum number of keys per page; zero leaves it to the backend.
+	Limit int64 `json:"limit,omitempty" protobuf:"4"`
+	// Only list keys matching this pattern (as in path.Match).
+	Pattern string `json:"pattern,omitempty" protobuf:"5"`
+	// Only list keys modified after this RFC 3339 timestamp.
+	ModifiedAfter string `json:"modified_after,omitempty" protobuf:"6"`
 }
 
 type ListResponse struct {
-	Keys []string `json:"keys"`
+	Keys []string `json:"keys" protobuf:"1"`
+	// Set if there are more keys, to be requested with this cursor.
+	NextCursor string `json:"next_cursor,omitempty" protobuf:"2"`
 }
 
-func (r *RestStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	resp, err := r.client(ctx, "POST", "list", ListRequest{
+func (r *RestStorage) List(ctx context.Context, prefix string, recursive bool) (keys []string, err error) {
+	defer func(start time.Time) { r.logFailure(opList, prefix, start, err) }(time.Now())
+	defer func() {
+		if r.usingFallback(ctx, opList, prefix, err) {
+			keys, err = r.fallback.storage.List(ctx, prefix, recursive)
+		}
+	}()
+
+	if r.KeyEncoding != "" && r.KeyEncoding != KeyEncodingNone {
+		return r.listEncoded(ctx, prefix, recursive)
+	}
+
+	keys, err = r.list(ctx, r.backendKey(prefix), recursive, ListFilter{})
+	if err != nil {
+		return nil, err
+	}
+	return r.storageKeys(keys), nil
+}
+
+// list lists the keys below prefix, as named in the backend. The filter is
+// sent to backends of the RPC and REST dialects, which may ignore it.
+func (r *RestStorage) list(ctx context.Context, prefix string, recursive bool, filter ListFilter) ([]string, error) {
+	switch r.Dialect {
+	case DialectWebDAV:
+		return r.webdavList(ctx, prefix, recursive)
+	case DialectS3:
+		return r.s3List(ctx, prefix, recursive)
+	}
+
+	var keys []string
+	var cursor string
+	for {
+		page, next, err := r.listPage(ctx, prefix, recursive, filter, cursor)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+
+		if next == "" {
+			return keys, nil
+		}
+		if next == cursor {
+			return nil, fmt.Errorf("listing %v: backend returned cursor %q again", prefix, next)
+		}
+		cursor = next
+	}
+}
+
+// listPage returns the page of keys at cursor, and the cursor of the next
+// page if there is one.
+func (r *RestStorage) listPage(ctx context.Context, prefix string, recursive bool, filter ListFilter, cursor string) ([]string, string, error) {
+	header := http.Header{}
+	header.Set("Accept", r.listAccept())
+
+	listReq := ListRequest{
 		Prefix:    prefix,
 		Recursive: recursive,
-	})
+		Cursor:    cursor,
+		Limit:     int64(r.ListPageSize),
+		Pattern:   filter.Pattern,
+	}
+	if !filter.ModifiedAfter.IsZero() {
+		listReq.ModifiedAfter = filter.ModifiedAfter.UTC().Format(time.RFC3339Nano)
+	}
+
+	resp, err := r.call(ctx, opList, prefix, header, listReq)
 
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 {
-		return nil, fs.ErrNotExist
+	if r.notFound(opList, resp) {
+		return nil, "", fs.ErrNotExist
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	if !r.succeeded(opList, resp, 200) {
+		return nil, "", r.statusError(resp)
 	}
 
-	var listResp ListResponse
+	// Streamed responses are never paginated.
+	if isNDJSON(resp) {
+		keys, err := decodeKeyLines(resp.Body)
+		return keys, "", err
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&listResp)
+	listResp, err := decodeListResponse(resp)
 
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return listResp.Keys, nil
+	return listResp.Keys, listResp.NextCursor, nil
 }
 
 type StatRequest struct {
-	Key string `json:"key"`
+	Key string `json:"key" protobuf:"1"`
 }
 
 type StatResponse struct {
-	Key        string `json:"key"`
-	Modified   string `json:"modified"`
-	Size       int64  `json:"size"`
-	IsTerminal bool   `json:"isTerminal"`
+	Key        string    `json:"key" protobuf:"1"`
+	Modified   Timestamp `json:"modified" protobuf:"2"`
+	Size       int64     `json:"size" protobuf:"3"`
+	IsTerminal bool      `json:"isTerminal" protobuf:"4"`
 }
 
-func (r *RestStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	resp, err := r.client(ctx, "POST", "stat", StatRequest{
-		Key: key,
-	})
+func (r *RestStorage) Stat(ctx context.Context, key string) (info certmagic.KeyInfo, err error) {
+	defer func(start time.Time) { r.logFailure(opStat, key, start, err) }(time.Now())
+	defer func() {
+		if r.usingFallback(ctx, opStat, key, err) {
+			info, err = r.fallback.storage.Stat(ctx, key)
+		}
+	}()
+
+	backendKey := r.backendKey(key)
 
+	if info, ok := r.keyInfos.get(backendKey); ok {
+		return info, nil
+	}
+	if exists, ok := r.existence.get(backendKey); ok && !exists {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+
+	info, err = r.stat(ctx, backendKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		r.existence.add(backendKey, false)
+	}
 	if err != nil {
 		return certmagic.KeyInfo{}, err
 	}
 
+	if storageKey, ok := r.storageKey(info.Key); ok {
+		info.Key = storageKey
+	} else {
+		// SHA-256 hashed keys can't be decoded.
+		info.Key = key
+	}
+
+	r.keyInfos.add(backendKey, info)
+	r.existence.add(backendKey, true)
+
+	return info, nil
+}
+
+func (r *RestStorage) stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if r.Dialect == DialectWebDAV {
+		return r.webdavStat(ctx, key)
+	}
+
+	resp, err := r.call(ctx, opStat, key, nil, StatRequest{
+		Key: key,
+	})
+
 	if err != nil {
 		return certmagic.KeyInfo{}, err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 {
+	if r.notFound(opStat, resp) {
 		return certmagic.KeyInfo{}, fs.ErrNotExist
 	}
 
-	if resp.StatusCode != 200 {
-		return certmagic.KeyInfo{}, fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	if !r.succeeded(opStat, resp, 200) {
+		return certmagic.KeyInfo{}, r.statusError(resp)
+	}
+
+	if resp.Request.Method == "HEAD" {
+		return r.statFromHeaders(key, resp)
 	}
 
 	var statResp StatResponse
 
-	err = json.NewDecoder(resp.Body).Decode(&statResp)
+	err = decode(resp, &statResp)
 
 	if err != nil {
 		return certmagic.KeyInfo{}, err
 	}
 
-	parsedTime, err := time.Parse(time.RFC3339, statResp.Modified)
+	parsedTime, err := r.parseTimestamp(string(statResp.Modified))
 
 	if err != nil {
 		return certmagic.KeyInfo{}, err
@@ -382,3 +1588,13 @@ func (r *RestStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo,
 		IsTerminal: statResp.IsTerminal,
 	}, nil
 }
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*RestStorage)(nil)
+	_ caddy.Validator        = (*RestStorage)(nil)
+	_ caddy.CleanerUpper     = (*RestStorage)(nil)
+	_ caddy.StorageConverter = (*RestStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*RestStorage)(nil)
+	_ certmagic.Storage      = (*RestStorage)(nil)
+)
@@ -0,0 +1,249 @@
+package rest_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rest "github.com/appmasker/caddy_rest_storage"
+	"github.com/appmasker/caddy_rest_storage/conformance"
+	"github.com/appmasker/caddy_rest_storage/resttest"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+// The tests check the semantics certmagic relies on against the storage
+// server, through the module.
+
+func newStorage(t *testing.T) (*resttest.Server, *rest.RestStorage) {
+	t.Helper()
+
+	server := resttest.NewServer()
+	t.Cleanup(server.Close)
+
+	return server, server.Storage(t, nil)
+}
+
+func TestServerConformance(t *testing.T) {
+	server := resttest.NewServer()
+	defer server.Close()
+
+	conformance.Test(t, conformance.Backend{
+		Endpoint: server.Endpoint,
+		APIKey:   server.APIKey,
+		Leases:   true,
+	})
+}
+
+func TestStoreLoad(t *testing.T) {
+	_, r := newStorage(t)
+	ctx := context.Background()
+
+	for _, value := range [][]byte{[]byte("value"), {}, {0, 1, 2, 0xff}} {
+		if err := r.Store(ctx, "a/b", value); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		loaded, err := r.Load(ctx, "a/b")
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if string(loaded) != string(value) {
+			t.Errorf("Load returned %q, stored %q", loaded, value)
+		}
+	}
+}
+
+func TestNotExist(t *testing.T) {
+	_, r := newStorage(t)
+	ctx := context.Background()
+
+	if _, err := r.Load(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of a missing key returned %v, not fs.ErrNotExist", err)
+	}
+	if _, err := r.Stat(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing key returned %v, not fs.ErrNotExist", err)
+	}
+	if _, err := r.List(ctx, "missing", false); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("List of a missing directory returned %v, not fs.ErrNotExist", err)
+	}
+	if r.Exists(ctx, "missing") {
+		t.Error("Exists returned true for a missing key")
+	}
+
+	if err := r.Store(ctx, "deleted", []byte("value")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := r.Delete(ctx, "deleted"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := r.Load(ctx, "deleted"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of a deleted key returned %v, not fs.ErrNotExist", err)
+	}
+	if r.Exists(ctx, "deleted") {
+		t.Error("Exists returned true for a deleted key")
+	}
+}
+
+func TestList(t *testing.T) {
+	_, r := newStorage(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"certs/a.crt", "certs/a.key", "certs/sub/b.crt", "other"} {
+		if err := r.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	tests := []struct {
+		recursive bool
+		want      []string
+	}{
+		{false, []string{"certs/a.crt", "certs/a.key", "certs/sub"}},
+		{true, []string{"certs/a.crt", "certs/a.key", "certs/sub/b.crt"}},
+	}
+	for _, test := range tests {
+		keys, err := r.List(ctx, "certs", test.recursive)
+		if err != nil {
+			t.Fatalf("List(recursive=%t): %v", test.recursive, err)
+		}
+		slices.Sort(keys)
+		if !slices.Equal(keys, test.want) {
+			t.Errorf("List(recursive=%t) returned %q, want %q", test.recursive, keys, test.want)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	_, r := newStorage(t)
+	ctx := context.Background()
+
+	before := time.Now().Add(-time.Second)
+	if err := r.Store(ctx, "dir/key", []byte("12345")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	info, err := r.Stat(ctx, "dir/key")
+	if err != nil {
+		t.Fatalf("Stat of a key: %v", err)
+	}
+	if info.Key != "dir/key" || !info.IsTerminal || info.Size != 5 {
+		t.Errorf("Stat of a key returned %+v", info)
+	}
+	if info.Modified.Before(before) {
+		t.Errorf("Stat of a key returned modification time %v, stored at %v", info.Modified, before)
+	}
+
+	info, err = r.Stat(ctx, "dir")
+	if err != nil {
+		t.Fatalf("Stat of a directory: %v", err)
+	}
+	if info.Key != "dir" || info.IsTerminal {
+		t.Errorf("Stat of a directory returned %+v", info)
+	}
+}
+
+func TestLockMutualExclusion(t *testing.T) {
+	server := resttest.NewServer()
+	defer server.Close()
+
+	// Instances with different IDs don't share their held locks, like
+	// separate Caddy instances.
+	instances := make([]certmagic.Storage, 3)
+	for i := range instances {
+		instances[i] = server.Storage(t, &rest.RestStorage{
+			InstanceID:       "instance-" + string(rune('a'+i)),
+			LockPollInterval: caddy.Duration(5 * time.Millisecond),
+		})
+	}
+
+	ctx := context.Background()
+	var holders, violations atomic.Int32
+	var wg sync.WaitGroup
+	for _, storage := range instances {
+		for worker := 0; worker < 3; worker++ {
+			wg.Add(1)
+			go func(storage certmagic.Storage) {
+				defer wg.Done()
+				for i := 0; i < 10; i++ {
+					if err := storage.Lock(ctx, "issue_cert_example.com"); err != nil {
+						t.Errorf("Lock: %v", err)
+						return
+					}
+					if holders.Add(1) > 1 {
+						violations.Add(1)
+					}
+					time.Sleep(time.Millisecond)
+					holders.Add(-1)
+					if err := storage.Unlock(ctx, "issue_cert_example.com"); err != nil {
+						t.Errorf("Unlock: %v", err)
+						return
+					}
+				}
+			}(storage)
+		}
+	}
+	wg.Wait()
+
+	if n := violations.Load(); n > 0 {
+		t.Errorf("the lock was held by more than one holder %d times", n)
+	}
+}
+
+func TestLockFailFast(t *testing.T) {
+	server := resttest.NewServer()
+	defer server.Close()
+	ctx := context.Background()
+
+	holder := server.Storage(t, &rest.RestStorage{InstanceID: "holder"})
+	other := server.Storage(t, &rest.RestStorage{
+		InstanceID:   "other",
+		LockMode:     rest.LockModeFailFast,
+		LockAttempts: 1,
+	})
+
+	if err := holder.Lock(ctx, "key"); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	var locked *rest.LockedError
+	if err := other.Lock(ctx, "key"); !errors.As(err, &locked) {
+		t.Fatalf("Lock of a held lock returned %v, not a LockedError", err)
+	}
+
+	if err := holder.Unlock(ctx, "key"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := other.Lock(ctx, "key"); err != nil {
+		t.Fatalf("Lock of a released lock: %v", err)
+	}
+	if err := other.Unlock(ctx, "key"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+}
+
+func TestLockBackendFailure(t *testing.T) {
+	server := resttest.NewServer()
+	defer server.Close()
+	ctx := context.Background()
+
+	r := server.Storage(t, &rest.RestStorage{InstanceID: "holder"})
+	if err := r.Lock(ctx, "key"); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	// A lock the backend can't confirm must not be granted.
+	server.Inject(resttest.Fault{Op: "lock", Status: 503})
+	other := server.Storage(t, &rest.RestStorage{
+		InstanceID:   "other",
+		LockMode:     rest.LockModeFailFast,
+		LockAttempts: 1,
+	})
+	if err := other.Lock(ctx, "key"); err == nil {
+		t.Fatal("Lock succeeded while the backend failed")
+	}
+}
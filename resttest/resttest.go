@@ -0,0 +1,228 @@
+// Package resttest provides a storage backend for tests of code using the
+// rest storage module, so they don't need an external service. Like
+// net/http/httptest, it starts a server on a loopback address:
+//
+//	server := resttest.NewServer()
+//	defer server.Close()
+//
+//	storage := server.Storage(t, nil)
+//
+// The server is rest_storage_server serving keys kept in memory, so it
+// implements the whole API of the default dialect, including locks with
+// leases and fencing tokens. Faults can be injected to test how the code
+// copes with failing or slow backends.
+package resttest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	rest "github.com/appmasker/caddy_rest_storage"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Server is a storage backend serving the keys from memory.
+type Server struct {
+	*httptest.Server
+
+	// The endpoint to configure in the rest storage module.
+	Endpoint string
+	// The API key the server accepts in the x-api-key header.
+	APIKey string
+
+	handler *rest.StorageServer
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	faults   []*Fault
+	requests map[string]int
+}
+
+// Fault makes the server delay or fail requests.
+type Fault struct {
+	// The operation of the requests, e.g. "load" or "lock". Empty matches
+	// all operations.
+	Op string
+	// How long to wait before responding.
+	Delay time.Duration
+	// The status to respond with instead of serving the request. Zero
+	// serves the request after Delay.
+	Status int
+	// Closes the connection instead of responding.
+	Drop bool
+	// How many requests the fault applies to. Zero applies it to all
+	// requests until the faults are cleared.
+	Times int
+}
+
+// NewServer starts a server with empty storage. It panics if the server
+// can't be set up, like httptest.NewServer.
+func NewServer() *Server {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic("resttest: " + err.Error())
+	}
+	name := hex.EncodeToString(id)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+
+	s := &Server{
+		APIKey: name,
+		handler: &rest.StorageServer{
+			// Each server has its own storage, and with it its own locks.
+			StorageRaw: caddyconfig.JSONModuleObject(rest.MemoryStorage{Name: "resttest-" + name}, "module", "rest_memory", nil),
+			ApiKeys:    []string{name},
+		},
+		cancel:   cancel,
+		requests: make(map[string]int),
+	}
+	if err := s.handler.Provision(ctx); err != nil {
+		cancel()
+		panic("resttest: provisioning the storage server: " + err.Error())
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.Endpoint = s.URL + "/"
+
+	return s
+}
+
+// Close shuts down the server and discards the storage.
+func (s *Server) Close() {
+	s.Server.Close()
+	s.cancel()
+}
+
+// Storage returns the rest storage module r, provisioned to use the
+// server. r may be nil; its endpoint and API key are set if empty. The
+// module is cleaned up when the test ends.
+func (s *Server) Storage(t testing.TB, r *rest.RestStorage) *rest.RestStorage {
+	t.Helper()
+
+	if r == nil {
+		r = new(rest.RestStorage)
+	}
+	if r.Endpoint == "" {
+		r.Endpoint = s.Endpoint
+	}
+	if r.ApiKey == "" {
+		r.ApiKey = s.APIKey
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	err := r.Provision(ctx)
+	t.Cleanup(func() { r.Cleanup() })
+	if err != nil {
+		t.Fatalf("provisioning the rest storage: %v", err)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatalf("validating the rest storage: %v", err)
+	}
+
+	return r
+}
+
+// Config returns the JSON config of the rest storage module using the
+// server, e.g. to use it in a Caddy config.
+func (s *Server) Config() json.RawMessage {
+	return caddyconfig.JSONModuleObject(rest.RestStorage{Endpoint: s.Endpoint, ApiKey: s.APIKey}, "module", "rest", nil)
+}
+
+// Inject adds a fault. Faults apply in the order they were added; the
+// first one matching a request is used.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// Requests returns how many requests for op the server received, or for
+// all operations if op is empty, including those failed by faults.
+func (s *Server) Requests(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if op != "" {
+		return s.requests[op]
+	}
+	var total int
+	for _, n := range s.requests {
+		total += n
+	}
+	return total
+}
+
+// fault counts the request for op and returns the fault to apply to it,
+// if any.
+func (s *Server) fault(op string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[op]++
+
+	for i, fault := range s.faults {
+		if fault.Op != "" && fault.Op != op {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = slices.Delete(s.faults, i, i+1)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if fault := s.fault(path.Base(req.URL.Path)); fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if fault.Drop {
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if fault.Status != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(fault.Status)
+			json.NewEncoder(w).Encode(map[string]string{"error": "injected fault"})
+			return
+		}
+	}
+
+	s.handler.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+		http.NotFound(w, req)
+		return nil
+	}))
+}
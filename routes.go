@@ -0,0 +1,263 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DialectRPC POSTs JSON requests to one path per operation. This is
+	// the default.
+	DialectRPC = "rpc"
+	// DialectREST uses HTTP methods on /keys/{key} and /locks/{key}.
+	DialectREST = "rest"
+)
+
+const (
+	// Exists requests are sent as in the dialect. This is the default.
+	ExistsModeBody = "body"
+	// Exists requests are HEAD requests, answered by status code alone.
+	ExistsModeHead = "head"
+)
+
+// The storage operations, as used in routes.
+const (
+	opStore  = "store"
+	opLoad   = "load"
+	opDelete = "delete"
+	opExists = "exists"
+	opList   = "list"
+	opStat   = "stat"
+	opLock   = "lock"
+	opUnlock = "unlock"
+	opRenew  = "renew"
+	opInfo   = "info"
+
+	opUploadInit   = "upload_init"
+	opUploadAppend = "upload_append"
+	opUploadStatus = "upload_status"
+	opUploadCommit = "upload_commit"
+
+	opStoreBatch  = "store_batch"
+	opDeleteBatch = "delete_batch"
+	opLoadBatch   = "load_batch"
+	opStatBatch   = "stat_batch"
+
+	opDeletePrefix = "delete_prefix"
+
+	opWatch = "watch"
+
+	opListValues = "list_values"
+)
+
+// Route is the HTTP method and path used for a storage operation.
+type Route struct {
+	Method string `json:"method,omitempty"`
+	// Relative to the endpoint. {key} is replaced with the URL-encoded key.
+	Path string `json:"path,omitempty"`
+}
+
+var rpcRoutes = map[string]Route{
+	opStore:  {"POST", "store"},
+	opLoad:   {"POST", "load"},
+	opDelete: {"DELETE", "delete"},
+	opExists: {"POST", "exists"},
+	opList:   {"POST", "list"},
+	opStat:   {"POST", "stat"},
+	opLock:   {"POST", "lock"},
+	opUnlock: {"POST", "unlock"},
+	opRenew:  {"POST", "renew"},
+	opInfo:   {"GET", "info"},
+
+	opUploadInit:   {"POST", "upload_init"},
+	opUploadAppend: {"POST", "upload_append"},
+	opUploadStatus: {"POST", "upload_status"},
+	opUploadCommit: {"POST", "upload_commit"},
+
+	opStoreBatch:  {"POST", "store_batch"},
+	opDeleteBatch: {"POST", "delete_batch"},
+	opLoadBatch:   {"POST", "load_batch"},
+	opStatBatch:   {"POST", "stat_batch"},
+
+	opDeletePrefix: {"POST", "delete_prefix"},
+
+	opWatch: {"POST", "watch"},
+
+	opListValues: {"POST", "list_values"},
+}
+
+var restRoutes = map[string]Route{
+	opStore:  {"PUT", "keys/{key}"},
+	opLoad:   {"GET", "keys/{key}"},
+	opDelete: {"DELETE", "keys/{key}"},
+	opExists: {"HEAD", "keys/{key}"},
+	opList:   {"GET", "keys"},
+	opStat:   {"HEAD", "keys/{key}"},
+	opLock:   {"POST", "locks/{key}"},
+	opUnlock: {"DELETE", "locks/{key}"},
+	opRenew:  {"PUT", "locks/{key}"},
+	opInfo:   {"GET", "info"},
+
+	// The upload ID takes the place of the key.
+	opUploadInit:   {"POST", "uploads"},
+	opUploadAppend: {"PATCH", "uploads/{key}"},
+	opUploadStatus: {"GET", "uploads/{key}"},
+	opUploadCommit: {"POST", "uploads/{key}/commit"},
+
+	opStoreBatch:  {"POST", "batch/store"},
+	opDeleteBatch: {"POST", "batch/delete"},
+	opLoadBatch:   {"POST", "batch/load"},
+	opStatBatch:   {"POST", "batch/stat"},
+
+	opDeletePrefix: {"DELETE", "prefixes/{key}"},
+
+	opWatch: {"GET", "watch"},
+
+	opListValues: {"GET", "values"},
+}
+
+// route returns the method and path for op on key, and whether the key is
+// part of the path.
+func (r *RestStorage) route(op, key string) (string, string, bool) {
+	rt := r.routeTemplate(op)
+
+	escaped := url.PathEscape(key)
+	if r.Dialect == DialectWebDAV || r.Dialect == DialectS3 {
+		escaped = escapeKeyPath(key)
+	}
+
+	keyInPath := strings.Contains(rt.Path, "{key}")
+	path := strings.ReplaceAll(rt.Path, "{key}", escaped)
+
+	return rt.Method, path, keyInPath
+}
+
+// routeTemplate returns the route of op, with {key} in its path if the key
+// is part of it. Routes configured by the user take precedence over those
+// of the dialect.
+func (r *RestStorage) routeTemplate(op string) Route {
+	rt := rpcRoutes[op]
+	switch r.Dialect {
+	case DialectREST:
+		rt = restRoutes[op]
+	case DialectWebDAV:
+		rt = webdavRoutes[op]
+	case DialectS3:
+		rt = s3Routes[op]
+	}
+
+	if op == opExists && r.ExistsMode == ExistsModeHead {
+		rt.Method = "HEAD"
+	}
+
+	if override, ok := r.Routes[op]; ok {
+		if override.Method != "" {
+			rt.Method = override.Method
+		}
+		if override.Path != "" {
+			rt.Path = strings.TrimPrefix(override.Path, "/")
+		}
+	}
+
+	return rt
+}
+
+// escapeKeyPath escapes each segment of key, keeping the slashes between
+// them so that keys map to nested paths.
+func escapeKeyPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func validateRoutes(routes map[string]Route) error {
+	for op, rt := range routes {
+		if _, ok := rpcRoutes[op]; !ok {
+			return fmt.Errorf("routes: unknown operation %q", op)
+		}
+		if rt.Method != "" && strings.ToUpper(rt.Method) != rt.Method {
+			return fmt.Errorf("routes: method of %s must be upper case", op)
+		}
+	}
+	return nil
+}
+
+// call sends dataStruct to the route of op on key. GET and HEAD requests
+// have no body, so the fields of dataStruct are sent as query parameters.
+// With a gRPC endpoint, the Storage method of op is invoked instead.
+func (r *RestStorage) call(ctx context.Context, op, key string, header http.Header, dataStruct any) (*http.Response, error) {
+	if r.grpcConn != nil {
+		return r.callGRPC(ctx, op, key, dataStruct)
+	}
+
+	method, path, keyInPath := r.route(op, key)
+
+	if header == nil {
+		header = http.Header{}
+	}
+
+	c := r.codec()
+	if header.Get("Accept") == "" && c.contentType() != "application/json" {
+		header.Set("Accept", c.contentType()+", application/json;q=0.5")
+	}
+
+	if method == "GET" || method == "HEAD" {
+		query, err := queryParams(dataStruct, keyInPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+		return r.request(ctx, op, key, method, path, header, nil)
+	}
+
+	requestBody, err := c.marshal(dataStruct)
+	if err != nil {
+		return nil, err
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", c.contentType())
+	}
+
+	return r.request(ctx, op, key, method, path, header, requestBody)
+}
+
+// queryParams flattens the JSON fields of dataStruct into query parameters.
+func queryParams(dataStruct any, skipKey bool) (url.Values, error) {
+	encoded, err := json.Marshal(dataStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	for name, value := range fields {
+		if skipKey && name == "key" {
+			continue
+		}
+		switch value := value.(type) {
+		case nil:
+		case string:
+			query.Set(name, value)
+		default:
+			query.Set(name, fmt.Sprint(value))
+		}
+	}
+
+	return query, nil
+}
+
+func (r *RestStorage) rawValues() bool {
+	return r.RawValues || r.Dialect == DialectREST
+}
@@ -0,0 +1,207 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DialectS3 stores keys as objects in an S3 bucket, whose URL is the
+// endpoint. Locks are lock objects created with conditional writes.
+const DialectS3 = "s3"
+
+var s3Routes = map[string]Route{
+	opStore:  {"PUT", "{key}"},
+	opLoad:   {"GET", "{key}"},
+	opDelete: {"DELETE", "{key}"},
+	opExists: {"HEAD", "{key}"},
+	opList:   {"GET", ""},
+	opStat:   {"HEAD", "{key}"},
+	opLock:   {"PUT", "locks/{key}.lock"},
+	opUnlock: {"DELETE", "locks/{key}.lock"},
+}
+
+func (r *RestStorage) s3Store(ctx context.Context, key string, value []byte, header http.Header) error {
+	header.Set("Content-Type", rawContentType)
+
+	method, path, _ := r.route(opStore, key)
+
+	resp, err := r.request(ctx, opStore, key, method, path, header, value)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !r.succeeded(opStore, resp, 200) {
+		return r.storeError(key, header, resp)
+	}
+
+	r.rememberETag(key, resp, "", value)
+
+	return nil
+}
+
+// s3Delete deletes the object key and, since S3 has no directories, all
+// objects below key/.
+func (r *RestStorage) s3Delete(ctx context.Context, key string) error {
+	method, path, _ := r.route(opDelete, key)
+
+	resp, err := r.request(ctx, opDelete, key, method, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !r.succeeded(opDelete, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	children, err := r.s3List(ctx, key, true)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		method, path, _ := r.route(opDelete, child)
+
+		resp, err := r.request(ctx, opDelete, child, method, path, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if !r.succeeded(opDelete, resp, 204) {
+			return fmt.Errorf("deleting %v: %w", child, r.statusError(resp))
+		}
+	}
+
+	return nil
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// s3List lists the keys below prefix with ListObjectsV2. Without recursion,
+// the common prefixes stand in for directories.
+func (r *RestStorage) s3List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	method, path, _ := r.route(opList, prefix)
+
+	var keys []string
+	var continuationToken string
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if !recursive {
+			query.Set("delimiter", "/")
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := r.request(ctx, opList, prefix, method, path+"?"+query.Encode(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if !r.succeeded(opList, resp, 200) {
+			resp.Body.Close()
+			return nil, r.statusError(resp)
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding ListObjectsV2 response: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			keys = append(keys, strings.TrimSuffix(commonPrefix.Prefix, "/"))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// s3Lock creates the lock object of key if it doesn't exist. The lock
+// object describes its holder like the body of a 423 response, so if it
+// already exists, the response to reading it is returned as a 423.
+func (r *RestStorage) s3Lock(ctx context.Context, key string) (*http.Response, error) {
+	body, err := json.Marshal(LockedResponse{
+		Holder:     r.InstanceID,
+		AcquiredAt: Timestamp(time.Now().UTC().Format(time.RFC3339)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("If-None-Match", "*")
+
+	method, path, _ := r.route(opLock, key)
+
+	resp, err := r.request(ctx, opLock, key, method, path, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// 412: The lock object exists. 409: Another instance is creating it
+	// at the same time.
+	if resp.StatusCode != 412 && resp.StatusCode != 409 {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	resp, err = r.request(ctx, opLock, key, "GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// 404: The lock was released in the meantime; try again later.
+	if resp.StatusCode == 200 || resp.StatusCode == 404 {
+		resp.StatusCode = 423
+	}
+
+	return resp, nil
+}
+
+func (r *RestStorage) s3Unlock(ctx context.Context, key string) error {
+	method, path, _ := r.route(opUnlock, key)
+
+	resp, err := r.request(ctx, opUnlock, key, method, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !r.succeeded(opUnlock, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	return nil
+}
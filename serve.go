@@ -0,0 +1,135 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/filestorage"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func serveCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve --root <dir> | --database <file> [--listen <addr>] (--api-key <key>... | --insecure) [--access-log]",
+		Short: "Runs a storage backend that stores the keys in a directory or SQLite database",
+		Long: `
+Runs the reference implementation of the API the rest storage module speaks,
+storing the keys in the directory --root, or in the SQLite database file
+--database, so rest storage modules can use it as their endpoint without a
+separate backend service. It implements all operations, including locks
+with leases and fencing tokens, conditional and create-only stores,
+batches, chunked uploads and watching.
+
+Requests are served on --listen (default localhost:8080, so only local
+clients can connect; e.g. :8080 listens on all interfaces) at any path,
+e.g. with the endpoint http://localhost:8080/. They must carry one of the
+API keys given with --api-key; the server refuses to start without one,
+unless --insecure is given to serve requests without authentication. With
+--root, locks are kept in memory, so they are lost when the server
+restarts; with --database, they are kept in the database.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdServe),
+	}
+	cmd.Flags().StringP("root", "r", "", "The directory to store the keys in")
+	cmd.Flags().StringP("database", "d", "", "The SQLite database file to store the keys and locks in")
+	cmd.Flags().StringP("listen", "l", "localhost:8080", "The address to listen on")
+	cmd.Flags().StringArray("api-key", nil, "An API key accepted in the x-api-key header (repeatable)")
+	cmd.Flags().Bool("insecure", false, "Serve requests without authentication if no --api-key is given")
+	cmd.Flags().Int64("max-body-size", 64<<20, "The maximum size of request bodies in bytes")
+	cmd.Flags().Bool("access-log", false, "Enable the access log")
+	return cmd
+}
+
+func cmdServe(fl caddycmd.Flags) (int, error) {
+	root := fl.String("root")
+	database := fl.String("database")
+	listen := fl.String("listen")
+	apiKeys, _ := fl.GetStringArray("api-key")
+	maxBodySize, _ := fl.GetInt64("max-body-size")
+
+	if (root == "") == (database == "") {
+		return caddy.ExitCodeFailedStartup, errors.New("either --root or --database is required")
+	}
+	insecure := fl.Bool("insecure")
+	if len(apiKeys) == 0 && !insecure {
+		return caddy.ExitCodeFailedStartup, errors.New("--api-key is required; give --insecure to serve requests without authentication")
+	}
+	if len(apiKeys) > 0 && insecure {
+		return caddy.ExitCodeFailedStartup, errors.New("--api-key and --insecure are mutually exclusive")
+	}
+
+	location := root
+	if database != "" {
+		location = database
+	}
+	location, err := filepath.Abs(location)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	storageRaw := caddyconfig.JSONModuleObject(filestorage.FileStorage{Root: location}, "module", "file_system", nil)
+	if database != "" {
+		storageRaw = caddyconfig.JSONModuleObject(&SQLiteStorage{Path: location}, "module", "rest_sqlite", nil)
+	}
+
+	handler := StorageServer{
+		StorageRaw:     storageRaw,
+		ApiKeys:        apiKeys,
+		InsecureNoAuth: insecure,
+		MaxBodySize:    maxBodySize,
+	}
+	route := caddyhttp.Route{
+		HandlersRaw: []json.RawMessage{
+			caddyconfig.JSONModuleObject(&handler, "handler", "rest_storage_server", nil),
+			// Requests for unknown operations fall through to here.
+			caddyconfig.JSONModuleObject(caddyhttp.StaticResponse{
+				StatusCode: caddyhttp.WeakString("404"),
+			}, "handler", "static_response", nil),
+		},
+	}
+
+	server := &caddyhttp.Server{
+		Listen:            []string{listen},
+		ReadHeaderTimeout: caddy.Duration(10 * time.Second),
+		IdleTimeout:       caddy.Duration(2 * time.Minute),
+		Routes:            caddyhttp.RouteList{route},
+	}
+	if fl.Bool("access-log") {
+		server.Logs = &caddyhttp.ServerLogConfig{}
+	}
+
+	httpApp := caddyhttp.App{
+		Servers: map[string]*caddyhttp.Server{"rest_storage": server},
+	}
+
+	var persist bool
+	cfg := &caddy.Config{
+		Admin: &caddy.AdminConfig{
+			Disabled: true,
+			Config:   &caddy.ConfigSettings{Persist: &persist},
+		},
+		AppsRaw: caddy.ModuleMap{
+			"http": caddyconfig.JSON(httpApp, nil),
+		},
+	}
+
+	// Like caddy run, stop gracefully on SIGINT and SIGTERM.
+	caddy.TrapSignals()
+
+	if err := caddy.Run(cfg); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	caddy.Log().Info("Serving the storage",
+		zap.String("location", location),
+		zap.String("listen", listen),
+		zap.Bool("authenticated", !insecure))
+
+	select {}
+}
@@ -0,0 +1,32 @@
+package rest
+
+import (
+	"strings"
+	"testing"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func TestServeRequiresAuth(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--root", "/tmp/storage"}, "--api-key is required"},
+		{[]string{"--root", "/tmp/storage", "--api-key", "key", "--insecure"}, "mutually exclusive"},
+	}
+	for _, test := range tests {
+		cmd := serveCommand()
+		if err := cmd.ParseFlags(test.args); err != nil {
+			t.Fatal(err)
+		}
+		_, err := cmdServe(caddycmd.Flags{FlagSet: cmd.Flags()})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("serve %s returned %v, want %q", strings.Join(test.args, " "), err, test.err)
+		}
+	}
+
+	if listen := serveCommand().Flags().Lookup("listen").DefValue; listen != "localhost:8080" {
+		t.Errorf("serve listens on %s by default", listen)
+	}
+}
@@ -0,0 +1,861 @@
+package rest
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// StorageServer is an HTTP handler that serves the storage API this module
+// speaks, in the default RPC dialect, backed by any storage module. That
+// lets one Caddy instance be the storage backend of a fleet, or chain
+// storages, without a separate backend service.
+//
+// Requests are answered in the encoding they were sent in. Locks are kept
+// in memory, so the clients sharing locks must all talk to the same Caddy
+// instance.
+type StorageServer struct {
+	// The storage module to serve, e.g. {"module": "file_system", "root":
+	// "..."}. Defaults to the storage configured for Caddy.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	// The api keys accepted in the x-api-key header. Required unless
+	// insecure_no_auth is set.
+	ApiKeys []string `json:"api_keys,omitempty"`
+	// Serves requests without authenticating them, e.g. behind a proxy
+	// that does. Anyone who can reach the handler can then read and
+	// overwrite the storage, including private keys.
+	InsecureNoAuth bool `json:"insecure_no_auth,omitempty"`
+	// The maximum size of request bodies in bytes. Defaults to 64 MiB.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	storage certmagic.Storage
+	state   *serverState
+	locks   serverLocker
+	logger  *zap.Logger
+}
+
+func (*StorageServer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.rest_storage_server",
+		New: func() caddy.Module { return new(StorageServer) },
+	}
+}
+
+func (s *StorageServer) Provision(ctx caddy.Context) error {
+	expandPlaceholders(caddy.NewReplacer(), reflect.ValueOf(s).Elem())
+
+	s.logger = ctx.Logger()
+	if s.InsecureNoAuth {
+		s.logger.Warn("insecure_no_auth is set; requests are not authenticated")
+	}
+
+	if s.MaxBodySize == 0 {
+		s.MaxBodySize = 64 << 20
+	}
+
+	if len(s.StorageRaw) > 0 {
+		storage, err := loadStorageModule(ctx, s.StorageRaw)
+		if err != nil {
+			return err
+		}
+		s.storage = storage
+	} else {
+		s.storage = ctx.Storage()
+	}
+
+	// Locks, uploads and events survive config reloads, as long as the
+	// storage stays the same.
+	s.state = serverStateFor(string(s.StorageRaw))
+	s.locks = s.state.locks
+	if locker, ok := s.storage.(serverLocker); ok {
+		s.locks = locker
+	}
+
+	return nil
+}
+
+// serverState is the state of the storage servers serving the same storage
+// that isn't kept in the storage itself.
+type serverState struct {
+	locks   *serverLocks
+	writes  *writeLocks
+	uploads *serverUploads
+	events  *serverEvents
+}
+
+// allServerStates are the states of each storage, by its JSON config.
+var allServerStates struct {
+	mu     sync.Mutex
+	states map[string]*serverState
+}
+
+func serverStateFor(storage string) *serverState {
+	allServerStates.mu.Lock()
+	defer allServerStates.mu.Unlock()
+
+	if allServerStates.states == nil {
+		allServerStates.states = make(map[string]*serverState)
+	}
+	state, ok := allServerStates.states[storage]
+	if !ok {
+		state = &serverState{
+			locks:   newServerLocks(),
+			writes:  newWriteLocks(),
+			uploads: newServerUploads(),
+			events:  newServerEvents(),
+		}
+		allServerStates.states[storage] = state
+	}
+	return state
+}
+
+func (s *StorageServer) Validate() error {
+	if s.MaxBodySize < 0 {
+		return errors.New("max_body_size must not be negative")
+	}
+	if len(s.ApiKeys) == 0 && !s.InsecureNoAuth {
+		return errors.New("api_keys must be specified; set insecure_no_auth to serve requests without authentication")
+	}
+	if len(s.ApiKeys) > 0 && s.InsecureNoAuth {
+		return errors.New("api_keys and insecure_no_auth are mutually exclusive")
+	}
+	for _, key := range s.ApiKeys {
+		if key == "" {
+			return errors.New("api_keys must not be empty")
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens:
+//
+//	rest_storage_server {
+//		storage file_system /var/lib/caddy-storage
+//		api_keys {env.STORAGE_API_KEY}
+//		max_body_size 1048576
+//	}
+//
+// The options are parsed like those of the storage module.
+func (s *StorageServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		if err := unmarshalField(d, reflect.ValueOf(s).Elem(), d.Val(), d.Val()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseStorageServer(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	s := new(StorageServer)
+	err := s.UnmarshalCaddyfile(h.Dispenser)
+	return s, err
+}
+
+// serverHandlers are the operations the server implements, by the last
+// segment of their path.
+var serverHandlers = map[string]func(*StorageServer, http.ResponseWriter, *http.Request) error{
+	opStore:        (*StorageServer).serveStore,
+	opLoad:         (*StorageServer).serveLoad,
+	opDelete:       (*StorageServer).serveDelete,
+	opExists:       (*StorageServer).serveExists,
+	opList:         (*StorageServer).serveList,
+	opStat:         (*StorageServer).serveStat,
+	opLock:         (*StorageServer).serveLock,
+	opUnlock:       (*StorageServer).serveUnlock,
+	opRenew:        (*StorageServer).serveRenew,
+	opInfo:         (*StorageServer).serveInfo,
+	opStoreBatch:   (*StorageServer).serveStoreBatch,
+	opDeleteBatch:  (*StorageServer).serveDeleteBatch,
+	opLoadBatch:    (*StorageServer).serveLoadBatch,
+	opStatBatch:    (*StorageServer).serveStatBatch,
+	opDeletePrefix: (*StorageServer).serveDeletePrefix,
+	opListValues:   (*StorageServer).serveListValues,
+	opUploadInit:   (*StorageServer).serveUploadInit,
+	opUploadAppend: (*StorageServer).serveUploadAppend,
+	opUploadStatus: (*StorageServer).serveUploadStatus,
+	opUploadCommit: (*StorageServer).serveUploadCommit,
+	opWatch:        (*StorageServer).serveWatch,
+}
+
+// ServeHTTP serves the operation named by the last segment of the request
+// path, e.g. /storage/store, and passes other requests on to next.
+func (s *StorageServer) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	op := path.Base(req.URL.Path)
+	handler, ok := serverHandlers[op]
+	if !ok {
+		return next.ServeHTTP(w, req)
+	}
+
+	method := rpcRoutes[op].Method
+	if req.Method != method && !(op == opExists && req.Method == http.MethodHead) {
+		w.Header().Set("Allow", method)
+		s.writeError(w, &serverError{http.StatusMethodNotAllowed, fmt.Sprintf("%s requires %s", op, method)})
+		return nil
+	}
+
+	if !s.authorized(req) {
+		s.writeError(w, &serverError{http.StatusUnauthorized, "invalid api key"})
+		return nil
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, s.MaxBodySize)
+
+	if err := handler(s, w, req); err != nil {
+		s.writeError(w, err)
+	}
+	return nil
+}
+
+// authorized reports whether req carries one of the api keys.
+func (s *StorageServer) authorized(req *http.Request) bool {
+	if s.InsecureNoAuth {
+		return true
+	}
+	apiKey := []byte(req.Header.Get("x-api-key"))
+	if len(apiKey) == 0 {
+		return false
+	}
+	for _, key := range s.ApiKeys {
+		if subtle.ConstantTimeCompare(apiKey, []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// serverError is an error response with the given status code.
+type serverError struct {
+	status  int
+	message string
+}
+
+func (e *serverError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...any) error {
+	return &serverError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+var errServerNotFound = &serverError{http.StatusNotFound, "key not found"}
+
+// errorStatus returns the status of err if it is a *serverError, and 500
+// otherwise.
+func errorStatus(err error) int {
+	var serverErr *serverError
+	if errors.As(err, &serverErr) {
+		return serverErr.status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError responds with the status of err, and its message in the error
+// field of a JSON object. Errors other than *serverError are logged and
+// answered with 500.
+func (s *StorageServer) writeError(w http.ResponseWriter, err error) {
+	var serverErr *serverError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &serverErr):
+	case errors.As(err, &maxBytesErr):
+		serverErr = &serverError{http.StatusRequestEntityTooLarge, err.Error()}
+	case errors.Is(err, fs.ErrNotExist):
+		serverErr = errServerNotFound
+	default:
+		s.logger.Error("Storage request failed", zap.Error(err))
+		serverErr = &serverError{http.StatusInternalServerError, err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(serverErr.status)
+	json.NewEncoder(w).Encode(map[string]string{"error": serverErr.message})
+}
+
+// decodeRequest decodes the body of req with the codec of its Content-Type.
+func decodeRequest(req *http.Request, v any) error {
+	if err := contentTypeCodec(req.Header.Get("Content-Type")).decode(req.Body, v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return err
+		}
+		return badRequest("decoding request: %v", err)
+	}
+	return nil
+}
+
+// respond encodes body with the codec req was sent with. A nil body sends
+// the status code alone.
+func respond(w http.ResponseWriter, req *http.Request, status int, body any) error {
+	if body == nil {
+		w.WriteHeader(status)
+		return nil
+	}
+
+	c := contentTypeCodec(req.Header.Get("Content-Type"))
+	encoded, err := c.marshal(body)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", c.contentType())
+	w.WriteHeader(status)
+	_, err = w.Write(encoded)
+	return err
+}
+
+// validateServerKey rejects keys that storage modules may map outside of
+// their root, like ../x.
+func validateServerKey(key string, allowEmpty bool) error {
+	if key == "" {
+		if allowEmpty {
+			return nil
+		}
+		return badRequest("key must not be empty")
+	}
+	if strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return badRequest("invalid key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return badRequest("invalid key %q", key)
+		}
+	}
+	return nil
+}
+
+// version returns the version of value, which is used as its ETag.
+func valueVersion(value []byte) string {
+	return sha256Hex(value)[:32]
+}
+
+func (s *StorageServer) serveStore(w http.ResponseWriter, req *http.Request) error {
+	var storeReq StoreRequest
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == rawContentType {
+		value, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		storeReq = StoreRequest{
+			Key:      req.Header.Get(keyHeader),
+			Value:    value,
+			Checksum: req.Header.Get(checksumHeader),
+		}
+		if tokens := req.Header.Get(fencingTokensHeader); tokens != "" {
+			if err := json.Unmarshal([]byte(tokens), &storeReq.FencingTokens); err != nil {
+				return badRequest("decoding %s: %v", fencingTokensHeader, err)
+			}
+		}
+	} else if err := decodeRequest(req, &storeReq); err != nil {
+		return err
+	}
+
+	if req.Header.Get("If-None-Match") == "*" {
+		storeReq.CreateOnly = true
+	}
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && storeReq.IfMatch == "" {
+		storeReq.IfMatch = ifMatch
+	}
+
+	result := s.store(req, storeReq, storeReq.FencingTokens)
+	if result.failed() {
+		return &serverError{int(result.Status), result.Error}
+	}
+
+	w.Header().Set("ETag", versionETag(result.Version))
+	return respond(w, req, http.StatusCreated, nil)
+}
+
+// store applies a Store and returns its outcome as a batch result.
+func (s *StorageServer) store(req *http.Request, storeReq StoreRequest, fencingTokens map[string]uint64) BatchResult {
+	result := BatchResult{Key: storeReq.Key, Status: http.StatusCreated}
+	fail := func(status int, format string, args ...any) BatchResult {
+		result.Status = int64(status)
+		result.Error = fmt.Sprintf(format, args...)
+		return result
+	}
+
+	if err := validateServerKey(storeReq.Key, false); err != nil {
+		return fail(http.StatusBadRequest, "%v", err)
+	}
+	if err := compareChecksum(storeReq.Key, storeReq.Checksum, storeReq.Value); err != nil {
+		return fail(http.StatusBadRequest, "%v", err)
+	}
+	if err := s.locks.checkFencingTokens(req.Context(), fencingTokens); err != nil {
+		return fail(errorStatus(err), "%v", err)
+	}
+
+	defer s.state.writes.lock(storeReq.Key)()
+
+	if storeReq.CreateOnly || storeReq.IfMatch != "" {
+		current, err := s.storage.Load(req.Context(), storeReq.Key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fail(http.StatusInternalServerError, "%v", err)
+		}
+
+		if storeReq.CreateOnly && exists {
+			return fail(http.StatusConflict, "key %v already exists", storeReq.Key)
+		}
+		if storeReq.IfMatch != "" && (!exists || !etagMatches(storeReq.IfMatch, valueVersion(current))) {
+			return fail(http.StatusPreconditionFailed, "value of %v changed", storeReq.Key)
+		}
+	}
+
+	if err := s.storage.Store(req.Context(), storeReq.Key, storeReq.Value); err != nil {
+		s.logger.Error("Unable to store value", zap.String("key", storeReq.Key), zap.Error(err))
+		return fail(http.StatusInternalServerError, "%v", err)
+	}
+
+	s.state.events.publish(storeReq.Key, "store")
+
+	result.Version = valueVersion(storeReq.Value)
+	return result
+}
+
+// etagMatches reports whether the ETag (or bare version) etag names version.
+func etagMatches(etag, version string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	return strings.Trim(etag, `"`) == version
+}
+
+func (s *StorageServer) serveLoad(w http.ResponseWriter, req *http.Request) error {
+	var loadReq LoadRequest
+	if err := decodeRequest(req, &loadReq); err != nil {
+		return err
+	}
+
+	result := s.load(req, loadReq.Key)
+	if result.failed() {
+		return &serverError{int(result.Status), result.Error}
+	}
+
+	etag := versionETag(result.Version)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, result.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), rawContentType) {
+		w.Header().Set("Content-Type", rawContentType)
+		w.Header().Set(checksumHeader, result.Checksum)
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(result.Value)
+		return err
+	}
+
+	return respond(w, req, http.StatusOK, LoadResponse{
+		Value:    result.Value,
+		Version:  result.Version,
+		Checksum: result.Checksum,
+	})
+}
+
+// load loads key and returns its value, or the error, as a batch result.
+func (s *StorageServer) load(req *http.Request, key string) BatchResult {
+	if err := validateServerKey(key, false); err != nil {
+		return BatchResult{Key: key, Status: http.StatusBadRequest, Error: err.Error()}
+	}
+
+	value, err := s.storage.Load(req.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return BatchResult{Key: key, Status: http.StatusNotFound, Error: "key not found"}
+	}
+	if err != nil {
+		s.logger.Error("Unable to load value", zap.String("key", key), zap.Error(err))
+		return BatchResult{Key: key, Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+
+	return BatchResult{
+		Key:      key,
+		Status:   http.StatusOK,
+		Value:    value,
+		Version:  valueVersion(value),
+		Checksum: sha256Hex(value),
+	}
+}
+
+func (s *StorageServer) serveDelete(w http.ResponseWriter, req *http.Request) error {
+	var deleteReq DeleteRequest
+	if err := decodeRequest(req, &deleteReq); err != nil {
+		return err
+	}
+
+	result := s.delete(req, deleteReq.Key, deleteReq.FencingTokens)
+	if result.failed() {
+		return &serverError{int(result.Status), result.Error}
+	}
+	return respond(w, req, http.StatusNoContent, nil)
+}
+
+// delete deletes key, and the keys below it, and returns the outcome as a
+// batch result.
+func (s *StorageServer) delete(req *http.Request, key string, fencingTokens map[string]uint64) BatchResult {
+	if err := validateServerKey(key, false); err != nil {
+		return BatchResult{Key: key, Status: http.StatusBadRequest, Error: err.Error()}
+	}
+	if err := s.locks.checkFencingTokens(req.Context(), fencingTokens); err != nil {
+		return BatchResult{Key: key, Status: int64(errorStatus(err)), Error: err.Error()}
+	}
+
+	defer s.state.writes.lock(key)()
+
+	err := s.deleteTree(req.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return BatchResult{Key: key, Status: http.StatusNotFound, Error: "key not found"}
+	}
+	if err != nil {
+		s.logger.Error("Unable to delete key", zap.String("key", key), zap.Error(err))
+		return BatchResult{Key: key, Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+
+	return BatchResult{Key: key, Status: http.StatusNoContent}
+}
+
+// deleteTree deletes key and the keys below it, or returns fs.ErrNotExist
+// if there are none. Not every storage module deletes the keys below a
+// directory, so they are deleted one by one.
+func (s *StorageServer) deleteTree(ctx context.Context, key string) error {
+	keys, err := s.storage.List(ctx, key, true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if s.storage.Exists(ctx, key) {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fs.ErrNotExist
+	}
+
+	// Deleting the deepest keys first leaves no empty directories behind.
+	slices.SortFunc(keys, func(a, b string) int { return len(b) - len(a) })
+	for _, k := range keys {
+		if err := s.storage.Delete(ctx, k); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("deleting %v: %w", k, err)
+		}
+		s.state.events.publish(k, "delete")
+	}
+	return nil
+}
+
+func (s *StorageServer) serveExists(w http.ResponseWriter, req *http.Request) error {
+	// HEAD requests carry the key as a query parameter and are answered by
+	// status code alone.
+	if req.Method == http.MethodHead {
+		key := req.URL.Query().Get("key")
+		if err := validateServerKey(key, false); err != nil {
+			return err
+		}
+		if !s.storage.Exists(req.Context(), key) {
+			return respond(w, req, http.StatusNotFound, nil)
+		}
+		return respond(w, req, http.StatusOK, nil)
+	}
+
+	var existsReq ExistsRequest
+	if err := decodeRequest(req, &existsReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(existsReq.Key, false); err != nil {
+		return err
+	}
+
+	return respond(w, req, http.StatusOK, ExistsResponse{
+		Exists: s.storage.Exists(req.Context(), existsReq.Key),
+	})
+}
+
+func (s *StorageServer) serveList(w http.ResponseWriter, req *http.Request) error {
+	var listReq ListRequest
+	if err := decodeRequest(req, &listReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(listReq.Prefix, true); err != nil {
+		return err
+	}
+
+	var modifiedAfter time.Time
+	if listReq.ModifiedAfter != "" {
+		var err error
+		modifiedAfter, err = time.Parse(time.RFC3339Nano, listReq.ModifiedAfter)
+		if err != nil {
+			return badRequest("parsing modified_after: %v", err)
+		}
+	}
+	if listReq.Pattern != "" {
+		if _, err := path.Match(listReq.Pattern, ""); err != nil {
+			return badRequest("invalid pattern %q: %v", listReq.Pattern, err)
+		}
+	}
+
+	keys, err := s.storage.List(req.Context(), listReq.Prefix, listReq.Recursive)
+	if err != nil {
+		return err
+	}
+
+	filtered := keys[:0]
+	for _, key := range keys {
+		if listReq.Pattern != "" {
+			if matched, _ := path.Match(listReq.Pattern, key); !matched {
+				continue
+			}
+		}
+		if !modifiedAfter.IsZero() {
+			info, err := s.storage.Stat(req.Context(), key)
+			if err != nil || !info.Modified.After(modifiedAfter) {
+				continue
+			}
+		}
+		filtered = append(filtered, key)
+	}
+
+	page, next := serverPage(filtered, listReq.Cursor, listReq.Limit)
+	return respond(w, req, http.StatusOK, ListResponse{Keys: page, NextCursor: next})
+}
+
+// serverPage returns the keys after cursor, at most limit of them if limit
+// is positive, and the cursor of the next page if there is one. The cursor
+// is the last key of the previous page.
+func serverPage(keys []string, cursor string, limit int64) ([]string, string) {
+	slices.Sort(keys)
+	if cursor != "" {
+		i, found := slices.BinarySearch(keys, cursor)
+		if found {
+			i++
+		}
+		keys = keys[i:]
+	}
+
+	if limit > 0 && int64(len(keys)) > limit {
+		keys = keys[:limit]
+		return keys, keys[len(keys)-1]
+	}
+	return keys, ""
+}
+
+// storageChildren returns keys, the keys below the directory dir, or if
+// recursive isn't set, the keys and directories directly below dir, for
+// storage modules that store keys flat.
+func storageChildren(keys []string, dir string, recursive bool) []string {
+	if !recursive {
+		for i, key := range keys {
+			child, _, _ := strings.Cut(strings.TrimPrefix(key, dir), "/")
+			keys[i] = dir + child
+		}
+	}
+
+	// Directories may sort after their siblings, like a/b after a/b.crt.
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+func (s *StorageServer) serveStat(w http.ResponseWriter, req *http.Request) error {
+	var statReq StatRequest
+	if err := decodeRequest(req, &statReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(statReq.Key, false); err != nil {
+		return err
+	}
+
+	info, err := s.storage.Stat(req.Context(), statReq.Key)
+	if err != nil {
+		return err
+	}
+
+	return respond(w, req, http.StatusOK, statResponse(info))
+}
+
+func statResponse(info certmagic.KeyInfo) StatResponse {
+	return StatResponse{
+		Key:        info.Key,
+		Modified:   Timestamp(info.Modified.UTC().Format(time.RFC3339Nano)),
+		Size:       info.Size,
+		IsTerminal: info.IsTerminal,
+	}
+}
+
+func (s *StorageServer) serveInfo(w http.ResponseWriter, req *http.Request) error {
+	return respond(w, req, http.StatusOK, InfoResponse{
+		Version:         "caddy rest_storage_server",
+		ProtocolVersion: ProtocolVersion,
+		Capabilities: []string{
+			CapabilityRawValues,
+			CapabilityLockLeases,
+			CapabilityBatch,
+			CapabilityDeletePrefix,
+			CapabilityListFilters,
+			CapabilityListValues,
+		},
+	})
+}
+
+func (s *StorageServer) serveStoreBatch(w http.ResponseWriter, req *http.Request) error {
+	var batchReq StoreBatchRequest
+	if err := decodeRequest(req, &batchReq); err != nil {
+		return err
+	}
+	if len(batchReq.Items) > maxBatchSize {
+		return badRequest("at most %d items may be sent per batch", maxBatchSize)
+	}
+
+	var batchResp BatchResponse
+	for _, item := range batchReq.Items {
+		batchResp.Results = append(batchResp.Results, s.store(req, item, batchReq.FencingTokens))
+	}
+	return respond(w, req, http.StatusOK, batchResp)
+}
+
+func (s *StorageServer) serveDeleteBatch(w http.ResponseWriter, req *http.Request) error {
+	var batchReq DeleteBatchRequest
+	if err := decodeRequest(req, &batchReq); err != nil {
+		return err
+	}
+	if len(batchReq.Keys) > maxBatchSize {
+		return badRequest("at most %d keys may be sent per batch", maxBatchSize)
+	}
+
+	var batchResp BatchResponse
+	for _, key := range batchReq.Keys {
+		batchResp.Results = append(batchResp.Results, s.delete(req, key, batchReq.FencingTokens))
+	}
+	return respond(w, req, http.StatusOK, batchResp)
+}
+
+func (s *StorageServer) serveLoadBatch(w http.ResponseWriter, req *http.Request) error {
+	var batchReq LoadBatchRequest
+	if err := decodeRequest(req, &batchReq); err != nil {
+		return err
+	}
+	if len(batchReq.Keys) > maxBatchSize {
+		return badRequest("at most %d keys may be sent per batch", maxBatchSize)
+	}
+
+	var batchResp BatchResponse
+	for _, key := range batchReq.Keys {
+		batchResp.Results = append(batchResp.Results, s.load(req, key))
+	}
+	return respond(w, req, http.StatusOK, batchResp)
+}
+
+func (s *StorageServer) serveStatBatch(w http.ResponseWriter, req *http.Request) error {
+	var batchReq StatBatchRequest
+	if err := decodeRequest(req, &batchReq); err != nil {
+		return err
+	}
+	if len(batchReq.Keys) > maxBatchSize {
+		return badRequest("at most %d keys may be sent per batch", maxBatchSize)
+	}
+
+	batchResp := StatBatchResponse{Results: []StatResponse{}}
+	for _, key := range batchReq.Keys {
+		if err := validateServerKey(key, false); err != nil {
+			return err
+		}
+		info, err := s.storage.Stat(req.Context(), key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		batchResp.Results = append(batchResp.Results, statResponse(info))
+	}
+	return respond(w, req, http.StatusOK, batchResp)
+}
+
+func (s *StorageServer) serveDeletePrefix(w http.ResponseWriter, req *http.Request) error {
+	var prefixReq DeletePrefixRequest
+	if err := decodeRequest(req, &prefixReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(prefixReq.Prefix, false); err != nil {
+		return err
+	}
+	if err := s.locks.checkFencingTokens(req.Context(), prefixReq.FencingTokens); err != nil {
+		return err
+	}
+
+	defer s.state.writes.lock(prefixReq.Prefix)()
+
+	if err := s.deleteTree(req.Context(), prefixReq.Prefix); err != nil {
+		return err
+	}
+	return respond(w, req, http.StatusNoContent, nil)
+}
+
+func (s *StorageServer) serveListValues(w http.ResponseWriter, req *http.Request) error {
+	var listReq ListValuesRequest
+	if err := decodeRequest(req, &listReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(listReq.Prefix, true); err != nil {
+		return err
+	}
+
+	keys, err := s.storage.List(req.Context(), listReq.Prefix, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return respond(w, req, http.StatusOK, ListValuesResponse{Values: []BatchResult{}})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only keys with values are returned; paging by all keys keeps the
+	// cursor stable.
+	page, next := serverPage(keys, listReq.Cursor, listReq.Limit)
+	listResp := ListValuesResponse{Values: []BatchResult{}, NextCursor: next}
+	for _, key := range page {
+		info, err := s.storage.Stat(req.Context(), key)
+		if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.IsTerminal) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		result := s.load(req, key)
+		if result.Status == http.StatusNotFound {
+			continue
+		}
+		if result.failed() {
+			return &serverError{int(result.Status), result.Error}
+		}
+		result.Status = 0
+		listResp.Values = append(listResp.Values, result)
+	}
+
+	return respond(w, req, http.StatusOK, listResp)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*StorageServer)(nil)
+	_ caddy.Validator             = (*StorageServer)(nil)
+	_ caddyhttp.MiddlewareHandler = (*StorageServer)(nil)
+	_ caddyfile.Unmarshaler       = (*StorageServer)(nil)
+)
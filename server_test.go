@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// testServer is a storage server with its own rest_memory storage, for
+// tests in this package, which can't use resttest.
+type testServer struct {
+	*httptest.Server
+	endpoint, apiKey string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	handler, apiKey := newTestHandler(t)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return &testServer{Server: server, endpoint: server.URL + "/", apiKey: apiKey}
+}
+
+// newTestHandler returns a storage server handler and its api key.
+func newTestHandler(t *testing.T) (http.Handler, string) {
+	t.Helper()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	name := hex.EncodeToString(id)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	handler := &StorageServer{
+		StorageRaw: caddyconfig.JSONModuleObject(MemoryStorage{Name: "test-" + name}, "module", "rest_memory", nil),
+		ApiKeys:    []string{name},
+	}
+	if err := handler.Provision(ctx); err != nil {
+		t.Fatalf("provisioning the storage server: %v", err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+			http.NotFound(w, req)
+			return nil
+		}))
+	}), name
+}
+
+// testFallback returns the config of a file_system fallback storage that
+// records pending writes in a temporary directory too.
+func testFallback(t *testing.T) *FallbackConfig {
+	return &FallbackConfig{
+		StorageRaw:  caddyconfig.JSONModuleObject(map[string]string{"root": t.TempDir()}, "module", "file_system", nil),
+		PendingPath: filepath.Join(t.TempDir(), "pending.json"),
+	}
+}
+
+// storage provisions r to use the server. r may be nil.
+func (s *testServer) storage(t *testing.T, r *RestStorage) *RestStorage {
+	t.Helper()
+
+	if r == nil {
+		r = new(RestStorage)
+	}
+	if r.Endpoint == "" {
+		r.Endpoint = s.endpoint
+	}
+	if r.ApiKey == "" {
+		r.ApiKey = s.apiKey
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	err := r.Provision(ctx)
+	t.Cleanup(func() { r.Cleanup() })
+	if err != nil {
+		t.Fatalf("provisioning the rest storage: %v", err)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatalf("validating the rest storage: %v", err)
+	}
+	return r
+}
+
+func TestStorageServerAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  *StorageServer
+		valid   bool
+		apiKey  string
+		allowed bool
+	}{
+		{"no api keys", &StorageServer{}, false, "", false},
+		{"api key", &StorageServer{ApiKeys: []string{"a", "b"}}, true, "b", true},
+		{"wrong api key", &StorageServer{ApiKeys: []string{"a"}}, true, "b", false},
+		{"missing api key", &StorageServer{ApiKeys: []string{"a"}}, true, "", false},
+		{"empty api key", &StorageServer{ApiKeys: []string{""}}, false, "", false},
+		{"insecure_no_auth", &StorageServer{InsecureNoAuth: true}, true, "", true},
+		{"api keys and insecure_no_auth", &StorageServer{ApiKeys: []string{"a"}, InsecureNoAuth: true}, false, "a", true},
+	}
+	for _, test := range tests {
+		if err := test.server.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate returned %v", test.name, err)
+		}
+
+		req := httptest.NewRequest("POST", "/load", nil)
+		if test.apiKey != "" {
+			req.Header.Set("x-api-key", test.apiKey)
+		}
+		if allowed := test.server.authorized(req); allowed != test.allowed {
+			t.Errorf("%s: authorized returned %t", test.name, allowed)
+		}
+	}
+}
+
+func TestWriteLocks(t *testing.T) {
+	locks := newWriteLocks()
+	unlock := locks.lock("certificates/example.com/example.com.crt")
+
+	// Writes of other keys don't wait.
+	done := make(chan struct{})
+	go func() {
+		locks.lock("certificates/example.org/example.org.crt")()
+		locks.lock("certificates/example.com/example.com.key")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes of other keys wait for the locked key")
+	}
+
+	// Writes of the key, and deletes of the keys above it, do.
+	for _, key := range []string{"certificates/example.com/example.com.crt", "certificates/example.com", "certificates"} {
+		locked := make(chan struct{})
+		go func() {
+			locks.lock(key)()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+			t.Errorf("%s was locked while the key below it is locked", key)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		unlock()
+		<-locked
+		unlock = locks.lock("certificates/example.com/example.com.crt")
+	}
+	unlock()
+}
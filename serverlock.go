@@ -0,0 +1,331 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serverLocker grants the locks of storage servers. Storage modules that
+// implement it keep the locks along with the values; the locks of other
+// storage modules are kept in memory by serverLocks.
+type serverLocker interface {
+	// lock grants the lock on key to holder and returns its fencing token,
+	// or the lock that is held instead.
+	lock(ctx context.Context, key, holder string, ttl time.Duration) (uint64, *serverLock, error)
+	// unlock releases the lock on key if holder holds it, or if force is
+	// set. Releasing a lock that isn't held succeeds.
+	unlock(ctx context.Context, key, holder string, force bool) error
+	// renew extends the lease of holder on key by ttl.
+	renew(ctx context.Context, key, holder string, ttl time.Duration) error
+	// checkFencingTokens returns an error if any of tokens is older than
+	// the last token granted for its lock.
+	checkFencingTokens(ctx context.Context, tokens map[string]uint64) error
+}
+
+// serverLocks are the locks granted by the storage servers serving the same
+// storage.
+type serverLocks struct {
+	mu    sync.Mutex
+	locks map[string]*serverLock
+	// The last fencing token granted for each key, kept after the lock is
+	// released so that late writes of former holders are rejected.
+	tokens map[string]uint64
+	// The last fencing token granted for any key.
+	lastToken uint64
+}
+
+type serverLock struct {
+	holder   string
+	acquired time.Time
+	// Zero if the lock was not requested as a lease.
+	expires time.Time
+}
+
+func (l *serverLock) expired(now time.Time) bool {
+	return !l.expires.IsZero() && now.After(l.expires)
+}
+
+func newServerLocks() *serverLocks {
+	return &serverLocks{
+		locks:  make(map[string]*serverLock),
+		tokens: make(map[string]uint64),
+	}
+}
+
+func (s *serverLocks) lock(_ context.Context, key, holder string, ttl time.Duration) (uint64, *serverLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if held, ok := s.locks[key]; ok && !held.expired(now) {
+		return 0, held, nil
+	}
+
+	lock := &serverLock{holder: holder, acquired: now}
+	if ttl > 0 {
+		lock.expires = now.Add(ttl)
+	}
+	s.locks[key] = lock
+
+	s.lastToken++
+	s.tokens[key] = s.lastToken
+	return s.lastToken, nil, nil
+}
+
+func (s *serverLocks) unlock(_ context.Context, key, holder string, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.locks[key]
+	if ok && !force && held.holder != holder && !held.expired(time.Now()) {
+		return &serverError{http.StatusConflict, fmt.Sprintf("lock on %v is held by %v", key, held.holder)}
+	}
+	delete(s.locks, key)
+	return nil
+}
+
+func (s *serverLocks) renew(_ context.Context, key, holder string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	held, ok := s.locks[key]
+	if !ok || held.expired(now) {
+		return &serverError{http.StatusGone, fmt.Sprintf("lease on %v was lost", key)}
+	}
+	if held.holder != holder {
+		return &serverError{http.StatusConflict, fmt.Sprintf("lock on %v is held by %v", key, held.holder)}
+	}
+	if ttl > 0 {
+		held.expires = now.Add(ttl)
+	}
+	return nil
+}
+
+func (s *serverLocks) checkFencingTokens(_ context.Context, tokens map[string]uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, token := range tokens {
+		if err := checkFencingToken(key, token, s.tokens[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFencingToken returns a 409 error if token is older than last, the
+// last token granted for the lock on key.
+func checkFencingToken(key string, token, last uint64) error {
+	if token < last {
+		return &serverError{http.StatusConflict, fmt.Sprintf("fencing token %d of lock %v is stale; the lock was granted again with %d", token, key, last)}
+	}
+	return nil
+}
+
+func (s *StorageServer) serveLock(w http.ResponseWriter, req *http.Request) error {
+	var lockReq LockRequest
+	if err := decodeRequest(req, &lockReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(lockReq.Key, false); err != nil {
+		return err
+	}
+
+	token, held, err := s.locks.lock(req.Context(), lockReq.Key, lockReq.Holder, time.Duration(lockReq.TTL)*time.Second)
+	if err != nil {
+		return err
+	}
+	if held != nil {
+		return respond(w, req, http.StatusLocked, LockedResponse{
+			Holder:     held.holder,
+			AcquiredAt: Timestamp(held.acquired.UTC().Format(time.RFC3339Nano)),
+		})
+	}
+
+	return respond(w, req, http.StatusCreated, LockResponse{FencingToken: token})
+}
+
+func (s *StorageServer) serveUnlock(w http.ResponseWriter, req *http.Request) error {
+	var unlockReq UnlockRequest
+	if err := decodeRequest(req, &unlockReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(unlockReq.Key, false); err != nil {
+		return err
+	}
+
+	if err := s.locks.unlock(req.Context(), unlockReq.Key, unlockReq.Holder, unlockReq.Force); err != nil {
+		return err
+	}
+	return respond(w, req, http.StatusNoContent, nil)
+}
+
+func (s *StorageServer) serveRenew(w http.ResponseWriter, req *http.Request) error {
+	var renewReq RenewRequest
+	if err := decodeRequest(req, &renewReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(renewReq.Key, false); err != nil {
+		return err
+	}
+
+	if err := s.locks.renew(req.Context(), renewReq.Key, renewReq.Holder, time.Duration(renewReq.TTL)*time.Second); err != nil {
+		return err
+	}
+	return respond(w, req, http.StatusNoContent, nil)
+}
+
+// leasedLocks implement certmagic.Locker with the locks of a serverLocker,
+// for storage modules that Caddy may use directly. Locks are acquired as
+// leases of ttl, which are renewed until they are unlocked, so the locks of
+// a crashed instance expire.
+type leasedLocks struct {
+	locker serverLocker
+	holder string
+	ttl    time.Duration
+	logger *zap.Logger
+
+	// Stops the renewal of the locks, by key.
+	mu       sync.Mutex
+	renewals map[string]context.CancelFunc
+}
+
+func newLeasedLocks(locker serverLocker, holder string, ttl time.Duration, logger *zap.Logger) *leasedLocks {
+	return &leasedLocks{
+		locker:   locker,
+		holder:   holder,
+		ttl:      ttl,
+		logger:   logger,
+		renewals: make(map[string]context.CancelFunc),
+	}
+}
+
+// Lock acquires the lock on key, waiting until it is released or expires.
+func (l *leasedLocks) Lock(ctx context.Context, key string) error {
+	for {
+		_, held, err := l.locker.lock(ctx, key, l.holder, l.ttl)
+		if err != nil {
+			return err
+		}
+		if held == nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	renewCtx, cancel := context.WithCancel(context.Background())
+	l.mu.Lock()
+	l.renewals[key] = cancel
+	l.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := l.locker.renew(renewCtx, key, l.holder, l.ttl); err != nil && renewCtx.Err() == nil {
+				l.logger.Error("Unable to renew lock", zap.String("key", key), zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (l *leasedLocks) Unlock(ctx context.Context, key string) error {
+	l.mu.Lock()
+	if cancel, ok := l.renewals[key]; ok {
+		cancel()
+		delete(l.renewals, key)
+	}
+	l.mu.Unlock()
+
+	return l.locker.unlock(ctx, key, l.holder, false)
+}
+
+// releaseAll releases the locks that are still held, e.g. when the storage
+// module is cleaned up.
+func (l *leasedLocks) releaseAll() {
+	l.mu.Lock()
+	keys := make([]string, 0, len(l.renewals))
+	for key, cancel := range l.renewals {
+		cancel()
+		keys = append(keys, key)
+	}
+	clear(l.renewals)
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range keys {
+		if err := l.locker.unlock(ctx, key, l.holder, false); err != nil {
+			l.logger.Error("Unable to release lock on cleanup", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// writeLocks serialize the writes of the storage servers serving the same
+// storage by key, so conditional and create-only stores can't race with
+// other writes of the key. Deletes remove the keys below the deleted key,
+// so a key is locked against writes of the keys above and below it too.
+type writeLocks struct {
+	mu sync.Mutex
+	// Closed when the key is unlocked.
+	held map[string]chan struct{}
+}
+
+func newWriteLocks() *writeLocks {
+	return &writeLocks{held: make(map[string]chan struct{})}
+}
+
+// lock waits until no write of key, or of a key above or below it, is in
+// progress, and returns the function unlocking key.
+func (w *writeLocks) lock(key string) func() {
+	w.mu.Lock()
+	for {
+		unlocked := w.conflicting(key)
+		if unlocked == nil {
+			break
+		}
+		w.mu.Unlock()
+		<-unlocked
+		w.mu.Lock()
+	}
+
+	unlocked := make(chan struct{})
+	w.held[key] = unlocked
+	w.mu.Unlock()
+
+	return func() {
+		w.mu.Lock()
+		delete(w.held, key)
+		w.mu.Unlock()
+		close(unlocked)
+	}
+}
+
+// conflicting returns the channel of a locked key that key conflicts with,
+// or nil if there is none.
+func (w *writeLocks) conflicting(key string) chan struct{} {
+	for held, unlocked := range w.held {
+		if underPrefix(key, held) || underPrefix(held, key) {
+			return unlocked
+		}
+	}
+	return nil
+}
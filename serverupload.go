@@ -0,0 +1,170 @@
+package rest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serverUploadTTL is how long unfinished uploads are kept after their last
+// chunk.
+const serverUploadTTL = time.Hour
+
+// serverUploads are the unfinished chunked uploads of a storage server.
+type serverUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*serverUpload
+}
+
+type serverUpload struct {
+	key      string
+	size     int64
+	checksum string
+	data     []byte
+	updated  time.Time
+}
+
+func newServerUploads() *serverUploads {
+	return &serverUploads{uploads: make(map[string]*serverUpload)}
+}
+
+// get returns the upload with id, or a 404 error.
+func (u *serverUploads) get(id string) (*serverUpload, error) {
+	upload, ok := u.uploads[id]
+	if !ok || time.Since(upload.updated) > serverUploadTTL {
+		return nil, &serverError{http.StatusNotFound, fmt.Sprintf("upload %v not found", id)}
+	}
+	return upload, nil
+}
+
+// expire forgets the uploads that were abandoned.
+func (u *serverUploads) expire() {
+	for id, upload := range u.uploads {
+		if time.Since(upload.updated) > serverUploadTTL {
+			delete(u.uploads, id)
+		}
+	}
+}
+
+func (s *StorageServer) serveUploadInit(w http.ResponseWriter, req *http.Request) error {
+	var initReq UploadInitRequest
+	if err := decodeRequest(req, &initReq); err != nil {
+		return err
+	}
+	if err := validateServerKey(initReq.Key, false); err != nil {
+		return err
+	}
+	if initReq.Size < 0 {
+		return badRequest("size must not be negative")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	uploadID := hex.EncodeToString(id)
+
+	s.state.uploads.mu.Lock()
+	defer s.state.uploads.mu.Unlock()
+
+	s.state.uploads.expire()
+	s.state.uploads.uploads[uploadID] = &serverUpload{
+		key:      initReq.Key,
+		size:     initReq.Size,
+		checksum: initReq.Checksum,
+		updated:  time.Now(),
+	}
+
+	return respond(w, req, http.StatusCreated, UploadInitResponse{UploadID: uploadID})
+}
+
+func (s *StorageServer) serveUploadAppend(w http.ResponseWriter, req *http.Request) error {
+	var appendReq UploadAppendRequest
+	if err := decodeRequest(req, &appendReq); err != nil {
+		return err
+	}
+
+	s.state.uploads.mu.Lock()
+	defer s.state.uploads.mu.Unlock()
+
+	upload, err := s.state.uploads.get(appendReq.UploadID)
+	if err != nil {
+		return err
+	}
+
+	// Chunks must be appended in order; the client resumes from the offset
+	// reported by upload_status.
+	received := int64(len(upload.data))
+	if appendReq.Offset != received {
+		return &serverError{http.StatusConflict, fmt.Sprintf("expected offset %d, got %d", received, appendReq.Offset)}
+	}
+	if received+int64(len(appendReq.Data)) > upload.size {
+		return badRequest("chunk exceeds the size of the upload")
+	}
+
+	upload.data = append(upload.data, appendReq.Data...)
+	upload.updated = time.Now()
+
+	return respond(w, req, http.StatusNoContent, nil)
+}
+
+func (s *StorageServer) serveUploadStatus(w http.ResponseWriter, req *http.Request) error {
+	var statusReq UploadStatusRequest
+	if err := decodeRequest(req, &statusReq); err != nil {
+		return err
+	}
+
+	s.state.uploads.mu.Lock()
+	defer s.state.uploads.mu.Unlock()
+
+	upload, err := s.state.uploads.get(statusReq.UploadID)
+	if err != nil {
+		return err
+	}
+
+	return respond(w, req, http.StatusOK, UploadStatusResponse{Offset: int64(len(upload.data))})
+}
+
+func (s *StorageServer) serveUploadCommit(w http.ResponseWriter, req *http.Request) error {
+	var commitReq UploadCommitRequest
+	if err := decodeRequest(req, &commitReq); err != nil {
+		return err
+	}
+	if req.Header.Get("If-None-Match") == "*" {
+		commitReq.CreateOnly = true
+	}
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && commitReq.IfMatch == "" {
+		commitReq.IfMatch = ifMatch
+	}
+
+	s.state.uploads.mu.Lock()
+	upload, err := s.state.uploads.get(commitReq.UploadID)
+	s.state.uploads.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if int64(len(upload.data)) != upload.size {
+		return badRequest("upload is incomplete: received %d of %d bytes", len(upload.data), upload.size)
+	}
+
+	result := s.store(req, StoreRequest{
+		Key:        upload.key,
+		Value:      upload.data,
+		Checksum:   upload.checksum,
+		IfMatch:    commitReq.IfMatch,
+		CreateOnly: commitReq.CreateOnly,
+	}, commitReq.FencingTokens)
+	if result.failed() {
+		return &serverError{int(result.Status), result.Error}
+	}
+
+	s.state.uploads.mu.Lock()
+	delete(s.state.uploads.uploads, commitReq.UploadID)
+	s.state.uploads.mu.Unlock()
+
+	w.Header().Set("ETag", versionETag(result.Version))
+	return respond(w, req, http.StatusCreated, nil)
+}
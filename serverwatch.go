@@ -0,0 +1,128 @@
+package rest
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How many events are kept for clients to resume from.
+	maxServerEvents = 10000
+	// How long watch requests are held when no keys change.
+	serverWatchTimeout = 30 * time.Second
+)
+
+// serverEvents are the keys recently changed through the storage servers
+// serving the same storage. The cursor of a client is the sequence number
+// of the next event it hasn't seen.
+type serverEvents struct {
+	mu     sync.Mutex
+	events []WatchEvent
+	// The sequence number of events[0].
+	first uint64
+	// Closed and replaced when an event is published.
+	changed chan struct{}
+}
+
+func newServerEvents() *serverEvents {
+	return &serverEvents{changed: make(chan struct{})}
+}
+
+func (e *serverEvents) publish(key, eventType string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.events = append(e.events, WatchEvent{Key: key, Type: eventType})
+	if len(e.events) > maxServerEvents {
+		dropped := len(e.events) - maxServerEvents
+		e.events = slices.Delete(e.events, 0, dropped)
+		e.first += uint64(dropped)
+	}
+
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// since returns the events below prefix from the cursor on, the cursor
+// after them, and a channel that is closed when more events are published.
+// It returns false if the events at cursor were dropped already.
+func (e *serverEvents) since(cursor uint64, prefix string) ([]WatchEvent, uint64, <-chan struct{}, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	next := e.first + uint64(len(e.events))
+	if cursor < e.first || cursor > next {
+		return nil, next, e.changed, false
+	}
+
+	var events []WatchEvent
+	for _, event := range e.events[cursor-e.first:] {
+		if strings.HasPrefix(event.Key, prefix) {
+			events = append(events, event)
+		}
+	}
+	return events, next, e.changed, true
+}
+
+// cursor returns the cursor of the next event.
+func (e *serverEvents) cursor() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.first + uint64(len(e.events))
+}
+
+// serveWatch holds the request until keys below the prefix change, or until
+// serverWatchTimeout passes.
+func (s *StorageServer) serveWatch(w http.ResponseWriter, req *http.Request) error {
+	var watchReq WatchRequest
+	if err := decodeRequest(req, &watchReq); err != nil {
+		return err
+	}
+	if watchReq.Cursor == "" {
+		watchReq.Cursor = req.Header.Get("Last-Event-ID")
+	}
+
+	cursor := s.state.events.cursor()
+	if watchReq.Cursor != "" {
+		var err error
+		cursor, err = strconv.ParseUint(watchReq.Cursor, 10, 64)
+		if err != nil {
+			return badRequest("invalid cursor %q", watchReq.Cursor)
+		}
+	}
+
+	timeout := time.NewTimer(serverWatchTimeout)
+	defer timeout.Stop()
+
+	for {
+		events, next, changed, ok := s.state.events.since(cursor, watchReq.Prefix)
+		if !ok {
+			return &serverError{http.StatusGone, "cursor expired"}
+		}
+		cursor = next
+
+		if len(events) > 0 {
+			return respond(w, req, http.StatusOK, WatchResponse{
+				Events: events,
+				Cursor: strconv.FormatUint(cursor, 10),
+			})
+		}
+
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return nil
+		case <-timeout.C:
+			// Respond with the cursor, so that events published until the
+			// next request aren't missed.
+			return respond(w, req, http.StatusOK, WatchResponse{
+				Events: []WatchEvent{},
+				Cursor: strconv.FormatUint(cursor, 10),
+			})
+		}
+	}
+}
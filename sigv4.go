@@ -0,0 +1,332 @@
+package rest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	imdsEndpoint  = "http://169.254.169.254"
+	ecsEndpoint   = "http://169.254.170.2"
+)
+
+// AWSSigV4Config signs every request with AWS Signature Version 4, so the
+// storage API can sit behind an IAM-protected API Gateway.
+//
+// Credentials are taken from the static fields when set, otherwise from the
+// AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY / AWS_SESSION_TOKEN environment
+// variables, otherwise from the ECS task role or EC2 instance role.
+type AWSSigV4Config struct {
+	Region string `json:"region"`
+	// Defaults to execute-api.
+	Service         string `json:"service,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+
+	credentials *awsCredentialProvider
+}
+
+func (a *AWSSigV4Config) provision() {
+	if a.Service == "" {
+		a.Service = "execute-api"
+	}
+
+	a.credentials = &awsCredentialProvider{httpClient: &http.Client{Timeout: 5 * time.Second}}
+	if a.AccessKeyID != "" {
+		a.credentials.static = &awsCredentials{
+			AccessKeyID:     a.AccessKeyID,
+			SecretAccessKey: a.SecretAccessKey,
+			SessionToken:    a.SessionToken,
+		}
+	}
+}
+
+func (a *AWSSigV4Config) validate() error {
+	if a.Region == "" {
+		return errors.New("aws_sigv4: region must be specified")
+	}
+
+	if (a.AccessKeyID == "") != (a.SecretAccessKey == "") {
+		return errors.New("aws_sigv4: access_key_id and secret_access_key must be specified together")
+	}
+
+	return nil
+}
+
+func (a *AWSSigV4Config) sign(req *http.Request, body []byte, now time.Time) error {
+	creds, err := a.credentials.get(req.Context())
+	if err != nil {
+		return fmt.Errorf("aws_sigv4: obtaining credentials: %v", err)
+	}
+
+	signAWSv4(req, body, creds, a.Region, a.Service, now)
+
+	return nil
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// signAWSv4 adds the SigV4 authorization headers to req. S3 is the only
+// service whose canonical path is not encoded twice.
+func signAWSv4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	scope := now.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsCanonicalURI(req.URL, service != "s3"),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// awsCanonicalURI returns the canonical URI of the path of u as it is sent,
+// i.e. escaped, so a key escaped into a single segment, e.g.
+// certificates%2Fx, stays one. Services other than S3 encode the escaped
+// segments again, e.g. to certificates%252Fx; S3 encodes the unescaped
+// segments once.
+func awsCanonicalURI(u *url.URL, doubleEncode bool) string {
+	escaped := u.EscapedPath()
+	if escaped == "" {
+		return "/"
+	}
+	segments := strings.Split(escaped, "/")
+	for i, segment := range segments {
+		if !doubleEncode {
+			if unescaped, err := url.PathUnescape(segment); err == nil {
+				segment = unescaped
+			}
+		}
+		segments[i] = awsURIEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key)+"="+awsURIEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes everything except the RFC 3986 unreserved
+// characters, as required by SigV4.
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsCredentialProvider resolves and caches AWS credentials.
+type awsCredentialProvider struct {
+	static     *awsCredentials
+	httpClient *http.Client
+
+	mu     sync.Mutex
+	cached awsCredentials
+}
+
+func (p *awsCredentialProvider) get(ctx context.Context) (awsCredentials, error) {
+	if p.static != nil {
+		return *p.static, nil
+	}
+
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Refresh role credentials a few minutes before they expire.
+	if p.cached.AccessKeyID != "" && time.Until(p.cached.Expires) > 5*time.Minute {
+		return p.cached, nil
+	}
+
+	var creds awsCredentials
+	var err error
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		creds, err = p.fetchRoleCredentials(ctx, ecsEndpoint+relativeURI, nil)
+	} else {
+		creds, err = p.fetchInstanceCredentials(ctx)
+	}
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	p.cached = creds
+	return creds, nil
+}
+
+// fetchInstanceCredentials reads the EC2 instance role credentials via IMDSv2.
+func (p *awsCredentialProvider) fetchInstanceCredentials(ctx context.Context) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := p.fetch(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching IMDS token: %v", err)
+	}
+
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	req, err = http.NewRequestWithContext(ctx, "GET", imdsEndpoint+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header = header.Clone()
+	roles, err := p.fetch(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching instance role: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, errors.New("no instance role attached")
+	}
+
+	return p.fetchRoleCredentials(ctx, imdsEndpoint+"/latest/meta-data/iam/security-credentials/"+role, header)
+}
+
+func (p *awsCredentialProvider) fetchRoleCredentials(ctx context.Context, url string, header http.Header) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	body, err := p.fetch(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching role credentials: %v", err)
+	}
+
+	var roleCreds struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &roleCreds); err != nil {
+		return awsCredentials{}, err
+	}
+
+	return awsCredentials{
+		AccessKeyID:     roleCreds.AccessKeyId,
+		SecretAccessKey: roleCreds.SecretAccessKey,
+		SessionToken:    roleCreds.Token,
+		Expires:         roleCreds.Expiration,
+	}, nil
+}
+
+func (p *awsCredentialProvider) fetch(req *http.Request) ([]byte, error) {
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,48 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// ValueTooLargeError is returned by Store when a value exceeds
+// MaxValueSize. The value isn't sent to the backend.
+type ValueTooLargeError struct {
+	Key   string
+	Size  int
+	Limit int
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value of %v is %d bytes, exceeding max_value_size of %d bytes", e.Key, e.Size, e.Limit)
+}
+
+// checkValueSize checks the size of value as it is sent to the backend
+// against MaxValueSize, and logs a warning above ValueSizeWarning.
+func (r *RestStorage) checkValueSize(key string, value []byte) error {
+	if r.MaxValueSize > 0 && len(value) > r.MaxValueSize {
+		return &ValueTooLargeError{Key: key, Size: len(value), Limit: r.MaxValueSize}
+	}
+
+	if r.ValueSizeWarning > 0 && len(value) > r.ValueSizeWarning {
+		r.logger.Warn("Storing a large value",
+			zap.String("key", key),
+			zap.Int("size", len(value)),
+			zap.Int("value_size_warning", r.ValueSizeWarning),
+			zap.Int("max_value_size", r.MaxValueSize))
+	}
+
+	return nil
+}
+
+func validateValueSizes(maxSize, warning int) error {
+	if maxSize < 0 || warning < 0 {
+		return errors.New("max_value_size and value_size_warning must not be negative")
+	}
+	if maxSize > 0 && warning > maxSize {
+		return errors.New("value_size_warning must not exceed max_value_size")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// requestTiming records when the phases of a request ended, relative to
+// its start, for logging slow requests.
+type requestTiming struct {
+	start time.Time
+
+	mu                    sync.Mutex
+	dnsStart, dns         time.Duration
+	connectStart, connect time.Duration
+	tlsStart, tls         time.Duration
+	firstByte             time.Duration
+	reused                bool
+}
+
+// traceTiming returns ctx with a client trace recording the timing of the
+// requests made with it.
+func traceTiming(ctx context.Context) (context.Context, *requestTiming) {
+	t := &requestTiming{start: time.Now()}
+	since := func(d *time.Duration) func() {
+		return func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			*d = time.Since(t.start)
+		}
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { since(&t.dnsStart)() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { since(&t.dns)() },
+		ConnectStart:      func(string, string) { since(&t.connectStart)() },
+		ConnectDone:       func(string, string, error) { since(&t.connect)() },
+		TLSHandshakeStart: since(&t.tlsStart),
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { since(&t.tls)() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+		},
+		GotFirstResponseByte: since(&t.firstByte),
+	}
+	return httptrace.WithClientTrace(ctx, trace), t
+}
+
+// logSlowRequest logs a request for op on key at warn level if it took
+// longer than slow_request_threshold, with the time spent in each phase.
+// timing is nil for gRPC calls.
+func (r *RestStorage) logSlowRequest(op, key string, start time.Time, timing *requestTiming, resp *http.Response, err error) {
+	duration := time.Since(start)
+	if r.SlowRequestThreshold <= 0 || duration < time.Duration(r.SlowRequestThreshold) {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("operation", op),
+		zap.String("key", key),
+		zap.String("endpoint", r.Endpoint),
+		zap.Duration("duration", duration),
+	}
+
+	if timing != nil {
+		timing.mu.Lock()
+		fields = append(fields,
+			zap.Duration("dns", timing.dns-timing.dnsStart),
+			zap.Duration("connect", timing.connect-timing.connectStart),
+			zap.Duration("tls", timing.tls-timing.tlsStart),
+			zap.Duration("ttfb", timing.firstByte),
+			zap.Bool("reused_connection", timing.reused))
+		timing.mu.Unlock()
+	}
+
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	} else {
+		fields = append(fields, zap.Int("status", resp.StatusCode))
+	}
+
+	r.logger.Warn("Slow storage request", fields...)
+}
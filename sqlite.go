@@ -0,0 +1,420 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStorage is a storage module that keeps the keys, their modification
+// times and the locks in a SQLite database file. Served by
+// rest_storage_server, it's a durable backend for small clusters without
+// other infrastructure: unlike with file_system, locks are granted in
+// transactions and survive restarts of the server.
+type SQLiteStorage struct {
+	// The path of the database file, which is created if it doesn't exist.
+	Path string `json:"path,omitempty"`
+	// How long locks of Caddy using this storage directly are held without
+	// being renewed, e.g. after a crash. Defaults to 1m.
+	LockTTL caddy.Duration `json:"lock_ttl,omitempty"`
+
+	db     *sql.DB
+	leases *leasedLocks
+}
+
+func (*SQLiteStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.rest_sqlite",
+		New: func() caddy.Module { return new(SQLiteStorage) },
+	}
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS storage (
+	key      TEXT PRIMARY KEY,
+	value    BLOB NOT NULL,
+	modified INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS locks (
+	key      TEXT PRIMARY KEY,
+	holder   TEXT NOT NULL,
+	acquired INTEGER NOT NULL,
+	-- 0 if the lock doesn't expire
+	expires  INTEGER NOT NULL
+);
+-- The last fencing token granted for each lock, kept after it is released.
+CREATE TABLE IF NOT EXISTS fencing_tokens (
+	key   TEXT PRIMARY KEY,
+	token INTEGER NOT NULL
+);
+`
+
+func (s *SQLiteStorage) Provision(ctx caddy.Context) error {
+	expandPlaceholders(caddy.NewReplacer(), reflect.ValueOf(s).Elem())
+
+	if s.LockTTL == 0 {
+		s.LockTTL = caddy.Duration(time.Minute)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	s.leases = newLeasedLocks(s, "rest_sqlite-"+hex.EncodeToString(id), time.Duration(s.LockTTL), ctx.Logger())
+
+	path, err := filepath.Abs(s.Path)
+	if err != nil {
+		return err
+	}
+
+	// Writers wait for each other instead of failing with SQLITE_BUSY, and
+	// transactions take the write lock up front, so that reading and then
+	// writing in one can't deadlock.
+	dsn := (&url.URL{
+		Scheme: "file",
+		Opaque: path,
+		RawQuery: url.Values{
+			"_pragma": {"busy_timeout(10000)", "journal_mode(WAL)", "synchronous(NORMAL)"},
+			"_txlock": {"immediate"},
+		}.Encode(),
+	}).String()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return err
+	}
+	s.db = db
+
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		return fmt.Errorf("creating tables in %s: %v", path, err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteStorage) Validate() error {
+	if s.Path == "" {
+		return errors.New("path is required")
+	}
+	if s.LockTTL < 0 {
+		return errors.New("lock_ttl must not be negative")
+	}
+	return nil
+}
+
+// Cleanup releases the locks acquired with Lock and closes the database.
+func (s *SQLiteStorage) Cleanup() error {
+	if s.db == nil {
+		return nil
+	}
+
+	s.leases.releaseAll()
+
+	return s.db.Close()
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens:
+//
+//	storage rest_sqlite /var/lib/caddy/storage.db {
+//		lock_ttl 1m
+//	}
+//
+// The path may also be given as the path option.
+func (s *SQLiteStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the module name
+	if d.NextArg() {
+		s.Path = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		if err := unmarshalField(d, reflect.ValueOf(s).Elem(), d.Val(), d.Val()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return s, nil
+}
+
+func (s *SQLiteStorage) Store(ctx context.Context, key string, value []byte) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO storage (key, value, modified) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, modified = excluded.modified`,
+		key, value, time.Now().UnixNano())
+	return err
+}
+
+func (s *SQLiteStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM storage WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fs.ErrNotExist
+	}
+	// Empty blobs are scanned as nil, which the server would encode as null.
+	if err == nil && value == nil {
+		value = []byte{}
+	}
+	return value, err
+}
+
+// Delete deletes key, and the keys below it if it is a directory.
+func (s *SQLiteStorage) Delete(ctx context.Context, key string) error {
+	dir := key + "/"
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM storage WHERE key = ? OR substr(key, 1, ?) = ?`,
+		key, utf8.RuneCountInString(dir), dir)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Exists(ctx context.Context, key string) bool {
+	dir := key + "/"
+	var exists bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM storage WHERE key = ? OR substr(key, 1, ?) = ?)`,
+		key, utf8.RuneCountInString(dir), dir).Scan(&exists)
+	return err == nil && exists
+}
+
+// Stat returns the info of key, or of the directory key if keys are stored
+// below it. The modification time of a directory is that of the last key
+// modified below it.
+func (s *SQLiteStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	var modified, size int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT modified, length(value) FROM storage WHERE key = ?`, key).Scan(&modified, &size)
+	if err == nil {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   time.Unix(0, modified),
+			Size:       size,
+			IsTerminal: true,
+		}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return certmagic.KeyInfo{}, err
+	}
+
+	dir := key + "/"
+	var lastModified sql.NullInt64
+	err = s.db.QueryRowContext(ctx,
+		`SELECT max(modified) FROM storage WHERE substr(key, 1, ?) = ?`, utf8.RuneCountInString(dir), dir).Scan(&lastModified)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	if !lastModified.Valid {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	return certmagic.KeyInfo{Key: key, Modified: time.Unix(0, lastModified.Int64)}, nil
+}
+
+// List returns the keys and directories directly below prefix, or all keys
+// below it if recursive is set.
+func (s *SQLiteStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	dir := prefix + "/"
+	if prefix == "" {
+		dir = ""
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT key FROM storage WHERE substr(key, 1, ?) = ?`, utf8.RuneCountInString(dir), dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 && prefix != "" {
+		return nil, fs.ErrNotExist
+	}
+	return storageChildren(keys, dir, recursive), nil
+}
+
+// Lock acquires the lock on key for Caddy using this storage directly. The
+// lock is renewed until it is unlocked.
+func (s *SQLiteStorage) Lock(ctx context.Context, key string) error {
+	return s.leases.Lock(ctx, key)
+}
+
+func (s *SQLiteStorage) Unlock(ctx context.Context, key string) error {
+	return s.leases.Unlock(ctx, key)
+}
+
+// The locks of rest_storage_server are kept in the database as well, so
+// they are shared with Caddy using the storage directly.
+
+func (s *SQLiteStorage) lock(ctx context.Context, key, holder string, ttl time.Duration) (uint64, *serverLock, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	held, err := heldSQLiteLock(ctx, tx, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if held != nil && !held.expired(now) {
+		return 0, held, nil
+	}
+
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixNano()
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO locks (key, holder, acquired, expires) VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET holder = excluded.holder, acquired = excluded.acquired, expires = excluded.expires`,
+		key, holder, now.UnixNano(), expires)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Tokens are never deleted, so the largest one is the last granted.
+	var token uint64
+	err = tx.QueryRowContext(ctx, `SELECT coalesce(max(token), 0) + 1 FROM fencing_tokens`).Scan(&token)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO fencing_tokens (key, token) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET token = excluded.token`,
+		key, token)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return token, nil, tx.Commit()
+}
+
+func (s *SQLiteStorage) unlock(ctx context.Context, key, holder string, force bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	held, err := heldSQLiteLock(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+	if held != nil && !force && held.holder != holder && !held.expired(time.Now()) {
+		return &serverError{http.StatusConflict, fmt.Sprintf("lock on %v is held by %v", key, held.holder)}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM locks WHERE key = ?`, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) renew(ctx context.Context, key, holder string, ttl time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	held, err := heldSQLiteLock(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+	if held == nil || held.expired(now) {
+		return &serverError{http.StatusGone, fmt.Sprintf("lease on %v was lost", key)}
+	}
+	if held.holder != holder {
+		return &serverError{http.StatusConflict, fmt.Sprintf("lock on %v is held by %v", key, held.holder)}
+	}
+
+	if ttl > 0 {
+		_, err := tx.ExecContext(ctx, `UPDATE locks SET expires = ? WHERE key = ?`, now.Add(ttl).UnixNano(), key)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) checkFencingTokens(ctx context.Context, tokens map[string]uint64) error {
+	for key, token := range tokens {
+		var last uint64
+		err := s.db.QueryRowContext(ctx, `SELECT token FROM fencing_tokens WHERE key = ?`, key).Scan(&last)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := checkFencingToken(key, token, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heldSQLiteLock returns the lock on key, or nil if there is none.
+func heldSQLiteLock(ctx context.Context, tx *sql.Tx, key string) (*serverLock, error) {
+	var holder string
+	var acquired, expires int64
+	err := tx.QueryRowContext(ctx,
+		`SELECT holder, acquired, expires FROM locks WHERE key = ?`, key).Scan(&holder, &acquired, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &serverLock{holder: holder, acquired: time.Unix(0, acquired)}
+	if expires != 0 {
+		lock.expires = time.Unix(0, expires)
+	}
+	return lock, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*SQLiteStorage)(nil)
+	_ caddy.Validator        = (*SQLiteStorage)(nil)
+	_ caddy.CleanerUpper     = (*SQLiteStorage)(nil)
+	_ caddy.StorageConverter = (*SQLiteStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*SQLiteStorage)(nil)
+	_ certmagic.Storage      = (*SQLiteStorage)(nil)
+	_ serverLocker           = (*SQLiteStorage)(nil)
+)
@@ -0,0 +1,44 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkConnection stats the probe key to verify at startup that the
+// endpoint is reachable and accepts the api key or other credentials. The
+// error tells which of the two failed.
+func (r *RestStorage) checkConnection(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := r.stat(ctx, r.backendKey(probeKey))
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	var urlErr *url.Error
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &urlErr):
+		return fmt.Errorf("endpoint %s is unreachable: %v", r.Endpoint, urlErr.Err)
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == 401 || statusErr.StatusCode == 403):
+		return fmt.Errorf("endpoint %s rejected the credentials: %w", r.Endpoint, err)
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return fmt.Errorf("endpoint %s is unreachable: %w", r.Endpoint, err)
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return fmt.Errorf("endpoint %s rejected the credentials: %w", r.Endpoint, err)
+	}
+
+	return fmt.Errorf("checking endpoint %s: %w", r.Endpoint, err)
+}
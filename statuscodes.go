@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// StatusCodes overrides the HTTP status codes that indicate the results of
+// an operation, for backends with their own conventions. Results without
+// codes keep the defaults.
+type StatusCodes struct {
+	// Defaults to the code of the operation in the README, or any 2xx code
+	// outside the RPC dialect.
+	Success []int `json:"success,omitempty"`
+	// Defaults to 404.
+	NotFound []int `json:"not_found,omitempty"`
+	// Only used for lock. Defaults to 423.
+	Locked []int `json:"locked,omitempty"`
+}
+
+func validateStatusCodes(statusCodes map[string]StatusCodes) error {
+	for op, sc := range statusCodes {
+		if _, ok := rpcRoutes[op]; !ok {
+			return fmt.Errorf("status_codes: unknown operation %q", op)
+		}
+		if len(sc.Locked) > 0 && op != opLock {
+			return fmt.Errorf("status_codes: locked codes only apply to %s", opLock)
+		}
+		for _, codes := range [][]int{sc.Success, sc.NotFound, sc.Locked} {
+			for _, code := range codes {
+				if code < 100 || code > 599 {
+					return fmt.Errorf("status_codes: invalid status code %d for %s", code, op)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// succeeded reports whether resp indicates that op succeeded. Unless
+// configured otherwise, the RPC dialect uses exactly the given status codes
+// and other dialects accept any 2xx code.
+func (r *RestStorage) succeeded(op string, resp *http.Response, codes ...int) bool {
+	if configured := r.StatusCodes[op].Success; len(configured) > 0 {
+		return slices.Contains(configured, resp.StatusCode)
+	}
+	if r.Dialect != "" && r.Dialect != DialectRPC {
+		return resp.StatusCode >= 200 && resp.StatusCode < 300
+	}
+	return slices.Contains(codes, resp.StatusCode)
+}
+
+// notFound reports whether resp indicates that the key of op doesn't exist.
+func (r *RestStorage) notFound(op string, resp *http.Response) bool {
+	if configured := r.StatusCodes[op].NotFound; len(configured) > 0 {
+		return slices.Contains(configured, resp.StatusCode)
+	}
+	return resp.StatusCode == 404
+}
+
+// locked reports whether resp to a lock request indicates that the lock is
+// held elsewhere.
+func (r *RestStorage) locked(resp *http.Response) bool {
+	if configured := r.StatusCodes[opLock].Locked; len(configured) > 0 {
+		return slices.Contains(configured, resp.StatusCode)
+	}
+	return resp.StatusCode == 423
+}
@@ -0,0 +1,313 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPreallocSize caps the buffer allocated up front for a body of known
+// length, so a bogus Content-Length can't exhaust memory.
+const maxPreallocSize = 16 << 20
+
+// valueBuffers holds the buffers values are decoded into before they are
+// copied out at their exact size, so that loading large values doesn't
+// grow a new buffer every time.
+var valueBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// readBody reads the body of resp, allocating it at once if its length is
+// known.
+func readBody(resp *http.Response) ([]byte, error) {
+	if resp.ContentLength < 0 || resp.ContentLength > maxPreallocSize {
+		return io.ReadAll(resp.Body)
+	}
+
+	value := make([]byte, resp.ContentLength)
+	if _, err := io.ReadFull(resp.Body, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// decodeLoadResponse decodes the LoadResponse in the body of resp. JSON is
+// decoded as a stream: the base64 value is decoded straight from the body
+// rather than read into a string first, so a value is only held in memory
+// once.
+func decodeLoadResponse(resp *http.Response) (LoadResponse, error) {
+	var loadResp LoadResponse
+	if _, ok := responseCodec(resp).(jsonCodec); !ok {
+		err := decode(resp, &loadResp)
+		return loadResp, err
+	}
+
+	src := io.Reader(resp.Body)
+	dec := json.NewDecoder(src)
+	if err := expectDelim(dec, '{'); err != nil {
+		return loadResp, err
+	}
+
+	for dec.More() {
+		name, err := fieldName(dec)
+		if err != nil {
+			return loadResp, err
+		}
+
+		switch name {
+		case "value":
+			rest := bufio.NewReader(io.MultiReader(dec.Buffered(), src))
+			if loadResp.Value, err = readBase64Value(rest); err != nil {
+				return loadResp, fmt.Errorf("decoding value: %v", err)
+			}
+
+			// Go on with the fields after the value as an object of
+			// their own.
+			next, err := nextNonSpace(rest)
+			if err != nil {
+				return loadResp, err
+			}
+			if next == '}' {
+				return loadResp, nil
+			}
+			if next != ',' {
+				return loadResp, fmt.Errorf("invalid character %q after value", next)
+			}
+			src = io.MultiReader(strings.NewReader("{"), rest)
+			dec = json.NewDecoder(src)
+			if err := expectDelim(dec, '{'); err != nil {
+				return loadResp, err
+			}
+		case "version":
+			err = dec.Decode(&loadResp.Version)
+		case "checksum":
+			err = dec.Decode(&loadResp.Checksum)
+		default:
+			err = dec.Decode(new(json.RawMessage))
+		}
+		if err != nil {
+			return loadResp, err
+		}
+	}
+
+	return loadResp, nil
+}
+
+// decodeListResponse decodes the ListResponse in the body of resp. JSON is
+// decoded one key at a time, so the response is never held in memory as a
+// whole.
+func decodeListResponse(resp *http.Response) (ListResponse, error) {
+	var listResp ListResponse
+	if _, ok := responseCodec(resp).(jsonCodec); !ok {
+		err := decode(resp, &listResp)
+		return listResp, err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	if err := expectDelim(dec, '{'); err != nil {
+		return listResp, err
+	}
+
+	for dec.More() {
+		name, err := fieldName(dec)
+		if err != nil {
+			return listResp, err
+		}
+
+		switch name {
+		case "keys":
+			listResp.Keys, err = decodeKeyArray(dec)
+		case "next_cursor":
+			err = dec.Decode(&listResp.NextCursor)
+		default:
+			err = dec.Decode(new(json.RawMessage))
+		}
+		if err != nil {
+			return listResp, err
+		}
+	}
+
+	return listResp, nil
+}
+
+func decodeKeyArray(dec *json.Decoder) ([]string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if tok != json.Delim('[') {
+		return nil, fmt.Errorf("expected keys to be an array, got %v", tok)
+	}
+
+	var keys []string
+	for dec.More() {
+		var key string
+		if err := dec.Decode(&key); err != nil {
+			return nil, fmt.Errorf("decoding key %d of list response: %v", len(keys)+1, err)
+		}
+		keys = append(keys, key)
+	}
+
+	_, err = dec.Token()
+	return keys, err
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+func fieldName(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	name, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a field name, got %v", tok)
+	}
+	return name, nil
+}
+
+func nextNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
+
+// readBase64Value reads the colon and the JSON string (or null) following
+// a field name, and decodes the string as base64 like encoding/json does.
+func readBase64Value(r *bufio.Reader) ([]byte, error) {
+	c, err := nextNonSpace(r)
+	if err != nil {
+		return nil, err
+	}
+	if c != ':' {
+		return nil, fmt.Errorf("invalid character %q after field name", c)
+	}
+
+	c, err = nextNonSpace(r)
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case 'n':
+		null := make([]byte, 3)
+		if _, err := io.ReadFull(r, null); err != nil || string(null) != "ull" {
+			return nil, errors.New("invalid literal")
+		}
+		return nil, nil
+	case '"':
+	default:
+		return nil, fmt.Errorf("expected a string, got %q", c)
+	}
+
+	buf := valueBuffers.Get().(*bytes.Buffer)
+	defer valueBuffers.Put(buf)
+	buf.Reset()
+
+	if _, err := io.Copy(buf, base64.NewDecoder(base64.StdEncoding, &jsonStringReader{r: r})); err != nil {
+		return nil, err
+	}
+
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// jsonStringReader reads the contents of a JSON string whose opening quote
+// was already read, unescaping it, until the closing quote. Only escapes of
+// ASCII characters are supported, which is all base64 needs.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (s *jsonStringReader) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+
+		switch c {
+		case '"':
+			s.done = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		case '\\':
+			if c, err = s.unescape(); err != nil {
+				return n, err
+			}
+		}
+
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+func (s *jsonStringReader) unescape() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch c {
+	case '"', '\\', '/':
+		return c, nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'u':
+		hex := make([]byte, 4)
+		if _, err := io.ReadFull(s.r, hex); err != nil {
+			return 0, err
+		}
+		code, err := strconv.ParseUint(string(hex), 16, 16)
+		if err != nil || code >= 0x80 {
+			return 0, fmt.Errorf("invalid escape \\u%s in base64 value", hex)
+		}
+		return byte(code), nil
+	default:
+		return 0, fmt.Errorf("invalid escape \\%c", c)
+	}
+}
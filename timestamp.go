@@ -0,0 +1,102 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Timestamp is a point in time reported by the backend. Besides strings in
+// any format parseTimestamp understands, it accepts Unix epoch numbers,
+// which are kept in their decimal form.
+type Timestamp string
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return t.set(v)
+}
+
+func (t *Timestamp) DecodeMsgpack(dec *msgpack.Decoder) error {
+	v, err := dec.DecodeInterface()
+	if err != nil {
+		return err
+	}
+	return t.set(v)
+}
+
+func (t *Timestamp) UnmarshalCBOR(data []byte) error {
+	var v any
+	if err := cbor.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return t.set(v)
+}
+
+func (t *Timestamp) set(v any) error {
+	switch v := v.(type) {
+	case nil:
+		*t = ""
+	case string:
+		*t = Timestamp(v)
+	case float64:
+		*t = Timestamp(strconv.FormatFloat(v, 'f', -1, 64))
+	case float32:
+		*t = Timestamp(strconv.FormatFloat(float64(v), 'f', -1, 32))
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		*t = Timestamp(fmt.Sprint(v))
+	case time.Time:
+		*t = Timestamp(v.Format(time.RFC3339Nano))
+	default:
+		return fmt.Errorf("cannot decode %T as a timestamp", v)
+	}
+	return nil
+}
+
+// Epoch numbers above this are in milliseconds; as seconds, they would be
+// more than 3000 years in the future.
+const maxEpochSeconds = 1e11
+
+// parseTimestamp parses a timestamp in the configured timestamp layout,
+// RFC 3339 (with or without fractional seconds), an HTTP date format such
+// as RFC 1123, or as Unix epoch seconds or milliseconds.
+func (r *RestStorage) parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	if r.TimestampLayout != "" {
+		if t, err := time.Parse(r.TimestampLayout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	if t, err := http.ParseTime(s); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse(time.RFC1123Z, s); err == nil {
+		return t, nil
+	}
+
+	if epoch, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(epoch, 0) && !math.IsNaN(epoch) {
+		if math.Abs(epoch) > maxEpochSeconds {
+			return time.UnixMilli(int64(epoch)).UTC(), nil
+		}
+		sec, frac := math.Modf(epoch)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", s)
+}
@@ -0,0 +1,66 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/appmasker/caddy_rest_storage"
+
+// startSpan starts the client span of a request for op on the backend key.
+// If ctx carries a span, e.g. of Caddy's tracing handler, the new span is
+// its child and is recorded by the same tracer provider; otherwise, the
+// global tracer provider is used.
+func (r *RestStorage) startSpan(ctx context.Context, op, backendKey string) (context.Context, trace.Span) {
+	provider := otel.GetTracerProvider()
+	if parent := trace.SpanFromContext(ctx); parent.SpanContext().IsValid() {
+		provider = parent.TracerProvider()
+	}
+
+	// Hashed keys have no prefix to tell.
+	var prefix string
+	if key, ok := r.storageKey(backendKey); ok {
+		prefix = keyPrefix(key)
+	}
+
+	return provider.Tracer(tracerName).Start(ctx, "storage.rest."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("storage.operation", op),
+			attribute.String("storage.key_prefix", prefix),
+		))
+}
+
+// endSpan records the outcome of a request and ends its span.
+func endSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	span.End()
+}
+
+// injectTraceContext adds the W3C traceparent header of the span in ctx to
+// header.
+func injectTraceContext(ctx context.Context, header http.Header) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// keyPrefix returns the first segment of key, e.g. "certificates", which
+// tells what kind of asset a key is without naming a domain.
+func keyPrefix(key string) string {
+	prefix, _, _ := strings.Cut(key, "/")
+	return prefix
+}
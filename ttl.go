@@ -0,0 +1,52 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ttlHeader carries the TTL of a stored value in seconds.
+const ttlHeader = "x-storage-ttl"
+
+// keyTTL returns the TTL of the longest prefix in TTLs that key starts
+// with, or zero if there is none.
+func (r *RestStorage) keyTTL(key string) time.Duration {
+	var ttl time.Duration
+	longest := -1
+	for prefix, prefixTTL := range r.TTLs {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			ttl, longest = time.Duration(prefixTTL), len(prefix)
+		}
+	}
+	return ttl
+}
+
+// setTTL adds the TTL of a Store to its headers and returns it in seconds.
+func setTTL(header http.Header, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	seconds := int64(ttl / time.Second)
+	header.Set(ttlHeader, strconv.FormatInt(seconds, 10))
+	return seconds
+}
+
+// ttlSeconds returns the TTL in the headers of a Store, in seconds.
+func ttlSeconds(header http.Header) int64 {
+	seconds, _ := strconv.ParseInt(header.Get(ttlHeader), 10, 64)
+	return seconds
+}
+
+func validateTTLs(ttls map[string]caddy.Duration) error {
+	for _, ttl := range ttls {
+		if ttl != 0 && time.Duration(ttl) < time.Second {
+			return errors.New("ttls must be at least 1s")
+		}
+	}
+	return nil
+}
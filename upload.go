@@ -0,0 +1,296 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ChunkedUploadConfig uploads large values in chunks, so they survive flaky
+// connections and proxies that limit the request body size. A value is
+// uploaded by an upload_init request, upload_append requests for each
+// chunk, and an upload_commit request that stores the value. Failed chunks
+// are retried from the offset reported by upload_status, and a Store of the
+// same value after an error resumes the interrupted upload.
+type ChunkedUploadConfig struct {
+	// Values larger than this many bytes are uploaded in chunks. Defaults
+	// to 4 MiB.
+	Threshold int `json:"threshold,omitempty"`
+	// The size of each chunk in bytes. Defaults to 1 MiB.
+	ChunkSize int `json:"chunk_size,omitempty"`
+	// How often a chunk is retried before Store fails. Defaults to 3.
+	Retries int `json:"retries,omitempty"`
+}
+
+func (c *ChunkedUploadConfig) provision() {
+	if c.Threshold == 0 {
+		c.Threshold = 4 << 20
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = 1 << 20
+	}
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+}
+
+func (c *ChunkedUploadConfig) validate() error {
+	if c.Threshold < 0 || c.ChunkSize < 0 || c.Retries < 0 {
+		return errors.New("chunked_upload: threshold, chunk_size and retries must not be negative")
+	}
+	return nil
+}
+
+type UploadInitRequest struct {
+	Key string `json:"key" protobuf:"1"`
+	// The total size of the value.
+	Size int64 `json:"size" protobuf:"2"`
+	// The hex-encoded SHA-256 hash of the value.
+	Checksum string `json:"checksum" protobuf:"3"`
+}
+
+type UploadInitResponse struct {
+	UploadID string `json:"upload_id" protobuf:"1"`
+}
+
+type UploadAppendRequest struct {
+	UploadID string `json:"upload_id" protobuf:"1"`
+	// The position of Data in the value.
+	Offset int64  `json:"offset" protobuf:"2"`
+	Data   []byte `json:"data" protobuf:"3"`
+}
+
+type UploadStatusRequest struct {
+	UploadID string `json:"upload_id" protobuf:"1"`
+}
+
+type UploadStatusResponse struct {
+	// The number of bytes received so far.
+	Offset int64 `json:"offset" protobuf:"1"`
+}
+
+type UploadCommitRequest struct {
+	UploadID      string            `json:"upload_id" protobuf:"1"`
+	FencingTokens map[string]uint64 `json:"fencing_tokens,omitempty" protobuf:"2"`
+	IfMatch       string            `json:"if_match,omitempty" protobuf:"3"`
+	CreateOnly    bool              `json:"create_only,omitempty" protobuf:"4"`
+	TTL           int64             `json:"ttl,omitempty" protobuf:"5"`
+}
+
+// storeChunked stores value with a chunked upload, resuming a previous
+// upload of the same value to key if there is one.
+func (r *RestStorage) storeChunked(ctx context.Context, key string, value []byte, header http.Header) error {
+	checksum := sha256Hex(value)
+	size := int64(len(value))
+
+	uploadID := r.uploads.get(key, checksum)
+	var offset int64
+	if uploadID != "" {
+		var err error
+		offset, err = r.uploadStatus(ctx, uploadID)
+		if err != nil {
+			r.logger.Warn("Unable to resume upload; starting over", zap.String("key", key), zap.Error(err))
+			uploadID = ""
+		}
+	}
+
+	if uploadID == "" {
+		var err error
+		uploadID, err = r.uploadInit(ctx, key, size, checksum)
+		if err != nil {
+			return err
+		}
+		r.uploads.set(key, checksum, uploadID)
+		offset = 0
+	}
+
+	failures := 0
+	for offset < size {
+		end := min(offset+int64(r.ChunkedUpload.ChunkSize), size)
+
+		err := r.uploadAppend(ctx, uploadID, offset, value[offset:end])
+		if err == nil {
+			offset = end
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures > r.ChunkedUpload.Retries || ctx.Err() != nil {
+			return fmt.Errorf("uploading %v at offset %d: %w", key, offset, err)
+		}
+
+		restMetrics.retries.WithLabelValues(opUploadAppend).Inc()
+		r.logger.Warn("Error uploading chunk; will resume",
+			zap.String("key", key),
+			zap.Int64("offset", offset),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(failures) * time.Second):
+		}
+
+		// The chunk may have been received even though the response was lost.
+		if received, err := r.uploadStatus(ctx, uploadID); err == nil {
+			offset = received
+		}
+	}
+
+	if err := r.uploadCommit(ctx, key, uploadID, header); err != nil {
+		return err
+	}
+
+	r.uploads.remove(key)
+	r.forgetETag(key)
+
+	return nil
+}
+
+func (r *RestStorage) uploadInit(ctx context.Context, key string, size int64, checksum string) (string, error) {
+	resp, err := r.call(ctx, opUploadInit, key, nil, UploadInitRequest{
+		Key:      key,
+		Size:     size,
+		Checksum: checksum,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opUploadInit, resp, 201) {
+		return "", r.statusError(resp)
+	}
+
+	var initResp UploadInitResponse
+
+	err = decode(resp, &initResp)
+
+	if err != nil {
+		return "", err
+	}
+
+	if initResp.UploadID == "" {
+		return "", errors.New("backend returned no upload_id")
+	}
+
+	return initResp.UploadID, nil
+}
+
+func (r *RestStorage) uploadAppend(ctx context.Context, uploadID string, offset int64, data []byte) error {
+	resp, err := r.call(ctx, opUploadAppend, uploadID, nil, UploadAppendRequest{
+		UploadID: uploadID,
+		Offset:   offset,
+		Data:     data,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opUploadAppend, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	return nil
+}
+
+func (r *RestStorage) uploadStatus(ctx context.Context, uploadID string) (int64, error) {
+	resp, err := r.call(ctx, opUploadStatus, uploadID, nil, UploadStatusRequest{
+		UploadID: uploadID,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opUploadStatus, resp, 200) {
+		return 0, r.statusError(resp)
+	}
+
+	var statusResp UploadStatusResponse
+
+	err = decode(resp, &statusResp)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return statusResp.Offset, nil
+}
+
+// uploadCommit stores the uploaded value, conditional on the If-Match and
+// If-None-Match headers of the Store.
+func (r *RestStorage) uploadCommit(ctx context.Context, key, uploadID string, header http.Header) error {
+	resp, err := r.call(ctx, opUploadCommit, uploadID, header, UploadCommitRequest{
+		UploadID:      uploadID,
+		FencingTokens: r.locks.fencingTokens(),
+		IfMatch:       header.Get("If-Match"),
+		CreateOnly:    header.Get("If-None-Match") == "*",
+		TTL:           ttlSeconds(header),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if !r.succeeded(opUploadCommit, resp, 201) {
+		return r.storeError(key, header, resp)
+	}
+
+	return nil
+}
+
+// uploads remembers unfinished chunked uploads by key, so they can be
+// resumed when the same value is stored again.
+type uploads struct {
+	mu      sync.Mutex
+	pending map[string]pendingUpload
+}
+
+type pendingUpload struct {
+	checksum string
+	id       string
+}
+
+func newUploads() *uploads {
+	return &uploads{pending: make(map[string]pendingUpload)}
+}
+
+// get returns the ID of the unfinished upload of the value with checksum to
+// key, if any.
+func (u *uploads) get(key, checksum string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if upload, ok := u.pending[key]; ok && upload.checksum == checksum {
+		return upload.id
+	}
+	return ""
+}
+
+func (u *uploads) set(key, checksum, id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending[key] = pendingUpload{checksum: checksum, id: id}
+}
+
+func (u *uploads) remove(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.pending, key)
+}
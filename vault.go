@@ -0,0 +1,294 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// Used when the secret has no lease, e.g. KV secrets.
+	vaultDefaultRefresh = 5 * time.Minute
+	vaultRetryInterval  = 30 * time.Second
+)
+
+// VaultConfig reads the API key from HashiCorp Vault instead of the Caddy
+// config. The secret is read at Provision and re-read when two thirds of its
+// lease (or of the token's lease) has elapsed; expiring tokens of the token
+// method are renewed then. Only the API key is read from Vault; client
+// certificates for the endpoint are not supported.
+type VaultConfig struct {
+	Address   string `json:"address"`
+	Namespace string `json:"namespace,omitempty"`
+
+	// token (the default), approle or kubernetes.
+	AuthMethod string `json:"auth_method,omitempty"`
+	// Mount path of the auth method; defaults to the method name.
+	AuthMount string `json:"auth_mount,omitempty"`
+	// For the token method; defaults to $VAULT_TOKEN.
+	Token string `json:"token,omitempty"`
+	// For the approle method.
+	RoleID   string `json:"role_id,omitempty"`
+	SecretID string `json:"secret_id,omitempty"`
+	// For the kubernetes method.
+	Role string `json:"role,omitempty"`
+
+	// API path of the secret, e.g. secret/data/caddy/storage for KV v2.
+	SecretPath string `json:"secret_path"`
+	// Field of the secret holding the API key; defaults to api_key.
+	Field string `json:"field,omitempty"`
+}
+
+func (v *VaultConfig) validate() error {
+	if v.Address == "" {
+		return errors.New("vault: address must be specified")
+	}
+
+	if v.SecretPath == "" {
+		return errors.New("vault: secret_path must be specified")
+	}
+
+	return v.validateAuth()
+}
+
+func (v *VaultConfig) validateAuth() error {
+	switch v.AuthMethod {
+	case "", "token":
+	case "approle":
+		if v.RoleID == "" || v.SecretID == "" {
+			return errors.New("vault: role_id and secret_id are required for approle auth")
+		}
+	case "kubernetes":
+		if v.Role == "" {
+			return errors.New("vault: role is required for kubernetes auth")
+		}
+	default:
+		return fmt.Errorf("vault: unknown auth_method %q", v.AuthMethod)
+	}
+
+	return nil
+}
+
+// vaultSecret holds the current value of a secret read from Vault.
+type vaultSecret struct {
+	cfg        VaultConfig
+	httpClient *http.Client
+
+	mu    sync.RWMutex
+	value string
+}
+
+func newVaultSecret(ctx context.Context, cfg VaultConfig) (*vaultSecret, time.Duration, error) {
+	v := &vaultSecret{cfg: cfg.normalized(), httpClient: &http.Client{Timeout: 10 * time.Second}}
+
+	refresh, err := v.refresh(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return v, refresh, nil
+}
+
+// normalized returns the config with defaults applied.
+func (cfg VaultConfig) normalized() VaultConfig {
+	cfg.Address = strings.TrimSuffix(cfg.Address, "/")
+	cfg.SecretPath = strings.Trim(cfg.SecretPath, "/")
+	if cfg.AuthMethod == "" {
+		cfg.AuthMethod = "token"
+	}
+	if cfg.AuthMount == "" {
+		cfg.AuthMount = cfg.AuthMethod
+	}
+	if cfg.Field == "" {
+		cfg.Field = "api_key"
+	}
+	if cfg.Token == "" && cfg.AuthMethod == "token" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	return cfg
+}
+
+func (v *vaultSecret) get() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.value
+}
+
+// refresh logs in if needed and re-reads the secret. It returns how long to
+// wait before the next refresh.
+func (v *vaultSecret) refresh(ctx context.Context) (time.Duration, error) {
+	token, tokenLease, err := v.token(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("vault login: %v", err)
+	}
+
+	var secret vaultResponse
+	if err := v.call(ctx, "GET", v.cfg.SecretPath, token, nil, &secret); err != nil {
+		return 0, fmt.Errorf("reading vault secret %s: %v", v.cfg.SecretPath, err)
+	}
+
+	data := secret.Data
+	// KV v2 nests the secret under data.data.
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[v.cfg.Field].(string)
+	if !ok || value == "" {
+		return 0, fmt.Errorf("vault secret %s has no field %q", v.cfg.SecretPath, v.cfg.Field)
+	}
+
+	v.mu.Lock()
+	v.value = value
+	v.mu.Unlock()
+
+	lease := time.Duration(secret.LeaseDuration) * time.Second
+	if tokenLease > 0 && (lease == 0 || tokenLease < lease) {
+		lease = tokenLease
+	}
+	if lease == 0 {
+		return vaultDefaultRefresh, nil
+	}
+	return lease * 2 / 3, nil
+}
+
+// token returns the token to read secrets with and its lease, which is zero
+// for tokens that don't expire. The configured token is renewed; the other
+// methods log in again.
+func (v *vaultSecret) token(ctx context.Context) (string, time.Duration, error) {
+	if v.cfg.AuthMethod != "token" {
+		return v.login(ctx)
+	}
+
+	lease, err := v.renewToken(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	return v.cfg.Token, lease, nil
+}
+
+// renewToken renews the configured token if it expires. A token that expires
+// but can't be renewed is rejected, as the secret could not be re-read once
+// it has expired.
+func (v *vaultSecret) renewToken(ctx context.Context) (time.Duration, error) {
+	var lookup vaultResponse
+	if err := v.call(ctx, "GET", "auth/token/lookup-self", v.cfg.Token, nil, &lookup); err != nil {
+		return 0, fmt.Errorf("looking up token: %v", err)
+	}
+
+	ttl, _ := lookup.Data["ttl"].(float64)
+	if ttl == 0 {
+		return 0, nil
+	}
+	if renewable, _ := lookup.Data["renewable"].(bool); !renewable {
+		return 0, fmt.Errorf("token expires in %v and is not renewable; use a periodic or non-expiring token",
+			time.Duration(ttl)*time.Second)
+	}
+
+	var renewed vaultResponse
+	if err := v.call(ctx, "POST", "auth/token/renew-self", v.cfg.Token, nil, &renewed); err != nil {
+		return 0, fmt.Errorf("renewing token: %v", err)
+	}
+	return time.Duration(renewed.Auth.LeaseDuration) * time.Second, nil
+}
+
+func (v *vaultSecret) login(ctx context.Context) (string, time.Duration, error) {
+	var body map[string]string
+	switch v.cfg.AuthMethod {
+	case "approle":
+		body = map[string]string{"role_id": v.cfg.RoleID, "secret_id": v.cfg.SecretID}
+	case "kubernetes":
+		jwt, err := os.ReadFile(kubernetesTokenPath)
+		if err != nil {
+			return "", 0, err
+		}
+		body = map[string]string{"role": v.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	}
+
+	var resp vaultResponse
+	if err := v.call(ctx, "POST", "auth/"+strings.Trim(v.cfg.AuthMount, "/")+"/login", "", body, &resp); err != nil {
+		return "", 0, err
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", 0, errors.New("login response contains no client token")
+	}
+
+	return resp.Auth.ClientToken, time.Duration(resp.Auth.LeaseDuration) * time.Second, nil
+}
+
+type vaultResponse struct {
+	LeaseDuration int            `json:"lease_duration"`
+	Data          map[string]any `json:"data"`
+	Auth          struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+func (v *vaultSecret) call(ctx context.Context, method, path, token string, body any, out *vaultResponse) error {
+	var requestBody []byte
+	if body != nil {
+		var err error
+		requestBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.cfg.Address+"/v1/"+path, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unknown status code received: %v", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// renew re-reads the secret per its lease until ctx is done. Failures keep
+// the last good value and are retried.
+func (v *vaultSecret) renew(ctx context.Context, wait time.Duration, logger *zap.Logger) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			next, err := v.refresh(ctx)
+			if err != nil {
+				logger.Error("Error refreshing secret from vault; keeping previous value", zap.Error(err))
+				next = vaultRetryInterval
+			}
+			timer.Reset(next)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault serves a KV v2 secret and the token endpoints for a token with
+// the given ttl, and counts the renewals.
+type fakeVault struct {
+	ttl       int
+	renewable bool
+
+	mu       sync.Mutex
+	renewals int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("X-Vault-Token") != "token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var resp map[string]any
+	switch req.Method + " " + req.URL.Path {
+	case "GET /v1/auth/token/lookup-self":
+		resp = map[string]any{"data": map[string]any{"ttl": f.ttl, "renewable": f.renewable}}
+	case "POST /v1/auth/token/renew-self":
+		f.renewals++
+		resp = map[string]any{"auth": map[string]any{"client_token": "token", "lease_duration": 3600}}
+	case "GET /v1/secret/data/caddy":
+		resp = map[string]any{"data": map[string]any{
+			"data":     map[string]any{"api_key": "key"},
+			"metadata": map[string]any{"version": 1},
+		}}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestVaultTokenRenewal(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       int
+		renewable bool
+		refresh   time.Duration
+		renewals  int
+		err       string
+	}{
+		{name: "non-expiring", refresh: vaultDefaultRefresh},
+		{name: "renewable", ttl: 60, renewable: true, refresh: 40 * time.Minute, renewals: 1},
+		{name: "not renewable", ttl: 60, err: "not renewable"},
+	}
+	for _, test := range tests {
+		vault := &fakeVault{ttl: test.ttl, renewable: test.renewable}
+		server := httptest.NewServer(vault)
+
+		secret, refresh, err := newVaultSecret(context.Background(), VaultConfig{
+			Address:    server.URL,
+			Token:      "token",
+			SecretPath: "secret/data/caddy",
+		})
+		server.Close()
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if secret.get() != "key" {
+			t.Errorf("%s: secret is %q", test.name, secret.get())
+		}
+		if refresh != test.refresh {
+			t.Errorf("%s: refreshing after %v, want %v", test.name, refresh, test.refresh)
+		}
+		if vault.renewals != test.renewals {
+			t.Errorf("%s: token renewed %d times, want %d", test.name, vault.renewals, test.renewals)
+		}
+	}
+}
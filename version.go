@@ -0,0 +1,142 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// ProtocolVersion is the version of the storage API implemented by this
+// module. It is increased on incompatible changes.
+const ProtocolVersion = 1
+
+const (
+	// VersionCheckOff skips the version check. This is the default.
+	VersionCheckOff = "off"
+	// VersionCheckWarn logs a warning if the backend is incompatible or
+	// doesn't report its version.
+	VersionCheckWarn = "warn"
+	// VersionCheckRequire fails provisioning in those cases.
+	VersionCheckRequire = "require"
+)
+
+type InfoRequest struct {
+	// The protocol version of this module.
+	ProtocolVersion int64 `json:"protocol_version" protobuf:"1"`
+}
+
+type InfoResponse struct {
+	// The version of the backend software, for logging.
+	Version string `json:"version,omitempty" protobuf:"1"`
+	// The newest protocol version the backend implements.
+	ProtocolVersion int64 `json:"protocol_version" protobuf:"2"`
+	// The oldest protocol version the backend implements. Defaults to
+	// ProtocolVersion.
+	MinProtocolVersion int64 `json:"min_protocol_version,omitempty" protobuf:"3"`
+	// The optional features the backend supports.
+	Capabilities []string `json:"capabilities,omitempty" protobuf:"4"`
+}
+
+// Optional features a backend may report in its capabilities.
+const (
+	// The backend accepts and returns raw values; see RawValues.
+	CapabilityRawValues = "raw_values"
+	// The backend supports lock leases and the renew endpoint.
+	CapabilityLockLeases = "lock_leases"
+	// The backend supports the store_batch, delete_batch, load_batch and
+	// stat_batch endpoints.
+	CapabilityBatch = "batch"
+	// The backend supports the delete_prefix endpoint.
+	CapabilityDeletePrefix = "delete_prefix"
+	// The backend applies the pattern and modified_after filters of list
+	// requests.
+	CapabilityListFilters = "list_filters"
+	// The backend supports the list_values endpoint.
+	CapabilityListValues = "list_values"
+)
+
+// The lock TTL used when the backend reports lock lease support and no
+// lock_ttl is configured.
+const defaultLockTTL = 2 * time.Minute
+
+// handshake asks the backend for its info. Depending on the configuration,
+// it verifies that the backend implements ProtocolVersion and adapts the
+// client to the backend's capabilities.
+func (r *RestStorage) handshake(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	resp, err := r.call(ctx, opInfo, "", nil, InfoRequest{
+		ProtocolVersion: ProtocolVersion,
+	})
+
+	if err != nil {
+		return fmt.Errorf("requesting backend info: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if r.notFound(opInfo, resp) {
+		return errors.New("backend does not implement the info endpoint")
+	}
+
+	if !r.succeeded(opInfo, resp, 200) {
+		return r.statusError(resp)
+	}
+
+	var info InfoResponse
+
+	err = decode(resp, &info)
+
+	if err != nil {
+		return fmt.Errorf("decoding backend info: %v", err)
+	}
+
+	minVersion := info.MinProtocolVersion
+	if minVersion == 0 {
+		minVersion = info.ProtocolVersion
+	}
+
+	if r.VersionCheck != "" && r.VersionCheck != VersionCheckOff &&
+		(ProtocolVersion < minVersion || ProtocolVersion > info.ProtocolVersion) {
+		return fmt.Errorf("backend implements protocol versions %d to %d, but this module requires version %d",
+			minVersion, info.ProtocolVersion, ProtocolVersion)
+	}
+
+	r.logger.Info("Connected to storage backend",
+		zap.String("version", info.Version),
+		zap.Int64("protocol_version", info.ProtocolVersion),
+		zap.Strings("capabilities", info.Capabilities))
+
+	if r.DetectCapabilities {
+		r.applyCapabilities(info.Capabilities)
+	}
+
+	return nil
+}
+
+// applyCapabilities enables the optional features the backend supports and
+// disables configured ones it doesn't.
+func (r *RestStorage) applyCapabilities(capabilities []string) {
+	r.capabilities = make(map[string]bool)
+	for _, capability := range capabilities {
+		r.capabilities[capability] = true
+	}
+
+	// Values are always binary over gRPC.
+	if r.capabilities[CapabilityRawValues] && r.grpcConn == nil {
+		r.RawValues = true
+	}
+
+	switch {
+	case r.capabilities[CapabilityLockLeases] && r.LockTTL == 0:
+		r.LockTTL = caddy.Duration(defaultLockTTL)
+	case !r.capabilities[CapabilityLockLeases] && r.LockTTL != 0:
+		r.logger.Warn("Backend does not support lock leases; disabling lock_ttl")
+		r.LockTTL = 0
+	}
+}
@@ -0,0 +1,231 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const eventStreamContentType = "text/event-stream"
+
+// WatchConfig subscribes to the keys changed in the backend, so that values
+// changed by other instances are evicted from the local caches right away
+// instead of once they expire.
+type WatchConfig struct {
+	// How long to wait before watching again after a failed request.
+	// Defaults to 5s.
+	RetryInterval caddy.Duration `json:"retry_interval,omitempty"`
+}
+
+func (c *WatchConfig) provision() {
+	if c.RetryInterval == 0 {
+		c.RetryInterval = caddy.Duration(5 * time.Second)
+	}
+}
+
+func (c *WatchConfig) validate() error {
+	if c.RetryInterval < 0 {
+		return errors.New("watch: retry_interval must not be negative")
+	}
+	return nil
+}
+
+type WatchRequest struct {
+	Prefix string `json:"prefix,omitempty" protobuf:"1"`
+	// The cursor of the previous response; empty to watch from now on.
+	Cursor string `json:"cursor,omitempty" protobuf:"2"`
+}
+
+type WatchResponse struct {
+	Events []WatchEvent `json:"events" protobuf:"1"`
+	// Where to resume watching.
+	Cursor string `json:"cursor,omitempty" protobuf:"2"`
+}
+
+type WatchEvent struct {
+	Key string `json:"key" protobuf:"1"`
+	// "store" or "delete"
+	Type string `json:"type,omitempty" protobuf:"2"`
+}
+
+// errCursorExpired is returned when the backend can't resume watching from
+// a cursor, so that changes may have been missed.
+var errCursorExpired = errors.New("watch cursor expired")
+
+// watch evicts the keys reported by the backend until ctx is done. Requests
+// are long polls, or event streams if the backend responds with
+// text/event-stream; either way, the next request resumes from the cursor
+// of the last one. If changes may have been missed, all caches are dropped.
+func (r *RestStorage) watch(ctx context.Context) {
+	retryInterval := time.Duration(r.Watch.RetryInterval)
+
+	var cursor string
+	var missed bool
+	for {
+		next, err := r.watchEvents(ctx, cursor)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, errCursorExpired) {
+			r.logger.Warn("Backend can't resume watching; dropping all cached values")
+			r.invalidateAll()
+			cursor, missed = "", false
+			continue
+		}
+
+		if err != nil {
+			r.logger.Error("Error watching for changed keys; retrying",
+				zap.Duration("retry_interval", retryInterval), zap.Error(err))
+			missed = missed || cursor == ""
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+
+		if missed {
+			r.logger.Info("Watching for changed keys again; dropping all cached values")
+			r.invalidateAll()
+			missed = false
+		}
+		cursor = next
+	}
+}
+
+// watchEvents waits for changed keys after cursor, and returns the cursor
+// to continue from.
+func (r *RestStorage) watchEvents(ctx context.Context, cursor string) (string, error) {
+	header := http.Header{}
+	header.Set("Accept", eventStreamContentType+", "+r.codec().contentType()+";q=0.9")
+	if cursor != "" {
+		header.Set("Last-Event-ID", cursor)
+	}
+
+	// Watch requests are held open, so they mustn't take up one of the
+	// max_concurrent_requests.
+	resp, err := r.call(withoutLimit(ctx), opWatch, "", header, WatchRequest{
+		Prefix: r.watchPrefix(),
+		Cursor: cursor,
+	})
+
+	if err != nil {
+		return cursor, err
+	}
+
+	defer resp.Body.Close()
+
+	// No changes before the long poll timed out.
+	if resp.StatusCode == http.StatusNoContent {
+		return cursor, nil
+	}
+
+	if resp.StatusCode == http.StatusGone && cursor != "" {
+		return "", errCursorExpired
+	}
+
+	if !r.succeeded(opWatch, resp, 200) {
+		return cursor, r.statusError(resp)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == eventStreamContentType {
+		return r.readEventStream(resp, cursor)
+	}
+
+	var watchResp WatchResponse
+	err = decode(resp, &watchResp)
+
+	if err != nil {
+		return cursor, err
+	}
+
+	for _, event := range watchResp.Events {
+		r.changed(event)
+	}
+
+	if watchResp.Cursor != "" {
+		cursor = watchResp.Cursor
+	}
+	return cursor, nil
+}
+
+// readEventStream handles the events of a server-sent event stream until
+// the backend closes it. The data of each event is a JSON WatchEvent, and
+// its id the cursor to resume from.
+func (r *RestStorage) readEventStream(resp *http.Response, cursor string) (string, error) {
+	var id string
+	var data strings.Builder
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		case "":
+			// A blank line dispatches the event; a line starting with a
+			// colon is a comment, e.g. a keep-alive.
+			if scanner.Text() != "" || data.Len() == 0 {
+				continue
+			}
+
+			var event WatchEvent
+			if err := json.Unmarshal([]byte(data.String()), &event); err != nil {
+				return cursor, fmt.Errorf("decoding watch event: %v", err)
+			}
+			data.Reset()
+
+			r.changed(event)
+			if id != "" {
+				cursor = id
+			}
+		}
+	}
+
+	return cursor, scanner.Err()
+}
+
+// watchPrefix returns the prefix of the backend keys to watch: the
+// namespace, unless the encoding of keys doesn't preserve prefixes.
+func (r *RestStorage) watchPrefix() string {
+	if r.KeyEncoding == KeyEncodingBase64URL || r.KeyEncoding == KeyEncodingSHA256 {
+		return ""
+	}
+	return r.backendKey("")
+}
+
+// changed evicts the backend key of event, and the keys below it, from the
+// local caches.
+func (r *RestStorage) changed(event WatchEvent) {
+	if event.Key == "" {
+		return
+	}
+
+	r.logger.Debug("Key changed in the backend", zap.String("key", event.Key), zap.String("type", event.Type))
+
+	r.forgetETagPrefix(event.Key)
+	r.invalidatePrefix(event.Key)
+	if event.Type == "delete" {
+		r.diskCache.removePrefix(event.Key)
+	}
+}
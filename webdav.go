@@ -0,0 +1,338 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// DialectWebDAV stores keys as files on a WebDAV server and uses WebDAV
+// locks.
+const DialectWebDAV = "webdav"
+
+var webdavRoutes = map[string]Route{
+	opStore:  {"PUT", "{key}"},
+	opLoad:   {"GET", "{key}"},
+	opDelete: {"DELETE", "{key}"},
+	opExists: {"HEAD", "{key}"},
+	opList:   {"PROPFIND", "{key}"},
+	opStat:   {"PROPFIND", "{key}"},
+	opLock:   {"LOCK", "locks/{key}.lock"},
+	opUnlock: {"UNLOCK", "locks/{key}.lock"},
+	opRenew:  {"LOCK", "locks/{key}.lock"},
+}
+
+func (r *RestStorage) webdavStore(ctx context.Context, key string, value []byte, header http.Header) error {
+	method, p, _ := r.route(opStore, key)
+
+	resp, err := r.request(ctx, opStore, key, method, p, header, value)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// 409: The parent collection doesn't exist yet. Some servers respond
+	// with 404 instead.
+	if resp.StatusCode == 409 || resp.StatusCode == 404 {
+		if err := r.webdavMkcolAll(ctx, opStore, path.Dir(p)); err != nil {
+			return err
+		}
+
+		resp, err = r.request(ctx, opStore, key, method, p, header, value)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	if !r.succeeded(opStore, resp, 201) {
+		return r.storeError(key, header, resp)
+	}
+
+	r.rememberETag(key, resp, "", value)
+
+	return nil
+}
+
+// webdavMkcolAll creates the collection at dir and any missing parents,
+// as part of op.
+func (r *RestStorage) webdavMkcolAll(ctx context.Context, op, dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+
+	segments := strings.Split(strings.Trim(dir, "/"), "/")
+	for i := range segments {
+		collection := strings.Join(segments[:i+1], "/") + "/"
+
+		resp, err := r.request(ctx, op, collection, "MKCOL", collection, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		// 405: The collection already exists
+		if resp.StatusCode != 201 && resp.StatusCode != 405 {
+			return fmt.Errorf("creating collection %v: %w", collection, r.statusError(resp))
+		}
+	}
+
+	return nil
+}
+
+func (r *RestStorage) webdavDelete(ctx context.Context, key string) error {
+	method, p, _ := r.route(opDelete, key)
+
+	resp, err := r.request(ctx, opDelete, key, method, p, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Some servers (e.g. nginx) require collections to be deleted with a
+	// trailing slash.
+	if resp.StatusCode == 409 {
+		resp, err = r.request(ctx, opDelete, key, method, p+"/", nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	if r.notFound(opDelete, resp) {
+		return fs.ErrNotExist
+	}
+
+	if !r.succeeded(opDelete, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	return nil
+}
+
+func (r *RestStorage) webdavList(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	prefix = strings.Trim(prefix, "/")
+
+	responses, err := r.webdavPropfind(ctx, opList, prefix, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, response := range responses {
+		key, err := r.webdavKey(response.Href)
+		if err != nil {
+			return nil, err
+		}
+		if key == prefix {
+			continue
+		}
+
+		keys = append(keys, key)
+
+		if recursive && response.isCollection() {
+			// Depth: infinity is disabled on many servers.
+			children, err := r.webdavList(ctx, key, true)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, children...)
+		}
+	}
+
+	return keys, nil
+}
+
+func (r *RestStorage) webdavStat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	responses, err := r.webdavPropfind(ctx, opStat, key, "0")
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	if len(responses) == 0 {
+		return certmagic.KeyInfo{}, fmt.Errorf("no properties received for %v", key)
+	}
+
+	response := responses[0]
+	info := certmagic.KeyInfo{
+		Key:        key,
+		IsTerminal: !response.isCollection(),
+	}
+
+	for _, propstat := range response.Propstats {
+		prop := propstat.Prop
+		if prop.ContentLength != "" {
+			info.Size, err = strconv.ParseInt(prop.ContentLength, 10, 64)
+			if err != nil {
+				return certmagic.KeyInfo{}, fmt.Errorf("parsing getcontentlength: %v", err)
+			}
+		}
+		if prop.LastModified != "" {
+			info.Modified, err = http.ParseTime(prop.LastModified)
+			if err != nil {
+				return certmagic.KeyInfo{}, fmt.Errorf("parsing getlastmodified: %v", err)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string `xml:"DAV: href"`
+	Propstats []struct {
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+			ContentLength string `xml:"DAV: getcontentlength"`
+			LastModified  string `xml:"DAV: getlastmodified"`
+		} `xml:"DAV: prop"`
+	} `xml:"DAV: propstat"`
+}
+
+func (d davResponse) isCollection() bool {
+	for _, propstat := range d.Propstats {
+		if propstat.Prop.ResourceType.Collection != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// webdavPropfind returns the properties of key and, with depth 1, of its
+// members.
+func (r *RestStorage) webdavPropfind(ctx context.Context, op, key, depth string) ([]davResponse, error) {
+	method, p, _ := r.route(op, key)
+	if depth == "1" && p != "" {
+		p += "/"
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	header.Set("Depth", depth)
+
+	resp, err := r.request(ctx, op, key, method, p, header, []byte(webdavPropfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, fs.ErrNotExist
+	}
+
+	if resp.StatusCode != 207 {
+		return nil, r.statusError(resp)
+	}
+
+	var multistatus davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("decoding multistatus response: %v", err)
+	}
+
+	return multistatus.Responses, nil
+}
+
+// webdavKey converts the href of a PROPFIND response to a key.
+func (r *RestStorage) webdavKey(href string) (string, error) {
+	hrefURL, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("parsing href: %v", err)
+	}
+
+	endpoint, err := url.Parse(r.baseURL())
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimPrefix(hrefURL.Path, endpoint.Path)
+	return strings.Trim(key, "/"), nil
+}
+
+// webdavLock requests an exclusive write lock on the lock resource of key,
+// or refreshes the lock with the given lock token.
+func (r *RestStorage) webdavLock(ctx context.Context, key, token string) (*http.Response, error) {
+	header := http.Header{}
+
+	timeout := "Infinite"
+	if r.LockTTL > 0 {
+		timeout = fmt.Sprintf("Second-%d", time.Duration(r.LockTTL)/time.Second)
+	}
+	header.Set("Timeout", timeout)
+
+	op := opLock
+	var body []byte
+	if token != "" {
+		op = opRenew
+		header.Set("If", "("+token+")")
+	} else {
+		var owner bytes.Buffer
+		xml.EscapeText(&owner, []byte(r.InstanceID))
+		body = []byte(`<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>` + owner.String() + `</D:owner></D:lockinfo>`)
+		header.Set("Content-Type", "application/xml; charset=utf-8")
+		header.Set("Depth", "0")
+	}
+
+	method, p, _ := r.route(op, key)
+
+	resp, err := r.request(ctx, op, key, method, p, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// 409: The collection of lock resources doesn't exist yet. Servers
+	// based on golang.org/x/net/webdav, like Caddy's webdav handler,
+	// respond with 500 instead.
+	if (resp.StatusCode == 409 || resp.StatusCode == 500) && token == "" {
+		resp.Body.Close()
+
+		if err := r.webdavMkcolAll(ctx, op, path.Dir(p)); err != nil {
+			return nil, err
+		}
+
+		return r.request(ctx, op, key, method, p, header, body)
+	}
+
+	return resp, nil
+}
+
+func (r *RestStorage) webdavUnlock(ctx context.Context, key, token string) error {
+	if token == "" {
+		return fmt.Errorf("no lock token held for %v", key)
+	}
+
+	header := http.Header{}
+	header.Set("Lock-Token", token)
+
+	method, p, _ := r.route(opUnlock, key)
+
+	resp, err := r.request(ctx, opUnlock, key, method, p, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !r.succeeded(opUnlock, resp, 204) {
+		return r.statusError(resp)
+	}
+
+	return nil
+}